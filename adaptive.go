@@ -0,0 +1,90 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+const (
+	minBlockSize = 5 * 1024 * 1024
+	maxBlockSize = 210 * 1024 * 1024
+
+	// adaptiveTarget is how long we'd like a single chunk upload to take:
+	// long enough that per-request overhead is negligible, short enough that
+	// a retry doesn't throw away minutes of transfer.
+	adaptiveTarget = 30 * time.Second
+)
+
+// adaptiveSizer picks the size of the next chunk to read from the observed
+// upload behaviour of earlier ones:
+//
+//   - a chunk that needed retries halves the size (fail small, retry cheap);
+//   - otherwise the size moves halfway towards throughput*adaptiveTarget,
+//     growing by at most 2x per observation;
+//   - the result is clamped to [floor, maxBlockSize] and rounded to whole
+//     MiB, where floor is minBlockSize unless a part limit raises it.
+//
+// Observations arrive from several workers while the reader is already ahead,
+// so the size reacts to the link with a lag of roughly maxSem chunks.
+type adaptiveSizer struct {
+	mu    sync.Mutex
+	size  int64
+	floor int64
+}
+
+func newAdaptiveSizer(initial int64) *adaptiveSizer {
+	return &adaptiveSizer{size: clampBlockSize(initial), floor: minBlockSize}
+}
+
+// keepWithin raises the floor so that size bytes take no more than limit
+// parts however the size varies. It must be called before the first Next.
+func (a *adaptiveSizer) keepWithin(size int64, limit int) error {
+	if limit <= 0 {
+		return nil
+	}
+	floor, err := fitPartLimit(size, minBlockSize, limit, false)
+	if err != nil {
+		return err
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.floor = max(a.floor, floor)
+	a.size = max(a.size, a.floor)
+	return nil
+}
+
+func (a *adaptiveSizer) Next() int64 {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.size
+}
+
+func (a *adaptiveSizer) Observe(n int64, elapsed time.Duration, attempts int) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if attempts > 1 {
+		a.size = max(clampBlockSize(a.size/2), a.floor)
+		return
+	}
+	if elapsed <= 0 {
+		return
+	}
+	ideal := int64(float64(n) / elapsed.Seconds() * adaptiveTarget.Seconds())
+	next := (a.size + ideal) / 2
+	if next > 2*a.size {
+		next = 2 * a.size
+	}
+	a.size = max(clampBlockSize(next), a.floor)
+}
+
+func clampBlockSize(n int64) int64 {
+	const mib = 1024 * 1024
+	n = n / mib * mib
+	if n < minBlockSize {
+		return minBlockSize
+	}
+	if n > maxBlockSize {
+		return maxBlockSize
+	}
+	return n
+}
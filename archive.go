@@ -0,0 +1,94 @@
+package main
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+)
+
+// archiveName is the attachment name for dir uploaded with -archive format.
+func archiveName(dir, format string) string {
+	return filepath.Base(filepath.Clean(dir)) + "." + format
+}
+
+// archiveDir streams dir as a tar archive, gzipped for format "tar.gz",
+// without staging it on disk. Entries are stored under the directory's base
+// name. Symlinks are archived as links, not followed; sockets, devices and
+// other special files are left out. A walk or read error ends the stream
+// with that error, which fails the upload reading from it.
+func archiveDir(dir, format string) io.ReadCloser {
+	pr, pw := io.Pipe()
+	go func() {
+		pw.CloseWithError(writeArchive(pw, dir, format == "tar.gz"))
+	}()
+	return pr
+}
+
+func writeArchive(w io.Writer, dir string, gz bool) error {
+	if gz {
+		zw := gzip.NewWriter(w)
+		if err := writeArchive(zw, dir, false); err != nil {
+			return err
+		}
+		return zw.Close()
+	}
+	tw := tar.NewWriter(w)
+	root := filepath.Clean(dir)
+	base := filepath.Base(root)
+	err := filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		fi, err := d.Info()
+		if err != nil {
+			return err
+		}
+		mode := fi.Mode()
+		if !mode.IsRegular() && !mode.IsDir() && mode&fs.ModeSymlink == 0 {
+			return nil
+		}
+		link := ""
+		if mode&fs.ModeSymlink != 0 {
+			if link, err = os.Readlink(path); err != nil {
+				return err
+			}
+		}
+		hdr, err := tar.FileInfoHeader(fi, link)
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(root, path)
+		if err != nil {
+			return err
+		}
+		hdr.Name = filepath.ToSlash(filepath.Join(base, rel))
+		if mode.IsDir() {
+			hdr.Name += "/"
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		if !mode.IsRegular() {
+			return nil
+		}
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		// A file that changes size under us would corrupt the archive; tar
+		// reports it as ErrWriteTooLong or a short write.
+		if _, err := io.Copy(tw, f); err != nil {
+			return fmt.Errorf("archiving %s: %w", path, err)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	return tw.Close()
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/cenkalti/backoff/v4"
+)
+
+// defaultFinalizeTimeout is how long a finalize answered with 202 is
+// polled for when FinalizeTimeout is 0.
+const defaultFinalizeTimeout = 10 * time.Minute
+
+// Values of UploadResult.FinalizeStatus.
+const (
+	finalizeCompleted        = "completed"         // finalize answered with the file
+	finalizeAlreadyCompleted = "already completed" // a retry or another run got there first
+	finalizeAssembled        = "assembled"         // accepted with 202, confirmed by polling
+)
+
+// errStillAssembling is a status poll finding the file not ready yet.
+var errStillAssembling = errors.New("still assembling")
+
+// awaitAssembly waits for a file the server accepted for assembly in the
+// background: finalize answered 202 Accepted instead of with the
+// attachment. It polls the response's Location, or else the lookup path
+// template, with backoff until the attachment is reported ready, it fails,
+// or FinalizeTimeout passes. The answer to a poll is read like a finalize
+// response; a "status" field of pending, processing, assembling and the
+// like, a 202 or a 404 mean it isn't there yet.
+func (fu *FileUploader) awaitAssembly(ctx context.Context, uploadID string, resp *http.Response) error {
+	url := ""
+	if loc, err := resp.Location(); err == nil {
+		url = loc.String()
+	} else if fu.Paths.Lookup != "" {
+		url = fu.endpoint(fu.Paths.Lookup, "{uploadId}", uploadID)
+	} else {
+		return fmt.Errorf("finalize of %s was accepted for assembly (status 202), but the response has no Location "+
+			"and no lookup path template is configured to check on it", uploadID)
+	}
+	timeout := fu.FinalizeTimeout
+	if timeout <= 0 {
+		timeout = defaultFinalizeTimeout
+	}
+	fu.debugf("Finalize of %s accepted for assembly; polling %s for up to %s", uploadID, url, timeout)
+	fu.emit("phase_changed", map[string]interface{}{"phase": "assemble"})
+
+	poll := func() error {
+		req, _ := http.NewRequestWithContext(ctx, "GET", url, nil)
+		resp, tok, err := fu.do(req)
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+		data, _ := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+		switch {
+		case resp.StatusCode == http.StatusUnauthorized:
+			return fu.unauthorized(tok)
+		case resp.StatusCode == http.StatusAccepted, resp.StatusCode == http.StatusNotFound:
+			return errStillAssembling
+		case resp.StatusCode == http.StatusTooManyRequests, resp.StatusCode >= 500:
+			return &statusError{op: "assembly status", status: resp.StatusCode}
+		case resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusCreated:
+			return backoff.Permanent(&statusError{op: "assembly status", status: resp.StatusCode, body: string(data)})
+		}
+		info := parseFinalizeResponse(data)
+		switch status := assemblyStatus(data); status {
+		case "completed", "complete", "ready", "done", "assembled", "succeeded", "success":
+		case "failed", "failure", "error", "rejected", "aborted":
+			return backoff.Permanent(fmt.Errorf("server failed to assemble %s: %.200s", uploadID, data))
+		case "":
+			if info == nil {
+				return errStillAssembling
+			}
+		default:
+			return fmt.Errorf("%w (status %q)", errStillAssembling, status)
+		}
+		fu.Attachment = info
+		return nil
+	}
+	policy := fu.boundedRetryPolicy(ctx, timeout, time.Second, 15*time.Second)
+	notify := func(err error, d time.Duration) {
+		fu.debugf("Attachment for %s not ready: %v; checking again in %s", uploadID, err, d.Round(time.Millisecond))
+	}
+	started := time.Now()
+	err := backoff.RetryNotify(poll, policy, notify)
+	switch {
+	case err == nil:
+		fu.debugf("Server assembled %s after %s", uploadID, time.Since(started).Round(time.Millisecond))
+		fu.finalizeStatus = finalizeAssembled
+		return nil
+	case ctx.Err() != nil:
+		return err
+	case errors.Is(err, errStillAssembling), time.Since(started) >= timeout:
+		return fmt.Errorf("%w: %s wasn't reported ready within %s (-finalize-timeout); last answer: %v",
+			errAssemblyTimeout, uploadID, timeout, err)
+	}
+	return err
+}
+
+// assemblyStatus is the lower-cased "status" (or "state") of a status
+// poll's answer, at the top level or under "data"; "" when there is none.
+func assemblyStatus(body []byte) string {
+	type status struct {
+		Status string `json:"status"`
+		State  string `json:"state"`
+	}
+	var out struct {
+		status
+		Data status `json:"data"`
+	}
+	if json.Unmarshal(body, &out) != nil {
+		return ""
+	}
+	for _, s := range []string{out.Data.Status, out.Data.State, out.Status, out.State} {
+		if s != "" {
+			return strings.ToLower(strings.ReplaceAll(s, "_", " "))
+		}
+	}
+	return ""
+}
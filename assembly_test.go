@@ -0,0 +1,151 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	backoff "github.com/cenkalti/backoff/v4"
+)
+
+func TestAssemblyStatus(t *testing.T) {
+	tests := []struct{ body, want string }{
+		{`{"status":"PROCESSING"}`, "processing"},
+		{`{"data":{"state":"in_progress"}}`, "in progress"},
+		{`{"status":"ignored","data":{"status":"ready"}}`, "ready"},
+		{`{"data":{"id":"att-1"}}`, ""},
+		{`not json`, ""},
+	}
+	for _, tt := range tests {
+		if got := assemblyStatus([]byte(tt.body)); got != tt.want {
+			t.Errorf("assemblyStatus(%s) = %q, want %q", tt.body, got, tt.want)
+		}
+	}
+}
+
+// assemblingServer answers finalize with 202, pointing at /status when
+// location is set, and answers status polls with the next of polls, the
+// last one repeating; the rest goes to a finalizeRecorder.
+type assemblingServer struct {
+	location bool
+	polls    []string
+
+	mu     sync.Mutex
+	polled int
+	rec    finalizeRecorder
+}
+
+func (s *assemblingServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch {
+	case strings.HasSuffix(r.URL.Path, "/file/chunked"):
+		io.Copy(io.Discard, r.Body)
+		if s.location {
+			w.Header().Set("Location", "/status/u1")
+		}
+		w.WriteHeader(http.StatusAccepted)
+	case strings.HasPrefix(r.URL.Path, "/status/"):
+		s.mu.Lock()
+		poll := s.polls[min(s.polled, len(s.polls)-1)]
+		s.polled++
+		s.mu.Unlock()
+		io.WriteString(w, poll)
+	default:
+		s.rec.ServeHTTP(w, r)
+	}
+}
+
+func TestAwaitAssembly(t *testing.T) {
+	tests := []struct {
+		name     string
+		location bool
+		lookup   string
+		polls    []string
+		timeout  time.Duration
+		wantErr  string
+		wantID   string
+	}{
+		{"ready after a pending poll", true, "", []string{`{"status":"processing"}`, `{"data":{"id":"att-9","name":"data.bin"}}`}, 0, "", "att-9"},
+		{"lookup path without Location", false, "/status/{uploadId}", []string{`{"status":"done","data":{"id":"att-9"}}`}, 0, "", "att-9"},
+		{"assembly failed", true, "", []string{`{"status":"FAILED","reason":"bad part"}`}, 0, "failed to assemble", ""},
+		{"never ready", true, "", []string{`{"status":"pending"}`}, 200 * time.Millisecond, "not assembled in time", ""},
+		{"nowhere to poll", false, "", nil, 0, "no Location", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := &assemblingServer{location: tt.location, polls: tt.polls}
+			srv := httptest.NewServer(s)
+			defer srv.Close()
+			path, _ := writeTestFile(t, minBlockSize+1)
+
+			fu := newTestUploader(t, path, srv.URL)
+			fu.Paths.Lookup = tt.lookup
+			fu.FinalizeTimeout = tt.timeout
+			res, err := fu.RunContext(t.Context())
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("got error %v, want one mentioning %q", err, tt.wantErr)
+				}
+				if tt.timeout > 0 && (!errors.Is(err, errAssemblyTimeout) || exitCodeFor(err) != exitServer) {
+					t.Errorf("timeout error %v isn't errAssemblyTimeout with exit code %d", err, exitServer)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if res.Attachment == nil || res.Attachment.ID != tt.wantID || res.FinalizeStatus != finalizeAssembled {
+				t.Errorf("got attachment %+v, finalize status %q; want %s, %q", res.Attachment, res.FinalizeStatus, tt.wantID, finalizeAssembled)
+			}
+		})
+	}
+}
+
+// TestAwaitAssemblyBackoff checks that polling for a file assembled in the
+// background follows the uploader's Backoff and FinalizeTimeout.
+func TestAwaitAssemblyBackoff(t *testing.T) {
+	tests := []struct {
+		name    string
+		pending int64 // polls answered 202 before the attachment
+		wantErr error
+	}{
+		{"assembled", 3, nil},
+		{"timeout", 1 << 30, errAssemblyTimeout},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var polls atomic.Int64
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if polls.Add(1) <= tt.pending {
+					w.WriteHeader(http.StatusAccepted)
+					return
+				}
+				io.WriteString(w, `{"data":{"id":"att-9","status":"ready"}}`)
+			}))
+			defer srv.Close()
+
+			fu := newTestUploader(t, "data.bin", srv.URL)
+			fu.Paths.Lookup = "/status/{uploadId}"
+			fu.FinalizeTimeout = 100 * time.Millisecond
+			// Only the timeout stops this policy.
+			fu.Backoff = func() backoff.BackOff { return backoff.NewConstantBackOff(5 * time.Millisecond) }
+			started := time.Now()
+			err := fu.awaitAssembly(t.Context(), "u1", &http.Response{Header: http.Header{}, Request: &http.Request{}})
+			if !errors.Is(err, tt.wantErr) || (tt.wantErr == nil && err != nil) {
+				t.Fatalf("got error %v, want %v", err, tt.wantErr)
+			}
+			// The default policy would wait a second before the second poll.
+			if d := time.Since(started); d > time.Second {
+				t.Errorf("took %s; Backoff wasn't used", d)
+			}
+			if tt.wantErr == nil && (fu.Attachment == nil || fu.Attachment.ID != "att-9") {
+				t.Errorf("attachment %+v, want att-9", fu.Attachment)
+			}
+		})
+	}
+}
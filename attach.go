@@ -0,0 +1,118 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// readHashList reads the parts -attach-existing assembles: one "hash,size"
+// line per part, in order, where hash is the hex digest of the part's bytes,
+// optionally prefixed with "sha256-" or "sha512-". Blank lines and lines
+// starting with # are skipped. It returns the parts' ETags and the hash
+// algorithm, which follows from the digest length and must be the same for
+// every part.
+func readHashList(path string) ([]string, string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, "", err
+	}
+	defer f.Close()
+	var etags []string
+	alg := ""
+	sc := bufio.NewScanner(f)
+	for n := 1; sc.Scan(); n++ {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		sum, sizeText, ok := strings.Cut(line, ",")
+		sum = strings.ToLower(strings.TrimSpace(sum))
+		sum = strings.TrimPrefix(strings.TrimPrefix(sum, "sha256-"), "sha512-")
+		size, err := strconv.ParseInt(strings.TrimSpace(sizeText), 10, 64)
+		if !ok || err != nil || size <= 0 {
+			return nil, "", fmt.Errorf("%s:%d: want hash,size with a positive size, got %q", path, n, line)
+		}
+		var lineAlg string
+		switch _, err := hex.DecodeString(sum); {
+		case err != nil:
+			return nil, "", fmt.Errorf("%s:%d: %q is not a hex digest", path, n, sum)
+		case len(sum) == 2*sha256.Size:
+			lineAlg = "sha256"
+		case len(sum) == 2*sha512.Size:
+			lineAlg = "sha512"
+		default:
+			return nil, "", fmt.Errorf("%s:%d: %q is neither a SHA-256 nor a SHA-512 digest", path, n, sum)
+		}
+		if alg != "" && lineAlg != alg {
+			return nil, "", fmt.Errorf("%s:%d: mixes %s and %s digests", path, n, alg, lineAlg)
+		}
+		alg = lineAlg
+		etags = append(etags, fmt.Sprintf("%s-%d", sum, size))
+	}
+	if err := sc.Err(); err != nil {
+		return nil, "", err
+	}
+	if len(etags) == 0 {
+		return nil, "", fmt.Errorf("%s lists no parts", path)
+	}
+	return etags, alg, nil
+}
+
+// AttachExisting assembles an attachment called Name (or the base name of
+// FilePath) from parts the server already holds, given by their ETags in
+// order, without reading or sending any data: it creates a session, probes
+// that every part is there and finalizes. HashAlgorithm must match the
+// ETags. A missing part fails the run before finalize, naming the parts.
+func (fu *FileUploader) AttachExisting(ctx context.Context, etags []string) (res *UploadResult, err error) {
+	res = &UploadResult{IssueKey: fu.IssueKey, Name: fu.attachmentName(), BaseURL: fu.BaseURL}
+	started := time.Now()
+	fu.retried.Store(0)
+	for _, et := range etags {
+		res.Size += etagSize(et)
+	}
+	res.Parts = len(etags)
+	defer func() {
+		res.Elapsed, res.Retries = time.Since(started), int(fu.retried.Load())
+		res.endPhase()
+		err = stopped(ctx, err)
+	}()
+
+	if limit := fu.MaxParts; limit > 0 && len(etags) > limit {
+		return res, fmt.Errorf("%w: the list has %d parts, more than -max-parts %d", errTooManyParts, len(etags), limit)
+	}
+	res.beginPhase("session")
+	uploadID, err := fu.createUpload(ctx, res.Size)
+	if err != nil {
+		return res, err
+	}
+	if limit := fu.partLimit(); limit > 0 && len(etags) > limit {
+		return res, fmt.Errorf("%w: the list has %d parts, more than the %d the server allows", errTooManyParts, len(etags), limit)
+	}
+	fu.UploadID, res.UploadID = uploadID, uploadID
+	fu.emit("session_created", map[string]interface{}{"uploadId": uploadID, "resumed": false})
+
+	res.beginPhase("verify")
+	if err := fu.verifyParts(ctx, etags, uploadID); err != nil {
+		return res, err
+	}
+	res.BytesSkipped = res.Size
+	res.Sources = chunkSources{Probed: len(etags), BytesProbed: res.Size}
+
+	res.beginPhase("finalize")
+	fu.emit("phase_changed", map[string]interface{}{"phase": "finalize"})
+	if err := fu.createFileChunked(ctx, etags, uploadID); err != nil {
+		return res, err
+	}
+	res.IdempotencyKey = fu.IdempotencyKey
+	res.Attachment = fu.Attachment
+	res.FinalizeStatus = fu.finalizeStatus
+	return res, nil
+}
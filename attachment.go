@@ -0,0 +1,57 @@
+package main
+
+import (
+	"encoding/json"
+	"time"
+)
+
+// attachmentInfo is what the finalize response tells us about the new file.
+// Servers differ in how much they return; every field but ID is optional.
+type attachmentInfo struct {
+	ID           string `json:"id"`
+	DownloadURL  string `json:"downloadUrl,omitempty"`
+	ThumbnailURL string `json:"thumbnailUrl,omitempty"`
+	Created      string `json:"created,omitempty"` // RFC 3339
+	// Raw is the response's "data" object exactly as the server sent it.
+	Raw json.RawMessage `json:"raw,omitempty"`
+}
+
+// parseFinalizeResponse reads {"data": {...}}. Links are accepted either as
+// downloadUrl/thumbnailUrl or nested under "links", and createdAt either as
+// a string or as epoch milliseconds. It returns nil for an empty or
+// unrecognised body.
+func parseFinalizeResponse(body []byte) *attachmentInfo {
+	var out struct {
+		Data json.RawMessage `json:"data"`
+	}
+	if json.Unmarshal(body, &out) != nil || len(out.Data) == 0 {
+		return nil
+	}
+	var d struct {
+		ID           string      `json:"id"`
+		DownloadURL  string      `json:"downloadUrl"`
+		ThumbnailURL string      `json:"thumbnailUrl"`
+		CreatedAt    interface{} `json:"createdAt"`
+		Links        struct {
+			Download  string `json:"download"`
+			Thumbnail string `json:"thumbnail"`
+		} `json:"links"`
+	}
+	if json.Unmarshal(out.Data, &d) != nil || d.ID == "" {
+		return nil
+	}
+	info := &attachmentInfo{ID: d.ID, DownloadURL: d.DownloadURL, ThumbnailURL: d.ThumbnailURL, Raw: out.Data}
+	if info.DownloadURL == "" {
+		info.DownloadURL = d.Links.Download
+	}
+	if info.ThumbnailURL == "" {
+		info.ThumbnailURL = d.Links.Thumbnail
+	}
+	switch c := d.CreatedAt.(type) {
+	case string:
+		info.Created = c
+	case float64:
+		info.Created = time.UnixMilli(int64(c)).UTC().Format(time.RFC3339)
+	}
+	return info
+}
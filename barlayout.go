@@ -0,0 +1,126 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sync/atomic"
+	"time"
+
+	"github.com/vbauerster/mpb/v7/cwriter"
+	"github.com/vbauerster/mpb/v7/decor"
+)
+
+// The full set of progress bar decorators needs about fullBarWidth columns.
+// In a narrower terminal the line would wrap, and every redraw would scroll
+// it, so the bar falls back to fewer decorators, and below compactBarWidth
+// to no bar at all.
+const (
+	fullBarWidth    = 100
+	compactBarWidth = 40
+	// plainInterval is how often the plain layout prints a line.
+	plainInterval = 5 * time.Second
+)
+
+type barLayout int32
+
+const (
+	layoutFull    barLayout = iota
+	layoutCompact           // percentage and speed
+	layoutPlain             // no bar, a line every plainInterval
+)
+
+// pickBarLayout picks the layout for a terminal width columns wide. A width
+// of 0 or less is unknown, as when the output isn't a terminal, and keeps
+// the full layout.
+func pickBarLayout(width int) barLayout {
+	switch {
+	case width <= 0 || width >= fullBarWidth:
+		return layoutFull
+	case width >= compactBarWidth:
+		return layoutCompact
+	default:
+		return layoutPlain
+	}
+}
+
+// stdoutWidth is the width of the terminal the bar is drawn on, or 0 when
+// stdout isn't one.
+func stdoutWidth() int {
+	w, _, err := cwriter.GetSize(int(os.Stdout.Fd()))
+	if err != nil {
+		return 0
+	}
+	return w
+}
+
+// barLayoutSwitch shows a bar's decorators by the layout for the current
+// terminal width. mpb measures the terminal on every redraw and hands the
+// full width to the first decorator, Track, so a resized window changes the
+// layout on the next redraw. Full and compact alternate that way; the plain
+// layout replaces the bar, so it is only chosen when the bar is created.
+type barLayoutSwitch struct {
+	current atomic.Int32
+}
+
+// Track records the layout for the width the bar is drawn at. It must be
+// the bar's first decorator, and shows nothing.
+func (s *barLayoutSwitch) Track() decor.Decorator {
+	return decor.Any(func(st decor.Statistics) string {
+		layout := pickBarLayout(st.AvailableWidth)
+		// Too narrow for the compact layout, the bar still shows it
+		// rather than nothing.
+		s.current.Store(int32(min(layout, layoutCompact)))
+		return ""
+	})
+}
+
+// Only shows d in the given layouts.
+func (s *barLayoutSwitch) Only(d decor.Decorator, layouts ...barLayout) decor.Decorator {
+	return decor.Any(func(st decor.Statistics) string {
+		for _, l := range layouts {
+			if barLayout(s.current.Load()) == l {
+				return d.Decor(st)
+			}
+		}
+		return ""
+	})
+}
+
+// plainProgress prints label, the share done (the bytes done, for a stream),
+// the speed and any retry status every plainInterval until the returned stop
+// is called. It stands in for the bar when the terminal is too narrow for one.
+func plainProgress(w io.Writer, label string, meter *rateMeter, retries *retryTracker, breaker *circuitBreaker) (stop func()) {
+	done := make(chan struct{})
+	finished := make(chan struct{})
+	go func() {
+		defer close(finished)
+		tick := time.NewTicker(plainInterval)
+		defer tick.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-tick.C:
+			}
+			meter.mu.Lock()
+			size, done := meter.size, meter.done
+			meter.mu.Unlock()
+			// A stream's size isn't known, so it gets bytes instead.
+			progress := fmt.Sprintf("% .1f", decor.SizeB1024(done))
+			if size > 0 {
+				progress = fmt.Sprintf("%.0f%%", 100*float64(done)/float64(size))
+			}
+			cur, _ := meter.rates()
+			line := fmt.Sprintf("%s %s, % .1f/s", label, progress, decor.SizeB1024(int64(cur)))
+			if s := retries.status(breaker); s != "" {
+				line += ", " + s
+			}
+			fmt.Fprintln(w, line)
+		}
+	}()
+	return func() {
+		close(done)
+		<-finished
+	}
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/vbauerster/mpb/v7/decor"
+)
+
+func TestPickBarLayout(t *testing.T) {
+	tests := []struct {
+		width int
+		want  barLayout
+	}{
+		{-1, layoutFull},
+		{0, layoutFull},
+		{20, layoutPlain},
+		{compactBarWidth - 1, layoutPlain},
+		{compactBarWidth, layoutCompact},
+		{60, layoutCompact},
+		{fullBarWidth - 1, layoutCompact},
+		{fullBarWidth, layoutFull},
+		{200, layoutFull},
+	}
+	for _, tt := range tests {
+		if got := pickBarLayout(tt.width); got != tt.want {
+			t.Errorf("pickBarLayout(%d) = %d, want %d", tt.width, got, tt.want)
+		}
+	}
+}
+
+// TestBarLayoutSwitch checks that the decorators follow the width each
+// redraw reports, as after a resize.
+func TestBarLayoutSwitch(t *testing.T) {
+	s := &barLayoutSwitch{}
+	track := s.Track()
+	full := s.Only(decor.Name("full"), layoutFull)
+	compact := s.Only(decor.Name("compact"), layoutCompact)
+	both := s.Only(decor.Name("both"), layoutFull, layoutCompact)
+	tests := []struct {
+		width int
+		want  string
+	}{
+		{120, "full,,both"},
+		{60, ",compact,both"},
+		// Too narrow even for the compact layout, a bar that is already
+		// drawn keeps it.
+		{20, ",compact,both"},
+		{120, "full,,both"},
+	}
+	for _, tt := range tests {
+		st := decor.Statistics{AvailableWidth: tt.width}
+		track.Decor(st)
+		if got := full.Decor(st) + "," + compact.Decor(st) + "," + both.Decor(st); got != tt.want {
+			t.Errorf("width %d: decorators show %q, want %q", tt.width, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,295 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/vbauerster/mpb/v7/decor"
+)
+
+// uploadJob is one file of a batch and the issue it goes to. err is set for
+// a -mapping row that failed validation; the job is then reported as failed
+// without being attempted.
+type uploadJob struct {
+	IssueKey string
+	File     string
+	err      error
+}
+
+var issueKeyPattern = regexp.MustCompile(`^[A-Za-z][A-Za-z0-9_]*-[0-9]+$`)
+
+// readMapping reads a -mapping CSV file of "issueKey,filePath" rows. Blank
+// lines and lines starting with "#" are skipped, as is an optional header
+// row. Malformed rows become jobs carrying an error so the rest of the batch
+// still runs.
+func readMapping(path string) ([]uploadJob, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	r := csv.NewReader(f)
+	r.Comment = '#'
+	r.FieldsPerRecord = -1
+	r.TrimLeadingSpace = true
+	var jobs []uploadJob
+	for row := 1; ; row++ {
+		rec, err := r.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", path, err)
+		}
+		line, _ := r.FieldPos(0)
+		if row == 1 && len(rec) == 2 && strings.EqualFold(rec[0], "issueKey") {
+			continue
+		}
+		job := uploadJob{}
+		if len(rec) >= 1 {
+			job.IssueKey = strings.TrimSpace(rec[0])
+		}
+		if len(rec) >= 2 {
+			job.File = strings.TrimSpace(rec[1])
+		}
+		switch {
+		case len(rec) != 2:
+			job.err = fmt.Errorf("%s:%d: expected issueKey,filePath, got %d fields", path, line, len(rec))
+		case !issueKeyPattern.MatchString(job.IssueKey):
+			job.err = fmt.Errorf("%s:%d: invalid issue key %q", path, line, job.IssueKey)
+		case job.File == "":
+			job.err = fmt.Errorf("%s:%d: empty file path", path, line)
+		}
+		jobs = append(jobs, job)
+	}
+	if len(jobs) == 0 {
+		return nil, fmt.Errorf("%s: no entries", path)
+	}
+	return jobs, nil
+}
+
+// fileResult is the per-file record written to -output-dir.
+type fileResult struct {
+	File     string `json:"file"`
+	IssueKey string `json:"issueKey"`
+	Name     string `json:"name"`
+	// Profile is the credential profile the run used, by name.
+	Profile        string `json:"profile,omitempty"`
+	Size           int64  `json:"size"`
+	SHA256         string `json:"sha256,omitempty"`
+	UploadID       string `json:"uploadId,omitempty"`
+	IdempotencyKey string `json:"idempotencyKey,omitempty"`
+	AttachmentID   string `json:"attachmentId,omitempty"`
+	// Attachment has everything the finalize response said about the file,
+	// and FinalizeStatus how finalize ended; see UploadResult.
+	Attachment     *attachmentInfo `json:"attachment,omitempty"`
+	FinalizeStatus string          `json:"finalizeStatus,omitempty"`
+	Status         string          `json:"status"` // "success", "skipped" or "failed"
+	Error          string          `json:"error,omitempty"`
+	Reason         string          `json:"reason,omitempty"` // why a file was skipped
+	// FailedParts lists the chunks that failed for good, all of them.
+	FailedParts []chunkFailure `json:"failedParts,omitempty"`
+	Started     time.Time      `json:"started"`
+	Finished    time.Time      `json:"finished"`
+	// Parts, BytesSent and BytesSkipped are the transfer summary.
+	Parts        int   `json:"parts,omitempty"`
+	BytesSent    int64 `json:"bytesSent,omitempty"`
+	BytesSkipped int64 `json:"bytesSkipped,omitempty"`
+	// BytesPresent is what -probe-first found on the server up front.
+	BytesPresent int64 `json:"bytesPresent,omitempty"`
+	// Sources splits the parts into uploaded, probed and resumed ones; it
+	// is left out when every part was uploaded.
+	Sources *chunkSources `json:"sources,omitempty"`
+	// Chunks holds the per-chunk metrics when -stats is on.
+	Chunks []chunkStat `json:"chunks,omitempty"`
+	// Phases and Retries are the timings and retry count of the upload.
+	Phases  []phaseTiming `json:"phases,omitempty"`
+	Retries int           `json:"retries,omitempty"`
+	// PartsRepaired counts parts re-uploaded after finalize reported them
+	// missing (-finalize-repairs).
+	PartsRepaired int `json:"partsRepaired,omitempty"`
+	// Failovers are the -urls servers given up on, and URL the one the
+	// upload then went to; both are empty without a failover.
+	URL       string     `json:"url,omitempty"`
+	Failovers []failover `json:"failovers,omitempty"`
+	// CommentID is the issue comment -comment posted.
+	CommentID string `json:"commentId,omitempty"`
+
+	// code is the exit status this file's failure maps to.
+	code int
+}
+
+// apply copies an upload's outcome into the record. Chunks is left to the
+// caller, since it is only reported with -stats.
+func (r *fileResult) apply(u *UploadResult) {
+	if u.Name != "" {
+		r.Name = u.Name
+	}
+	r.Size = u.Size
+	r.SHA256 = u.SHA256
+	r.UploadID = u.UploadID
+	r.IdempotencyKey = u.IdempotencyKey
+	r.FinalizeStatus = u.FinalizeStatus
+	if a := u.Attachment; a != nil {
+		r.AttachmentID = a.ID
+		r.Attachment = a
+	}
+	r.Parts, r.BytesSent, r.BytesSkipped = u.Parts, u.BytesSent, u.BytesSkipped
+	r.BytesPresent = u.BytesPresent
+	if s := u.Sources; s.Probed > 0 || s.Resumed > 0 {
+		r.Sources = &s
+	}
+	r.Phases = append(r.Phases, u.Phases...)
+	r.Retries = u.Retries
+	r.PartsRepaired = u.PartsRepaired
+	r.Failovers = u.Failovers
+	if len(u.Failovers) > 0 {
+		r.URL = u.BaseURL
+	}
+}
+
+// batchSummary is written to summary.json in the -output-dir.
+type batchSummary struct {
+	Succeeded int          `json:"succeeded"`
+	Skipped   int          `json:"skipped"`
+	Failed    int          `json:"failed"`
+	Results   []fileResult `json:"results"`
+}
+
+func summarize(results []fileResult) batchSummary {
+	sum := batchSummary{Results: results}
+	for _, r := range results {
+		switch r.Status {
+		case "success":
+			sum.Succeeded++
+		case "skipped":
+			sum.Skipped++
+		default:
+			sum.Failed++
+		}
+	}
+	return sum
+}
+
+// exitCode maps a batch outcome to the process exit status: 0 if nothing
+// failed, exitPartialFailure if something else made it, otherwise the
+// failures' common status, or exitFailure when their causes differ.
+func (s batchSummary) exitCode() int {
+	switch {
+	case s.Failed == 0:
+		return 0
+	case s.Succeeded+s.Skipped > 0:
+		return exitPartialFailure
+	}
+	code := s.Results[0].code
+	for _, r := range s.Results[1:] {
+		if r.code != code {
+			return exitFailure
+		}
+	}
+	return code
+}
+
+// printSummary writes the end-of-batch table: uploaded files first, then
+// skipped, then failed, each group in batch order. Failures show how much
+// was sent before the error.
+func printSummary(w io.Writer, s batchSummary) {
+	fmt.Fprintf(w, "\n%d uploaded, %d skipped, %d failed\n", s.Succeeded, s.Skipped, s.Failed)
+	rows := append([]fileResult(nil), s.Results...)
+	rank := map[string]int{"success": 0, "skipped": 1, "failed": 2}
+	sort.SliceStable(rows, func(i, j int) bool { return rank[rows[i].Status] < rank[rows[j].Status] })
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	for _, r := range rows {
+		detail := r.AttachmentID
+		switch r.Status {
+		case "success":
+			if r.BytesPresent > 0 {
+				detail = fmt.Sprintf("%s (% .1f already on the server)", detail, decor.SizeB1024(r.BytesPresent))
+			}
+		case "skipped":
+			detail = r.Reason
+		case "failed":
+			detail = r.Error
+			if r.BytesSent+r.BytesSkipped > 0 {
+				detail = fmt.Sprintf("% .1f of % .1f done: %s",
+					decor.SizeB1024(r.BytesSent+r.BytesSkipped), decor.SizeB1024(r.Size), r.Error)
+			}
+		}
+		fmt.Fprintf(tw, "  %s\t%s\t%s\t%s\n", r.Status, r.IssueKey, r.File, detail)
+	}
+	tw.Flush()
+}
+
+// outputDir hands out per-file artifact names inside dir. Files from
+// different directories that share a basename get "-2", "-3", ... suffixes
+// in argument order, skipping any name already handed out, so a batch always
+// maps to the same artifact names and never two files to one.
+type outputDir struct {
+	dir  string
+	used map[string]bool
+}
+
+func newOutputDir(dir string) (*outputDir, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	return &outputDir{dir: dir, used: map[string]bool{}}, nil
+}
+
+// stem returns the unique artifact prefix for file, e.g. "dir/report.zip"
+// or "dir/report.zip-2". A suffixed name counts as used too, so a later
+// file that is really called "report.zip-2" gets "report.zip-2-2".
+func (o *outputDir) stem(file string) string {
+	base := filepath.Base(file)
+	name := base
+	for n := 2; o.used[name]; n++ {
+		name = fmt.Sprintf("%s-%d", base, n)
+	}
+	o.used[name] = true
+	return filepath.Join(o.dir, name)
+}
+
+// writeJSONFile writes v as indented JSON with writeFileAtomic.
+func writeJSONFile(path string, v interface{}) error {
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(path, append(data, '\n'))
+}
+
+// writeFileAtomic writes data to a temporary file next to path and renames
+// it into place, so readers never see a partial document. Missing parent
+// directories are created.
+func writeFileAtomic(path string, data []byte) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp*")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := os.Chmod(tmp.Name(), 0o644); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
@@ -0,0 +1,30 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+// TestOutputDirStem checks that files sharing a basename get suffixed
+// artifact names in argument order, and that a suffix never lands on a name
+// already handed out, suffixed or not.
+func TestOutputDirStem(t *testing.T) {
+	dir := t.TempDir()
+	o, err := newOutputDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct{ file, want string }{
+		{"a/report.zip", "report.zip"},
+		{"report.zip-2", "report.zip-2"},
+		{"b/report.zip", "report.zip-3"},
+		{"report.zip-3", "report.zip-3-2"},
+		{"c/report.zip", "report.zip-4"},
+		{"other.bin", "other.bin"},
+	}
+	for _, tt := range tests {
+		if got := o.stem(tt.file); got != filepath.Join(dir, tt.want) {
+			t.Errorf("stem(%q) = %q, want %q", tt.file, got, filepath.Join(dir, tt.want))
+		}
+	}
+}
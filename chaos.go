@@ -0,0 +1,160 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+)
+
+// hiddenFlags are registered like any other but left out of the usage
+// text; they are testing aids, not for everyday uploads.
+var hiddenFlags = map[string]bool{"simulate-failure": true}
+
+// printFlagDefaults is flag.PrintDefaults without the hidden flags.
+func printFlagDefaults() {
+	fs := flag.NewFlagSet(flag.CommandLine.Name(), flag.ContinueOnError)
+	fs.SetOutput(flag.CommandLine.Output())
+	flag.VisitAll(func(f *flag.Flag) {
+		if hiddenFlags[f.Name] {
+			return
+		}
+		fs.Var(f.Value, f.Name, f.Usage)
+		// The value may have been parsed already; the default is the original.
+		fs.Lookup(f.Name).DefValue = f.DefValue
+	})
+	fs.PrintDefaults()
+}
+
+// chaosReset stands in for a status in -simulate-failure: the response is
+// replaced by a connection reset instead.
+const chaosReset = 0
+
+// chaosTransport (-simulate-failure) turns a share of responses into
+// failures after the server has handled the request, so the retry, backoff
+// and resume paths can be exercised against a healthy server. A request the
+// server accepted but whose response was lost is the hard case they must
+// cope with.
+type chaosTransport struct {
+	next     http.RoundTripper
+	rate     float64
+	statuses []int
+	logf     func(format string, args ...interface{}) // nil for silence
+
+	mu  sync.Mutex
+	rng *rand.Rand
+}
+
+// newChaosTransport parses spec, "rate=0.1,statuses=500,503[,seed=N]".
+// statuses defaults to 503 and may include "reset" for a dropped
+// connection; with a seed the same failures hit the same requests on every
+// run with the same request order.
+func newChaosTransport(next http.RoundTripper, spec string) (*chaosTransport, error) {
+	if next == nil {
+		next = http.DefaultTransport
+	}
+	c := &chaosTransport{next: next, rate: -1}
+	seed, seeded := uint64(0), false
+	key := ""
+	for _, item := range strings.Split(spec, ",") {
+		item = strings.TrimSpace(item)
+		value := item
+		if k, v, ok := strings.Cut(item, "="); ok {
+			key, value = k, v
+		} else if key != "statuses" {
+			return nil, fmt.Errorf("-simulate-failure: %q is not key=value", item)
+		}
+		var err error
+		switch key {
+		case "rate":
+			c.rate, err = strconv.ParseFloat(value, 64)
+			if err == nil && (c.rate < 0 || c.rate > 1) {
+				err = fmt.Errorf("must be between 0 and 1")
+			}
+		case "statuses":
+			if value == "reset" {
+				c.statuses = append(c.statuses, chaosReset)
+				break
+			}
+			var status int
+			status, err = strconv.Atoi(value)
+			if err == nil && (status < 400 || status > 599) {
+				err = fmt.Errorf("%d is not an error status", status)
+			}
+			c.statuses = append(c.statuses, status)
+		case "seed":
+			seed, err = strconv.ParseUint(value, 10, 64)
+			seeded = true
+		default:
+			return nil, fmt.Errorf("-simulate-failure: unknown key %q (want rate, statuses or seed)", key)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("-simulate-failure: %s: %v", key, err)
+		}
+	}
+	if c.rate < 0 {
+		return nil, fmt.Errorf("-simulate-failure: rate is required, e.g. rate=0.1")
+	}
+	if len(c.statuses) == 0 {
+		c.statuses = []int{http.StatusServiceUnavailable}
+	}
+	if !seeded {
+		seed = rand.Uint64()
+	}
+	c.rng = rand.New(rand.NewPCG(seed, seed))
+	return c, nil
+}
+
+// pick decides whether this response fails, and how.
+func (c *chaosTransport) pick() (status int, fail bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.rng.Float64() >= c.rate {
+		return 0, false
+	}
+	return c.statuses[c.rng.IntN(len(c.statuses))], true
+}
+
+// Unwrap returns the transport c sends through.
+func (c *chaosTransport) Unwrap() http.RoundTripper { return c.next }
+
+func (c *chaosTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := c.next.RoundTrip(req)
+	if err != nil {
+		return resp, err
+	}
+	status, fail := c.pick()
+	if !fail {
+		return resp, nil
+	}
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+	if c.logf != nil {
+		what := "HTTP " + strconv.Itoa(status)
+		if status == chaosReset {
+			what = "a connection reset"
+		}
+		c.logf("Simulating %s for %s %s (the server answered %d)", what, req.Method, req.URL.Path, resp.StatusCode)
+	}
+	if status == chaosReset {
+		return nil, &net.OpError{Op: "read", Net: "tcp", Err: syscall.ECONNRESET}
+	}
+	body := `{"error":"simulated failure"}`
+	return &http.Response{
+		Status:        fmt.Sprintf("%d %s", status, http.StatusText(status)),
+		StatusCode:    status,
+		Proto:         resp.Proto,
+		ProtoMajor:    resp.ProtoMajor,
+		ProtoMinor:    resp.ProtoMinor,
+		Header:        http.Header{"Content-Type": {"application/json"}, "X-Simulated-Failure": {"1"}},
+		Body:          io.NopCloser(strings.NewReader(body)),
+		ContentLength: int64(len(body)),
+		Request:       req,
+	}, nil
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"testing"
+
+	backoff "github.com/cenkalti/backoff/v4"
+)
+
+func TestNewChaosTransport(t *testing.T) {
+	tests := []struct {
+		spec     string
+		rate     float64
+		statuses []int
+		wantErr  string
+	}{
+		{"rate=0.1", 0.1, []int{503}, ""},
+		{"rate=0.5,statuses=500,503,reset,seed=7", 0.5, []int{500, 503, chaosReset}, ""},
+		{" rate=1 , statuses=429 ", 1, []int{429}, ""},
+		{"statuses=500", 0, nil, "rate is required"},
+		{"rate=2", 0, nil, "between 0 and 1"},
+		{"rate=0.1,statuses=200", 0, nil, "200 is not an error status"},
+		{"rate=0.1,seed=x", 0, nil, "seed"},
+		{"rate=0.1,delay=5", 0, nil, `unknown key "delay"`},
+		{"0.1", 0, nil, "not key=value"},
+	}
+	for _, tt := range tests {
+		c, err := newChaosTransport(nil, tt.spec)
+		if tt.wantErr != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("%q: got error %v, want one mentioning %q", tt.spec, err, tt.wantErr)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q: %v", tt.spec, err)
+			continue
+		}
+		if c.rate != tt.rate || fmt.Sprint(c.statuses) != fmt.Sprint(tt.statuses) {
+			t.Errorf("%q: got rate %v statuses %v, want %v %v", tt.spec, c.rate, c.statuses, tt.rate, tt.statuses)
+		}
+	}
+}
+
+// TestChaosTransport checks that a simulated failure replaces the response
+// only after the server has handled the request, and that a seed makes the
+// failures repeat.
+func TestChaosTransport(t *testing.T) {
+	var handled atomic.Int64
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		handled.Add(1)
+		io.WriteString(w, "ok")
+	}))
+	defer srv.Close()
+
+	get := func(c *chaosTransport) (int, error) {
+		resp, err := (&http.Client{Transport: c}).Get(srv.URL)
+		if err != nil {
+			return 0, err
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK && resp.Header.Get("X-Simulated-Failure") == "" {
+			t.Errorf("failure %d isn't marked as simulated", resp.StatusCode)
+		}
+		return resp.StatusCode, nil
+	}
+
+	c, _ := newChaosTransport(nil, "rate=1,statuses=502")
+	if status, err := get(c); err != nil || status != http.StatusBadGateway {
+		t.Errorf("rate=1: got %d, %v; want 502", status, err)
+	}
+	c, _ = newChaosTransport(nil, "rate=1,statuses=reset")
+	if _, err := get(c); !errors.Is(err, syscall.ECONNRESET) {
+		t.Errorf("statuses=reset: got %v, want a connection reset", err)
+	}
+	c, _ = newChaosTransport(nil, "rate=0")
+	if status, err := get(c); err != nil || status != http.StatusOK {
+		t.Errorf("rate=0: got %d, %v; want 200", status, err)
+	}
+	if handled.Load() != 3 {
+		t.Errorf("server handled %d requests, want all 3", handled.Load())
+	}
+
+	var runs [2][]int
+	for i := range runs {
+		c, _ := newChaosTransport(nil, "rate=0.5,statuses=500,503,seed=42")
+		for range 20 {
+			status, _ := get(c)
+			runs[i] = append(runs[i], status)
+		}
+	}
+	if fmt.Sprint(runs[0]) != fmt.Sprint(runs[1]) {
+		t.Errorf("the same seed gave %v and %v", runs[0], runs[1])
+	}
+}
+
+// TestChaosUpload checks that an upload gets through simulated failures on
+// every kind of request by retrying them.
+func TestChaosUpload(t *testing.T) {
+	path, data := writeTestFile(t, 4*minBlockSize+123)
+	rec := &finalizeRecorder{}
+	srv := httptest.NewServer(rec)
+	defer srv.Close()
+
+	fu := newTestUploader(t, path, srv.URL)
+	fu.BlockSize = constantBlockSize(minBlockSize)
+	fu.Backoff = func() backoff.BackOff { return backoff.WithMaxRetries(&backoff.ZeroBackOff{}, 20) }
+	chaos, err := newChaosTransport(nil, "rate=0.2,statuses=500,503,reset,seed=1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fu.Client = &http.Client{Transport: chaos}
+	if _, err := fu.RunContext(t.Context()); err != nil {
+		t.Fatal(err)
+	}
+	etags := partETags(data, minBlockSize)
+	if len(rec.finalizes) == 0 || len(rec.finalizes[len(rec.finalizes)-1].Chunks) != len(etags) {
+		t.Errorf("finalize requests %+v, want the last listing %d chunks", rec.finalizes, len(etags))
+	}
+}
+
+func TestHiddenFlags(t *testing.T) {
+	var out strings.Builder
+	flag.CommandLine.SetOutput(&out)
+	defer flag.CommandLine.SetOutput(nil)
+	// The flags are registered in main, which tests don't run.
+	for _, name := range []string{"simulate-failure", "abfu-test-visible"} {
+		if flag.Lookup(name) == nil {
+			flag.Bool(name, false, "")
+		}
+	}
+	printFlagDefaults()
+	if strings.Contains(out.String(), "simulate-failure") {
+		t.Error("usage lists -simulate-failure")
+	}
+	if !strings.Contains(out.String(), "abfu-test-visible") {
+		t.Error("usage leaves out a visible flag")
+	}
+}
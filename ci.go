@@ -0,0 +1,92 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/vbauerster/mpb/v7/decor"
+)
+
+// ciAnnotations resolves -ci-annotations auto|off. In auto mode GitHub
+// Actions is detected from GITHUB_ACTIONS, which the runner sets to "true".
+func ciAnnotations(mode string) (bool, error) {
+	switch mode {
+	case "auto":
+		return os.Getenv("GITHUB_ACTIONS") == "true", nil
+	case "off":
+		return false, nil
+	}
+	return false, fmt.Errorf("-ci-annotations must be auto or off, not %q", mode)
+}
+
+// workflowCommand formats a GitHub Actions "::error::"-style line. The
+// message is escaped so multi-line errors stay a single annotation.
+func workflowCommand(kind, msg string) string {
+	msg = strings.NewReplacer("%", "%25", "\r", "%0D", "\n", "%0A").Replace(msg)
+	return "::" + kind + "::" + msg
+}
+
+// writeStepSummary appends a markdown table of the batch to
+// $GITHUB_STEP_SUMMARY and exports the attachment ids of successful uploads
+// (including skipped ones) to $GITHUB_OUTPUT: attachment-id for the first,
+// attachment-ids as a JSON array for all of them and attachment-url for the
+// first download link the server returned. Either file may be unset outside
+// a job step.
+func writeStepSummary(results []fileResult) error {
+	if path := os.Getenv("GITHUB_STEP_SUMMARY"); path != "" {
+		var b strings.Builder
+		b.WriteString("| File | Size | Issue | Attachment | Duration |\n")
+		b.WriteString("|------|------|-------|------------|----------|\n")
+		for _, r := range results {
+			link := r.AttachmentID
+			if a := r.Attachment; a != nil && a.DownloadURL != "" {
+				link = "[" + a.ID + "](" + a.DownloadURL + ")"
+			}
+			if r.Status == "failed" {
+				link = "failed: " + strings.ReplaceAll(r.Error, "|", `\|`)
+			}
+			fmt.Fprintf(&b, "| %s | % .1f | %s | %s | %s |\n", r.Name, decor.SizeB1024(r.Size), r.IssueKey, link,
+				r.Finished.Sub(r.Started).Round(time.Second))
+		}
+		if err := appendFile(path, b.String()); err != nil {
+			return err
+		}
+	}
+	if path := os.Getenv("GITHUB_OUTPUT"); path != "" {
+		var ids []string
+		url := ""
+		for _, r := range results {
+			if r.Status != "failed" && r.AttachmentID != "" {
+				ids = append(ids, r.AttachmentID)
+				if a := r.Attachment; url == "" && a != nil {
+					url = a.DownloadURL
+				}
+			}
+		}
+		if len(ids) == 0 {
+			return nil
+		}
+		data, _ := json.Marshal(ids)
+		out := "attachment-id=" + ids[0] + "\nattachment-ids=" + string(data) + "\n"
+		if url != "" {
+			out += "attachment-url=" + url + "\n"
+		}
+		return appendFile(path, out)
+	}
+	return nil
+}
+
+func appendFile(path, text string) error {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return err
+	}
+	if _, err := f.WriteString(text); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
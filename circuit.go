@@ -0,0 +1,146 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	backoff "github.com/cenkalti/backoff/v4"
+)
+
+// Circuit breaker defaults; see -circuit-threshold, -circuit-window and
+// -circuit-timeout.
+const (
+	defaultCircuitThreshold = 5
+	defaultCircuitWindow    = 30 * time.Second
+	defaultCircuitTimeout   = 5 * time.Minute
+)
+
+// circuitBreaker stops every chunk from spending its own 15 minutes of
+// retries when the service is down as a whole. Once threshold distinct
+// parts in a row have failed their first attempt with a 5xx or a connection
+// error, all within window, the circuit opens: workers stop sending, and
+// the first one to notice runs a single health check, retried with its own
+// backoff for up to timeout, while the others wait for its verdict. A
+// healthy service closes the circuit and everyone carries on; otherwise
+// every worker, and every later file of the batch, fails with
+// errServiceUnavailable. One breaker is shared by all workers and files; a
+// nil breaker is disabled.
+type circuitBreaker struct {
+	threshold int
+	window    time.Duration
+	timeout   time.Duration
+
+	mu      sync.Mutex
+	streak  map[int]time.Time // parts whose first attempt failed, since the last success
+	open    bool
+	probing chan struct{} // closed when the running health check is done
+	err     error         // the verdict once the service was given up on
+}
+
+func newCircuitBreaker(threshold int, window, timeout time.Duration) *circuitBreaker {
+	return &circuitBreaker{threshold: threshold, window: window, timeout: timeout, streak: map[int]time.Time{}}
+}
+
+// Record reports the outcome of an attempt to upload part; first is true
+// for its first attempt.
+func (b *circuitBreaker) Record(part int, first bool, err error) {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	switch {
+	case err == nil:
+		clear(b.streak)
+	case first && systemicFailure(err):
+		now := time.Now()
+		b.streak[part] = now
+		for p, at := range b.streak {
+			if now.Sub(at) > b.window {
+				delete(b.streak, p)
+			}
+		}
+		if !b.open && len(b.streak) >= b.threshold {
+			b.open = true
+			ui.Warnf("%d chunks in a row failed with server or connection errors; pausing uploads to check the service", len(b.streak))
+		}
+	}
+}
+
+// Paused reports whether the circuit is open, uploads waiting on a health
+// check.
+func (b *circuitBreaker) Paused() bool {
+	if b == nil {
+		return false
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.open && b.err == nil
+}
+
+// Wait returns at once while the circuit is closed. While it is open it
+// blocks until a health check decides; the first caller runs check itself,
+// retried by the policy newPolicy makes for the breaker's timeout. It
+// returns errServiceUnavailable once the service has been given up on.
+func (b *circuitBreaker) Wait(ctx context.Context, check func(context.Context) error, newPolicy func(timeout time.Duration) backoff.BackOff) error {
+	if b == nil {
+		return nil
+	}
+	b.mu.Lock()
+	if b.err != nil || !b.open {
+		defer b.mu.Unlock()
+		return b.err
+	}
+	if ch := b.probing; ch != nil {
+		b.mu.Unlock()
+		select {
+		case <-ch:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		return b.err
+	}
+	ch := make(chan struct{})
+	b.probing = ch
+	b.mu.Unlock()
+
+	err := backoff.Retry(func() error { return check(ctx) }, backoff.WithContext(newPolicy(b.timeout), ctx))
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	close(ch)
+	b.probing = nil
+	switch {
+	case ctx.Err() != nil:
+		// The run was stopped; the circuit stays open for whoever comes next.
+		return ctx.Err()
+	case err != nil:
+		b.err = fmt.Errorf("%w: no successful health check in %s: %w", errServiceUnavailable, b.timeout, err)
+		return b.err
+	}
+	b.open = false
+	clear(b.streak)
+	ui.Warnf("Service is responding again; resuming uploads")
+	return nil
+}
+
+// systemicFailure reports whether err points at the service rather than at
+// one request: a 5xx status or a failed connection. 429 is rate limiting,
+// which the throttle handles.
+func systemicFailure(err error) bool {
+	var status *statusError
+	if errors.As(err, &status) {
+		return status.status >= 500
+	}
+	if errors.Is(err, context.Canceled) {
+		return false
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr)
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+
+	backoff "github.com/cenkalti/backoff/v4"
+)
+
+// TestCircuitBreakerHealthCheck checks that the breaker opens after
+// threshold first attempts fail with 5xx and that its health check is
+// retried by the policy it is given, closing on success and giving up with
+// errServiceUnavailable at the timeout.
+func TestCircuitBreakerHealthCheck(t *testing.T) {
+	fu := NewFileUploader("data.bin", "TEST-1", "user", "token", "http://127.0.0.1")
+	fu.Backoff = func() backoff.BackOff { return backoff.NewConstantBackOff(time.Millisecond) }
+	policy := func(timeout time.Duration) backoff.BackOff {
+		return fu.boundedRetryPolicy(t.Context(), timeout, 0, 0)
+	}
+	down := &statusError{op: "upload chunk", status: http.StatusServiceUnavailable}
+
+	tests := []struct {
+		name     string
+		healthy  int // checks failing before one succeeds
+		wantErr  error
+		minCheck int
+	}{
+		{"recovers", 3, nil, 4},
+		{"gives up", 1 << 30, errServiceUnavailable, 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := newCircuitBreaker(3, time.Minute, 50*time.Millisecond)
+			for part := 1; part <= 3; part++ {
+				if b.Paused() {
+					t.Fatalf("paused after %d failures, want 3", part-1)
+				}
+				b.Record(part, true, down)
+			}
+			if !b.Paused() {
+				t.Fatal("not paused after 3 failures")
+			}
+			checks := 0
+			err := b.Wait(t.Context(), func(context.Context) error {
+				if checks++; checks <= tt.healthy {
+					return down
+				}
+				return nil
+			}, policy)
+			if !errors.Is(err, tt.wantErr) || (tt.wantErr == nil && err != nil) {
+				t.Fatalf("got error %v, want %v", err, tt.wantErr)
+			}
+			if checks < tt.minCheck {
+				t.Errorf("ran %d health checks, want at least %d", checks, tt.minCheck)
+			}
+			if b.Paused() {
+				t.Error("still paused after the health check decided")
+			}
+		})
+	}
+}
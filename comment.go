@@ -0,0 +1,66 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	backoff "github.com/cenkalti/backoff/v4"
+)
+
+// commentText is text followed by a link to the attachment, in the wiki
+// markup Jira's version 2 API renders: [^name] links to the issue's
+// attachment of that name.
+func commentText(text, name string) string {
+	name = strings.NewReplacer("[", "(", "]", ")", "|", "-").Replace(name)
+	return text + "\n\n[^" + name + "]"
+}
+
+// PostComment adds text as a comment on the issue, followed by a link to
+// the attachment, and returns the comment's id. It uses the comment path
+// template, which must accept Jira's {"body": "..."} and answer 201. Call
+// it after the upload; a failure doesn't undo the attachment.
+func (fu *FileUploader) PostComment(ctx context.Context, text string) (string, error) {
+	if fu.Paths.Comment == "" {
+		return "", fmt.Errorf("no comment path template to post to")
+	}
+	payload, _ := json.Marshal(map[string]string{"body": commentText(text, fu.attachmentName())})
+	var id string
+	op := func() error {
+		req, _ := http.NewRequestWithContext(ctx, "POST", fu.endpoint(fu.Paths.Comment), bytes.NewReader(payload))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Accept", "application/json")
+		resp, tok, err := fu.do(req)
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+
+		switch {
+		case resp.StatusCode == http.StatusUnauthorized:
+			return fu.unauthorized(tok)
+		case resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500:
+			return &statusError{op: "post comment", status: resp.StatusCode}
+		case resp.StatusCode != http.StatusCreated && resp.StatusCode != http.StatusOK:
+			body, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+			return backoff.Permanent(&statusError{op: "post comment", status: resp.StatusCode,
+				body: string(bytes.TrimSpace(body))})
+		}
+		// The id is nice to have; a comment without one was still posted.
+		var out struct {
+			ID string `json:"id"`
+		}
+		json.NewDecoder(resp.Body).Decode(&out)
+		id = out.ID
+		return nil
+	}
+	if err := backoff.Retry(op, fu.retryPolicy(ctx)); err != nil {
+		return "", err
+	}
+	fu.debugf("Posted comment %s on %s", id, fu.IssueKey)
+	return id, nil
+}
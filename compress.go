@@ -0,0 +1,51 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"net/http"
+)
+
+// defaultGzipThreshold is the JSON body size above which probe and finalize
+// requests are sent gzip-compressed.
+const defaultGzipThreshold = 64 * 1024
+
+// encodeJSON marshals payload and gzips it when it is larger than
+// GzipThreshold and the server hasn't rejected compressed bodies before.
+// Chunk bodies never go through here.
+func (fu *FileUploader) encodeJSON(payload interface{}) ([]byte, bool, error) {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return nil, false, err
+	}
+	if fu.GzipThreshold <= 0 || len(body) <= fu.GzipThreshold || fu.gzipRejected.Load() {
+		return body, false, nil
+	}
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	if _, err := zw.Write(body); err != nil {
+		return nil, false, err
+	}
+	if err := zw.Close(); err != nil {
+		return nil, false, err
+	}
+	return buf.Bytes(), true, nil
+}
+
+// gzipRefused reports whether resp is the server turning down a compressed
+// body. If so, compression is disabled for the rest of the run and the
+// returned error makes the caller retry uncompressed.
+func (fu *FileUploader) gzipRefused(resp *http.Response, gzipped bool) error {
+	if !gzipped {
+		return nil
+	}
+	if resp.StatusCode != http.StatusUnsupportedMediaType && resp.StatusCode != http.StatusBadRequest {
+		return nil
+	}
+	if !fu.gzipRejected.Swap(true) {
+		fu.debugf("Server refused gzip request body (status %d); sending uncompressed", resp.StatusCode)
+	}
+	return fmt.Errorf("gzip body refused with status %d", resp.StatusCode)
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"compress/gzip"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// encodingRecorder passes requests on to a finalizeRecorder, uncompressed,
+// noting each one's operation and Content-Encoding; with refuseGzip it
+// answers compressed bodies with 415 instead.
+type encodingRecorder struct {
+	finalizeRecorder
+	refuseGzip bool
+
+	mu        sync.Mutex
+	encodings []string // "op:encoding"
+}
+
+func (e *encodingRecorder) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	op := "chunk"
+	switch {
+	case strings.HasSuffix(r.URL.Path, "/create"):
+		op = "create"
+	case strings.HasSuffix(r.URL.Path, "/chunk/probe"):
+		op = "probe"
+	case strings.HasSuffix(r.URL.Path, "/file/chunked"):
+		op = "finalize"
+	}
+	enc := r.Header.Get("Content-Encoding")
+	e.mu.Lock()
+	e.encodings = append(e.encodings, op+":"+enc)
+	e.mu.Unlock()
+	if e.refuseGzip && enc == "gzip" {
+		http.Error(w, "unsupported encoding", http.StatusUnsupportedMediaType)
+		return
+	}
+	if enc == "gzip" {
+		zr, err := gzip.NewReader(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		r.Body = io.NopCloser(zr)
+	}
+	e.finalizeRecorder.ServeHTTP(w, r)
+}
+
+// count returns how many requests were op with encoding enc.
+func (e *encodingRecorder) count(op, enc string) int {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	n := 0
+	for _, s := range e.encodings {
+		if s == op+":"+enc {
+			n++
+		}
+	}
+	return n
+}
+
+func TestGzipBodies(t *testing.T) {
+	path, _ := writeTestFile(t, 3*minBlockSize+100)
+	for _, refuse := range []bool{false, true} {
+		rec := &encodingRecorder{refuseGzip: refuse}
+		srv := httptest.NewServer(rec)
+		defer srv.Close()
+
+		fu := newTestUploader(t, path, srv.URL)
+		fu.Concurrency = 1
+		fu.GzipThreshold = 1
+		if _, err := fu.RunContext(t.Context()); err != nil {
+			t.Fatalf("refuse %v: %v", refuse, err)
+		}
+		if len(rec.finalizes) != 1 || len(rec.finalizes[0].Chunks) != 4 {
+			t.Errorf("refuse %v: finalize requests %+v, want one listing 4 chunks", refuse, rec.finalizes)
+		}
+		if n := rec.count("chunk", "gzip"); n != 0 {
+			t.Errorf("refuse %v: %d chunk bodies were compressed", refuse, n)
+		}
+		if !refuse {
+			if rec.count("probe", "gzip") == 0 || rec.count("finalize", "gzip") != 1 || rec.count("finalize", "") != 0 {
+				t.Errorf("probe and finalize bodies weren't all compressed: %q", rec.encodings)
+			}
+			continue
+		}
+		// The first compressed body is refused and resent plain, and
+		// nothing is compressed after that.
+		if n := rec.count("probe", "gzip") + rec.count("finalize", "gzip"); n != 1 {
+			t.Errorf("sent %d compressed bodies to a server refusing them, want 1: %q", n, rec.encodings)
+		}
+		if rec.count("finalize", "") != 1 {
+			t.Errorf("finalize wasn't sent uncompressed once: %q", rec.encodings)
+		}
+	}
+}
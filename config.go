@@ -0,0 +1,249 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+)
+
+// Profile is one named identity from the config file. Token is either the
+// literal secret or a reference resolved at startup:
+//
+//	env:NAME             value of environment variable NAME
+//	file:PATH            first line of the file at PATH
+//	keychain:SERVICE[/ACCOUNT]  macOS Keychain or Secret Service (secret-tool)
+type Profile struct {
+	Name    string `json:"-"`
+	User    string `json:"user"`
+	BaseURL string `json:"url"`
+	Auth    string `json:"auth"` // "basic" (default) or "bearer"
+	Token   string `json:"token"`
+}
+
+type configFile struct {
+	DefaultProfile string              `json:"defaultProfile"`
+	Profiles       map[string]*Profile `json:"profiles"`
+	// MimeTypes maps file extensions to the content type attachments with
+	// them get, ahead of the standard table; see resolveMimeType.
+	MimeTypes map[string]string `json:"mimeTypes"`
+}
+
+func defaultConfigPath() string {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(dir, "atlassian-uploader", "config.json")
+}
+
+// loadMimeTypes returns the config's extension map, normalized. A missing
+// config file has none.
+func loadMimeTypes(path string) (map[string]string, error) {
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var cfg configFile
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		return nil, fmt.Errorf("config %s: %v", path, err)
+	}
+	return normalizeMimeMap(cfg.MimeTypes), nil
+}
+
+// loadProfile reads the config at path and returns the named profile, or the
+// config's defaultProfile when name is empty. A missing config file with no
+// profile requested is not an error.
+func loadProfile(path, name string) (*Profile, error) {
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) && name == "" {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var cfg configFile
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		return nil, fmt.Errorf("config %s: %v", path, err)
+	}
+	if name == "" {
+		name = cfg.DefaultProfile
+		if name == "" {
+			return nil, nil
+		}
+	}
+	p, ok := cfg.Profiles[name]
+	if !ok {
+		return nil, fmt.Errorf("profile %q not found in %s", name, path)
+	}
+	p.Name = name
+	switch p.Auth {
+	case "":
+		p.Auth = "basic"
+	case "basic", "bearer":
+	default:
+		return nil, fmt.Errorf("profile %q: unknown auth mode %q", name, p.Auth)
+	}
+	return p, nil
+}
+
+// credentials are what a run authenticates with. Profile names the config
+// profile that supplied any of them, "" for none; it is recorded with the
+// results, the secret never is.
+type credentials struct {
+	User     string
+	Token    string
+	BaseURL  string
+	AuthMode string // "basic" or "bearer"
+	Profile  string
+}
+
+// credentialSources are the places resolveCredentials takes credentials
+// from besides the flag values themselves.
+type credentialSources struct {
+	Config    string          // -config
+	Profile   string          // -profile
+	TokenFile string          // -token-file
+	TokenCmd  string          // -token-cmd
+	Set       map[string]bool // the flags given on the command line
+}
+
+// resolveCredentials settles the credentials of a run. flags holds the
+// values of -user, -token and -url, which are the build-time or built-in
+// defaults unless src.Set says they were given. A value given on the
+// command line wins, a token from -token-file or -token-cmd counting as
+// given; then comes the profile's, resolving its token reference; then the
+// default. Combinations of the token flags that can't go together are the
+// caller's to refuse. A token that can't be obtained is errAuthFailed.
+func resolveCredentials(flags credentials, src credentialSources) (credentials, error) {
+	creds := flags
+	creds.AuthMode = "basic"
+	prof, err := loadProfile(src.Config, src.Profile)
+	if err != nil {
+		return creds, err
+	}
+	tokenSet := src.Set["token"]
+	switch {
+	case src.TokenFile != "":
+		tokens, err := readTokenFile(src.TokenFile)
+		if err != nil {
+			return creds, &tokenError{err}
+		}
+		creds.Token, tokenSet = strings.Join(tokens, ","), true
+	case src.TokenCmd != "":
+		tok, err := runTokenCmd(src.TokenCmd)
+		if err != nil {
+			return creds, &tokenError{err}
+		}
+		creds.Token, tokenSet = tok, true
+	}
+	if prof == nil {
+		return creds, nil
+	}
+	creds.Profile, creds.AuthMode = prof.Name, prof.Auth
+	if !src.Set["user"] && prof.User != "" {
+		creds.User = prof.User
+	}
+	if !src.Set["url"] && prof.BaseURL != "" {
+		creds.BaseURL = prof.BaseURL
+	}
+	if !tokenSet && prof.Token != "" {
+		if creds.Token, err = prof.resolveToken(); err != nil {
+			return creds, &tokenError{err}
+		}
+	}
+	return creds, nil
+}
+
+// tokenError is a token that couldn't be obtained. It reads as its cause
+// and is errAuthFailed to errors.Is.
+type tokenError struct{ err error }
+
+func (e *tokenError) Error() string   { return e.err.Error() }
+func (e *tokenError) Unwrap() []error { return []error{e.err, errAuthFailed} }
+
+// resolveToken turns the profile's token reference into the secret itself.
+func (p *Profile) resolveToken() (string, error) {
+	kind, ref, found := strings.Cut(p.Token, ":")
+	if !found {
+		return p.Token, nil
+	}
+	switch kind {
+	case "env":
+		v := os.Getenv(ref)
+		if v == "" {
+			return "", fmt.Errorf("profile %q: environment variable %s is empty", p.Name, ref)
+		}
+		return v, nil
+	case "file":
+		data, err := os.ReadFile(ref)
+		if err != nil {
+			return "", fmt.Errorf("profile %q: %v", p.Name, err)
+		}
+		line, _, _ := strings.Cut(string(data), "\n")
+		return strings.TrimSpace(line), nil
+	case "keychain":
+		return keychainLookup(p.Name, ref)
+	default:
+		// Not a reference, just a token that happens to contain a colon.
+		return p.Token, nil
+	}
+}
+
+func keychainLookup(profile, ref string) (string, error) {
+	service, account, _ := strings.Cut(ref, "/")
+	var cmd *exec.Cmd
+	switch runtime.GOOS {
+	case "darwin":
+		args := []string{"find-generic-password", "-s", service, "-w"}
+		if account != "" {
+			args = append(args, "-a", account)
+		}
+		cmd = exec.Command("security", args...)
+	default:
+		args := []string{"lookup", "service", service}
+		if account != "" {
+			args = append(args, "account", account)
+		}
+		cmd = exec.Command("secret-tool", args...)
+	}
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return "", fmt.Errorf("profile %q: keychain lookup for %s failed: %v: %s",
+			profile, service, err, strings.TrimSpace(stderr.String()))
+	}
+	return strings.TrimSpace(string(out)), nil
+}
+
+// runTokenCmd runs command through the platform shell (sh -c, or cmd /C on
+// Windows) and returns its trimmed stdout. The output is never logged; on
+// failure only the command's stderr is surfaced.
+func runTokenCmd(command string) (string, error) {
+	var cmd *exec.Cmd
+	if runtime.GOOS == "windows" {
+		cmd = exec.Command("cmd", "/C", command)
+	} else {
+		cmd = exec.Command("sh", "-c", command)
+	}
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	cmd.Stdin = os.Stdin
+	out, err := cmd.Output()
+	if err != nil {
+		return "", fmt.Errorf("token command failed: %v: %s", err, strings.TrimSpace(stderr.String()))
+	}
+	tok := strings.TrimSpace(string(out))
+	if tok == "" {
+		return "", fmt.Errorf("token command printed nothing")
+	}
+	return tok, nil
+}
@@ -0,0 +1,294 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+// writeConfig writes a config file with the given JSON to a temporary
+// directory and returns its path.
+func writeConfig(t *testing.T, json string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "config.json")
+	if err := os.WriteFile(path, []byte(json), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadProfile(t *testing.T) {
+	config := writeConfig(t, `{
+		"defaultProfile": "internal",
+		"profiles": {
+			"internal": {"user": "alice", "url": "https://internal.example.com", "token": "env:ABFU_TEST_TOKEN"},
+			"support": {"auth": "bearer", "url": "https://support.example.com"},
+			"odd": {"auth": "digest"}
+		}
+	}`)
+	missing := filepath.Join(t.TempDir(), "missing.json")
+
+	tests := []struct {
+		name, path, profile string
+		want                *Profile
+		wantErr             string
+	}{
+		{"default profile", config, "", &Profile{Name: "internal", User: "alice", BaseURL: "https://internal.example.com", Auth: "basic", Token: "env:ABFU_TEST_TOKEN"}, ""},
+		{"named profile", config, "support", &Profile{Name: "support", BaseURL: "https://support.example.com", Auth: "bearer"}, ""},
+		{"no config file", missing, "", nil, ""},
+		{"profile without a config file", missing, "internal", nil, "missing.json"},
+		{"unknown profile", config, "nope", nil, `profile "nope" not found`},
+		{"unknown auth mode", config, "odd", nil, `unknown auth mode "digest"`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := loadProfile(tt.path, tt.profile)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("got error %v, want one mentioning %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if (got == nil) != (tt.want == nil) || got != nil && *got != *tt.want {
+				t.Errorf("got %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestResolveToken(t *testing.T) {
+	dir := t.TempDir()
+	tokenFile := filepath.Join(dir, "token")
+	os.WriteFile(tokenFile, []byte("file-token\nignored\n"), 0o600)
+	t.Setenv("ABFU_TEST_TOKEN", "env-token")
+
+	// A fake secret-tool (or security on macOS) stands in for the keychain.
+	bin := t.TempDir()
+	tool := "secret-tool"
+	if runtime.GOOS == "darwin" {
+		tool = "security"
+	}
+	if runtime.GOOS != "windows" {
+		os.WriteFile(filepath.Join(bin, tool), []byte("#!/bin/sh\necho keychain-token\n"), 0o700)
+		t.Setenv("PATH", bin+string(os.PathListSeparator)+os.Getenv("PATH"))
+	}
+
+	tests := []struct {
+		token, want, wantErr string
+	}{
+		{"env:ABFU_TEST_TOKEN", "env-token", ""},
+		{"file:" + tokenFile, "file-token", ""},
+		{"keychain:abfu/kim", "keychain-token", ""},
+		{"plain:token", "plain:token", ""},
+		{"secret", "secret", ""},
+		{"env:ABFU_TEST_UNSET", "", "ABFU_TEST_UNSET is empty"},
+		{"file:" + filepath.Join(dir, "missing"), "", "missing"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.token, func(t *testing.T) {
+			if runtime.GOOS == "windows" && strings.HasPrefix(tt.token, "keychain:") {
+				t.Skip("needs a POSIX shell")
+			}
+			p := &Profile{Name: "test", Token: tt.token}
+			got, err := p.resolveToken()
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("got %q, %v; want an error mentioning %q", got, err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRunTokenCmd(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("needs a POSIX shell")
+	}
+	tests := []struct {
+		command, want, wantErr string
+	}{
+		{"echo '  cmd-token  '", "cmd-token", ""},
+		{"true", "", "printed nothing"},
+		{"echo denied >&2; exit 3", "", "denied"},
+	}
+	for _, tt := range tests {
+		got, err := runTokenCmd(tt.command)
+		if tt.wantErr != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("runTokenCmd(%q) = %q, %v; want an error mentioning %q", tt.command, got, err, tt.wantErr)
+			}
+			continue
+		}
+		if err != nil || got != tt.want {
+			t.Errorf("runTokenCmd(%q) = %q, %v; want %q", tt.command, got, err, tt.want)
+		}
+	}
+}
+
+func TestResolveCredentials(t *testing.T) {
+	dir := t.TempDir()
+	tokenFile := filepath.Join(dir, "token")
+	os.WriteFile(tokenFile, []byte("file-token\nignored\n"), 0o600)
+	tokenList := filepath.Join(dir, "tokens")
+	os.WriteFile(tokenList, []byte("# rotation\nlist-a\n\nlist-b\n"), 0o600)
+	t.Setenv("ABFU_TEST_TOKEN", "env-token")
+
+	// A fake secret-tool (or security on macOS) stands in for the keychain.
+	bin := t.TempDir()
+	tool := "secret-tool"
+	if runtime.GOOS == "darwin" {
+		tool = "security"
+	}
+	if runtime.GOOS != "windows" {
+		os.WriteFile(filepath.Join(bin, tool), []byte("#!/bin/sh\necho keychain-token\n"), 0o700)
+		t.Setenv("PATH", bin+string(os.PathListSeparator)+os.Getenv("PATH"))
+	}
+
+	config := writeConfig(t, `{
+		"defaultProfile": "internal",
+		"profiles": {
+			"internal": {"user": "alice", "url": "https://internal.example.com", "token": "env:ABFU_TEST_TOKEN"},
+			"support": {"auth": "bearer", "url": "https://support.example.com", "token": "file:`+filepath.ToSlash(tokenFile)+`"},
+			"keychain": {"user": "kim", "token": "keychain:abfu/kim"},
+			"literal": {"user": "lee", "token": "plain:token"},
+			"urlonly": {"url": "https://urlonly.example.com"}
+		}
+	}`)
+	defaults := credentials{User: "built-in", Token: "built-in-token", BaseURL: "https://transfer.atlassian.com"}
+
+	tests := []struct {
+		name string
+		src  credentialSources
+		// flags overrides defaults for the flags named in src.Set.
+		flags credentials
+		want  credentials
+	}{
+		{
+			name: "default profile",
+			src:  credentialSources{},
+			want: credentials{User: "alice", Token: "env-token", BaseURL: "https://internal.example.com", AuthMode: "basic", Profile: "internal"},
+		},
+		{
+			name: "file token and bearer auth",
+			src:  credentialSources{Profile: "support"},
+			want: credentials{User: "built-in", Token: "file-token", BaseURL: "https://support.example.com", AuthMode: "bearer", Profile: "support"},
+		},
+		{
+			name: "literal token with a colon",
+			src:  credentialSources{Profile: "literal"},
+			want: credentials{User: "lee", Token: "plain:token", BaseURL: "https://transfer.atlassian.com", AuthMode: "basic", Profile: "literal"},
+		},
+		{
+			name: "profile without a token keeps the default",
+			src:  credentialSources{Profile: "urlonly"},
+			want: credentials{User: "built-in", Token: "built-in-token", BaseURL: "https://urlonly.example.com", AuthMode: "basic", Profile: "urlonly"},
+		},
+		{
+			name:  "flags win over the profile",
+			src:   credentialSources{Profile: "support", Set: map[string]bool{"url": true, "token": true}},
+			flags: credentials{BaseURL: "https://override.example.com", Token: "flag-token"},
+			want:  credentials{User: "built-in", Token: "flag-token", BaseURL: "https://override.example.com", AuthMode: "bearer", Profile: "support"},
+		},
+		{
+			name:  "user flag only",
+			src:   credentialSources{Set: map[string]bool{"user": true}},
+			flags: credentials{User: "bob"},
+			want:  credentials{User: "bob", Token: "env-token", BaseURL: "https://internal.example.com", AuthMode: "basic", Profile: "internal"},
+		},
+		{
+			name: "token file wins over the profile",
+			src:  credentialSources{TokenFile: tokenList},
+			want: credentials{User: "alice", Token: "list-a,list-b", BaseURL: "https://internal.example.com", AuthMode: "basic", Profile: "internal"},
+		},
+		{
+			name: "token command wins over the profile",
+			src:  credentialSources{TokenCmd: "echo cmd-token"},
+			want: credentials{User: "alice", Token: "cmd-token", BaseURL: "https://internal.example.com", AuthMode: "basic", Profile: "internal"},
+		},
+		{
+			name: "keychain token",
+			src:  credentialSources{Profile: "keychain"},
+			want: credentials{User: "kim", Token: "keychain-token", BaseURL: "https://transfer.atlassian.com", AuthMode: "basic", Profile: "keychain"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if runtime.GOOS == "windows" && (tt.src.Profile == "keychain" || tt.src.TokenCmd != "") {
+				t.Skip("needs a POSIX shell")
+			}
+			flags := defaults
+			if tt.src.Set["user"] {
+				flags.User = tt.flags.User
+			}
+			if tt.src.Set["token"] {
+				flags.Token = tt.flags.Token
+			}
+			if tt.src.Set["url"] {
+				flags.BaseURL = tt.flags.BaseURL
+			}
+			tt.src.Config = config
+			got, err := resolveCredentials(flags, tt.src)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Errorf("got %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestResolveCredentialsErrors(t *testing.T) {
+	config := writeConfig(t, `{"profiles": {"empty-env": {"token": "env:ABFU_TEST_UNSET"}, "odd": {"auth": "digest"}}}`)
+	missing := filepath.Join(t.TempDir(), "missing.json")
+	defaults := credentials{User: "built-in", Token: "built-in-token", BaseURL: "https://transfer.atlassian.com"}
+
+	tests := []struct {
+		name     string
+		src      credentialSources
+		wantAuth bool
+		wantMsg  string
+	}{
+		{"unknown profile", credentialSources{Config: config, Profile: "nope"}, false, `profile "nope" not found`},
+		{"unknown auth mode", credentialSources{Config: config, Profile: "odd"}, false, `unknown auth mode "digest"`},
+		{"profile without a config file", credentialSources{Config: missing, Profile: "internal"}, false, "missing.json"},
+		{"empty environment variable", credentialSources{Config: config, Profile: "empty-env"}, true, "ABFU_TEST_UNSET is empty"},
+		{"missing token file", credentialSources{Config: config, TokenFile: missing}, true, "missing.json"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := resolveCredentials(defaults, tt.src)
+			if err == nil {
+				t.Fatal("no error")
+			}
+			if errors.Is(err, errAuthFailed) != tt.wantAuth {
+				t.Errorf("error %v: errAuthFailed is %v, want %v", err, !tt.wantAuth, tt.wantAuth)
+			}
+			if !strings.Contains(err.Error(), tt.wantMsg) {
+				t.Errorf("error %q doesn't mention %q", err, tt.wantMsg)
+			}
+		})
+	}
+
+	// Without a config file, and no profile asked for, the flags stand.
+	got, err := resolveCredentials(defaults, credentialSources{Config: missing})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := (credentials{User: "built-in", Token: "built-in-token", BaseURL: "https://transfer.atlassian.com", AuthMode: "basic"}); got != want {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// dedupeEntry records one successful upload in the -dedupe-cache file.
+type dedupeEntry struct {
+	BaseURL      string    `json:"baseUrl"`
+	IssueKey     string    `json:"issueKey"`
+	SHA256       string    `json:"sha256"`
+	Name         string    `json:"name"`
+	Size         int64     `json:"size"`
+	AttachmentID string    `json:"attachmentId,omitempty"`
+	Uploaded     time.Time `json:"uploaded"`
+}
+
+// dedupeCache remembers files already uploaded to an issue, keyed by base
+// URL, issue key and the SHA-256 of the whole file. Several processes may
+// share the file: every update takes a lock file, re-reads the cache and
+// replaces it atomically, so concurrent runs neither corrupt it nor drop
+// each other's entries.
+type dedupeCache struct {
+	path string
+}
+
+// dedupeLockStale is how old a lock file must be before it is assumed to be
+// left over from a crashed process.
+const dedupeLockStale = 30 * time.Second
+
+func defaultDedupeCachePath() string {
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(dir, "abfu", "uploads.json")
+}
+
+// newDedupeCache returns nil for "" and "off". A leading "~/" is expanded so
+// the path works when quoted in CI configs.
+func newDedupeCache(path string) *dedupeCache {
+	if path == "" || path == "off" {
+		return nil
+	}
+	if strings.HasPrefix(path, "~/") {
+		if home, err := os.UserHomeDir(); err == nil {
+			path = filepath.Join(home, path[2:])
+		}
+	}
+	return &dedupeCache{path: path}
+}
+
+func dedupeKey(baseURL, issueKey, sum string) string {
+	return strings.TrimRight(baseURL, "/") + " " + issueKey + " " + sum
+}
+
+func (c *dedupeCache) load() (map[string]dedupeEntry, error) {
+	entries := map[string]dedupeEntry{}
+	data, err := os.ReadFile(c.path)
+	if os.IsNotExist(err) {
+		return entries, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &entries); err != nil {
+		return nil, fmt.Errorf("dedupe cache %s: %v", c.path, err)
+	}
+	return entries, nil
+}
+
+// Lookup returns the earlier upload of the file with this digest, if any.
+func (c *dedupeCache) Lookup(baseURL, issueKey, sum string) (*dedupeEntry, error) {
+	entries, err := c.load()
+	if err != nil {
+		return nil, err
+	}
+	e, ok := entries[dedupeKey(baseURL, issueKey, sum)]
+	if !ok {
+		return nil, nil
+	}
+	return &e, nil
+}
+
+// Record adds a successful upload.
+func (c *dedupeCache) Record(e dedupeEntry) error {
+	unlock, err := c.lock()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	entries, err := c.load()
+	if err != nil {
+		return err
+	}
+	entries[dedupeKey(e.BaseURL, e.IssueKey, e.SHA256)] = e
+	return writeJSONFile(c.path, entries)
+}
+
+// Clear removes the cache file.
+func (c *dedupeCache) Clear() error {
+	unlock, err := c.lock()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	if err := os.Remove(c.path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+func (c *dedupeCache) lock() (func(), error) {
+	if err := os.MkdirAll(filepath.Dir(c.path), 0o755); err != nil {
+		return nil, err
+	}
+	lockPath := c.path + ".lock"
+	deadline := time.Now().Add(2 * dedupeLockStale)
+	for {
+		f, err := os.OpenFile(lockPath, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0o644)
+		if err == nil {
+			f.Close()
+			return func() { os.Remove(lockPath) }, nil
+		}
+		if !os.IsExist(err) {
+			return nil, err
+		}
+		if fi, err := os.Stat(lockPath); err == nil && time.Since(fi.ModTime()) > dedupeLockStale {
+			os.Remove(lockPath)
+			continue
+		}
+		if time.Now().After(deadline) {
+			return nil, fmt.Errorf("dedupe cache %s is locked by another process", c.path)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+// fileSHA256 hashes a whole file for the dedupe cache lookup.
+func fileSHA256(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestDedupeCache(t *testing.T) {
+	if newDedupeCache("off") != nil || newDedupeCache("") != nil {
+		t.Error("off and empty paths should disable the cache")
+	}
+	home, _ := os.UserHomeDir()
+	if c := newDedupeCache("~/abfu.json"); home != "" && c.path != filepath.Join(home, "abfu.json") {
+		t.Errorf("~/ expanded to %q", c.path)
+	}
+
+	c := newDedupeCache(filepath.Join(t.TempDir(), "sub", "uploads.json"))
+	if e, err := c.Lookup("https://jira.example.com", "TEST-1", "abc"); err != nil || e != nil {
+		t.Fatalf("lookup in a missing cache = %v, %v", e, err)
+	}
+	want := dedupeEntry{BaseURL: "https://jira.example.com/", IssueKey: "TEST-1", SHA256: "abc",
+		Name: "data.bin", Size: 1000, AttachmentID: "att-1", Uploaded: time.Now().UTC().Truncate(time.Second)}
+	if err := c.Record(want); err != nil {
+		t.Fatal(err)
+	}
+	// The trailing slash on the base URL doesn't make it a different site.
+	e, err := c.Lookup("https://jira.example.com", "TEST-1", "abc")
+	if err != nil || e == nil || *e != want {
+		t.Fatalf("lookup = %+v, %v; want %+v", e, err, want)
+	}
+	for _, miss := range [][3]string{
+		{"https://other.example.com", "TEST-1", "abc"},
+		{"https://jira.example.com", "TEST-2", "abc"},
+		{"https://jira.example.com", "TEST-1", "def"},
+	} {
+		if e, _ := c.Lookup(miss[0], miss[1], miss[2]); e != nil {
+			t.Errorf("lookup %q found %+v", miss, e)
+		}
+	}
+
+	if err := c.Clear(); err != nil {
+		t.Fatal(err)
+	}
+	if e, _ := c.Lookup("https://jira.example.com", "TEST-1", "abc"); e != nil {
+		t.Errorf("entry survived Clear: %+v", e)
+	}
+	if err := c.Clear(); err != nil {
+		t.Errorf("clearing a missing cache: %v", err)
+	}
+}
+
+// TestDedupeCacheConcurrent checks that runs recording at the same time keep
+// each other's entries, and that a lock left by a crashed run is taken over.
+func TestDedupeCacheConcurrent(t *testing.T) {
+	c := newDedupeCache(filepath.Join(t.TempDir(), "uploads.json"))
+	stale := c.path + ".lock"
+	if err := os.WriteFile(stale, nil, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	old := time.Now().Add(-2 * dedupeLockStale)
+	os.Chtimes(stale, old, old)
+
+	const runs = 8
+	var wg sync.WaitGroup
+	for i := range runs {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := c.Record(dedupeEntry{BaseURL: "https://jira.example.com", IssueKey: "TEST-1", SHA256: fmt.Sprint(i)}); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+	entries, err := c.load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != runs {
+		t.Errorf("got %d entries, want %d", len(entries), runs)
+	}
+	if _, err := os.Stat(stale); !os.IsNotExist(err) {
+		t.Errorf("lock file left behind: %v", err)
+	}
+}
+
+func TestFileSHA256(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "hello.txt")
+	os.WriteFile(path, []byte("hello\n"), 0o600)
+	got, err := fileSHA256(path)
+	if want := "5891b5b522d5df086d0ff0b110fbd9d21bb4fc7163af34d08286a2e846f6be03"; err != nil || got != want {
+		t.Errorf("fileSHA256 = %q, %v; want %q", got, err, want)
+	}
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net"
+	"net/http"
+	"slices"
+	"strings"
+)
+
+// Exit statuses, so wrapper scripts can tell "retry later" from "fix the
+// input". A batch whose files all failed for the same class of reason exits
+// with that class's status; mixed reasons exit exitFailure.
+const (
+	exitFailure        = 1 // anything not classified below
+	exitUsage          = 2 // invalid flags or arguments
+	exitAuth           = 3 // 401/403, or no token could be obtained
+	exitNetwork        = 4 // connection, DNS, TLS or request timeout
+	exitRejected       = 5 // the server refused the request (other 4xx)
+	exitServer         = 6 // 5xx or 429: the server may accept it later
+	exitPartialFailure = 7 // some files of a batch failed, others didn't
+	exitLocalFile      = 8 // the source file couldn't be read
+	exitCancelled      = 9 // interrupted, stopped by -max-idle-time or past a deadline
+)
+
+var (
+	errAuthFailed  = errors.New("authentication failed")
+	errInterrupted = errors.New("interrupted")
+	errStalled     = errors.New("upload stalled")
+	errSourceRead  = errors.New("failed reading source file")
+	errTruncated   = errors.New("file was truncated during the upload")
+	// errSourceChanged is a source file replaced or modified while it was
+	// being uploaded; see fileFingerprint.
+	errSourceChanged = errors.New("source file was replaced or modified during upload")
+	// errPermissionDenied is -check-permissions finding the token can't
+	// attach to the issue.
+	errPermissionDenied = errors.New("insufficient permissions")
+	// errServiceUnavailable is the circuit breaker giving up on the service.
+	errServiceUnavailable = errors.New("service unavailable")
+	// errSessionExpired is a session the server dropped after parts were
+	// sent to it, so it can't simply be replaced.
+	errSessionExpired = errors.New("upload session expired")
+	// errTooLarge and errAttachmentsDisabled are a file -target jsm can't
+	// attach at all.
+	errTooLarge            = errors.New("file too large")
+	errAttachmentsDisabled = errors.New("attachments are disabled")
+	// errChunkTooLarge is a chunk upload refused with 413, typically by a
+	// proxy with a lower body size limit than the service.
+	errChunkTooLarge = errors.New("chunk too large")
+	// errTooManyParts is an upload that would have more parts than
+	// -max-parts or the server allow.
+	errTooManyParts = errors.New("too many parts")
+	// errSharedSessionRefused is a finalize refused in a session shared
+	// with an earlier file; UploadReaderAt retries in a session of its own.
+	errSharedSessionRefused = errors.New("finalize refused in a shared upload session")
+	// errUnstableFile is a file that looks like it is still being written;
+	// see checkStable.
+	errUnstableFile = errors.New("file is still being written")
+	// errAssemblyTimeout is a finalize accepted for assembly in the
+	// background whose attachment didn't appear within FinalizeTimeout.
+	errAssemblyTimeout = errors.New("attachment not assembled in time")
+	// errUntrustedRedirect is the server redirecting a request to a host
+	// redirectPolicy won't send the credentials to.
+	errUntrustedRedirect = errors.New("redirect to an untrusted host")
+)
+
+// stopped makes sure the error of a run that ctx stopped wraps ctx.Err(), so
+// callers can tell context.Canceled from context.DeadlineExceeded with
+// errors.Is whichever request or wait noticed it first.
+func stopped(ctx context.Context, err error) error {
+	if err == nil || ctx.Err() == nil || errors.Is(err, ctx.Err()) {
+		return err
+	}
+	return fmt.Errorf("%w (%w)", err, ctx.Err())
+}
+
+// deadlinePassed reports whether err is a run stopped by its context's
+// deadline: context.DeadlineExceeded itself somewhere in the chain. An
+// http.Client.Timeout also matches it with errors.Is, but that is one
+// request timing out, a network failure.
+func deadlinePassed(err error) bool {
+	if err == context.DeadlineExceeded {
+		return true
+	}
+	switch e := err.(type) {
+	case interface{ Unwrap() error }:
+		return deadlinePassed(e.Unwrap())
+	case interface{ Unwrap() []error }:
+		return slices.ContainsFunc(e.Unwrap(), deadlinePassed)
+	}
+	return false
+}
+
+// statusError is a response with a status the operation doesn't accept.
+type statusError struct {
+	op     string // "create upload", "probe", "upload chunk", ...
+	status int
+	body   string
+}
+
+func (e *statusError) Error() string {
+	if e.body != "" {
+		return fmt.Sprintf("%s: status %d: %s", e.op, e.status, e.body)
+	}
+	return fmt.Sprintf("%s: status %d", e.op, e.status)
+}
+
+// alreadyCompleted recognises an error body saying the upload session was
+// finalized already ("already finalized", "UPLOAD_ALREADY_COMPLETED",
+// "chunk already committed to a completed upload", ...).
+func alreadyCompleted(body []byte) bool {
+	text := strings.ToLower(strings.ReplaceAll(string(body), "_", " "))
+	if !strings.Contains(text, "already") {
+		return false
+	}
+	for _, word := range []string{"finalized", "finalised", "completed", "complete", "committed"} {
+		if strings.Contains(text, "already "+word) || strings.Contains(text, "already been "+word) {
+			return true
+		}
+	}
+	return strings.Contains(text, "completed upload")
+}
+
+// exitCodeFor classifies the error that failed an upload.
+func exitCodeFor(err error) int {
+	var status *statusError
+	var rejected *finalizeRejectedError
+	var pathErr *fs.PathError
+	var netErr net.Error
+	switch {
+	case err == nil:
+		return 0
+	case errors.Is(err, errInterrupted), errors.Is(err, errStalled), errors.Is(err, context.Canceled),
+		deadlinePassed(err):
+		return exitCancelled
+	case errors.Is(err, errAuthFailed), errors.Is(err, errPermissionDenied):
+		return exitAuth
+	case errors.Is(err, errServiceUnavailable), errors.Is(err, errAssemblyTimeout):
+		return exitServer
+	case errors.As(err, &status):
+		switch {
+		case status.status == http.StatusUnauthorized, status.status == http.StatusForbidden:
+			return exitAuth
+		case status.status == http.StatusTooManyRequests, status.status >= 500:
+			return exitServer
+		case status.status >= 400:
+			return exitRejected
+		}
+	case errors.As(err, &rejected), errors.Is(err, errTooLarge), errors.Is(err, errAttachmentsDisabled),
+		errors.Is(err, errChunkTooLarge), errors.Is(err, errTooManyParts), errors.Is(err, errUntrustedRedirect):
+		return exitRejected
+	case errors.Is(err, errSourceRead), errors.Is(err, errSourceChanged), errors.Is(err, errUnstableFile),
+		errors.As(err, &pathErr):
+		return exitLocalFile
+	case errors.As(err, &netErr):
+		return exitNetwork
+	}
+	return exitFailure
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// TestExitCodeFor covers every class exitCodeFor sorts errors into, each
+// reached both directly and through wrapping.
+func TestExitCodeFor(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(200 * time.Millisecond)
+	}))
+	defer srv.Close()
+	_, clientTimeout := (&http.Client{Timeout: 10 * time.Millisecond}).Get(srv.URL)
+	ctx, cancel := context.WithDeadline(t.Context(), time.Now())
+	defer cancel()
+	<-ctx.Done()
+	req, _ := http.NewRequestWithContext(ctx, "GET", srv.URL, nil)
+	_, runDeadline := http.DefaultClient.Do(req)
+
+	tests := []struct {
+		name string
+		err  error
+		want int
+	}{
+		{"nil", nil, 0},
+		{"unclassified", errors.New("something else"), exitFailure},
+
+		{"interrupted", fmt.Errorf("upload: %w", errInterrupted), exitCancelled},
+		{"stalled", errStalled, exitCancelled},
+		{"cancelled", fmt.Errorf("upload: %w", context.Canceled), exitCancelled},
+		{"deadline", context.DeadlineExceeded, exitCancelled},
+		{"deadline in a request", runDeadline, exitCancelled},
+		{"deadline noticed by a failed request", stopped(ctx, &statusError{op: "probe", status: http.StatusBadGateway}), exitCancelled},
+
+		{"auth failed", errAuthFailed, exitAuth},
+		{"permission denied", fmt.Errorf("%w: TEST-1", errPermissionDenied), exitAuth},
+		{"401", &statusError{op: "probe", status: http.StatusUnauthorized}, exitAuth},
+		{"403", &statusError{op: "probe", status: http.StatusForbidden}, exitAuth},
+
+		{"429", &statusError{op: "probe", status: http.StatusTooManyRequests}, exitServer},
+		{"502", &statusError{op: "probe", status: http.StatusBadGateway}, exitServer},
+		{"service unavailable", errServiceUnavailable, exitServer},
+		{"assembly timeout", fmt.Errorf("%w: u1", errAssemblyTimeout), exitServer},
+
+		{"404", &statusError{op: "probe", status: http.StatusNotFound}, exitRejected},
+		{"finalize refused", &finalizeRejectedError{status: http.StatusConflict}, exitRejected},
+		{"file too large", errTooLarge, exitRejected},
+		{"attachments disabled", errAttachmentsDisabled, exitRejected},
+		{"chunk too large", fmt.Errorf("%w: part 3", errChunkTooLarge), exitRejected},
+		{"too many parts", fmt.Errorf("%w: 10001 parts", errTooManyParts), exitRejected},
+		{"untrusted redirect", fmt.Errorf("%w: evil.example.com", errUntrustedRedirect), exitRejected},
+
+		{"read failed", fmt.Errorf("%w at offset 7: %w", errSourceRead, io.ErrUnexpectedEOF), exitLocalFile},
+		{"file changed", errSourceChanged, exitLocalFile},
+		{"file unstable", fmt.Errorf("%w: data.bin.part", errUnstableFile), exitLocalFile},
+		{"missing file", &fs.PathError{Op: "open", Path: "data.bin", Err: fs.ErrNotExist}, exitLocalFile},
+
+		{"connection refused", &net.OpError{Op: "dial", Net: "tcp", Err: syscall.ECONNREFUSED}, exitNetwork},
+		{"request timeout", clientTimeout, exitNetwork},
+	}
+	for _, tt := range tests {
+		if got := exitCodeFor(tt.err); got != tt.want {
+			t.Errorf("%s: exitCodeFor(%v) = %d, want %d", tt.name, tt.err, got, tt.want)
+		}
+	}
+}
+
+func TestBatchExitCode(t *testing.T) {
+	ok, skipped := fileResult{Status: "success"}, fileResult{Status: "skipped"}
+	failed := func(code int) fileResult { return fileResult{Status: "failed", code: code} }
+	tests := []struct {
+		name    string
+		results []fileResult
+		want    int
+	}{
+		{"all uploaded", []fileResult{ok, skipped}, 0},
+		{"some failed", []fileResult{ok, failed(exitServer)}, exitPartialFailure},
+		{"failed or skipped", []fileResult{skipped, failed(exitAuth)}, exitPartialFailure},
+		{"all failed alike", []fileResult{failed(exitNetwork), failed(exitNetwork)}, exitNetwork},
+		{"all failed differently", []fileResult{failed(exitNetwork), failed(exitAuth)}, exitFailure},
+	}
+	for _, tt := range tests {
+		if got := summarize(tt.results).exitCode(); got != tt.want {
+			t.Errorf("%s: exit code %d, want %d", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestAlreadyCompleted(t *testing.T) {
+	tests := []struct {
+		body string
+		want bool
+	}{
+		{`{"error":"UPLOAD_ALREADY_COMPLETED"}`, true},
+		{`{"message":"Upload has already been finalized"}`, true},
+		{`chunk already committed to a completed upload`, true},
+		{`{"message":"already finalised"}`, true},
+		{`{"error":"chunk missing"}`, false},
+		{`{"error":"already in progress"}`, false},
+		{``, false},
+	}
+	for _, tt := range tests {
+		if got := alreadyCompleted([]byte(tt.body)); got != tt.want {
+			t.Errorf("alreadyCompleted(%q) = %v, want %v", tt.body, got, tt.want)
+		}
+	}
+}
+
+// TestChunkStatusMatrix answers every chunk upload with one status and
+// checks how often the chunk is tried and how the run fails.
+func TestChunkStatusMatrix(t *testing.T) {
+	tests := []struct {
+		status   int
+		attempts int64
+		exit     int
+		is       error
+	}{
+		{http.StatusRequestEntityTooLarge, 1, exitRejected, errChunkTooLarge},
+		{http.StatusInternalServerError, 4, exitServer, nil},
+		{http.StatusServiceUnavailable, 4, exitServer, nil},
+		{http.StatusTooManyRequests, 4, exitServer, nil},
+		{http.StatusUnauthorized, 1, exitAuth, nil},
+		{http.StatusBadRequest, 4, exitRejected, nil},
+	}
+	for _, tt := range tests {
+		t.Run(http.StatusText(tt.status), func(t *testing.T) {
+			var attempts atomic.Int64
+			rec := &finalizeRecorder{}
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if strings.Contains(r.URL.Path, "/chunk/") && !strings.HasSuffix(r.URL.Path, "/probe") {
+					io.Copy(io.Discard, r.Body)
+					attempts.Add(1)
+					w.WriteHeader(tt.status)
+					return
+				}
+				rec.ServeHTTP(w, r)
+			}))
+			defer srv.Close()
+			path, _ := writeTestFile(t, 1000)
+
+			fu := newTestUploader(t, path, srv.URL)
+			fu.BlockSize = constantBlockSize(minBlockSize)
+			_, err := fu.RunContext(t.Context())
+			if err == nil {
+				t.Fatal("run succeeded")
+			}
+			if got := attempts.Load(); got != tt.attempts {
+				t.Errorf("chunk tried %d times, want %d", got, tt.attempts)
+			}
+			if got := exitCodeFor(err); got != tt.exit {
+				t.Errorf("error %v exits %d, want %d", err, got, tt.exit)
+			}
+			if tt.is != nil && !errors.Is(err, tt.is) {
+				t.Errorf("error %v isn't %v", err, tt.is)
+			}
+			if len(rec.finalizes) != 0 {
+				t.Error("finalized after the chunk failed")
+			}
+		})
+	}
+}
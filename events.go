@@ -0,0 +1,70 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// eventsVersion is the "v" field of every progress event. Bump it when an
+// existing field changes meaning; adding fields or event types doesn't.
+const eventsVersion = 1
+
+// eventSink writes newline-delimited JSON progress events. Each event is
+// marshalled first and written with a single Write, so concurrent workers
+// never interleave partial lines, and the underlying file is unbuffered so
+// a tailing reader sees each line as soon as it is emitted.
+type eventSink struct {
+	mu sync.Mutex
+	w  io.WriteCloser
+}
+
+// openEventSink accepts a file descriptor number (e.g. "3", inherited from
+// the parent process) or a file path, which is appended to.
+func openEventSink(spec string) (*eventSink, error) {
+	if fd, err := strconv.Atoi(spec); err == nil {
+		f := os.NewFile(uintptr(fd), "fd"+spec)
+		if f == nil {
+			return nil, fmt.Errorf("progress events: invalid file descriptor %d", fd)
+		}
+		// Writes to a descriptor the parent didn't open would fail silently.
+		if _, err := f.Stat(); err != nil {
+			return nil, fmt.Errorf("progress events: file descriptor %d isn't open: %w", fd, err)
+		}
+		return &eventSink{w: f}, nil
+	}
+	f, err := os.OpenFile(spec, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	return &eventSink{w: f}, nil
+}
+
+// Emit writes one event. A nil sink is a no-op so callers needn't check.
+func (s *eventSink) Emit(typ string, fields map[string]interface{}) {
+	if s == nil {
+		return
+	}
+	ev := map[string]interface{}{"v": eventsVersion, "type": typ, "time": time.Now().UTC().Format(time.RFC3339Nano)}
+	for k, v := range fields {
+		ev[k] = v
+	}
+	line, err := json.Marshal(ev)
+	if err != nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.w.Write(append(line, '\n'))
+}
+
+func (s *eventSink) Close() error {
+	if s == nil {
+		return nil
+	}
+	return s.w.Close()
+}
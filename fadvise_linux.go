@@ -0,0 +1,21 @@
+//go:build linux
+
+package main
+
+import (
+	"io"
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// adviseSequential tells the kernel the range of r is about to be read
+// front to back, which doubles its read-ahead window for the file. Only
+// files can be advised; other readers are left alone.
+func adviseSequential(r io.ReaderAt, offset, size int64) error {
+	f, ok := r.(*os.File)
+	if !ok {
+		return nil
+	}
+	return unix.Fadvise(int(f.Fd()), offset, size, unix.FADV_SEQUENTIAL)
+}
@@ -0,0 +1,9 @@
+//go:build !linux
+
+package main
+
+import "io"
+
+// adviseSequential does nothing where there is no posix_fadvise to call;
+// the OS's own read-ahead detection applies.
+func adviseSequential(io.ReaderAt, int64, int64) error { return nil }
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// failover is an upload given up on one server before moving to the next,
+// as reported in UploadResult and the result file.
+type failover struct {
+	URL   string `json:"url"`
+	Error string `json:"error"`
+}
+
+// parseFailoverURLs splits -urls into the primary base URL and the ones to
+// fail over to, in order.
+func parseFailoverURLs(list string) (string, []string, error) {
+	var urls []string
+	for _, u := range strings.Split(list, ",") {
+		u = strings.TrimSpace(u)
+		if u == "" {
+			continue
+		}
+		if !strings.HasPrefix(u, "http://") && !strings.HasPrefix(u, "https://") {
+			return "", nil, fmt.Errorf("-urls: %q is not an http(s) URL", u)
+		}
+		urls = append(urls, u)
+	}
+	if len(urls) == 0 {
+		return "", nil, errors.New("-urls: no URL given")
+	}
+	return urls[0], urls[1:], nil
+}
+
+// failoverable reports whether err means the server failed rather than
+// the request or the source: connection errors and 5xx left over once the
+// retries ran out, or the circuit breaker giving up on the service.
+// Rejections, authentication and local errors would fail the same way
+// anywhere.
+func failoverable(ctx context.Context, err error) bool {
+	if err == nil || ctx.Err() != nil {
+		return false
+	}
+	return errors.Is(err, errServiceUnavailable) || systemicFailure(err)
+}
+
+// failOver points fu at url for a fresh upload: a new session there, and
+// nothing learned about the previous server's quirks or health carried
+// over.
+func (fu *FileUploader) failOver(url string) {
+	fu.BaseURL = url
+	if b, ok := fu.FailoverBreakers[url]; ok {
+		fu.Breaker = b
+	}
+	fu.UploadID, fu.IdempotencyKey, fu.Attachment = "", "", nil
+	fu.gzipRejected.Store(false)
+	fu.createBodyRejected.Store(false)
+	fu.strictFinalizeRejected.Store(false)
+	fu.rangesRefused.Store(false)
+}
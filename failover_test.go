@@ -0,0 +1,115 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseFailoverURLs(t *testing.T) {
+	tests := []struct {
+		list, primary string
+		rest          []string
+		wantErr       string
+	}{
+		{"https://a.example.com", "https://a.example.com", nil, ""},
+		{" https://a.example.com, http://b.example.com ,", "https://a.example.com", []string{"http://b.example.com"}, ""},
+		{"https://a.example.com,b.example.com", "", nil, "not an http(s) URL"},
+		{" , ", "", nil, "no URL given"},
+	}
+	for _, tt := range tests {
+		primary, rest, err := parseFailoverURLs(tt.list)
+		if tt.wantErr != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("parseFailoverURLs(%q): got error %v, want %q", tt.list, err, tt.wantErr)
+			}
+			continue
+		}
+		if err != nil || primary != tt.primary || !slices.Equal(rest, tt.rest) {
+			t.Errorf("parseFailoverURLs(%q) = %q, %q, %v; want %q, %q", tt.list, primary, rest, err, tt.primary, tt.rest)
+		}
+	}
+}
+
+// failingServer creates sessions and answers probes for chunks but fails
+// chunk uploads and empty health-check probes with status, as a server
+// whose storage is down does.
+func failingServer(status int, next http.Handler) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case strings.HasSuffix(r.URL.Path, "/create"):
+			next.ServeHTTP(w, r)
+			return
+		case strings.HasSuffix(r.URL.Path, "/chunk/probe"):
+			body, _ := io.ReadAll(r.Body)
+			var probe chunkList
+			if json.Unmarshal(body, &probe) == nil && len(probe.Chunks) > 0 {
+				r.Body = io.NopCloser(strings.NewReader(string(body)))
+				next.ServeHTTP(w, r)
+				return
+			}
+		default:
+			io.Copy(io.Discard, r.Body)
+		}
+		w.WriteHeader(status)
+	}
+}
+
+// TestFailover checks that an upload the primary server fails with server
+// errors starts over on the next -urls server, and that a rejection the
+// next server would repeat doesn't fail over.
+func TestFailover(t *testing.T) {
+	tests := []struct {
+		name         string
+		status       int
+		wantFailover bool
+	}{
+		{"server down", http.StatusServiceUnavailable, true},
+		{"unauthorized", http.StatusUnauthorized, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path, _ := writeTestFile(t, 2*minBlockSize)
+			primary := httptest.NewServer(failingServer(tt.status, &finalizeRecorder{}))
+			defer primary.Close()
+			rec := &finalizeRecorder{}
+			secondary := httptest.NewServer(rec)
+			defer secondary.Close()
+
+			// Give up on a server after one failed chunk and no health
+			// check passing straight away.
+			breaker := func() *circuitBreaker { return newCircuitBreaker(1, time.Minute, time.Millisecond) }
+			fu := newTestUploader(t, path, primary.URL)
+			fu.Breaker = breaker()
+			fu.FailoverURLs = []string{secondary.URL}
+			fu.FailoverBreakers = map[string]*circuitBreaker{secondary.URL: breaker()}
+			res, err := fu.RunContext(t.Context())
+
+			if !tt.wantFailover {
+				if !errors.Is(err, errAuthFailed) || len(res.Failovers) != 0 || len(rec.finalizes) != 0 {
+					t.Errorf("got %v after %d failovers, %d finalizes on the next server; want %v and no failover",
+						err, len(res.Failovers), len(rec.finalizes), errAuthFailed)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(res.Failovers) != 1 || res.Failovers[0].URL != primary.URL || res.BaseURL != secondary.URL {
+				t.Errorf("failovers %+v ending on %s, want one from %s to %s", res.Failovers, res.BaseURL, primary.URL, secondary.URL)
+			}
+			if !strings.Contains(res.Failovers[0].Error, errServiceUnavailable.Error()) {
+				t.Errorf("failover error %q, want the service given up on", res.Failovers[0].Error)
+			}
+			if len(rec.finalizes) != 1 || len(rec.finalizes[0].Chunks) != 2 {
+				t.Errorf("next server finalized %+v, want one file of 2 parts", rec.finalizes)
+			}
+		})
+	}
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// maxListedFailures caps how many failed chunks the error message names;
+// the JSON results list all of them.
+const maxListedFailures = 10
+
+// chunkFailure is a chunk that failed for good, as reported in the error and
+// the result file's failedParts.
+type chunkFailure struct {
+	Part     int    `json:"part"`
+	Offset   int64  `json:"offset"` // in the file, so -offset runs count from its start
+	Size     int    `json:"size"`
+	Attempts int    `json:"attempts"` // 0 when it failed before being sent, e.g. at the probe
+	Error    string `json:"error"`
+}
+
+// chunkSpan locates a chunk for errors and log lines: its part number and
+// the bytes of the file it holds.
+type chunkSpan struct {
+	Part   int
+	Offset int64 // in the file, as for chunkFailure
+	Size   int
+}
+
+func (s chunkSpan) String() string {
+	return fmt.Sprintf("part %d (bytes %d-%d)", s.Part, s.Offset, s.Offset+int64(s.Size)-1)
+}
+
+// chunkError is a chunk's probe or upload failing, with the chunk and the
+// attempt it failed on, so one of many workers' failures can be told apart.
+// It unwraps to the request's error.
+type chunkError struct {
+	chunkSpan
+	Attempts int // 0 when it failed before being sent, at the probe
+	err      error
+}
+
+func (e *chunkError) Error() string {
+	if e.Attempts == 0 {
+		return fmt.Sprintf("%s: %v", e.chunkSpan, e.err)
+	}
+	return fmt.Sprintf("part %d (bytes %d-%d, attempt %d): %v",
+		e.Part, e.Offset, e.Offset+int64(e.Size)-1, e.Attempts, e.err)
+}
+
+func (e *chunkError) Unwrap() error { return e.err }
+
+// chunkFailuresError is a run stopped by failed chunks. It names each of
+// them with its byte range, so they can be matched with server logs, and
+// unwraps to the error that stopped the run for exitCodeFor.
+type chunkFailuresError struct {
+	cause    error
+	failures []chunkFailure // by part number
+}
+
+func (e *chunkFailuresError) Error() string {
+	// Chunks failing alike, as in an outage, share one statement of why.
+	same := true
+	for _, f := range e.failures[1:] {
+		same = same && f.Error == e.failures[0].Error
+	}
+	var b strings.Builder
+	switch {
+	case len(e.failures) > 1 && same:
+		fmt.Fprintf(&b, "%d chunks failed with %s: ", len(e.failures), e.failures[0].Error)
+	case len(e.failures) > 1:
+		fmt.Fprintf(&b, "%d chunks failed: ", len(e.failures))
+	}
+	for i, f := range e.failures {
+		if i == maxListedFailures {
+			fmt.Fprintf(&b, "; and %d more", len(e.failures)-i)
+			break
+		}
+		if i > 0 {
+			b.WriteString("; ")
+		}
+		fmt.Fprintf(&b, "part %d (bytes %d-%d", f.Part, f.Offset, f.Offset+int64(f.Size)-1)
+		switch f.Attempts {
+		case 0:
+		case 1:
+			b.WriteString(", 1 attempt")
+		default:
+			fmt.Fprintf(&b, ", %d attempts", f.Attempts)
+		}
+		b.WriteString(")")
+		if !same || len(e.failures) == 1 {
+			fmt.Fprintf(&b, ": %s", f.Error)
+		}
+	}
+	return b.String()
+}
+
+func (e *chunkFailuresError) Unwrap() error { return e.cause }
+
+// collectFailures is the error to report for a run that cause stopped:
+// cause itself when no chunk failed on its own (a read error, the idle
+// watchdog), otherwise a chunkFailuresError with every chunk that did.
+// Chunks aborted because the run was cancelled don't count.
+func collectFailures(cause error, results []chunkResult) error {
+	// The caller's context stopped the run; every chunk it aborted failed
+	// with a request error that merely reports that.
+	if cause == context.Canceled || cause == context.DeadlineExceeded {
+		return cause
+	}
+	var failures []chunkFailure
+	fromChunk := false
+	for _, r := range results {
+		if r.Err == nil || errors.Is(r.Err, context.Canceled) {
+			continue
+		}
+		fromChunk = fromChunk || errors.Is(r.Err, cause)
+		// The failure names the chunk itself.
+		msg := r.Err.Error()
+		if ce, ok := r.Err.(*chunkError); ok {
+			msg = ce.err.Error()
+		}
+		failures = append(failures, chunkFailure{Part: r.Index, Offset: r.Offset, Size: r.Size,
+			Attempts: r.Attempts, Error: msg})
+	}
+	if !fromChunk {
+		return cause
+	}
+	sort.Slice(failures, func(i, j int) bool { return failures[i].Part < failures[j].Part })
+	return &chunkFailuresError{cause: cause, failures: failures}
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestChunkFailuresError(t *testing.T) {
+	failure := func(part, attempts int, msg string) chunkFailure {
+		return chunkFailure{Part: part, Offset: int64(part-1) * 100, Size: 100, Attempts: attempts, Error: msg}
+	}
+	var many []chunkFailure
+	for part := 1; part <= 12; part++ {
+		many = append(many, failure(part, 2, "status 500"))
+	}
+	tests := []struct {
+		name     string
+		failures []chunkFailure
+		want     string
+	}{
+		{"one", []chunkFailure{failure(3, 4, "upload chunk: status 500")},
+			"part 3 (bytes 200-299, 4 attempts): upload chunk: status 500"},
+		{"at the probe", []chunkFailure{failure(1, 0, "probe: status 404")},
+			"part 1 (bytes 0-99): probe: status 404"},
+		{"alike", []chunkFailure{failure(1, 1, "status 502"), failure(2, 1, "status 502")},
+			"2 chunks failed with status 502: part 1 (bytes 0-99, 1 attempt); part 2 (bytes 100-199, 1 attempt)"},
+		{"different", []chunkFailure{failure(1, 1, "status 502"), failure(2, 3, "status 500")},
+			"2 chunks failed: part 1 (bytes 0-99, 1 attempt): status 502; part 2 (bytes 100-199, 3 attempts): status 500"},
+		{"more than are listed", many, "; and 2 more"},
+	}
+	for _, tt := range tests {
+		err := &chunkFailuresError{cause: errors.New("cause"), failures: tt.failures}
+		if got := err.Error(); !strings.HasSuffix(got, tt.want) {
+			t.Errorf("%s: got %q, want it to end %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+// TestChunkErrorFields fails the probe or the upload of one part and checks
+// that the run's error names that part, its bytes and its attempts.
+func TestChunkErrorFields(t *testing.T) {
+	const blockSize = minBlockSize
+	tests := []struct {
+		name     string
+		fail     func(r *http.Request) int // status to answer with, 0 to pass on
+		part     int
+		attempts int
+		want     string
+	}{
+		{"probe", func(r *http.Request) int {
+			if strings.HasSuffix(r.URL.Path, "/chunk/probe") {
+				return http.StatusNotFound
+			}
+			return 0
+		}, 1, 0, fmt.Sprintf("part 1 (bytes 0-%d): probe: status 404", blockSize-1)},
+		{"upload", func(r *http.Request) int {
+			if r.URL.Query().Get("partNumber") == "2" {
+				return http.StatusInternalServerError
+			}
+			return 0
+		}, 2, 4, fmt.Sprintf("part 2 (bytes %d-%d, 4 attempts): upload chunk: status 500", blockSize, 2*blockSize-1)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := &finalizeRecorder{}
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if status := tt.fail(r); status != 0 {
+					io.Copy(io.Discard, r.Body)
+					w.WriteHeader(status)
+					return
+				}
+				rec.ServeHTTP(w, r)
+			}))
+			defer srv.Close()
+			path, _ := writeTestFile(t, 3*blockSize)
+
+			fu := newTestUploader(t, path, srv.URL)
+			fu.BlockSize = constantBlockSize(blockSize)
+			fu.Concurrency = 1
+			_, err := fu.RunContext(t.Context())
+			var failures *chunkFailuresError
+			if !errors.As(err, &failures) {
+				t.Fatalf("got error %v, want a chunkFailuresError", err)
+			}
+			if !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("error %q doesn't say %q", err, tt.want)
+			}
+			f := failures.failures[0]
+			if f.Part != tt.part || f.Offset != int64(tt.part-1)*blockSize || f.Size != blockSize || f.Attempts != tt.attempts {
+				t.Errorf("failure %+v, want part %d at %d, %d bytes, %d attempts",
+					f, tt.part, int64(tt.part-1)*blockSize, blockSize, tt.attempts)
+			}
+		})
+	}
+}
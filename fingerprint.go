@@ -0,0 +1,78 @@
+package main
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"os"
+	"time"
+)
+
+// fileFingerprint is what check compares before finalize: the
+// file's identity (inode and device, or the Windows file ID, through
+// os.SameFile), its size and mtime, and digests of its first and last
+// block. The digests catch an in-place rewrite that keeps size and an mtime
+// too coarse to change.
+type fileFingerprint struct {
+	file       *os.File
+	info       os.FileInfo
+	blockSize  int64
+	head, tail [sha256.Size]byte
+}
+
+// takeFingerprint records f as it is before the upload. blockSize is the
+// part size, so the sampled blocks are the first and last parts.
+func takeFingerprint(f *os.File, blockSize int64) (*fileFingerprint, error) {
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	fp := &fileFingerprint{file: f, info: info, blockSize: blockSize}
+	if fp.head, fp.tail, err = sampleBlocks(f, info.Size(), blockSize); err != nil {
+		return nil, err
+	}
+	return fp, nil
+}
+
+// check fails with errSourceChanged when the path no longer names the file
+// that was opened, or the open file's size, mtime or sampled blocks differ.
+// The upload itself reads through the descriptor opened at the start, so a
+// replacement never leaks into the uploaded parts; it would only make the
+// attachment disagree with what is now on disk.
+func (fp *fileFingerprint) check() error {
+	path := fp.file.Name()
+	cur, err := os.Stat(path)
+	if err != nil || !os.SameFile(fp.info, cur) {
+		return fmt.Errorf("%w: %s no longer names the file that was opened", errSourceChanged, path)
+	}
+	info, err := fp.file.Stat()
+	if err != nil {
+		return fmt.Errorf("%w: %w", errSourceRead, err)
+	}
+	if info.Size() != fp.info.Size() || !info.ModTime().Equal(fp.info.ModTime()) {
+		return fmt.Errorf("%w: size %d -> %d, modified %s -> %s", errSourceChanged,
+			fp.info.Size(), info.Size(), fp.info.ModTime().Format(time.RFC3339Nano), info.ModTime().Format(time.RFC3339Nano))
+	}
+	head, tail, err := sampleBlocks(fp.file, info.Size(), fp.blockSize)
+	if err != nil {
+		return fmt.Errorf("%w: %w", errSourceRead, err)
+	}
+	if head != fp.head || tail != fp.tail {
+		return fmt.Errorf("%w: first or last block differs", errSourceChanged)
+	}
+	return nil
+}
+
+// sampleBlocks hashes the first and last blockSize bytes of the file.
+func sampleBlocks(f *os.File, size, blockSize int64) (head, tail [sha256.Size]byte, err error) {
+	n := min(blockSize, size)
+	buf := make([]byte, n)
+	if _, err = f.ReadAt(buf, 0); err != nil && err != io.EOF {
+		return
+	}
+	head = sha256.Sum256(buf)
+	if _, err = f.ReadAt(buf, size-n); err != nil && err != io.EOF {
+		return
+	}
+	return head, sha256.Sum256(buf), nil
+}
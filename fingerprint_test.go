@@ -0,0 +1,110 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"runtime"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestFingerprint(t *testing.T) {
+	const blockSize = 1000
+	tests := []struct {
+		name   string
+		change func(t *testing.T, path string, data []byte)
+		want   string // in the error, "" for none
+	}{
+		{"unchanged", func(*testing.T, string, []byte) {}, ""},
+		{"replaced by rename", func(t *testing.T, path string, data []byte) {
+			if runtime.GOOS == "windows" {
+				t.Skip("Windows can't rename over an open file")
+			}
+			tmp := path + ".new"
+			if err := os.WriteFile(tmp, data, 0o600); err != nil {
+				t.Fatal(err)
+			}
+			if err := os.Rename(tmp, path); err != nil {
+				t.Fatal(err)
+			}
+		}, "no longer names the file"},
+		{"appended in place", func(t *testing.T, path string, _ []byte) {
+			f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			f.Write([]byte("more"))
+			f.Close()
+		}, "size 5000 -> 5004"},
+		{"last block rewritten, mtime kept", func(t *testing.T, path string, _ []byte) {
+			fi, err := os.Stat(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			f, err := os.OpenFile(path, os.O_WRONLY, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			f.WriteAt([]byte("x"), fi.Size()-1)
+			f.Close()
+			if err := os.Chtimes(path, fi.ModTime(), fi.ModTime()); err != nil {
+				t.Fatal(err)
+			}
+		}, "first or last block differs"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path, data := writeTestFile(t, 5*blockSize)
+			f, err := os.Open(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer f.Close()
+			fp, err := takeFingerprint(f, blockSize)
+			if err != nil {
+				t.Fatal(err)
+			}
+			tt.change(t, path, data)
+			err = fp.check()
+			switch {
+			case tt.want == "" && err != nil:
+				t.Errorf("unexpected error %v", err)
+			case tt.want != "" && (!errors.Is(err, errSourceChanged) || !strings.Contains(err.Error(), tt.want)):
+				t.Errorf("got error %v, want %v saying %q", err, errSourceChanged, tt.want)
+			}
+		})
+	}
+}
+
+// TestSourceChangedMidUpload appends to the file while its first chunk is
+// being uploaded and checks that the run fails before finalize.
+func TestSourceChangedMidUpload(t *testing.T) {
+	path, _ := writeTestFile(t, 3*minBlockSize)
+	rec := &finalizeRecorder{}
+	var once sync.Once
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.Contains(r.URL.Path, "/chunk/") && !strings.HasSuffix(r.URL.Path, "/probe") {
+			once.Do(func() {
+				f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0)
+				if err == nil {
+					f.Write([]byte("appended"))
+					f.Close()
+				}
+			})
+		}
+		rec.ServeHTTP(w, r)
+	}))
+	defer srv.Close()
+
+	fu := newTestUploader(t, path, srv.URL)
+	fu.BlockSize = constantBlockSize(minBlockSize)
+	if _, err := fu.RunContext(t.Context()); !errors.Is(err, errSourceChanged) {
+		t.Fatalf("got error %v, want %v", err, errSourceChanged)
+	}
+	if len(rec.finalizes) != 0 {
+		t.Errorf("finalized %d times after the file changed", len(rec.finalizes))
+	}
+}
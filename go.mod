@@ -5,6 +5,7 @@ go 1.24.1
 require (
 	github.com/cenkalti/backoff/v4 v4.3.0
 	github.com/vbauerster/mpb/v7 v7.5.3
+	golang.org/x/sys v0.0.0-20220909162455-aba9fc2a8ff2
 )
 
 require (
@@ -12,5 +13,4 @@ require (
 	github.com/acarl005/stripansi v0.0.0-20180116102854-5a71ef0e047d // indirect
 	github.com/mattn/go-runewidth v0.0.13 // indirect
 	github.com/rivo/uniseg v0.2.0 // indirect
-	golang.org/x/sys v0.0.0-20220909162455-aba9fc2a8ff2 // indirect
 )
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"runtime"
+)
+
+// runHook runs a -pre-hook/-post-hook command through the platform shell
+// with the upload context in its environment:
+//
+//	ABFU_ISSUE_KEY  target issue
+//	ABFU_FILE       path of the file being uploaded
+//	ABFU_STATUS     "pending" for the pre-hook, "success"/"skipped"/"failed" after
+//	ABFU_RESULT     the per-file result as JSON (post-hook only)
+//
+// The hook's output goes to our stderr so it never mixes with results on
+// stdout.
+func runHook(command string, res *fileResult, post bool) error {
+	var cmd *exec.Cmd
+	if runtime.GOOS == "windows" {
+		cmd = exec.Command("cmd", "/C", command)
+	} else {
+		cmd = exec.Command("sh", "-c", command)
+	}
+	cmd.Stdout = os.Stderr
+	cmd.Stderr = os.Stderr
+	cmd.Env = append(os.Environ(),
+		"ABFU_ISSUE_KEY="+res.IssueKey,
+		"ABFU_FILE="+res.File,
+	)
+	if post {
+		data, err := json.Marshal(res)
+		if err != nil {
+			return err
+		}
+		cmd.Env = append(cmd.Env, "ABFU_STATUS="+res.Status, "ABFU_RESULT="+string(data))
+	} else {
+		cmd.Env = append(cmd.Env, "ABFU_STATUS=pending")
+	}
+	if err := cmd.Run(); err != nil {
+		which := "pre-hook"
+		if post {
+			which = "post-hook"
+		}
+		return fmt.Errorf("%s failed: %v", which, err)
+	}
+	return nil
+}
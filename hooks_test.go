@@ -0,0 +1,49 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+func TestRunHook(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("needs a POSIX shell")
+	}
+	out := filepath.Join(t.TempDir(), "hook.out")
+	hook := `printf '%s|%s|%s|%s' "$ABFU_ISSUE_KEY" "$ABFU_FILE" "$ABFU_STATUS" "$ABFU_RESULT" > ` + out
+	res := &fileResult{File: "dir/data.bin", IssueKey: "TEST-1", Name: "data.bin", Size: 1000}
+
+	if err := runHook(hook, res, false); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := os.ReadFile(out); string(got) != "TEST-1|dir/data.bin|pending|" {
+		t.Errorf("pre-hook saw %q", got)
+	}
+
+	res.Status, res.UploadID = "success", "u1"
+	if err := runHook(hook, res, true); err != nil {
+		t.Fatal(err)
+	}
+	got, _ := os.ReadFile(out)
+	fields := strings.SplitN(string(got), "|", 4)
+	if len(fields) != 4 || fields[0] != "TEST-1" || fields[2] != "success" {
+		t.Fatalf("post-hook saw %q", got)
+	}
+	var result fileResult
+	if err := json.Unmarshal([]byte(fields[3]), &result); err != nil {
+		t.Fatalf("ABFU_RESULT %q: %v", fields[3], err)
+	}
+	if result.UploadID != "u1" || result.Status != "success" || result.Size != 1000 {
+		t.Errorf("ABFU_RESULT is %+v", result)
+	}
+
+	for post, which := range map[bool]string{false: "pre-hook", true: "post-hook"} {
+		if err := runHook("exit 3", res, post); err == nil || !strings.Contains(err.Error(), which+" failed") {
+			t.Errorf("a failing %s returned %v", which, err)
+		}
+	}
+}
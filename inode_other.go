@@ -0,0 +1,9 @@
+//go:build !unix
+
+package main
+
+import "os"
+
+// inode is 0 where os.FileInfo carries no inode number; fileIdentity then
+// goes by size and modification time alone.
+func inode(os.FileInfo) uint64 { return 0 }
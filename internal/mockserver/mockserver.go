@@ -0,0 +1,311 @@
+// Package mockserver is an in-memory server for the chunked upload protocol
+// in its "transfer" path layout: create, probe, chunk and finalize, plus the
+// Jira permissions check. It verifies every chunk against its ETag and
+// assembles finalized files, so a client run can be checked end to end. The
+// selftest command runs the uploader against it; tests can do the same with
+// httptest.NewServer(mockserver.New()).
+package mockserver
+
+import (
+	"compress/gzip"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Stats counts the requests the server accepted, by operation.
+type Stats struct {
+	Creates     int
+	Probes      int
+	Chunks      int
+	Finalizes   int
+	Permissions int
+	// Rejected counts requests refused as malformed or inconsistent, a
+	// chunk not matching its ETag for one; LastRejection says why the last
+	// one was.
+	Rejected      int
+	LastRejection string
+}
+
+// File is an attachment the server assembled at finalize.
+type File struct {
+	IssueKey string
+	ID       string
+	Name     string
+	MimeType string
+	Size     int64
+	SHA256   string // of the assembled content
+}
+
+// Server implements the protocol. Chunks are stored by ETag across
+// sessions, as the real service deduplicates them. Use New.
+//
+// A repeated finalize of a session gets the original response again. One
+// for a different file is refused with 409 UPLOAD_ALREADY_FINALIZED unless
+// MultiFileSessions is set, in which case it assembles another attachment.
+type Server struct {
+	MultiFileSessions bool
+
+	mu       sync.Mutex
+	sessions map[string]*session
+	chunks   map[string][]byte
+	files    []File
+	stats    Stats
+	nextID   int
+}
+
+type session struct {
+	issueKey  string
+	finalized map[string][]byte // finalize responses by request, returned again on a repeat
+}
+
+func New() *Server {
+	return &Server{sessions: map[string]*session{}, chunks: map[string][]byte{}}
+}
+
+// Stats returns the request counts so far.
+func (s *Server) Stats() Stats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.stats
+}
+
+// Files returns the attachments finalized so far, in order.
+func (s *Server) Files() []File {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]File(nil), s.files...)
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Header.Get("Authorization") == "" {
+		http.Error(w, `{"error":"missing credentials"}`, http.StatusUnauthorized)
+		return
+	}
+	if r.Header.Get("Content-Encoding") == "gzip" {
+		zr, err := gzip.NewReader(r.Body)
+		if err != nil {
+			s.reject(w, http.StatusBadRequest, "request body is not valid gzip")
+			return
+		}
+		r.Body = io.NopCloser(zr)
+	}
+	if r.URL.Path == "/rest/api/2/mypermissions" {
+		s.count(&s.stats.Permissions)
+		fmt.Fprint(w, `{"permissions":{"CREATE_ATTACHMENTS":{"havePermission":true}}}`)
+		return
+	}
+	key, op, ok := strings.Cut(strings.TrimPrefix(r.URL.Path, "/api/upload/"), "/")
+	if !ok || key == "" || !strings.HasPrefix(r.URL.Path, "/api/upload/") {
+		http.NotFound(w, r)
+		return
+	}
+	switch {
+	case op == "create" && r.Method == http.MethodPost:
+		s.create(w, r, key)
+	case op == "chunk/probe" && r.Method == http.MethodPost:
+		s.probe(w, r)
+	case strings.HasPrefix(op, "chunk/") && r.Method == http.MethodPost:
+		s.chunk(w, r, strings.TrimPrefix(op, "chunk/"))
+	case strings.HasPrefix(op, "chunk/"):
+		// No ranged uploads; clients fall back to multipart.
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	case op == "file/chunked" && r.Method == http.MethodPost:
+		s.finalize(w, r, key)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func (s *Server) create(w http.ResponseWriter, r *http.Request, key string) {
+	io.Copy(io.Discard, r.Body)
+	s.mu.Lock()
+	s.nextID++
+	id := fmt.Sprintf("selftest-%d", s.nextID)
+	s.sessions[id] = &session{issueKey: key, finalized: map[string][]byte{}}
+	s.stats.Creates++
+	s.mu.Unlock()
+	w.WriteHeader(http.StatusCreated)
+	fmt.Fprintf(w, `{"uploadId":%q}`, id)
+}
+
+type chunkRef struct {
+	Hash string `json:"hash"`
+	Size string `json:"size"`
+}
+
+func (s *Server) probe(w http.ResponseWriter, r *http.Request) {
+	if !s.knownSession(w, r) {
+		return
+	}
+	var body struct {
+		Chunks []chunkRef `json:"chunks"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		s.reject(w, http.StatusBadRequest, "probe body: "+err.Error())
+		return
+	}
+	results := map[string]map[string]bool{}
+	s.mu.Lock()
+	for _, c := range body.Chunks {
+		_, ok := s.chunks[c.Hash+"-"+c.Size]
+		results[algorithm(c.Hash)+"-"+c.Hash+"-"+c.Size] = map[string]bool{"exists": ok}
+	}
+	s.stats.Probes++
+	s.mu.Unlock()
+	json.NewEncoder(w).Encode(map[string]interface{}{"data": map[string]interface{}{"results": results}})
+}
+
+func (s *Server) chunk(w http.ResponseWriter, r *http.Request, etag string) {
+	if !s.knownSession(w, r) {
+		return
+	}
+	if n, err := strconv.Atoi(r.URL.Query().Get("partNumber")); err != nil || n < 1 {
+		s.reject(w, http.StatusBadRequest, "chunk without a valid partNumber")
+		return
+	}
+	sum, size, ok := strings.Cut(etag, "-")
+	h := newHash(sum)
+	if !ok || h == nil {
+		s.reject(w, http.StatusBadRequest, fmt.Sprintf("malformed ETag %q", etag))
+		return
+	}
+	file, _, err := r.FormFile("chunk")
+	if err != nil {
+		s.reject(w, http.StatusBadRequest, "chunk form: "+err.Error())
+		return
+	}
+	defer file.Close()
+	data, err := io.ReadAll(file)
+	if err != nil {
+		s.reject(w, http.StatusBadRequest, "reading chunk: "+err.Error())
+		return
+	}
+	h.Write(data)
+	if hex.EncodeToString(h.Sum(nil)) != sum || strconv.Itoa(len(data)) != size {
+		s.reject(w, http.StatusBadRequest, fmt.Sprintf("chunk of %d bytes doesn't match ETag %s", len(data), etag))
+		return
+	}
+	s.mu.Lock()
+	s.chunks[etag] = data
+	s.stats.Chunks++
+	s.mu.Unlock()
+	w.WriteHeader(http.StatusCreated)
+}
+
+func (s *Server) finalize(w http.ResponseWriter, r *http.Request, key string) {
+	if !s.knownSession(w, r) {
+		return
+	}
+	var body struct {
+		Chunks   []chunkRef `json:"chunks"`
+		Name     string     `json:"name"`
+		MimeType string     `json:"mimeType"`
+		// Optional; checked against the chunks when present.
+		Size      *int64 `json:"size"`
+		PartCount *int   `json:"partCount"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		s.reject(w, http.StatusBadRequest, "finalize body: "+err.Error())
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	sess := s.sessions[r.URL.Query().Get("uploadId")]
+	request := fmt.Sprint(body.Name, body.Chunks)
+	if resp, ok := sess.finalized[request]; ok {
+		w.Write(resp)
+		return
+	}
+	if len(sess.finalized) > 0 && !s.MultiFileSessions {
+		s.stats.Rejected++
+		s.stats.LastRejection = "a second file was finalized in one upload session"
+		http.Error(w, `{"error":{"code":"UPLOAD_ALREADY_FINALIZED"}}`, http.StatusConflict)
+		return
+	}
+	digest := sha256.New()
+	var size int64
+	for i, c := range body.Chunks {
+		data, ok := s.chunks[c.Hash+"-"+c.Size]
+		if !ok {
+			s.stats.Rejected++
+			s.stats.LastRejection = fmt.Sprintf("finalize lists part %d, which was never uploaded", i+1)
+			http.Error(w, `{"error":"missing chunk"}`, http.StatusBadRequest)
+			return
+		}
+		digest.Write(data)
+		size += int64(len(data))
+	}
+	if body.PartCount != nil && *body.PartCount != len(body.Chunks) {
+		s.stats.Rejected++
+		s.stats.LastRejection = fmt.Sprintf("finalize says partCount %d but lists %d chunks", *body.PartCount, len(body.Chunks))
+		http.Error(w, `{"error":"partCount mismatch"}`, http.StatusBadRequest)
+		return
+	}
+	if body.Size != nil && *body.Size != size {
+		s.stats.Rejected++
+		s.stats.LastRejection = fmt.Sprintf("finalize says size %d but the chunks add up to %d", *body.Size, size)
+		http.Error(w, `{"error":"size mismatch"}`, http.StatusBadRequest)
+		return
+	}
+	f := File{IssueKey: key, ID: fmt.Sprintf("att-%d", len(s.files)+1), Name: body.Name, MimeType: body.MimeType,
+		Size: size, SHA256: hex.EncodeToString(digest.Sum(nil))}
+	s.files = append(s.files, f)
+	s.stats.Finalizes++
+	resp, _ := json.Marshal(map[string]interface{}{"data": map[string]string{"id": f.ID, "name": f.Name}})
+	sess.finalized[request] = resp
+	w.Write(resp)
+}
+
+// knownSession refuses requests for an uploadId the server didn't hand out.
+func (s *Server) knownSession(w http.ResponseWriter, r *http.Request) bool {
+	id := r.URL.Query().Get("uploadId")
+	s.mu.Lock()
+	_, ok := s.sessions[id]
+	s.mu.Unlock()
+	if !ok {
+		s.reject(w, http.StatusNotFound, fmt.Sprintf("unknown uploadId %q", id))
+	}
+	return ok
+}
+
+func (s *Server) reject(w http.ResponseWriter, status int, reason string) {
+	s.mu.Lock()
+	s.stats.Rejected++
+	s.stats.LastRejection = reason
+	s.mu.Unlock()
+	body, _ := json.Marshal(map[string]string{"error": reason})
+	http.Error(w, string(body), status)
+}
+
+func (s *Server) count(n *int) {
+	s.mu.Lock()
+	*n++
+	s.mu.Unlock()
+}
+
+// algorithm names the hash an ETag's hex digest came from, by its length.
+func algorithm(sum string) string {
+	if len(sum) == 2*sha512.Size {
+		return "sha512"
+	}
+	return "sha256"
+}
+
+func newHash(sum string) hash.Hash {
+	switch len(sum) {
+	case 2 * sha256.Size:
+		return sha256.New()
+	case 2 * sha512.Size:
+		return sha512.New()
+	}
+	return nil
+}
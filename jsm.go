@@ -0,0 +1,399 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/textproto"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	backoff "github.com/cenkalti/backoff/v4"
+	"github.com/vbauerster/mpb/v7"
+	"github.com/vbauerster/mpb/v7/decor"
+)
+
+// Jira Service Management endpoints for attaching to a customer request.
+// attachTemporaryFile is still marked experimental and must be opted into.
+const (
+	jsmRequestPath   = "/rest/servicedeskapi/request/{key}"
+	jsmTemporaryPath = "/rest/servicedeskapi/servicedesk/{serviceDeskId}/attachTemporaryFile"
+	jsmAttachPath    = "/rest/servicedeskapi/request/{key}/attachment"
+	jsmMetaPath      = "/rest/api/2/attachment/meta"
+)
+
+// RunJSM attaches FilePath to the Jira Service Management request IssueKey
+// the way the service desk API requires, instead of through the chunked
+// protocol: the file is streamed in one multipart request as a temporary
+// file of the request's service desk, which is then attached to the request,
+// visible to the customer when JSMPublic is set. The attachment size limit
+// Jira reports is checked before anything is sent. A failed upload is
+// retried from the start; the file is re-read, never held in memory.
+func (fu *FileUploader) RunJSM(ctx context.Context) (res *UploadResult, err error) {
+	res = &UploadResult{IssueKey: fu.IssueKey, Name: fu.attachmentName(), BaseURL: fu.BaseURL}
+	started := time.Now()
+	file, err := os.Open(fu.FilePath)
+	if err != nil {
+		return res, err
+	}
+	defer file.Close()
+	fi, err := file.Stat()
+	if err != nil {
+		return res, err
+	}
+	if !fi.Mode().IsRegular() {
+		return res, fmt.Errorf("-target jsm uploads regular files only")
+	}
+	size := fi.Size()
+	var head []byte
+	if fu.MimeType == "" {
+		if head, err = readHead(file, 0, size); err != nil {
+			return res, fmt.Errorf("%w: %w", errSourceRead, err)
+		}
+	}
+	fu.mimeType = resolveMimeType(fu.MimeType, fu.MimeTypes, fu.FilePath, head)
+
+	fu.retried.Store(0)
+	var sent int64
+	defer func() {
+		res.Size, res.BytesSent, res.Parts = size, sent, 1
+		res.SHA256, res.Attachment = fu.SHA256, fu.Attachment
+		res.Elapsed = time.Since(started)
+		res.Retries = int(fu.retried.Load())
+		err = stopped(ctx, err)
+		status, ev := "success", map[string]interface{}{}
+		if err != nil {
+			status, ev["error"] = "failed", err.Error()
+		}
+		ev["status"] = status
+		ev["summary"] = map[string]interface{}{"size": size, "uploaded": sent}
+		fu.emit("run_completed", ev)
+	}()
+
+	res.beginPhase("session")
+	defer res.endPhase()
+	if err := fu.checkJSMLimit(ctx, size); err != nil {
+		return res, err
+	}
+	deskID, err := fu.jsmServiceDesk(ctx)
+	if err != nil {
+		return res, err
+	}
+
+	res.beginPhase("upload")
+	fu.emit("phase_changed", map[string]interface{}{"phase": "upload"})
+	meter := newRateMeter(size)
+	var barOpts []mpb.ContainerOption
+	if fu.Status != nil {
+		barOpts = append(barOpts, mpb.WithOutput(nil))
+	}
+	p := mpb.New(barOpts...)
+	bar := p.AddBar(size,
+		mpb.PrependDecorators(
+			decor.Name(ui.Label("Uploading:"), decor.WC{W: 10}),
+			decor.CountersKibiByte("% .1f / % .1f", decor.WC{W: 24}),
+		),
+		mpb.AppendDecorators(
+			decor.Percentage(decor.WC{W: 5}),
+			meter.SpeedDecorator(decor.WC{W: 32}),
+			meter.ETADecorator(decor.WC{W: 12}),
+		),
+	)
+	// As in uploadReaderAt, the bar ends before the run returns.
+	defer func() {
+		if err == nil {
+			bar.SetTotal(size, true)
+		}
+		if !bar.Completed() {
+			bar.Abort(err != nil)
+		}
+		p.Wait()
+	}()
+	progress := func(n int64) {
+		sent += n
+		meter.Add(n, n > 0)
+		fu.Status.Add(n, n > 0)
+		bar.SetCurrent(sent)
+	}
+	tempID, err := fu.jsmTemporaryFile(ctx, deskID, file, size, progress)
+	if err != nil {
+		return res, err
+	}
+
+	res.beginPhase("finalize")
+	fu.emit("phase_changed", map[string]interface{}{"phase": "finalize"})
+	return res, fu.jsmAttach(ctx, tempID)
+}
+
+// jsmGet fetches path as JSON into out, retrying 5xx, 429 and connection
+// errors. A 404 is returned as a *statusError for the caller to explain.
+func (fu *FileUploader) jsmGet(ctx context.Context, op, path string, out interface{}) error {
+	get := func() error {
+		req, _ := http.NewRequestWithContext(ctx, "GET", fu.endpoint(path), nil)
+		req.Header.Set("Accept", "application/json")
+		resp, tok, err := fu.do(req)
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+		fu.logConnectionInfo(resp)
+		if err := fu.jsmStatus(op, tok, resp, http.StatusOK); err != nil {
+			return err
+		}
+		if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+			return backoff.Permanent(fmt.Errorf("%s: decoding response: %w", op, err))
+		}
+		return nil
+	}
+	return backoff.Retry(get, fu.retryPolicy(ctx))
+}
+
+// jsmStatus turns a response other than want into an error: 401 through
+// unauthorized, 5xx and 429 to retry, anything else permanent.
+func (fu *FileUploader) jsmStatus(op, tok string, resp *http.Response, want int) error {
+	switch {
+	case resp.StatusCode == want:
+		return nil
+	case resp.StatusCode == http.StatusUnauthorized:
+		return fu.unauthorized(tok)
+	}
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+	err := &statusError{op: op, status: resp.StatusCode, body: string(bytes.TrimSpace(body))}
+	if resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500 {
+		return err
+	}
+	return backoff.Permanent(err)
+}
+
+// checkJSMLimit fails a file larger than Jira's attachment size limit
+// before it is sent. A server that won't say leaves the check to the 413
+// the upload would get.
+func (fu *FileUploader) checkJSMLimit(ctx context.Context, size int64) error {
+	var meta struct {
+		Enabled     bool  `json:"enabled"`
+		UploadLimit int64 `json:"uploadLimit"`
+	}
+	if err := fu.jsmGet(ctx, "attachment settings", jsmMetaPath, &meta); err != nil {
+		var status *statusError
+		if errors.As(err, &status) {
+			fu.debugf("Not checking the attachment size limit: %v", err)
+			return nil
+		}
+		return err
+	}
+	switch {
+	case !meta.Enabled:
+		return fmt.Errorf("%w on this Jira site", errAttachmentsDisabled)
+	case meta.UploadLimit > 0 && size > meta.UploadLimit:
+		return fmt.Errorf("%w: %s is % .1f, above the site's attachment limit of % .1f (%d bytes)",
+			errTooLarge, fu.attachmentName(), decor.SizeB1024(size), decor.SizeB1024(meta.UploadLimit), meta.UploadLimit)
+	}
+	if meta.UploadLimit > 0 {
+		fu.debugf("Attachment size limit: %d bytes", meta.UploadLimit)
+	}
+	return nil
+}
+
+// jsmServiceDesk looks up the service desk the request belongs to, which
+// temporary files are uploaded to.
+func (fu *FileUploader) jsmServiceDesk(ctx context.Context) (string, error) {
+	var req struct {
+		ServiceDeskID string `json:"serviceDeskId"`
+	}
+	if err := fu.jsmGet(ctx, "look up request", jsmRequestPath, &req); err != nil {
+		var status *statusError
+		if errors.As(err, &status) && status.status == http.StatusNotFound {
+			return "", fmt.Errorf("%w: %s isn't a service desk request visible to this account", errPermissionDenied, fu.IssueKey)
+		}
+		return "", err
+	}
+	if req.ServiceDeskID == "" {
+		return "", fmt.Errorf("look up request: %s has no serviceDeskId", fu.IssueKey)
+	}
+	fu.debugf("Request %s belongs to service desk %s", fu.IssueKey, req.ServiceDeskID)
+	return req.ServiceDeskID, nil
+}
+
+// jsmTemporaryFile streams the file as the multipart "file" field and
+// returns the temporary attachment id. The body's length is known up
+// front, so it isn't sent chunked; progress is reported as it is read, and
+// taken back when an attempt fails.
+func (fu *FileUploader) jsmTemporaryFile(ctx context.Context, deskID string, file io.ReaderAt, size int64,
+	progress func(int64)) (string, error) {
+	var envelope bytes.Buffer
+	mw := multipart.NewWriter(&envelope)
+	h := textproto.MIMEHeader{}
+	h.Set("Content-Disposition", fmt.Sprintf(`form-data; name="file"; filename="%s"`,
+		strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(fu.attachmentName())))
+	h.Set("Content-Type", fu.mimeType)
+	mw.CreatePart(h)
+	headLen := envelope.Len()
+	mw.Close()
+	head, tail := envelope.Bytes()[:headLen], envelope.Bytes()[headLen:]
+
+	// The single request may take far longer than the per-request timeout
+	// meant for chunks; ctx still stops it.
+	client := *fu.Client
+	client.Timeout = 0
+
+	var tempID string
+	attempts := 0
+	upload := func() error {
+		attempts++
+		counted := &countingReader{r: io.NewSectionReader(file, 0, size), h: sha256.New(), progress: progress}
+		defer func() {
+			if tempID == "" {
+				progress(-counted.n)
+			}
+		}()
+		body := io.MultiReader(bytes.NewReader(head), counted, bytes.NewReader(tail))
+		req, _ := http.NewRequestWithContext(ctx, "POST", fu.endpoint(jsmTemporaryPath, "{serviceDeskId}", deskID), body)
+		req.ContentLength = int64(len(head)) + size + int64(len(tail))
+		req.Header.Set("Content-Type", mw.FormDataContentType())
+		req.Header.Set("X-ExperimentalApi", "opt-in")
+		req.Header.Set("X-Atlassian-Token", "no-check")
+		resp, tok, err := fu.doWith(&client, req)
+		if err != nil {
+			if counted.err != nil {
+				return backoff.Permanent(fmt.Errorf("%w: %w", errSourceRead, counted.err))
+			}
+			return err
+		}
+		defer resp.Body.Close()
+		fu.logConnectionInfo(resp)
+		if resp.StatusCode == http.StatusRequestEntityTooLarge {
+			return backoff.Permanent(fmt.Errorf("%w: the server refused %s (% .1f) as larger than its attachment limit",
+				errTooLarge, fu.attachmentName(), decor.SizeB1024(size)))
+		}
+		if err := fu.jsmStatus("upload temporary file", tok, resp, http.StatusCreated); err != nil {
+			return err
+		}
+		var out struct {
+			TemporaryAttachments []struct {
+				TemporaryAttachmentID string `json:"temporaryAttachmentId"`
+			} `json:"temporaryAttachments"`
+		}
+		if err := json.NewDecoder(resp.Body).Decode(&out); err != nil {
+			return fmt.Errorf("upload temporary file: reading response: %v", err)
+		}
+		if len(out.TemporaryAttachments) == 0 || out.TemporaryAttachments[0].TemporaryAttachmentID == "" {
+			return backoff.Permanent(errors.New("upload temporary file: response has no temporaryAttachmentId"))
+		}
+		fu.SHA256 = hex.EncodeToString(counted.h.Sum(nil))
+		tempID = out.TemporaryAttachments[0].TemporaryAttachmentID
+		return nil
+	}
+	notify := func(err error, d time.Duration) {
+		fu.debugf("Upload attempt %d failed: %v; retrying in %s", attempts, err, d.Round(time.Millisecond))
+		fu.retried.Add(1)
+	}
+	err := backoff.RetryNotify(upload, fu.retryPolicy(ctx), notify)
+	return tempID, err
+}
+
+// jsmAttach attaches the temporary file to the request.
+func (fu *FileUploader) jsmAttach(ctx context.Context, tempID string) error {
+	body := map[string]interface{}{
+		"temporaryAttachmentIds": []string{tempID},
+		"public":                 fu.JSMPublic,
+	}
+	if fu.JSMComment != "" {
+		// Service desk attachments are linked to the comment already.
+		body["additionalComment"] = map[string]string{"body": fu.JSMComment}
+	}
+	payload, _ := json.Marshal(body)
+	attach := func() error {
+		req, _ := http.NewRequestWithContext(ctx, "POST", fu.endpoint(jsmAttachPath), bytes.NewReader(payload))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Accept", "application/json")
+		resp, tok, err := fu.do(req)
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+		fu.logConnectionInfo(resp)
+		if err := fu.jsmStatus("attach to request", tok, resp, http.StatusCreated); err != nil {
+			return err
+		}
+		body, err := io.ReadAll(resp.Body)
+		if err != nil {
+			return fmt.Errorf("attach to request: reading response: %v", err)
+		}
+		fu.Attachment = parseJSMAttachResponse(body)
+		return nil
+	}
+	return backoff.Retry(attach, fu.retryPolicy(ctx))
+}
+
+// parseJSMAttachResponse reads the attachment from the attach response:
+//
+//	{"attachments": {"values": [{"filename": "...", "created": {"iso8601": "..."},
+//	  "_links": {"jiraRest": ".../rest/api/2/attachment/10001", "content": "...", "thumbnail": "..."}}]}}
+//
+// The attachment id is only given as the last element of the jiraRest
+// link. It returns nil when the body doesn't describe one.
+func parseJSMAttachResponse(body []byte) *attachmentInfo {
+	var out struct {
+		Attachments struct {
+			Values []json.RawMessage `json:"values"`
+		} `json:"attachments"`
+	}
+	if json.Unmarshal(body, &out) != nil || len(out.Attachments.Values) == 0 {
+		return nil
+	}
+	raw := out.Attachments.Values[0]
+	var a struct {
+		Created struct {
+			ISO8601 string `json:"iso8601"`
+		} `json:"created"`
+		Links struct {
+			JiraRest  string `json:"jiraRest"`
+			Content   string `json:"content"`
+			Thumbnail string `json:"thumbnail"`
+		} `json:"_links"`
+	}
+	if json.Unmarshal(raw, &a) != nil {
+		return nil
+	}
+	id := path.Base(a.Links.JiraRest)
+	if _, err := strconv.ParseInt(id, 10, 64); err != nil {
+		return nil
+	}
+	return &attachmentInfo{ID: id, DownloadURL: a.Links.Content, ThumbnailURL: a.Links.Thumbnail,
+		Created: a.Created.ISO8601, Raw: raw}
+}
+
+// countingReader reports the bytes read through it to progress, hashes
+// them, and keeps the read error, which the HTTP client would otherwise
+// report as its own.
+type countingReader struct {
+	r        io.Reader
+	h        hash.Hash
+	n        int64
+	err      error
+	progress func(int64)
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	if n > 0 {
+		c.h.Write(p[:n])
+		c.n += int64(n)
+		c.progress(int64(n))
+	}
+	if err != nil && err != io.EOF {
+		c.err = err
+	}
+	return n, err
+}
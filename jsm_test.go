@@ -0,0 +1,121 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// jsmServer is a fake Jira Service Management site for RunJSM.
+type jsmServer struct {
+	meta         string // attachment settings response
+	requestFound bool
+	uploadStatus int // 0 for 201
+
+	file     []byte // the uploaded file
+	fileName string
+	attach   map[string]interface{} // the attach request body
+}
+
+func (s *jsmServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch r.URL.Path {
+	case "/rest/api/2/attachment/meta":
+		io.WriteString(w, s.meta)
+	case "/rest/servicedeskapi/request/TEST-1":
+		if !s.requestFound {
+			http.NotFound(w, r)
+			return
+		}
+		io.WriteString(w, `{"issueKey":"TEST-1","serviceDeskId":"7"}`)
+	case "/rest/servicedeskapi/servicedesk/7/attachTemporaryFile":
+		if r.Header.Get("X-ExperimentalApi") != "opt-in" {
+			http.Error(w, "experimental API not opted into", http.StatusBadRequest)
+			return
+		}
+		if s.uploadStatus != 0 {
+			io.Copy(io.Discard, r.Body)
+			w.WriteHeader(s.uploadStatus)
+			return
+		}
+		f, h, err := r.FormFile("file")
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		s.file, _ = io.ReadAll(f)
+		s.fileName = h.Filename
+		w.WriteHeader(http.StatusCreated)
+		io.WriteString(w, `{"temporaryAttachments":[{"temporaryAttachmentId":"tmp-1","fileName":"data.bin"}]}`)
+	case "/rest/servicedeskapi/request/TEST-1/attachment":
+		json.NewDecoder(r.Body).Decode(&s.attach)
+		w.WriteHeader(http.StatusCreated)
+		io.WriteString(w, `{"attachments":{"values":[{"filename":"data.bin","created":{"iso8601":"2024-06-01T10:00:00+0000"},
+			"_links":{"jiraRest":"https://jira.example.com/rest/api/2/attachment/10001","content":"https://jira.example.com/secure/attachment/10001"}}]}}`)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func TestRunJSM(t *testing.T) {
+	tests := []struct {
+		name string
+		srv  jsmServer
+		want error
+	}{
+		{"attached", jsmServer{meta: `{"enabled":true,"uploadLimit":104857600}`, requestFound: true}, nil},
+		{"no size limit reported", jsmServer{meta: `{"enabled":true}`, requestFound: true}, nil},
+		{"over the size limit", jsmServer{meta: `{"enabled":true,"uploadLimit":1000}`, requestFound: true}, errTooLarge},
+		{"attachments disabled", jsmServer{meta: `{"enabled":false}`, requestFound: true}, errAttachmentsDisabled},
+		{"not a service desk request", jsmServer{meta: `{"enabled":true}`}, errPermissionDenied},
+		{"refused as too large", jsmServer{meta: `{"enabled":true}`, requestFound: true, uploadStatus: http.StatusRequestEntityTooLarge}, errTooLarge},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path, data := writeTestFile(t, 100_000)
+			srv := httptest.NewServer(&tt.srv)
+			defer srv.Close()
+
+			fu := newTestUploader(t, path, srv.URL)
+			fu.JSMPublic = true
+			res, err := fu.RunJSM(t.Context())
+			if tt.want != nil {
+				if !errors.Is(err, tt.want) {
+					t.Fatalf("got error %v, want %v", err, tt.want)
+				}
+				if tt.srv.attach != nil {
+					t.Error("the file was attached anyway")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(tt.srv.file, data) || tt.srv.fileName != "data.bin" {
+				t.Errorf("server got %q with %d bytes, want data.bin with %d", tt.srv.fileName, len(tt.srv.file), len(data))
+			}
+			if ids, _ := tt.srv.attach["temporaryAttachmentIds"].([]interface{}); len(ids) != 1 || ids[0] != "tmp-1" || tt.srv.attach["public"] != true {
+				t.Errorf("attach request %v, want tmp-1 attached publicly", tt.srv.attach)
+			}
+			if res.Attachment == nil || res.Attachment.ID != "10001" || res.Size != int64(len(data)) || res.SHA256 == "" {
+				t.Errorf("result %+v, attachment %+v; want attachment 10001 of %d bytes", res, res.Attachment, len(data))
+			}
+		})
+	}
+}
+
+func TestParseJSMAttachResponse(t *testing.T) {
+	got := parseJSMAttachResponse([]byte(`{"attachments":{"values":[{"created":{"iso8601":"2024-06-01T10:00:00+0000"},
+		"_links":{"jiraRest":"https://jira.example.com/rest/api/2/attachment/10001","content":"https://c","thumbnail":"https://t"}}]}}`))
+	if got == nil || got.ID != "10001" || got.DownloadURL != "https://c" || got.ThumbnailURL != "https://t" || got.Created != "2024-06-01T10:00:00+0000" {
+		t.Errorf("got %+v", got)
+	}
+	for _, body := range []string{``, `{"attachments":{"values":[]}}`, `{"attachments":{"values":[{"_links":{"jiraRest":"https://x/attachment/abc"}}]}}`} {
+		if got := parseJSMAttachResponse([]byte(body)); got != nil {
+			t.Errorf("parseJSMAttachResponse(%q) = %+v, want nil", body, got)
+		}
+	}
+}
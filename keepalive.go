@@ -0,0 +1,123 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// uploadSession is the session the upload workers send chunks to. The
+// keepalive may replace it with a new one while no part has reached it, so
+// workers take the id from begin for every chunk rather than holding on to
+// it.
+type uploadSession struct {
+	mu       sync.Mutex
+	id       string
+	inFlight int
+	reached  bool      // the server has at least one part of this session
+	last     time.Time // when a chunk request last started or finished
+}
+
+func newUploadSession(id string, resumed bool) *uploadSession {
+	return &uploadSession{id: id, reached: resumed, last: time.Now()}
+}
+
+// begin marks a chunk request as started and returns the id to send it to.
+func (s *uploadSession) begin() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.inFlight++
+	s.last = time.Now()
+	return s.id
+}
+
+// end marks a chunk request as finished; ok means the server now has it.
+func (s *uploadSession) end(ok bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.inFlight--
+	s.last = time.Now()
+	s.reached = s.reached || ok
+}
+
+func (s *uploadSession) ID() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.id
+}
+
+// idle reports whether no chunk request has been in flight for d.
+func (s *uploadSession) idle(d time.Duration) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.inFlight == 0 && time.Since(s.last) >= d
+}
+
+func (s *uploadSession) touch() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.last = time.Now()
+}
+
+// replace swaps in a session from create, which only works while the old
+// one holds no parts; otherwise the upload can't continue. Workers wait in
+// begin until it returns.
+func (s *uploadSession) replace(create func() (string, error)) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.reached || s.inFlight > 0 {
+		return fmt.Errorf("%w: session %s lost the parts already sent", errSessionExpired, s.id)
+	}
+	id, err := create()
+	if err != nil {
+		return fmt.Errorf("%w; creating a new one: %w", errSessionExpired, err)
+	}
+	s.id = id
+	return nil
+}
+
+// keepSessionAlive probes the session with an empty chunk list whenever no
+// chunk request has been made for fu.Keepalive, so a server with a short
+// idle timeout doesn't drop it while the reader and hashers are still busy.
+// If the server no longer knows the session it is replaced through create,
+// or the run is cancelled when that isn't possible. Other probe failures are
+// only logged; real traffic reports its own errors. It returns when ctx is
+// done.
+func (fu *FileUploader) keepSessionAlive(ctx context.Context, cancel context.CancelCauseFunc, s *uploadSession, create func() (string, error)) {
+	t := time.NewTicker(max(fu.Keepalive/4, time.Second))
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+		if !s.idle(fu.Keepalive) {
+			continue
+		}
+		id := s.ID()
+		pctx, done := context.WithTimeout(ctx, fu.Keepalive)
+		_, err := fu.probeChunks(pctx, []string{}, id)
+		done()
+		s.touch()
+		var status *statusError
+		switch {
+		case err == nil:
+			fu.debugf("Keepalive: session %s is alive", id)
+		case errors.As(err, &status) && (status.status == http.StatusNotFound || status.status == http.StatusGone):
+			fu.debugf("Keepalive: server no longer knows session %s", id)
+			if err := s.replace(create); err != nil {
+				cancel(err)
+				return
+			}
+			fu.debugf("Keepalive: continuing with new session %s", s.ID())
+		case ctx.Err() != nil:
+			return
+		default:
+			fu.debugf("Keepalive: %v", err)
+		}
+	}
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestUploadSession(t *testing.T) {
+	s := newUploadSession("u1", false)
+	s.last = time.Now().Add(-time.Minute)
+	if !s.idle(time.Second) {
+		t.Error("session with no requests for a minute isn't idle")
+	}
+	id := s.begin()
+	if id != "u1" || s.idle(0) {
+		t.Errorf("begin = %q, idle %v; want u1 and busy", id, s.idle(0))
+	}
+	if err := s.replace(func() (string, error) { return "u2", nil }); !errors.Is(err, errSessionExpired) {
+		t.Errorf("replace with a request in flight: %v", err)
+	}
+	s.end(false)
+	if err := s.replace(func() (string, error) { return "u2", nil }); err != nil || s.ID() != "u2" {
+		t.Errorf("replace = %v, id %q; want u2", err, s.ID())
+	}
+	s.begin()
+	s.end(true)
+	if err := s.replace(func() (string, error) { return "u3", nil }); !errors.Is(err, errSessionExpired) || s.ID() != "u2" {
+		t.Errorf("replace after a part arrived = %v, id %q; want an expired session kept as u2", err, s.ID())
+	}
+}
+
+// TestKeepSessionAlive checks that an idle session is probed until the run
+// stops, and what happens when the server has dropped it: a session holding
+// no parts is replaced, one holding parts cancels the run.
+func TestKeepSessionAlive(t *testing.T) {
+	tests := []struct {
+		name     string
+		status   int // probe response
+		reached  bool
+		wantID   string
+		wantStop error // cause the run is cancelled with
+	}{
+		{"alive", http.StatusOK, false, "u1", nil},
+		{"dropped before any part", http.StatusNotFound, false, "u2", nil},
+		{"dropped holding parts", http.StatusGone, true, "u1", errSessionExpired},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			var probes atomic.Int64
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if !strings.HasSuffix(r.URL.Path, "/chunk/probe") {
+					http.NotFound(w, r)
+					return
+				}
+				probes.Add(1)
+				io.Copy(io.Discard, r.Body)
+				w.WriteHeader(tt.status)
+				io.WriteString(w, `{"data":{"results":{}}}`)
+			}))
+			defer srv.Close()
+
+			fu := newTestUploader(t, "data.bin", srv.URL)
+			fu.Keepalive = 100 * time.Millisecond
+			s := newUploadSession("u1", tt.reached)
+			ctx, cancel := context.WithCancelCause(context.Background())
+			defer cancel(nil)
+			stopped := make(chan struct{})
+			go func() {
+				defer close(stopped)
+				fu.keepSessionAlive(ctx, cancel, s, func() (string, error) { return "u2", nil })
+			}()
+
+			// The ticker runs at most once a second.
+			time.Sleep(1500 * time.Millisecond)
+			if probes.Load() == 0 {
+				t.Error("idle session was never probed")
+			}
+			if s.ID() != tt.wantID {
+				t.Errorf("session %q, want %q", s.ID(), tt.wantID)
+			}
+			if cause := context.Cause(ctx); !errors.Is(cause, tt.wantStop) {
+				t.Errorf("run cancelled with %v, want %v", cause, tt.wantStop)
+			}
+			cancel(nil)
+			select {
+			case <-stopped:
+			case <-time.After(time.Second):
+				t.Fatal("keepalive still running after the run stopped")
+			}
+		})
+	}
+}
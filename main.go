@@ -2,367 +2,3074 @@ package main
 
 import (
 	"bytes"
+	"cmp"
+	"context"
+	"crypto/md5"
+	"crypto/rand"
 	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
 	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
 	backoff "github.com/cenkalti/backoff/v4"
-	"github.com/vbauerster/mpb/v7"
 	"github.com/vbauerster/mpb/v7/decor"
 	"io"
+	"maps"
 	"math"
 	"mime"
 	"mime/multipart"
 	"net/http"
 	"os"
+	"os/signal"
 	"path/filepath"
-	"sort"
+	"runtime"
+	"runtime/debug"
+	"slices"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
+	"unicode"
 )
 
 var (
 	// These get injected at build time:
 	defaultUser  string
 	defaultToken string
+	version      string
 )
 
+// toolVersion is the version injected at build time, or else the module
+// version Go recorded, "(devel)" for a plain go build.
+func toolVersion() string {
+	if version != "" {
+		return version
+	}
+	if info, ok := debug.ReadBuildInfo(); ok {
+		return info.Main.Version
+	}
+	return "unknown"
+}
+
 const maxSem = 8
 
+// pendingChunk is a chunk travelling from the reader through the hashing
+// workers to the upload workers.
+type pendingChunk struct {
+	part   int
+	data   []byte
+	offset int64
+	etag   string
+	// hashOnly chunks are only needed for their ETag (-only-parts with
+	// -refinalize) and are not uploaded.
+	hashOnly bool
+	readAt   time.Time
+}
+
 type chunkResult struct {
-	ETag  string
-	Index int
-	Err   error
+	ETag     string
+	Index    int
+	Offset   int64
+	Size     int
+	Attempts int
+	Err      error
+}
+
+func main() {
+	// URL flag
+	// Flags
+	userFlag := flag.String("user", defaultUser, "Username (overrides build-time default)")
+	tokenFlag := flag.String("token", defaultToken, "Auth token (overrides build-time default); a comma-separated list rotates across them")
+	tokenFileFlag := flag.String("token-file", "", "File with one auth token per line to rotate across")
+	baseURL := flag.String("url", "https://transfer.atlassian.com",
+		"Base API URL (e.g. https://api.example.com)")
+	targetFlag := flag.String("target", "transfer", "Upload API: transfer (chunked, default) or jsm to attach to a Jira Service Management request")
+	visibilityFlag := flag.String("visibility", "internal", "With -target jsm: public (shown to the customer) or internal")
+	commentFlag := flag.String("comment", "", "After the upload, post this comment on the issue with a link to the attachment")
+	urlsFlag := flag.String("urls", "", "Comma-separated base URLs, primary first, to fail over to in order when a server is down")
+	etagLogFlag := flag.String("etag-log", "", "Append partNumber,etag lines here as chunks complete")
+	resumeFlag := flag.String("resume-file", "", "Session state file; reuses its uploadId and the -etag-log on a later run")
+	configFlag := flag.String("config", defaultConfigPath(), "Config file with credential profiles")
+	profileFlag := flag.String("profile", "", "Credential profile from the config file (default: its defaultProfile)")
+	verboseFlag := flag.Bool("v", false, "Verbose output")
+	tokenCmdFlag := flag.String("token-cmd", "", "Shell command whose stdout is the auth token")
+	pathTemplateFlag := flag.String("path-template", "transfer",
+		"Built-in API layout name, or op=path pairs separated by ';' (see README)")
+	adaptiveFlag := flag.Bool("adaptive", false, "Adjust chunk size during the upload from measured throughput")
+	gzipFlag := flag.Int("gzip-threshold", defaultGzipThreshold,
+		"Gzip probe/finalize JSON bodies larger than this many bytes (0 disables)")
+	checksumFlag := flag.String("chunk-checksum", "none", "Digest header on chunk uploads: md5, sha256 or none")
+	hashAlgFlag := flag.String("hash-algorithm", "sha256", "Chunk ETag hash: sha256 or sha512")
+	concurrencyFlag := flag.Int("concurrency", maxSem, "Number of parallel chunk uploads")
+	hashWorkersFlag := flag.Int("hash-workers", runtime.NumCPU(), "Number of goroutines hashing chunks ahead of the uploads")
+	strictFinalizeFlag := flag.Bool("strict-finalize", true, "Send the total size and part count with finalize so the server can check them; false for deployments that reject them")
+	finalizeRepairsFlag := flag.Int("finalize-repairs", 0, "When finalize reports parts missing, re-upload them and finalize again, up to this many times (0 disables)")
+	finalizeTimeoutFlag := flag.Duration("finalize-timeout", defaultFinalizeTimeout, "How long to wait for a server that assembles the file in the background (finalize answered 202)")
+	declareHashFlag := flag.Bool("declare-hash", false, "Send the SHA-256 of the whole file with finalize so the server can verify the assembled attachment")
+	attachExistingFlag := flag.String("attach-existing", "",
+		"Attach NAME from parts already on the server, listed as hash,size lines in this file, without reading any data")
+	checkManifestFlag := flag.String("check-manifest", "", "Compare FILE with this -etag-log of an earlier upload and report the parts that changed, without uploading")
+	maxMemoryFlag := flag.Int64("max-memory", defaultMaxMemory, "Bytes of chunks to read ahead of the uploads at most; the read-ahead adapts within it")
+	readBufferFlag := flag.Int("read-buffer", 0, "Read the file in reads of at most this many bytes instead of a chunk at a time (0 = a chunk at a time)")
+	readAdviceFlag := flag.Bool("read-advice", true, "Tell the OS the file is read sequentially so it reads further ahead (Linux); false to leave its read-ahead alone")
+	trustRedirectFlag := flag.String("trust-redirect-hosts", "",
+		"Comma-separated hosts or domains the server may redirect requests to with your credentials, besides its own subdomains")
+	maxConnsFlag := flag.Int("max-connections", 0, "Cap on TCP connections to the server, independent of -concurrency (0 = no cap)")
+	dumpHTTPFlag := flag.Bool("dump-http", false, "Print every HTTP exchange (secrets redacted, bodies truncated) to stderr")
+	sharedSessionFlag := flag.Bool("shared-session", false, "Upload the files of a batch that go to the same issue through one upload session")
+	noBreakerFlag := flag.Bool("no-circuit-breaker", false, "Let every chunk retry on its own even when the service looks down")
+	breakerThresholdFlag := flag.Int("circuit-threshold", defaultCircuitThreshold, "Chunks in a row failing with 5xx or connection errors that pause the upload for a health check")
+	breakerWindowFlag := flag.Duration("circuit-window", defaultCircuitWindow, "Time within which -circuit-threshold failures must happen")
+	breakerTimeoutFlag := flag.Duration("circuit-timeout", defaultCircuitTimeout, "How long the health check retries before the run fails with service unavailable")
+	reportFlag := flag.String("report", "", "Write a report of the run, e.g. markdown=report.md")
+	summaryOnlyFlag := flag.Bool("summary-only", false, "Show one batch status line instead of per-file progress, then the results table")
+	mimeTypeFlag := flag.String("mime-type", "", "Content type for every attachment, instead of detecting it")
+	nameFlag := flag.String("name", "", "Attachment name for the file, instead of its base name")
+	nameTemplateFlag := flag.String("name-template", "", "Attachment name built from placeholders, e.g. {issue}_{date}_{basename} (see README)")
+	printCurlFlag := flag.Bool("print-curl", false, "Print an equivalent curl command (secrets redacted) to stderr for every failed request")
+	preHookFlag := flag.String("pre-hook", "", "Shell command run before each upload; a non-zero exit skips the file")
+	postHookFlag := flag.String("post-hook", "", "Shell command run after each upload with the result in $ABFU_RESULT")
+	outputDirFlag := flag.String("output-dir", "", "Write a <file>.result.json per uploaded file into this directory")
+	tokenRefreshFlag := flag.Bool("token-refresh", true, "Re-run -token-cmd when the server returns 401 mid-run")
+	colorFlag := flag.String("color", "auto", "Colored output: auto, always or never (auto honours NO_COLOR)")
+	offsetFlag := flag.Int64("offset", 0, "Upload only the part of the file starting at this byte")
+	lengthFlag := flag.Int64("length", 0, "Upload only this many bytes from -offset (0 = to the end of the file)")
+	resultFileFlag := flag.String("result-file", "", "Write the attachment metadata as JSON to this path after the upload")
+	resultOnFailFlag := flag.String("result-on-failure", "absent",
+		"What -result-file holds when the upload fails: absent (no file) or write (a failed status)")
+	maxIdleFlag := flag.Duration("max-idle-time", 0, "Abort when no chunk completes for this long, e.g. 5m (0 disables)")
+	keepaliveFlag := flag.Duration("keepalive", 0, "Ping the upload session when no chunk was sent for this long, e.g. 5m (0 disables)")
+	statsFlag := flag.Bool("stats", false, "Print per-chunk throughput statistics after each file")
+	timingFlag := flag.Bool("timing", false, "Print where the time went at the end: wall time per phase and worker time reading, hashing, probing and sending")
+	dedupeFlag := flag.String("dedupe-cache", "off",
+		"Skip files already uploaded to the issue, per this local cache file (off disables)")
+	uploadIDFlag := flag.String("upload-id", "", "Attach to this existing upload session instead of creating one")
+	onlyPartsFlag := flag.String("only-parts", "", "With -upload-id, re-upload only these parts, e.g. 5,12,40-42")
+	refinalizeFlag := flag.Bool("refinalize", false, "With -only-parts, finalize again afterwards (reads and hashes every part)")
+	createBodyFlag := flag.String("create-body", "metadata",
+		"Create-upload payload: metadata, empty, a JSON object merged over the metadata, or @file holding one")
+	mappingFlag := flag.String("mapping", "", "CSV file of issueKey,filePath rows to upload instead of positional arguments")
+	failFastFlag := flag.Bool("fail-fast", false, "Stop the batch at the first file that fails")
+	ciFlag := flag.String("ci-annotations", "auto", "GitHub Actions annotations, step summary and outputs: auto or off")
+	checkpointFlag := flag.String("checkpoint-interval", "1",
+		"Flush the -etag-log every N chunks, or at this interval such as 30s")
+	eventsFlag := flag.String("progress-events", "", "Write NDJSON progress events to this file descriptor number or path")
+	progressFDFlag := flag.Int("progress-fd", -1, "Write NDJSON progress events to this inherited file descriptor, e.g. 3")
+	blockSizeFlag := flag.Int64("block-size", 0, "Part size in bytes for every file instead of the size-based default (0 = default)")
+	maxPartsFlag := flag.Int("max-parts", 0, "Keep every upload within this many parts, raising the default block size to fit (0 = no limit)")
+	rampUpFlag := flag.Duration("ramp-up", 0, "Stagger the workers' first chunk uploads evenly across this window, e.g. 10s")
+	paceFlag := flag.Duration("pace", 0, "Space consecutive chunk uploads at least about this far apart, with jitter, e.g. 200ms")
+	maxRateFlag := flag.Int64("max-rate", 0, "Cap chunk uploads at this many bytes per second, lowered on 429 (0 = no cap)")
+	verifyPartsFlag := flag.Bool("verify-parts", false, "Before finalize, check that the server has every part")
+	checkPermsFlag := flag.Bool("check-permissions", false, "Before uploading, check that the token may add attachments to each issue")
+	probeFirstFlag := flag.Bool("probe-first", false, "Hash the whole file and ask the server which chunks it has before uploading")
+	prehashFlag := flag.String("prehash", "auto", "With -probe-first: always hash first, never (probe chunk by chunk), or auto, which skips it when the estimate exceeds -prehash-threshold")
+	prehashThresholdFlag := flag.Duration("prehash-threshold", 2*time.Minute, "With -prehash auto, the estimated hashing time above which -probe-first is skipped or, at a terminal, offered to be")
+	resumableFlag := flag.Int64("resumable-chunks", 0,
+		"Send chunks of at least this many bytes as ranged PUTs that resume after a failure (0 disables)")
+	archiveFlag := flag.String("archive", "off", "Upload directory arguments as a tar or tar.gz archive built on the fly (off rejects directories)")
+	selftestSizeFlag := flag.Int64("selftest-size", 32<<20, "Size of the file selftest uploads, in bytes")
+	selftestListenFlag := flag.String("selftest-listen", "", "Address the selftest server listens on, e.g. :8443, reached by this host's name so proxy settings apply (default: loopback)")
+	selftestTLSFlag := flag.Bool("selftest-tls", false, "Serve the selftest over HTTPS with a generated certificate")
+	tempDirFlag := flag.String("temp-dir", os.TempDir(), "Directory for temporary files, such as the selftest's test file")
+	limitRateFlag := flag.String("limit-rate", "", "Cap chunk uploads at a share of the measured link capacity, e.g. 50%, or at a rate such as 10M (per second)")
+	limitRateWindowFlag := flag.Duration("limit-rate-window", 30*time.Second, "How long -limit-rate N% measures the link unthrottled before capping it")
+	minRateFlag := flag.Int64("min-rate", 0, "Lowest rate -max-rate backs off to on 429, in bytes per second (default: -max-rate/10)")
+	forceUnstableFlag := flag.Bool("force-unstable", false, "Upload files that look like they are still being downloaded or written")
+	stableWindowFlag := flag.Duration("stable-window", 0, "Watch each file this long for growing before uploading it, e.g. 2s (default off)")
+	simulateFailureFlag := flag.String("simulate-failure", "", "Testing aid: fail a share of responses, e.g. rate=0.1,statuses=500,503,reset,seed=1")
+	var headersFlag headerList
+	flag.Var(&headersFlag, "header", "Extra \"Name: value\" header for every request; repeat for more")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage of %s:\n", os.Args[0])
+		printFlagDefaults()
+	}
+	flag.Parse()
+
+	color, err := colorEnabled(*colorFlag, os.Stderr)
+	if err != nil {
+		usagef("%v", err)
+	}
+	ui.color = color
+	if ui.annotate, err = ciAnnotations(*ciFlag); err != nil {
+		usagef("%v", err)
+	}
+
+	// "cache clear" is an action of its own and needs no credentials.
+	if args := flag.Args(); len(args) == 2 && args[0] == "cache" && args[1] == "clear" {
+		cache := newDedupeCache(*dedupeFlag)
+		if cache == nil {
+			cache = newDedupeCache(defaultDedupeCachePath())
+		}
+		if err := cache.Clear(); err != nil {
+			fatalf("%v", err)
+		}
+		fmt.Printf("Cleared %s\n", cache.path)
+		return
+	}
+
+	// So is -check-manifest, which only reads the file.
+	if *checkManifestFlag != "" {
+		if flag.NArg() != 1 {
+			usagef("-check-manifest takes one file: %s -check-manifest ETAG-LOG FILE", os.Args[0])
+		}
+		file := flag.Arg(0)
+		check, err := checkManifest(file, *checkManifestFlag, *offsetFlag, *hashWorkersFlag)
+		if err != nil {
+			exitf(exitCodeFor(err), "%v", err)
+		}
+		extra := check.Size - *offsetFlag - check.Covered
+		if len(check.Changed) == 0 && extra <= 0 {
+			fmt.Printf("%s matches %s: %d parts, % .1f\n", file, *checkManifestFlag, check.Parts,
+				decor.SizeB1024(check.Covered))
+			return
+		}
+		if len(check.Changed) > 0 {
+			fmt.Printf("%s differs from %s in %d of %d parts: %s\n", file, *checkManifestFlag,
+				len(check.Changed), check.Parts, formatPartList(check.Changed))
+		}
+		if extra > 0 {
+			fmt.Printf("%s has %d bytes past the last part in %s\n", file, extra, *checkManifestFlag)
+		}
+		os.Exit(exitFailure)
+	}
+
+	// "selftest" uploads to a built-in mock server and needs no real
+	// credentials or service.
+	runSelftest := len(flag.Args()) == 1 && flag.Arg(0) == "selftest"
+
+	// Explicit flags win over the profile, which wins over build-time defaults.
+	set := map[string]bool{}
+	flag.Visit(func(f *flag.Flag) { set[f.Name] = true })
+	if set["token"] && *tokenCmdFlag != "" {
+		usagef("-token and -token-cmd are mutually exclusive")
+	}
+	if *tokenFileFlag != "" && (set["token"] || *tokenCmdFlag != "") {
+		usagef("-token-file can't be combined with -token or -token-cmd")
+	}
+	creds, err := resolveCredentials(credentials{User: *userFlag, Token: *tokenFlag, BaseURL: *baseURL},
+		credentialSources{Config: *configFlag, Profile: *profileFlag, TokenFile: *tokenFileFlag,
+			TokenCmd: *tokenCmdFlag, Set: set})
+	if err != nil {
+		code := exitFailure
+		if errors.Is(err, errAuthFailed) {
+			code = exitAuth
+		}
+		exitf(code, "%v", err)
+	}
+	*userFlag, *tokenFlag, *baseURL = creds.User, creds.Token, creds.BaseURL
+	authMode := creds.AuthMode
+
+	if runSelftest {
+		// The mock only checks that credentials are sent.
+		if *userFlag == "" {
+			*userFlag = "selftest"
+		}
+		if *tokenFlag == "" {
+			*tokenFlag = "selftest"
+		}
+	}
+	if (authMode == "basic" && *userFlag == "") || *tokenFlag == "" {
+		usagef("missing user or token. Provide via build-time -ldflags, -user/-token flags or a -profile.")
+	} else {
+		defaultUser = *userFlag
+		defaultToken = *tokenFlag
+	}
+	// A -token-cmd token is used as printed; anything else may be a list.
+	var tokens *tokenPool
+	if *tokenCmdFlag == "" {
+		list := splitTokens(defaultToken)
+		if tokens = newTokenPool(list); tokens != nil {
+			defaultToken = list[0]
+			if *verboseFlag {
+				fmt.Fprintf(os.Stderr, "Rotating requests across %d tokens\n", len(list))
+			}
+		}
+	}
+
+	if *adaptiveFlag && *resumeFlag != "" {
+		usagef("-adaptive cannot be combined with -resume-file (part boundaries would differ)")
+	}
+	if *probeFirstFlag && (*adaptiveFlag || *onlyPartsFlag != "") {
+		usagef("-probe-first needs fixed part boundaries and can't be combined with -adaptive or -only-parts")
+	}
+	switch *checksumFlag {
+	case "none":
+		*checksumFlag = ""
+	case "md5", "sha256":
+	default:
+		usagef("-chunk-checksum must be md5, sha256 or none, not %q", *checksumFlag)
+	}
+	if *hashAlgFlag != "sha256" && *hashAlgFlag != "sha512" {
+		usagef("-hash-algorithm must be sha256 or sha512, not %q", *hashAlgFlag)
+	}
+	if *blockSizeFlag != 0 && (*blockSizeFlag < minBlockSize || *blockSizeFlag > maxBlockSize) {
+		usagef("-block-size must be between %d and %d bytes", minBlockSize, maxBlockSize)
+	}
+	if *maxPartsFlag < 0 {
+		usagef("-max-parts must not be negative")
+	}
+	if *finalizeRepairsFlag < 0 {
+		usagef("-finalize-repairs must not be negative")
+	}
+	if *finalizeTimeoutFlag <= 0 {
+		usagef("-finalize-timeout must be positive")
+	}
+	switch *prehashFlag {
+	case "auto", "always", "never":
+	default:
+		usagef("-prehash must be auto, always or never, not %q", *prehashFlag)
+	}
+	if *stableWindowFlag < 0 {
+		usagef("-stable-window must not be negative")
+	}
+	if *breakerThresholdFlag < 1 || *breakerWindowFlag <= 0 || *breakerTimeoutFlag <= 0 {
+		usagef("-circuit-threshold must be at least 1 and -circuit-window and -circuit-timeout positive")
+	}
+	if *concurrencyFlag < 1 || *hashWorkersFlag < 1 {
+		usagef("-concurrency and -hash-workers must be at least 1")
+	}
+	if *maxConnsFlag < 0 {
+		usagef("-max-connections must not be negative")
+	}
+	if *maxMemoryFlag < 1 {
+		usagef("-max-memory must be positive")
+	}
+	if *readBufferFlag < 0 {
+		usagef("-read-buffer must not be negative")
+	}
+	paths, err := parsePathTemplates(*pathTemplateFlag)
+	if err != nil {
+		usagef("%v", err)
+	}
+	var reportPath string
+	if *reportFlag != "" {
+		if reportPath, err = parseReportSpec(*reportFlag); err != nil {
+			usagef("%v", err)
+		}
+	}
+	if runSelftest && set["path-template"] {
+		usagef("selftest speaks the transfer layout; drop -path-template")
+	}
+	if *checkPermsFlag && paths.Permissions == "" {
+		usagef("-check-permissions needs a permissions path in -path-template")
+	}
+	if *commentFlag != "" && paths.Comment == "" {
+		usagef("-comment needs a comment path in -path-template")
+	}
+
+	if set["temp-dir"] || runSelftest {
+		if err := checkTempDir(*tempDirFlag); err != nil {
+			usagef("%v", err)
+		}
+	}
+
+	// Positional args, or the -mapping file
+	args := flag.Args()
+	var jobs []uploadJob
+	var st *selftest
+	switch {
+	case runSelftest:
+		if *selftestSizeFlag < 1 {
+			usagef("-selftest-size must be positive")
+		}
+		if st, err = startSelftest(*selftestListenFlag, *selftestTLSFlag, *selftestSizeFlag, *tempDirFlag); err != nil {
+			fatalf("%v", err)
+		}
+		defer st.Close()
+		exitHooks = append(exitHooks, st.Close)
+		*baseURL = st.url
+		jobs = []uploadJob{{IssueKey: selftestIssue, File: st.file}}
+	case *mappingFlag != "" && len(args) == 0:
+		if jobs, err = readMapping(*mappingFlag); err != nil {
+			fatalf("%v", err)
+		}
+	case *mappingFlag == "" && len(args) >= 2:
+		for _, f := range args[1:] {
+			jobs = append(jobs, uploadJob{IssueKey: args[0], File: f})
+		}
+	default:
+		fmt.Fprintf(os.Stderr, "Usage: %s [options] ISSUE-KEY FILEPATH [FILEPATH...]\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "       %s [options] -mapping FILE\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "       %s [options] -attach-existing HASH-LIST ISSUE-KEY NAME\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "       %s [options] selftest\n", os.Args[0])
+		printFlagDefaults()
+		os.Exit(exitUsage)
+	}
+	filePaths := make([]string, len(jobs))
+	for i, job := range jobs {
+		filePaths[i] = job.File
+	}
+	if len(filePaths) > 1 && (*etagLogFlag != "" || *resumeFlag != "") {
+		usagef("-etag-log and -resume-file apply to a single file")
+	}
+	if len(filePaths) > 1 && *resultFileFlag != "" {
+		usagef("-result-file applies to a single file; use -output-dir for batches")
+	}
+	if *resultOnFailFlag != "absent" && *resultOnFailFlag != "write" {
+		usagef("-result-on-failure must be absent or write, not %q", *resultOnFailFlag)
+	}
+	if len(filePaths) > 1 && (set["offset"] || set["length"]) {
+		usagef("-offset and -length apply to a single file")
+	}
+	var onlyParts map[int]bool
+	if *onlyPartsFlag != "" {
+		if *uploadIDFlag == "" {
+			usagef("-only-parts needs the -upload-id of the session to repair")
+		}
+		if *adaptiveFlag {
+			usagef("-only-parts needs fixed part boundaries and can't be combined with -adaptive")
+		}
+		if onlyParts, err = parsePartList(*onlyPartsFlag); err != nil {
+			usagef("%v", err)
+		}
+	} else if *refinalizeFlag {
+		usagef("-refinalize only applies with -only-parts")
+	}
+	checkpoint, err := parseCheckpointInterval(*checkpointFlag)
+	if err != nil {
+		usagef("%v", err)
+	}
+	if *archiveFlag != "off" && *archiveFlag != "tar" && *archiveFlag != "tar.gz" {
+		usagef("-archive must be tar, tar.gz or off, not %q", *archiveFlag)
+	}
+	if *rampUpFlag < 0 || *paceFlag < 0 {
+		usagef("-ramp-up and -pace can't be negative")
+	}
+	var rateShare float64
+	if *limitRateFlag != "" {
+		if *maxRateFlag != 0 {
+			usagef("-limit-rate and -max-rate both set the rate cap; use one")
+		}
+		share, rate, err := parseRateLimit(*limitRateFlag)
+		if err != nil {
+			usagef("%v", err)
+		}
+		rateShare, *maxRateFlag = share, rate
+		if *limitRateWindowFlag <= 0 {
+			usagef("-limit-rate-window must be positive")
+		}
+	}
+	if *maxRateFlag < 0 || *minRateFlag < 0 || (*minRateFlag > 0 && rateShare == 0 && *minRateFlag > *maxRateFlag) {
+		usagef("-min-rate needs -max-rate or -limit-rate, and neither may be negative or below the other")
+	}
+	if *uploadIDFlag != "" && (len(filePaths) > 1 || *resumeFlag != "") {
+		usagef("-upload-id applies to a single file and can't be combined with -resume-file")
+	}
+	if *sharedSessionFlag && (*uploadIDFlag != "" || *resumeFlag != "") {
+		usagef("-shared-session picks the sessions itself and can't be combined with -upload-id or -resume-file")
+	}
+	jsm := false
+	switch *targetFlag {
+	case "transfer":
+		if set["visibility"] {
+			usagef("-visibility applies to -target jsm")
+		}
+	case "jsm":
+		jsm = true
+		if *visibilityFlag != "public" && *visibilityFlag != "internal" {
+			usagef("-visibility must be public or internal, not %q", *visibilityFlag)
+		}
+		// The service desk API takes the file in one request.
+		for _, name := range []string{"etag-log", "resume-file", "upload-id", "only-parts", "refinalize", "offset",
+			"length", "probe-first", "verify-parts", "adaptive", "block-size", "resumable-chunks", "chunk-checksum",
+			"hash-algorithm", "path-template", "create-body", "keepalive", "urls", "shared-session"} {
+			if set[name] {
+				usagef("-%s applies to the chunked upload API, not -target jsm", name)
+			}
+		}
+		if runSelftest {
+			usagef("selftest covers the chunked upload API; drop -target jsm")
+		}
+	default:
+		usagef("-target must be transfer or jsm, not %q", *targetFlag)
+	}
+	// -attach-existing reads no file; the one positional name is the
+	// attachment's.
+	var existingParts []string
+	if *attachExistingFlag != "" {
+		switch {
+		case runSelftest || *mappingFlag != "" || len(jobs) != 1:
+			usagef("-attach-existing takes one attachment: %s -attach-existing HASH-LIST ISSUE-KEY NAME", os.Args[0])
+		case jsm:
+			usagef("-attach-existing assembles parts with the chunked upload API, not -target jsm")
+		}
+		for _, name := range []string{"etag-log", "resume-file", "upload-id", "only-parts", "offset", "length",
+			"probe-first", "adaptive", "block-size", "archive", "dedupe-cache", "name-template", "urls"} {
+			if set[name] {
+				usagef("-%s doesn't apply to -attach-existing, which reads no file", name)
+			}
+		}
+		var alg string
+		if existingParts, alg, err = readHashList(*attachExistingFlag); err != nil {
+			fatalf("%v", err)
+		}
+		if set["hash-algorithm"] && *hashAlgFlag != alg {
+			usagef("%s lists %s digests, not -hash-algorithm %s", *attachExistingFlag, alg, *hashAlgFlag)
+		}
+		*hashAlgFlag = alg
+	}
+	var failoverURLs []string
+	if *urlsFlag != "" {
+		switch {
+		case set["url"]:
+			usagef("-urls replaces -url; give only one of them")
+		case runSelftest:
+			usagef("selftest uploads to its own server; drop -urls")
+		case *uploadIDFlag != "" || *resumeFlag != "":
+			usagef("-urls can't be combined with -upload-id or -resume-file, whose session lives on one server")
+		}
+		if *baseURL, failoverURLs, err = parseFailoverURLs(*urlsFlag); err != nil {
+			usagef("%v", err)
+		}
+	}
+	createBody := *createBodyFlag
+	if strings.HasPrefix(createBody, "@") {
+		data, err := os.ReadFile(createBody[1:])
+		if err != nil {
+			fatalf("-create-body: %v", err)
+		}
+		createBody = string(data)
+	}
+	if createBody != "metadata" && createBody != "empty" {
+		var obj map[string]interface{}
+		if err := json.Unmarshal([]byte(createBody), &obj); err != nil {
+			usagef("-create-body must be metadata, empty or a JSON object: %v", err)
+		}
+	}
+	mimeTypes, err := loadMimeTypes(*configFlag)
+	if err != nil {
+		fatalf("%v", err)
+	}
+	if *mimeTypeFlag != "" {
+		if _, _, err := mime.ParseMediaType(*mimeTypeFlag); err != nil {
+			usagef("-mime-type %q: %v", *mimeTypeFlag, err)
+		}
+	}
+	if *nameFlag != "" {
+		switch {
+		case *nameTemplateFlag != "":
+			usagef("-name and -name-template both name the attachment; give one")
+		case len(filePaths) > 1:
+			usagef("-name applies to a single file; use -name-template for batches")
+		}
+		if err := validateAttachmentName(*nameFlag); err != nil {
+			usagef("-name: %v", err)
+		}
+	}
+	var nameTmpl *nameTemplate
+	var host string
+	if *nameTemplateFlag != "" {
+		if nameTmpl, err = parseNameTemplate(*nameTemplateFlag); err != nil {
+			usagef("%v", err)
+		}
+		if host, err = os.Hostname(); err != nil {
+			fatalf("-name-template: %v", err)
+		}
+	}
+	cache := newDedupeCache(*dedupeFlag)
+	if cache != nil && (set["offset"] || set["length"]) {
+		usagef("-dedupe-cache works on whole files and can't be combined with -offset/-length")
+	}
+
+	var outDir *outputDir
+	if *outputDirFlag != "" {
+		if outDir, err = newOutputDir(*outputDirFlag); err != nil {
+			fatalf("%v", err)
+		}
+	}
+
+	// The CLI's own headers go through the same middleware embedders use,
+	// after each uploader's Authorize.
+	var middleware []func(*http.Request) error
+	if len(headersFlag) > 0 {
+		middleware = append(middleware, setHeaders(headersFlag))
+	}
+	middleware = append(middleware, setUserAgent("atlassian-uploader/"+toolVersion()))
+
+	if creds.Profile != "" && *verboseFlag {
+		fmt.Fprintf(os.Stderr, "Using profile %q (%s, %s auth)\n", creds.Profile, *baseURL, authMode)
+	}
+
+	// One client for the whole batch so connections are reused across files.
+	var client *http.Client
+	if *maxConnsFlag > 0 || st != nil {
+		client = newHTTPClient(*maxConnsFlag)
+		st.Trust(client)
+	} else if len(jobs) > 1 {
+		client = &http.Client{Timeout: 30 * time.Second}
+	}
+	if *simulateFailureFlag != "" {
+		if client == nil {
+			client = &http.Client{Timeout: 30 * time.Second}
+		}
+		// Beneath -dump-http and -print-curl, so they show the simulated
+		// failures the uploader sees.
+		chaos, err := newChaosTransport(client.Transport, *simulateFailureFlag)
+		if err != nil {
+			usagef("%v", err)
+		}
+		if *verboseFlag {
+			chaos.logf = func(format string, args ...interface{}) {
+				fmt.Fprintf(os.Stderr, format+"\n", args...)
+			}
+		}
+		client.Transport = chaos
+	}
+	if *dumpHTTPFlag {
+		if client == nil {
+			client = &http.Client{Timeout: 30 * time.Second}
+		}
+		client.Transport = newDumpTransport(client.Transport, os.Stderr, headersFlag.names())
+	}
+	if *printCurlFlag {
+		if client == nil {
+			client = &http.Client{Timeout: 30 * time.Second}
+		}
+		client.Transport = newCurlTransport(client.Transport, os.Stderr, headersFlag.names())
+	}
+	if *trustRedirectFlag != "" && client == nil {
+		client = &http.Client{Timeout: 30 * time.Second}
+	}
+	if client != nil {
+		client.CheckRedirect = redirectPolicy(strings.Split(*trustRedirectFlag, ","))
+	}
+
+	// The throttle is shared so -max-rate bounds the whole batch, and the
+	// breaker so an outage found during one file stops the rest.
+	throttle := newSendThrottle(*minRateFlag, *maxRateFlag)
+	var sessions *sessionPool
+	if *sharedSessionFlag {
+		sessions = newSessionPool()
+	}
+	if rateShare > 0 {
+		throttle = newShareThrottle(rateShare, *minRateFlag, *limitRateWindowFlag)
+	}
+	var breaker *circuitBreaker
+	var failoverBreakers map[string]*circuitBreaker
+	if !*noBreakerFlag {
+		breaker = newCircuitBreaker(*breakerThresholdFlag, *breakerWindowFlag, *breakerTimeoutFlag)
+		// Each -urls server has its own, so an outage of one doesn't stop
+		// the next.
+		failoverBreakers = map[string]*circuitBreaker{}
+		for _, u := range failoverURLs {
+			failoverBreakers[u] = newCircuitBreaker(*breakerThresholdFlag, *breakerWindowFlag, *breakerTimeoutFlag)
+		}
+	}
+
+	var status *batchStatus
+	if *summaryOnlyFlag {
+		status = newBatchStatus(os.Stderr, len(jobs))
+	}
+
+	var events *eventSink
+	if set["progress-fd"] {
+		switch {
+		case *eventsFlag != "":
+			usagef("-progress-fd and -progress-events both set where progress events go; give one")
+		case *progressFDFlag < 3:
+			usagef("-progress-fd must name a descriptor the parent opened, 3 or above, not %d", *progressFDFlag)
+		}
+		*eventsFlag = strconv.Itoa(*progressFDFlag)
+	}
+	if *eventsFlag != "" {
+		if events, err = openEventSink(*eventsFlag); err != nil {
+			fatalf("%v", err)
+		}
+		defer events.Close()
+	}
+
+	// Ctrl-C or SIGTERM stops the current upload cleanly, so the ETag log
+	// gets its final flush; a second signal kills the process as usual.
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	go func() {
+		<-ctx.Done()
+		stop()
+	}()
+
+	failed := 0
+	var results []fileResult
+	var timing *timingTotals
+	if *timingFlag {
+		timing = &timingTotals{}
+	}
+	token := defaultToken
+	// -check-permissions asks once per issue.
+	permChecked := map[string]error{}
+	for _, job := range jobs {
+		if ctx.Err() != nil {
+			break
+		}
+		filePath, issueKey := job.File, job.IssueKey
+		uploader := NewFileUploader(filePath, issueKey, defaultUser, token, *baseURL)
+		uploader.AuthMode = authMode
+		uploader.Paths = paths
+		uploader.Adaptive = *adaptiveFlag
+		uploader.MimeType = *mimeTypeFlag
+		uploader.MimeTypes = mimeTypes
+		if *blockSizeFlag != 0 {
+			uploader.BlockSize = constantBlockSize(*blockSizeFlag)
+			// Streamed directories have no file size either way.
+			uploader.ChunkSize = *blockSizeFlag
+		}
+		uploader.MaxParts = *maxPartsFlag
+		uploader.StableWindow = *stableWindowFlag
+		uploader.ForceUnstable = *forceUnstableFlag
+		uploader.GzipThreshold = *gzipFlag
+		uploader.ChunkChecksum = *checksumFlag
+		uploader.ResumableChunks = *resumableFlag
+		uploader.VerifyParts = *verifyPartsFlag
+		uploader.ProbeFirst = *probeFirstFlag && *prehashFlag != "never"
+		if *prehashFlag == "auto" {
+			uploader.PrehashLimit = *prehashThresholdFlag
+			if canPrompt() {
+				uploader.PrehashConfirm = promptPrehash
+			}
+		}
+		uploader.HashAlgorithm = *hashAlgFlag
+		uploader.Concurrency = *concurrencyFlag
+		uploader.HashWorkers = *hashWorkersFlag
+		uploader.MaxMemory = *maxMemoryFlag
+		uploader.ReadBuffer = *readBufferFlag
+		uploader.NoReadAdvice = !*readAdviceFlag
+		if client != nil {
+			uploader.Client = client
+		}
+		uploader.Verbose = *verboseFlag
+		uploader.RequestMiddleware = append([]func(*http.Request) error{uploader.Authorize}, middleware...)
+		if *tokenCmdFlag != "" && *tokenRefreshFlag {
+			uploader.RefreshToken = func() (string, error) { return runTokenCmd(*tokenCmdFlag) }
+		} else if tokens == nil && canPrompt() {
+			// Someone at the terminal can supply a new token.
+			uploader.RefreshToken = promptToken
+		}
+		uploader.ETagLog = *etagLogFlag
+		uploader.ResumeFile = *resumeFlag
+		uploader.Checkpoint = checkpoint
+		uploader.Offset = *offsetFlag
+		uploader.MaxIdleTime = *maxIdleFlag
+		uploader.Keepalive = *keepaliveFlag
+		uploader.ExistingUploadID = *uploadIDFlag
+		uploader.CreateBody = createBody
+		uploader.StrictFinalize = *strictFinalizeFlag
+		uploader.DeclareHash = *declareHashFlag
+		uploader.FinalizeTimeout = *finalizeTimeoutFlag
+		uploader.FinalizeRepairs = *finalizeRepairsFlag
+		uploader.OnlyParts = onlyParts
+		uploader.Refinalize = *refinalizeFlag
+		uploader.Length = *lengthFlag
+		uploader.Events = events
+		uploader.Throttle = throttle
+		uploader.Sessions = sessions
+		uploader.Pacer = newDispatchPacer(*rampUpFlag, *paceFlag, *concurrencyFlag)
+		uploader.Breaker = breaker
+		uploader.FailoverURLs = failoverURLs
+		uploader.FailoverBreakers = failoverBreakers
+		uploader.JSMPublic = *visibilityFlag == "public"
+		uploader.JSMComment = *commentFlag
+		uploader.Tokens = tokens
+		uploader.Status = status
+
+		res := fileResult{File: filePath, IssueKey: issueKey, Name: filepath.Base(filePath), Profile: creds.Profile,
+			Started: time.Now()}
+		err := job.err
+		var prior *dedupeEntry
+		var sum string
+		var up *UploadResult
+		if err == nil && *preHookFlag != "" {
+			err = runHook(*preHookFlag, &res, false)
+		}
+		if err == nil && *checkPermsFlag {
+			var checked bool
+			if err, checked = permChecked[issueKey]; !checked {
+				err = uploader.CheckPermissions(ctx)
+				if ctx.Err() == nil {
+					permChecked[issueKey] = err
+				}
+			}
+		}
+		// Directories and pipes are streamed, so nothing that needs the size
+		// up front or a second read applies, the dedupe cache included.
+		isDir, isPipe := false, false
+		// The whole-file digest, for the name template or the dedupe cache,
+		// is the "hash" phase of the results.
+		hashFile := func() (string, error) {
+			start := time.Now()
+			defer func() {
+				res.Phases = append(res.Phases, phaseTiming{Name: "hash", Seconds: time.Since(start).Seconds()})
+			}()
+			return fileSHA256(filePath)
+		}
+		if err == nil && existingParts == nil {
+			if fi, statErr := os.Stat(filePath); statErr == nil {
+				res.Size = fi.Size()
+				isDir = fi.IsDir()
+				isPipe = !isDir && !fi.Mode().IsRegular()
+			}
+			if isDir && *archiveFlag != "off" {
+				res.Name = archiveName(filePath, *archiveFlag)
+			}
+			if *nameFlag != "" {
+				res.Name = *nameFlag
+				uploader.Name = res.Name
+			}
+			if nameTmpl != nil {
+				if nameTmpl.sha && !isDir && !isPipe {
+					sum, err = hashFile()
+				}
+				if err == nil {
+					res.Name, err = nameTmpl.Render(nameVars{Issue: issueKey, Base: res.Name, SHA256: sum,
+						Host: host, Time: res.Started})
+				}
+				uploader.Name = res.Name
+			}
+			switch {
+			case err != nil:
+			case jsm && (isDir || isPipe):
+				err = fmt.Errorf("-target jsm uploads regular files only")
+			case isDir && *archiveFlag == "off":
+				err = fmt.Errorf("is a directory; use -archive tar or tar.gz to upload it")
+			case (isDir || isPipe) && (*etagLogFlag != "" || *resumeFlag != "" || *uploadIDFlag != "" ||
+				set["offset"] || set["length"] || *probeFirstFlag):
+				err = fmt.Errorf("-etag-log, -resume-file, -upload-id, -offset, -length and -probe-first don't apply to a directory or pipe")
+			case isDir:
+				res.Size = 0
+				src := archiveDir(filePath, *archiveFlag)
+				up, err = uploader.UploadReader(ctx, src, res.Name)
+				src.Close()
+			case isPipe:
+				// RunContext streams it.
+				res.Size = 0
+			case cache != nil:
+				if sum == "" {
+					sum, err = hashFile()
+				}
+				if err == nil {
+					prior, err = cache.Lookup(*baseURL, issueKey, sum)
+				}
+			}
+			switch {
+			case err != nil || prior != nil || isDir:
+			case jsm:
+				up, err = uploader.RunJSM(ctx)
+			default:
+				up, err = uploader.RunContext(ctx)
+			}
+		}
+		if err == nil && existingParts != nil {
+			up, err = uploader.AttachExisting(ctx, existingParts)
+		}
+		if err != nil && ctx.Err() != nil {
+			err = errInterrupted
+		}
+		res.Finished = time.Now()
+		// What follows prints per-file messages over the status line.
+		status.Clear()
+		if up != nil {
+			res.apply(up)
+			if *statsFlag {
+				res.Chunks = up.Chunks
+				printStats(os.Stderr, filePath, up.Chunks, up.Elapsed, up.ReadAhead)
+				if s := throttle.describeCapacity(); s != "" {
+					fmt.Fprintf(os.Stderr, "  link capacity: %s\n", s)
+				}
+			}
+			timing.Add(res.Phases, up.Work, res.Finished.Sub(res.Started))
+		}
+		// Carry a token refreshed mid-run over to the next file.
+		token = uploader.Token
+
+		switch {
+		case err != nil:
+			failed++
+			res.Status = "failed"
+			res.Error = err.Error()
+			res.code = exitCodeFor(err)
+			var failures *chunkFailuresError
+			if errors.As(err, &failures) {
+				res.FailedParts = failures.failures
+			}
+			if job.err != nil {
+				// Already names the mapping file and line.
+				res.code = exitUsage
+				ui.Errorf("%v", err)
+			} else {
+				ui.Errorf("%s: %v", filePath, err)
+			}
+		case prior != nil:
+			res.Status = "skipped"
+			res.SHA256 = sum
+			res.AttachmentID = prior.AttachmentID
+			res.Reason = "previously uploaded on " + prior.Uploaded.Local().Format("2006-01-02 15:04")
+			if status == nil {
+				ui.Successf("%s: %s to %s, skipping", filePath, res.Reason, issueKey)
+			}
+		default:
+			res.Status = "success"
+			msg := fmt.Sprintf("Successfully uploaded %s to %s", filePath, issueKey)
+			if isDir || nameTmpl != nil {
+				msg += " as " + res.Name
+			}
+			switch {
+			case isDir || isPipe:
+				msg += fmt.Sprintf(" (% .1f)", decor.SizeB1024(res.Size))
+			case res.BytesPresent > 0:
+				msg += fmt.Sprintf(" (% .1f of % .1f was already on the server)",
+					decor.SizeB1024(res.BytesPresent), decor.SizeB1024(res.Size))
+			case res.Sources != nil:
+				s := res.Sources
+				var parts []string
+				for _, src := range []struct {
+					n     int
+					bytes int64
+					how   string
+				}{
+					{s.Resumed, s.BytesResumed, "taken from the resume state"},
+					{s.Probed, s.BytesProbed, "already on the server"},
+					{s.Uploaded, s.BytesUploaded, "sent"},
+				} {
+					if src.n > 0 {
+						parts = append(parts, fmt.Sprintf("% .1f in %d parts %s", decor.SizeB1024(src.bytes), src.n, src.how))
+					}
+				}
+				msg += " (" + strings.Join(parts, ", ") + ")"
+			}
+			if res.PartsRepaired > 0 {
+				msg += fmt.Sprintf("; %d parts were re-uploaded after finalize found them missing", res.PartsRepaired)
+			}
+			// With -summary-only the results table reports it.
+			if status == nil {
+				ui.Successf("%s", msg)
+				if a := res.Attachment; a != nil && a.DownloadURL != "" {
+					fmt.Println("  Download:", ui.Link(a.DownloadURL))
+				}
+			}
+			// RunJSM sent the comment along with the attachment.
+			if *commentFlag != "" && !jsm {
+				id, err := uploader.PostComment(ctx, *commentFlag)
+				if err != nil {
+					ui.Warnf("%s: uploaded, but posting the comment failed: %v", filePath, err)
+				}
+				res.CommentID = id
+			}
+			if cache != nil && !isDir && !isPipe {
+				err := cache.Record(dedupeEntry{BaseURL: *baseURL, IssueKey: issueKey, SHA256: res.SHA256,
+					Name: res.Name, Size: res.Size, AttachmentID: res.AttachmentID, Uploaded: res.Finished})
+				if err != nil {
+					ui.Warnf("%s: %v", filePath, err)
+				}
+			}
+		}
+		if *postHookFlag != "" {
+			if err := runHook(*postHookFlag, &res, true); err != nil {
+				ui.Warnf("%s: %v", filePath, err)
+			}
+		}
+		if outDir != nil && filePath != "" {
+			if err := writeJSONFile(outDir.stem(filePath)+".result.json", res); err != nil {
+				ui.Errorf("writing result for %s: %v", filePath, err)
+			}
+		}
+		if *resultFileFlag != "" {
+			if res.Status != "failed" || *resultOnFailFlag == "write" {
+				if err := writeJSONFile(*resultFileFlag, res); err != nil {
+					ui.Errorf("writing %s: %v", *resultFileFlag, err)
+				}
+			} else {
+				// A stale file from an earlier run must not look like success.
+				os.Remove(*resultFileFlag)
+			}
+		}
+		results = append(results, res)
+		status.FileDone(res.Status == "failed")
+		if client == nil {
+			uploader.Close()
+		}
+		if err != nil && *failFastFlag {
+			break
+		}
+	}
+	if client != nil {
+		client.CloseIdleConnections()
+	}
+	if ui.annotate {
+		if err := writeStepSummary(results); err != nil {
+			ui.Warnf("writing step summary: %v", err)
+		}
+	}
+	status.Stop()
+	timing.Print(os.Stderr)
+	summary := summarize(results)
+	if len(jobs) > 1 || status != nil {
+		printSummary(os.Stdout, summary)
+	}
+	if outDir != nil {
+		if err := writeJSONFile(filepath.Join(outDir.dir, "summary.json"), summary); err != nil {
+			ui.Errorf("writing batch summary: %v", err)
+		}
+	}
+	if reportPath != "" {
+		if err := writeMarkdownReport(reportPath, summary); err != nil {
+			ui.Errorf("writing report: %v", err)
+		}
+	}
+	selftestFailed := false
+	if st != nil {
+		var res fileResult
+		if len(results) > 0 {
+			res = results[0]
+		}
+		selftestFailed = !st.Report(os.Stdout, res, *checkPermsFlag)
+		st.Close()
+	}
+	if failed > 0 {
+		events.Close()
+		os.Exit(summary.exitCode())
+	}
+	if selftestFailed {
+		events.Close()
+		os.Exit(exitFailure)
+	}
+}
+
+type FileUploader struct {
+	FilePath string
+	// Name is the attachment name; empty means the base name of FilePath.
+	Name string
+	// MimeType forces the attachment's content type; MimeTypes maps
+	// extensions to types ahead of the standard table. See resolveMimeType.
+	MimeType  string
+	MimeTypes map[string]string
+	mimeType  string
+	IssueKey  string
+	User      string
+	Token     string
+	BaseURL   string
+	AuthMode  string // "basic" or "bearer"
+	Paths     PathTemplates
+	Client    *http.Client
+	// Concurrency is the number of upload workers and HashWorkers the number
+	// of goroutines computing chunk ETags ahead of them. MaxMemory bounds
+	// the chunks read ahead of the workers, 0 meaning defaultMaxMemory; see
+	// readAhead. The Concurrency chunks being uploaded come on top.
+	Concurrency int
+	HashWorkers int
+	MaxMemory   int64
+	Verbose     bool
+
+	// ReadBuffer, when positive, is the most bytes read from the file at a
+	// time; 0 reads each chunk in one go. NoReadAdvice skips telling the OS
+	// that the file is read sequentially. See sourceReader.
+	ReadBuffer   int
+	NoReadAdvice bool
+
+	// RequestMiddleware runs over every request before it is sent, in
+	// order; an error fails the request unsent. NewFileUploader puts
+	// Authorize first, to set the credentials, and callers append their own
+	// to add headers, sign requests and the like, or replace Authorize to
+	// supply the credentials themselves. ShouldRetry, when set, sees
+	// the outcome of every request, a response or an error, and may
+	// override whether it is retried; see RetryDecision. Upload workers
+	// send requests in parallel, so both are called concurrently and must
+	// be safe for that; they must not read or close the response body.
+	RequestMiddleware []func(*http.Request) error
+	ShouldRetry       func(resp *http.Response, err error) RetryDecision
+
+	// RefreshToken, when set, is called on a 401 mid-run to obtain a new
+	// token; the failed request is then retried. Token is guarded by tokenMu,
+	// as is refreshFailed, the error of a refresh that failed.
+	RefreshToken  func() (string, error)
+	tokenMu       sync.RWMutex
+	refreshFailed error
+
+	// GzipThreshold is the JSON body size above which probe and finalize
+	// bodies are compressed; 0 disables compression.
+	GzipThreshold int
+	gzipRejected  atomic.Bool
+
+	// CreateBody selects the create-upload payload: "metadata" (or "") sends
+	// the file's name, size and mimeType, "empty" sends no body, and a JSON
+	// object is sent with its fields merged over the metadata ones.
+	CreateBody         string
+	createBodyRejected atomic.Bool
+
+	// Backoff makes the retry policy for each operation; nil means
+	// backoff.NewExponentialBackOff. Tests can return a zero-delay policy
+	// such as backoff.ZeroBackOff. Every policy is stopped by the run's
+	// context, and those of the circuit breaker's health check and the
+	// wait for assembly also by their timeouts; see retryPolicy and
+	// boundedRetryPolicy.
+	Backoff func() backoff.BackOff
+
+	// StrictFinalize adds the total size and part count to the finalize
+	// request, so the server can check what it assembled. A server that
+	// refuses them gets the plain request for the rest of the run.
+	StrictFinalize         bool
+	strictFinalizeRejected atomic.Bool
+	// DeclareHash adds the SHA-256 of the whole file to the finalize
+	// request as contentHash, so the server can check the assembled
+	// attachment. Like StrictFinalize, a refusal drops it for the rest of
+	// the run. Nothing is declared when not every byte was read, as with
+	// OnlyParts.
+	DeclareHash         bool
+	declareHashRejected atomic.Bool
+	// FinalizeTimeout bounds the wait for a file the server assembles in
+	// the background (finalize answered 202); 0 means
+	// defaultFinalizeTimeout. See awaitAssembly. finalizeStatus becomes
+	// UploadResult.FinalizeStatus.
+	FinalizeTimeout time.Duration
+	finalizeStatus  string
+	// FinalizeRepairs is how many times a finalize refused for missing
+	// parts is answered by re-uploading them and finalizing again; 0
+	// leaves the refusal to fail the upload. See finalizeRepairing.
+	FinalizeRepairs int
+
+	// ChunkChecksum adds a digest header to chunk uploads: "md5"
+	// (Content-MD5), "sha256" (X-Checksum-Sha256) or "" for none.
+	ChunkChecksum string
+
+	// ResumableChunks, when positive, sends chunks of at least this many
+	// bytes as ranged PUTs so a retry resumes where the last attempt broke
+	// off; see putChunkRange.
+	ResumableChunks int64
+	rangesRefused   atomic.Bool
+
+	// HashAlgorithm names the chunk ETag hash: "sha256" or "sha512".
+	HashAlgorithm string
+
+	// UploadID is set by Run once the upload session is open,
+	// IdempotencyKey once finalize is attempted and Attachment when the
+	// finalize response describes the new file.
+	UploadID       string
+	IdempotencyKey string
+	Attachment     *attachmentInfo
+	// SHA256 is the hex digest of the uploaded bytes, set once all of them
+	// have been read.
+	SHA256 string
+	// ChunkStats has one entry per chunk Run actually transferred.
+	ChunkStats []chunkStat
+
+	// Adaptive varies the chunk size during the run; see adaptive.go.
+	Adaptive bool
+	sizer    *adaptiveSizer
+	// barDone, when set, gets the progress bar's count and whether it
+	// completed by itself, as Run takes the bar down.
+	barDone func(current int64, completed bool)
+
+	// retries feeds the progress bar's retry status during Run; retried
+	// counts the retries for UploadResult.Retries.
+	retries *retryTracker
+	retried atomic.Int64
+	// work times the workers of a run for UploadResult.Work.
+	work workTimes
+
+	// ChunkSize is the chunk size UploadReader cuts streams into; 0 means
+	// defaultStreamChunkSize. Run derives its own from the file size.
+	ChunkSize int64
+	// BlockSize is the policy that picks Run's part size from the file size;
+	// nil means getBlockSize. Its result must lie within
+	// minBlockSize..maxBlockSize.
+	BlockSize func(fileSize int64) int64
+	// MaxParts caps the number of parts of an upload; 0 means no cap. A
+	// block size from the default policy grows to fit it, a fixed one fails
+	// the run. serverMaxParts is the cap the create response reported.
+	MaxParts       int
+	serverMaxParts int
+	// serverPartSize is the part size the create response asked for, which
+	// replaces the block size from BlockSize; 0 when it named none.
+	serverPartSize int64
+
+	// StableWindow is how long Run watches a file for growing before it
+	// starts, 0 for not at all; ForceUnstable uploads files that look
+	// unfinished anyway. See checkStable.
+	StableWindow  time.Duration
+	ForceUnstable bool
+
+	// Optional crash resilience; see resume.go. Checkpoint sets how often
+	// the ETag log is flushed. resume is this run's resume state and source
+	// the file it is checked against, nil for other sources.
+	ETagLog    string
+	ResumeFile string
+	Checkpoint checkpointInterval
+	resume     *resumeState
+	source     os.FileInfo
+
+	// Offset and Length restrict the upload to a byte range of the file;
+	// Length 0 means up to the end. Part numbers start at 1 within the range.
+	Offset int64
+	Length int64
+
+	// MaxIdleTime aborts the run when no chunk completes for this long;
+	// 0 disables the watchdog.
+	MaxIdleTime time.Duration
+
+	// Keepalive pings the session with an empty probe whenever no chunk
+	// request has been made for this long; 0 disables it.
+	Keepalive time.Duration
+
+	// ExistingUploadID attaches to an upload session created earlier instead
+	// of creating one. OnlyParts then limits the run to those part numbers,
+	// which are re-uploaded even if the server claims to have them; the other
+	// parts are not read unless Refinalize asks for a new finalize, which
+	// needs all of their ETags.
+	ExistingUploadID string
+	OnlyParts        map[int]bool
+	Refinalize       bool
+
+	// Sessions shares upload sessions between the files of a batch to the
+	// same issue; see shared.go. sharedSession is set while a file uses a
+	// session from it.
+	Sessions      *sessionPool
+	sharedSession bool
+
+	// Events receives machine-readable progress; see events.go.
+	Events *eventSink
+
+	// VerifyParts probes every part before finalize; see verifyParts.
+	VerifyParts bool
+	// ProbeFirst hashes the whole range and probes every part before the
+	// upload starts; see probeFirst. With PrehashLimit set, a source too
+	// slow to hash within it is probed chunk by chunk instead, unless
+	// PrehashConfirm, given the file, the estimate and the measured rate in
+	// bytes per second, says to hash anyway. See shouldPrehash.
+	ProbeFirst     bool
+	PrehashLimit   time.Duration
+	PrehashConfirm func(name string, estimate time.Duration, rate float64) bool
+
+	// Tokens, when set, supplies the token for each request instead of
+	// Token; see tokenPool.
+	Tokens *tokenPool
+
+	// Status, when set, is the batch's -summary-only line: chunks are counted
+	// there and no progress bar is drawn.
+	Status *batchStatus
+
+	// Breaker pauses all chunk uploads when the service looks down; see
+	// circuitBreaker. nil disables it.
+	Breaker *circuitBreaker
+
+	// Throttle paces chunk uploads and slows down on 429; nil sends at full
+	// speed. See throttle.go.
+	Throttle *sendThrottle
+	// Pacer staggers the workers' first chunk requests and spaces out the
+	// rest; nil sends each as soon as a worker is free. See pacer.go.
+	Pacer *dispatchPacer
+
+	// FailoverURLs are base URLs UploadReaderAt moves on to, in order, when
+	// the upload to BaseURL fails because the server is down; see
+	// failoverable. Each gets a new session. FailoverBreakers holds their
+	// circuit breakers by URL, replacing Breaker after a failover.
+	FailoverURLs     []string
+	FailoverBreakers map[string]*circuitBreaker
+
+	// JSMPublic makes RunJSM's attachment visible to the customer rather
+	// than to agents only.
+	JSMPublic bool
+	// JSMComment, if set, is added to the request as a comment along with
+	// the attachment by RunJSM. The chunked upload leaves comments to
+	// PostComment.
+	JSMComment string
+}
+
+// retryPolicy returns a fresh retry policy for one operation, which gives
+// up as soon as ctx is done.
+func (fu *FileUploader) retryPolicy(ctx context.Context) backoff.BackOff {
+	var b backoff.BackOff
+	if fu.Backoff != nil {
+		b = fu.Backoff()
+	} else {
+		b = backoff.NewExponentialBackOff()
+	}
+	return backoff.WithContext(b, ctx)
+}
+
+// boundedRetryPolicy is retryPolicy for an operation that gives up after
+// timeout, such as a health check or the wait for a file to be assembled.
+// The default exponential policy starts at initial and grows to at most
+// maxInterval, 0 keeping backoff's defaults for either; a policy from
+// Backoff is used as it is and cut off at timeout.
+func (fu *FileUploader) boundedRetryPolicy(ctx context.Context, timeout, initial, maxInterval time.Duration) backoff.BackOff {
+	if fu.Backoff != nil {
+		return backoff.WithContext(&elapsedLimit{BackOff: fu.Backoff(), limit: timeout, start: time.Now()}, ctx)
+	}
+	b := backoff.NewExponentialBackOff()
+	b.MaxElapsedTime = timeout
+	if initial > 0 {
+		b.InitialInterval = initial
+	}
+	if maxInterval > 0 {
+		b.MaxInterval = maxInterval
+	}
+	return backoff.WithContext(b, ctx)
+}
+
+// elapsedLimit stops a retry policy once limit has passed since it started
+// or was last reset.
+type elapsedLimit struct {
+	backoff.BackOff
+	limit time.Duration
+	start time.Time
+}
+
+func (e *elapsedLimit) NextBackOff() time.Duration {
+	if time.Since(e.start) >= e.limit {
+		return backoff.Stop
+	}
+	return e.BackOff.NextBackOff()
+}
+
+func (e *elapsedLimit) Reset() {
+	e.start = time.Now()
+	e.BackOff.Reset()
+}
+
+// attachmentName is the name the attachment is created under.
+func (fu *FileUploader) attachmentName() string {
+	if fu.Name != "" {
+		return fu.Name
+	}
+	return filepath.Base(fu.FilePath)
+}
+
+func NewFileUploader(fp, ik, u, t, url string) *FileUploader {
+	fu := &FileUploader{
+		FilePath:       fp,
+		IssueKey:       ik,
+		User:           u,
+		Token:          t,
+		BaseURL:        url,
+		AuthMode:       "basic",
+		Paths:          builtinTemplates["transfer"],
+		GzipThreshold:  defaultGzipThreshold,
+		StrictFinalize: true,
+		HashAlgorithm:  "sha256",
+		Client:         &http.Client{Timeout: 30 * time.Second, CheckRedirect: redirectPolicy(nil)},
+		Concurrency:    maxSem,
+		HashWorkers:    runtime.NumCPU(),
+	}
+	fu.RequestMiddleware = []func(*http.Request) error{fu.Authorize}
+	return fu
+}
+
+// Authorize is the request middleware that sets the credentials for the
+// configured auth mode, with the next token of Tokens or else Token. The
+// token it used is recorded in the request's context for doWith, so that a
+// 401 is put down to that token; see unauthorized.
+func (fu *FileUploader) Authorize(req *http.Request) error {
+	var tok string
+	if fu.Tokens != nil {
+		tok = fu.Tokens.Next()
+	} else {
+		fu.tokenMu.RLock()
+		tok = fu.Token
+		fu.tokenMu.RUnlock()
+	}
+	if fu.AuthMode == "bearer" {
+		req.Header.Set("Authorization", "Bearer "+tok)
+	} else {
+		req.SetBasicAuth(fu.User, tok)
+	}
+	if used, ok := req.Context().Value(usedTokenKey{}).(*string); ok {
+		*used = tok
+	}
+	return nil
+}
+
+// unauthorized handles a 401 for a request sent with token used. With a
+// token pool the token is dropped and the request retried with the next one
+// until none are left. Without a RefreshToken hook it is permanent; with one,
+// the token is refreshed (once, however many workers hit the 401 together)
+// and a retryable error returned.
+func (fu *FileUploader) unauthorized(used string) error {
+	if fu.Tokens != nil {
+		left, dropped := fu.Tokens.Drop(used)
+		if dropped {
+			ui.Warnf("token %s was rejected with 401 and won't be used again; %d left", tokenHint(used), left)
+		}
+		if left == 0 {
+			return backoff.Permanent(fmt.Errorf("%w: every token was rejected", errAuthFailed))
+		}
+		return fmt.Errorf("%w, token %s dropped", errAuthFailed, tokenHint(used))
+	}
+	if fu.RefreshToken == nil {
+		return backoff.Permanent(errAuthFailed)
+	}
+	fu.tokenMu.Lock()
+	defer fu.tokenMu.Unlock()
+	if fu.Token != used {
+		return fmt.Errorf("%w, token already refreshed", errAuthFailed)
+	}
+	// Workers that got the 401 together don't ask again, or prompt again,
+	// after the refresh failed.
+	if fu.refreshFailed != nil {
+		return backoff.Permanent(fmt.Errorf("%w; refreshing token: %v", errAuthFailed, fu.refreshFailed))
+	}
+	fu.retries.Refreshing(true)
+	tok, err := fu.RefreshToken()
+	fu.retries.Refreshing(false)
+	if err != nil {
+		fu.refreshFailed = err
+		return backoff.Permanent(fmt.Errorf("%w; refreshing token: %v", errAuthFailed, err))
+	}
+	if tok == used {
+		return backoff.Permanent(errAuthFailed)
+	}
+	fu.Token = tok
+	fu.debugf("Token refreshed after 401")
+	return fmt.Errorf("%w, token refreshed", errAuthFailed)
+}
+
+// logConnectionInfo reports, in verbose mode, how the workers will share
+// connections to the server.
+func (fu *FileUploader) logConnectionInfo(resp *http.Response) {
+	limit := "unlimited"
+	if maxConns := maxConnsPerHost(fu.Client.Transport); maxConns > 0 {
+		limit = strconv.Itoa(maxConns)
+	}
+	mux := "no"
+	if resp.ProtoMajor == 2 {
+		mux = "yes"
+	}
+	fu.debugf("Workers: %d, max connections: %s, protocol: %s (HTTP/2 multiplexing: %s)",
+		fu.Concurrency, limit, resp.Proto, mux)
+}
+
+// maxConnsPerHost returns the connection limit of the *http.Transport
+// under rt and any wrappers in front of it, or 0 when there is none.
+func maxConnsPerHost(rt http.RoundTripper) int {
+	for {
+		switch t := rt.(type) {
+		case *http.Transport:
+			return t.MaxConnsPerHost
+		case interface{ Unwrap() http.RoundTripper }:
+			rt = t.Unwrap()
+		default:
+			return 0
+		}
+	}
+}
+
+// Close releases the idle connections held by fu.Client. An uploader can
+// run any number of files before Close, changing FilePath (and the other
+// per-file fields) between Run calls; each Run opens and closes its own file
+// handle. When several uploaders share one Client, close it once after the
+// last of them instead.
+func (fu *FileUploader) Close() error {
+	fu.Client.CloseIdleConnections()
+	return nil
+}
+
+// debugf prints to stderr when verbose output is enabled.
+func (fu *FileUploader) debugf(format string, args ...interface{}) {
+	if fu.Verbose {
+		fmt.Fprintf(os.Stderr, format+"\n", args...)
+	}
+}
+
+// emit sends a progress event tagged with this uploader's file.
+func (fu *FileUploader) emit(typ string, fields map[string]interface{}) {
+	if fu.Events == nil {
+		return
+	}
+	fields["file"] = fu.FilePath
+	fu.Events.Emit(typ, fields)
+}
+
+// Run uploads FilePath. It is RunContext for callers that only need to know
+// whether the upload succeeded.
+//
+// Deprecated: Run can't be cancelled; use RunContext, whose context can
+// also carry a deadline and tracing values.
+func (fu *FileUploader) Run() error {
+	_, err := fu.RunContext(context.Background())
+	return err
+}
+
+// RunContext uploads FilePath, stopping when ctx is cancelled or its
+// deadline passes. It is UploadReaderAt over the opened file, or
+// UploadReader when FilePath is a named pipe or another file that isn't
+// regular. A regular file is first checked for still being written; see
+// checkStable.
+func (fu *FileUploader) RunContext(ctx context.Context) (*UploadResult, error) {
+	file, err := os.Open(fu.FilePath)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	fi, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+	if !fi.Mode().IsRegular() {
+		// A FIFO or device reports no useful size and can't be read twice.
+		return fu.UploadReader(ctx, file, fu.FilePath)
+	}
+	if err := fu.checkStable(ctx, file, fi); err != nil {
+		return nil, err
+	}
+	return fu.UploadReaderAt(ctx, file, fi.Size(), fu.FilePath)
+}
+
+// UploadReaderAt uploads fileSize bytes from r as an attachment called name
+// (its base name is used, unless Name is set), for embedders whose data is
+// already addressable: an mmap'd region, a remote object or an archive
+// entry. Chunks are read in parallel through an io.SectionReader, so a retry
+// re-reads its section instead of holding it, and every file option applies:
+// Offset and Length select a range of r, and resume, part repair and the
+// probe work as they do for Run. An *os.File is also checked before
+// finalize for having been replaced or modified; see fileFingerprint. The
+// result is returned on failure too, filled in as far as the upload got.
+//
+// When the server fails and FailoverURLs are set, the upload starts over
+// on the next of them. Nothing but the session is tied to a server, so the
+// chunks are re-read and hashed the same way; a session pinned by
+// ExistingUploadID or ResumeFile rules failover out.
+func (fu *FileUploader) UploadReaderAt(ctx context.Context, r io.ReaderAt, fileSize int64, name string) (*UploadResult, error) {
+	res, err := fu.uploadReaderAt(ctx, r, fileSize, name)
+	if errors.Is(err, errSharedSessionRefused) && ctx.Err() == nil {
+		ui.Warnf("%s: the server refused a second finalize in upload session %s; uploading each file in its own session from now on",
+			res.Name, fu.UploadID)
+		fu.Sessions.Refuse()
+		fu.sharedSession = false
+		res, err = fu.uploadReaderAt(ctx, r, fileSize, name)
+	}
+	if fu.ExistingUploadID != "" || fu.ResumeFile != "" {
+		return res, err
+	}
+	for _, url := range fu.FailoverURLs {
+		if !failoverable(ctx, err) {
+			break
+		}
+		ui.Warnf("%s: %s failed (%v); failing over to %s", res.Name, fu.BaseURL, err, url)
+		fu.emit("failover", map[string]interface{}{"from": fu.BaseURL, "to": url, "error": err.Error()})
+		prev := res
+		prev.Failovers = append(prev.Failovers, failover{URL: fu.BaseURL, Error: err.Error()})
+		fu.failOver(url)
+		res, err = fu.uploadReaderAt(ctx, r, fileSize, name)
+		res.Failovers = prev.Failovers
+		res.Phases = append(prev.Phases, res.Phases...)
+		res.Retries += prev.Retries
+	}
+	return res, stopped(ctx, err)
+}
+
+func (fu *FileUploader) uploadReaderAt(ctx context.Context, r io.ReaderAt, fileSize int64, name string) (res *UploadResult, err error) {
+	fu.FilePath = name
+	res = &UploadResult{IssueKey: fu.IssueKey, Name: fu.attachmentName(), BaseURL: fu.BaseURL}
+	started := time.Now()
+	// The block size follows the whole file so that a range starting on a
+	// block boundary yields the same chunks as a full upload would.
+	policy, blockSource := fu.BlockSize, "-block-size"
+	if policy == nil {
+		policy, blockSource = getBlockSize, "the default policy"
+	}
+	blockSize := policy(fileSize)
+	offset, size, err := fu.byteRange(fileSize)
+	if err != nil {
+		return res, err
+	}
+	// The default policy's size grows to keep within -max-parts; under
+	// -adaptive the sizer keeps to it instead.
+	if !fu.Adaptive {
+		picked := blockSize
+		if blockSize, err = fitPartLimit(size, blockSize, fu.MaxParts, fu.BlockSize != nil); err != nil {
+			return res, err
+		}
+		if blockSize != picked {
+			ui.Warnf("%s: raising the block size to %s to stay within %d parts",
+				name, decor.SizeB1024(blockSize), fu.MaxParts)
+			blockSource = "-max-parts"
+		}
+	}
+	if fu.ResumeFile != "" && fu.ExistingUploadID == "" {
+		picked := blockSize
+		var reused bool
+		if blockSize, reused, err = resumeBlockSize(fu.ResumeFile, blockSize, fu.BlockSize != nil); err != nil {
+			return res, err
+		}
+		if reused {
+			blockSource = "the resume file"
+			ui.Warnf("%s: resuming with the block size of the resume file, %d bytes, rather than %d", name, blockSize, picked)
+			if _, err := fitPartLimit(size, blockSize, fu.MaxParts, true); err != nil {
+				return res, err
+			}
+		}
+	}
+	if blockSize < minBlockSize || blockSize > maxBlockSize {
+		return res, fmt.Errorf("block size %d is outside %d..%d", blockSize, minBlockSize, maxBlockSize)
+	}
+	// A file is fingerprinted so that a replacement or in-place change
+	// during the upload fails the run before finalize.
+	var fp *fileFingerprint
+	fu.source = nil
+	if file, ok := r.(*os.File); ok {
+		if fp, err = takeFingerprint(file, blockSize); err != nil {
+			return res, fmt.Errorf("%w: %w", errSourceRead, err)
+		}
+		fu.source = fp.info
+	}
+	// The start of the range is only read for sniffing when the type isn't
+	// forced.
+	var head []byte
+	if fu.MimeType == "" {
+		if head, err = readHead(r, offset, size); err != nil {
+			return res, fmt.Errorf("%w: %w", errSourceRead, err)
+		}
+	}
+	fu.mimeType = resolveMimeType(fu.MimeType, fu.MimeTypes, name, head)
+	// A size that is an exact multiple of the block size ends with a read
+	// returning (0, io.EOF), which produces no chunk, so round up rather
+	// than adding one.
+	totalChunks := int((size + blockSize - 1) / blockSize)
+	maxChunks := totalChunks
+	// The bar counts bytes, so its total is exact whatever the chunking.
+	barTotal := size
+	if fu.OnlyParts != nil {
+		barTotal = 0
+		for part := range fu.OnlyParts {
+			if part > totalChunks {
+				return res, fmt.Errorf("-only-parts: part %d is beyond the last part (%d)", part, totalChunks)
+			}
+			barTotal += min(blockSize, size-int64(part-1)*blockSize)
+		}
+	}
+	if fu.Adaptive {
+		fu.sizer = newAdaptiveSizer(blockSize)
+		if err := fu.sizer.keepWithin(size, fu.MaxParts); err != nil {
+			return res, err
+		}
+		maxChunks = int(size/minBlockSize) + 1
+	}
+
+	// 1) Create upload session, or reattach to the one in the resume file
+	fu.retried.Store(0)
+	fu.work.reset()
+	res.beginPhase("session")
+	defer res.endPhase()
+	if fu.ResumeFile != "" {
+		unlock, err := lockResumeState(fu.ResumeFile)
+		if err != nil {
+			return res, err
+		}
+		defer unlock()
+	}
+	uploadID, done, err := fu.openSession(ctx, size, blockSize)
+	if err != nil {
+		return res, err
+	}
+	// The part size and part limit the server reported only become known
+	// here, so a run that can't keep to them leaves a session behind to
+	// discard.
+	discard := func(err error) error {
+		if fu.Paths.Abort != "" && fu.ResumeFile == "" {
+			if err := fu.abortSession(uploadID); err != nil {
+				fu.debugf("Aborting upload session %s: %v", uploadID, err)
+			}
+		}
+		return err
+	}
+	// A part size the server asks for replaces the local choice, so no
+	// part is refused for its size. newSession recorded it in the resume
+	// file already.
+	if ps := fu.serverPartSize; ps > 0 && ps != blockSize && len(done) == 0 {
+		if ps > maxBlockSize {
+			return res, discard(fmt.Errorf("the server asks for parts of %s, more than the largest this tool sends, %s",
+				decor.SizeB1024(ps), decor.SizeB1024(maxBlockSize)))
+		}
+		if fu.BlockSize != nil {
+			ui.Warnf("%s: the server asks for parts of %s; using them instead of -block-size", name, decor.SizeB1024(ps))
+		}
+		if fu.sizer != nil {
+			ui.Warnf("%s: the server asks for parts of %s, so -adaptive is off for this upload", name, decor.SizeB1024(ps))
+			fu.sizer = nil
+		}
+		blockSize, blockSource = ps, "the server"
+		totalChunks = int((size + blockSize - 1) / blockSize)
+		maxChunks = totalChunks
+	}
+	if fu.serverMaxParts > 0 {
+		if fu.sizer != nil {
+			err = fu.sizer.keepWithin(size, fu.partLimit())
+		} else {
+			_, err = fitPartLimit(size, blockSize, fu.partLimit(), true)
+		}
+		if err != nil {
+			return res, discard(fmt.Errorf("the server allows %d parts per upload: %w", fu.serverMaxParts, err))
+		}
+	}
+	if fu.sizer != nil {
+		fu.debugf("Block size starts at %s, from %s, and adapts", decor.SizeB1024(blockSize), blockSource)
+	} else {
+		fu.debugf("Block size %s, from %s", decor.SizeB1024(blockSize), blockSource)
+	}
+	fu.UploadID = uploadID
+	fu.emit("session_created", map[string]interface{}{"uploadId": uploadID, "resumed": len(done) > 0, "shared": fu.sharedSession})
+	// logged is what the ETag log vouches for, before -probe-first adds to
+	// done, so each skipped part can be credited to the log or the probe.
+	logged := maps.Clone(done)
+	var uploaded, skipped, sentBytes, skippedBytes atomic.Int64
+	var probed, resumed, probedBytes, resumedBytes atomic.Int64
+	defer func() {
+		res.UploadID, res.IdempotencyKey = uploadID, fu.IdempotencyKey
+		res.Size = size
+		res.BytesSent, res.BytesSkipped = sentBytes.Load(), skippedBytes.Load()
+		res.Sources = chunkSources{
+			Uploaded: int(uploaded.Load()), Probed: int(probed.Load()), Resumed: int(resumed.Load()),
+			BytesUploaded: sentBytes.Load(), BytesProbed: probedBytes.Load(), BytesResumed: resumedBytes.Load(),
+		}
+		res.SHA256, res.Attachment = fu.SHA256, fu.Attachment
+		res.FinalizeStatus = fu.finalizeStatus
+		res.Chunks, res.Elapsed = fu.ChunkStats, time.Since(started)
+		res.Retries = int(fu.retried.Load())
+		res.Work = fu.work.timing()
+		status, ev := "success", map[string]interface{}{}
+		if err != nil {
+			status, ev["error"] = "failed", err.Error()
+		}
+		ev["status"] = status
+		summary := map[string]interface{}{
+			"size":     size,
+			"uploaded": uploaded.Load(),
+			"skipped":  skipped.Load(),
+			"probed":   probed.Load(),
+			"resumed":  resumed.Load(),
+		}
+		if fu.ProbeFirst {
+			summary["present"], summary["bytesPresent"] = res.PartsPresent, res.BytesPresent
+		}
+		ev["summary"] = summary
+		fu.emit("run_completed", ev)
+	}()
+	var elog *etagLog
+	if fu.ETagLog != "" {
+		elog, err = openETagLog(fu.ETagLog, len(done) == 0, fu.Checkpoint)
+		if err != nil {
+			return res, err
+		}
+		// The final flush; a failure means the log lost entries.
+		defer func() {
+			if cerr := elog.Close(); cerr != nil && err == nil {
+				err = fmt.Errorf("etag log: %v", cerr)
+			}
+		}()
+	}
+
+	label := "Uploading:"
+	if len(done) > 0 {
+		label = "Resuming:"
+	}
+	prehash := fu.ProbeFirst
+	if prehash {
+		if prehash, err = fu.shouldPrehash(r, offset, size, blockSize); err != nil {
+			return res, err
+		}
+	}
+	if prehash {
+		res.beginPhase("probe")
+		fu.emit("phase_changed", map[string]interface{}{"phase": "probe"})
+		present, err := fu.probeFirst(ctx, r, offset, size, blockSize, uploadID)
+		if err != nil {
+			return res, err
+		}
+		if done == nil {
+			done = map[int]string{}
+		}
+		maps.Copy(done, present)
+		for _, et := range done {
+			res.PartsPresent++
+			res.BytesPresent += etagSize(et)
+		}
+		rest := "nothing left to upload"
+		if res.BytesPresent < size {
+			rest = fmt.Sprintf("uploading the remaining % .1f", decor.SizeB1024(size-res.BytesPresent))
+		}
+		fmt.Fprintf(os.Stderr, "Server already has %d of %d chunks (% .1f of % .1f, %d%%); %s\n",
+			res.PartsPresent, totalChunks, decor.SizeB1024(res.BytesPresent), decor.SizeB1024(size),
+			percentOf(res.BytesPresent, size), rest)
+		fu.emit("probe_completed", map[string]interface{}{
+			"chunks": totalChunks, "chunksPresent": res.PartsPresent,
+			"bytes": size, "bytesPresent": res.BytesPresent,
+		})
+	}
+
+	// 2) Progress bar, in bytes. On resume, or after -probe-first, it starts
+	// at the bytes the server already has, so the percentage reflects the
+	// work that remains.
+	var doneBytes int64
+	for _, et := range done {
+		doneBytes += etagSize(et)
+	}
+	progress := fu.newUploadProgress(label, barTotal, doneBytes)
+	// Every exit path ends the bar here, before the upload returns. A failed
+	// run drops the bar; an empty file's bar has nothing to count and is
+	// completed explicitly.
+	defer func() { progress.finish(err) }()
+
+	src := fu.sourceReader(r, offset, size)
+
+	res.beginPhase("upload")
+	fu.emit("phase_changed", map[string]interface{}{"phase": "upload"})
+
+	// 3) Spawn workers: the reader feeds a pool of hashers, which feed the
+	// upload workers, so hashing the next chunks overlaps with network time.
+	// A failed chunk or read cancels ctx with its error as the cause; the
+	// stages then drain their input without doing more work, and in-flight
+	// requests are aborted.
+	// parent outlives the upload stage, for the requests that follow it.
+	parent := ctx
+	ctx, cancel := context.WithCancelCause(ctx)
+	defer cancel(nil)
+	var confirmedMu sync.Mutex
+	fu.ChunkStats = nil
+	var lastProgress atomic.Int64
+	lastProgress.Store(time.Now().UnixNano())
+	if fu.MaxIdleTime > 0 {
+		go fu.watchIdle(ctx, cancel, &lastProgress)
+	}
+	session := newUploadSession(uploadID, len(done) > 0 || fu.ExistingUploadID != "" || fu.sharedSession)
+	// A run that stops short of finalizing leaves the parts confirmed so
+	// far in the resume file.
+	confirmed := maps.Clone(done)
+	if confirmed == nil {
+		confirmed = map[int]string{}
+	}
+	if fu.ResumeFile != "" {
+		defer func() {
+			if err != nil {
+				confirmedMu.Lock()
+				defer confirmedMu.Unlock()
+				fu.saveResumeParts(session.ID(), confirmed)
+			}
+		}()
+	}
+	if fu.Keepalive > 0 {
+		go fu.keepSessionAlive(ctx, cancel, session, func() (string, error) {
+			id, err := fu.newSession(ctx, size, blockSize)
+			if err == nil {
+				fu.UploadID = id
+				fu.emit("session_created", map[string]interface{}{"uploadId": id, "resumed": false, "recreated": true})
+			}
+			return id, err
+		})
+	}
+	results := make(chan chunkResult, maxChunks)
+	toHash := make(chan pendingChunk)
+	toUpload := make(chan pendingChunk)
+	budget := fu.MaxMemory
+	if budget <= 0 {
+		budget = defaultMaxMemory
+	}
+	// Starting with a chunk per hash worker keeps them all busy.
+	ahead := newReadAhead(fu.HashWorkers+1, int(budget/blockSize), budget, fu.debugf)
+	defer func() { res.ReadAhead = ahead.Stats() }()
+
+	fu.hashChunks(ctx, toHash, toUpload)
+
+	var uploadWG sync.WaitGroup
+	for i := 0; i < fu.Concurrency; i++ {
+		uploadWG.Add(1)
+		go func() {
+			defer uploadWG.Done()
+			for {
+				waitStart := time.Now()
+				c, ok := <-toUpload
+				if !ok {
+					break
+				}
+				// The buffer's capacity is what Acquire counted.
+				ahead.Take(int64(cap(c.data)), c.readAt, time.Since(waitStart))
+				if ctx.Err() != nil {
+					continue
+				}
+				var err error
+				attempts := 0
+				if done[c.part] != c.etag && !c.hashOnly {
+					start := time.Now()
+					id := session.begin()
+					attempts, err = fu.sendChunk(ctx, c, id)
+					session.end(err == nil)
+					if err == nil && elog != nil {
+						err = elog.Append(c.part, c.etag)
+					}
+					if err == nil {
+						confirmedMu.Lock()
+						confirmed[c.part] = c.etag
+						confirmedMu.Unlock()
+						progress.add(c, attempts, start)
+					}
+				}
+				if err == nil {
+					if attempts > 0 {
+						uploaded.Add(1)
+						sentBytes.Add(int64(len(c.data)))
+					} else {
+						skipped.Add(1)
+						skippedBytes.Add(int64(len(c.data)))
+						switch {
+						case c.hashOnly:
+						case logged[c.part] == c.etag:
+							resumed.Add(1)
+							resumedBytes.Add(int64(len(c.data)))
+						default:
+							probed.Add(1)
+							probedBytes.Add(int64(len(c.data)))
+						}
+					}
+					lastProgress.Store(time.Now().UnixNano())
+					progress.completed(c, attempts)
+				} else {
+					cancel(err)
+				}
+				results <- chunkResult{ETag: c.etag, Index: c.part, Offset: c.offset, Size: len(c.data),
+					Attempts: attempts, Err: err}
+			}
+		}()
+	}
+	go func() {
+		uploadWG.Wait()
+		close(results)
+	}()
+
+	idx := 0
+	pos := offset
+	digest := sha256.New()
+	hashed := true
+	var readErr error
+	for ctx.Err() == nil {
+		next := blockSize
+		if fu.sizer != nil {
+			next = fu.sizer.Next()
+		}
+		hashOnly := fu.OnlyParts != nil && !fu.OnlyParts[idx+1]
+		if hashOnly && !fu.Refinalize {
+			n := min(next, offset+size-pos)
+			if n <= 0 {
+				break
+			}
+			if _, err := src.Seek(n, io.SeekCurrent); err != nil {
+				readErr = fmt.Errorf("%w at offset %d: %w", errSourceRead, pos, err)
+				break
+			}
+			hashed = false
+			idx++
+			pos += n
+			continue
+		}
+		if ahead.Acquire(ctx, next) != nil {
+			break
+		}
+		// ReadFull keeps reading through short reads and treats "data plus
+		// io.EOF" in one call as a final partial chunk: io.EOF means nothing
+		// was read, io.ErrUnexpectedEOF means this is the last, short chunk.
+		buf := make([]byte, next)
+		readStart := time.Now()
+		n, err := io.ReadFull(src, buf)
+		since(&fu.work.read, readStart)
+		if err == io.EOF {
+			break
+		}
+		if err != nil && err != io.ErrUnexpectedEOF {
+			readErr = fmt.Errorf("%w at offset %d: %w", errSourceRead, pos+int64(n), err)
+			break
+		}
+		digest.Write(buf[:n])
+		toHash <- pendingChunk{part: idx + 1, data: buf[:n], offset: pos, hashOnly: hashOnly, readAt: time.Now()}
+
+		idx++
+		pos += int64(n)
+		if err == io.ErrUnexpectedEOF {
+			break
+		}
+	}
+	close(toHash)
+	if readErr == nil && ctx.Err() == nil && pos < offset+size {
+		readErr = fmt.Errorf("%w at offset %d: %w", errSourceRead, pos, errTruncated)
+	}
+	if readErr == nil && ctx.Err() == nil && hashed {
+		fu.SHA256 = hex.EncodeToString(digest.Sum(nil))
+	}
+	if readErr != nil {
+		// Wait for in-flight chunks so no worker outlives the failed run.
+		cancel(readErr)
+		for range results {
+		}
+		uploadID = session.ID()
+		// A session kept for -resume-file may still be completed later.
+		if fu.Paths.Abort != "" && fu.ResumeFile == "" {
+			if err := fu.abortSession(uploadID); err != nil {
+				fu.debugf("Aborting upload session %s: %v", uploadID, err)
+			}
+		}
+		return res, readErr
+	}
+
+	// 4) Collect results. Every one is drained, so no worker outlives a
+	// failed run and each chunk that failed can be reported.
+	var chunks []chunkResult
+	for c := range results {
+		chunks = append(chunks, c)
+	}
+	// Report what cancelled the run (failed chunks, the idle watchdog or
+	// keepalive) rather than the chunks aborted as a consequence.
+	if cause := context.Cause(ctx); cause != nil {
+		return res, collectFailures(cause, chunks)
+	}
+	// All chunks are in; this also stops the idle watchdog and keepalive.
+	cancel(nil)
+	uploadID = session.ID()
+	if len(logged) > 0 && resumed.Load() == 0 {
+		ui.Warnf("%s: none of the %d parts recorded for resuming matched the file; all of it was sent again", name, len(logged))
+	}
+
+	etags := partOrder(chunks)
+	res.Parts = len(etags)
+	if fu.OnlyParts != nil && !fu.Refinalize {
+		return res, nil
+	}
+	if err := checkParts(chunks, size); err != nil {
+		return res, err
+	}
+	// The log of a completed upload is its manifest, so it ends with the
+	// whole file's digest.
+	if elog != nil && fu.SHA256 != "" {
+		if err := elog.AppendSHA256(fu.SHA256); err != nil {
+			fu.debugf("Recording the file digest in the ETag log: %v", err)
+		}
+	}
+
+	// 5) Finalize upload
+	if fp != nil {
+		if err := fp.check(); err != nil {
+			return res, err
+		}
+	}
+	if fu.VerifyParts {
+		res.beginPhase("verify")
+		fu.emit("phase_changed", map[string]interface{}{"phase": "verify"})
+		if err := fu.verifyParts(parent, etags, uploadID); err != nil {
+			return res, err
+		}
+	}
+	res.beginPhase("finalize")
+	fu.emit("phase_changed", map[string]interface{}{"phase": "finalize"})
+	repaired, err := fu.finalizeRepairing(parent, r, offset, etags, uploadID)
+	res.PartsRepaired = repaired
+	if err != nil {
+		var rejected *finalizeRejectedError
+		if len(done) == 0 || !errors.As(err, &rejected) {
+			return res, err
+		}
+		// Parts taken from the ETag log were never probed this run; the
+		// server may have lost some since. Re-check them and try again.
+		repaired, rerr := fu.repairLoggedChunks(parent, r, offset, etags, done, uploadID)
+		if rerr != nil {
+			return res, rerr
+		}
+		if repaired == 0 {
+			return res, err
+		}
+		repaired, err = fu.finalizeRepairing(parent, r, offset, etags, uploadID)
+		res.PartsRepaired += repaired
+		if err != nil {
+			return res, err
+		}
+	}
+	if fu.ResumeFile != "" {
+		os.Remove(fu.ResumeFile)
+	}
+	var attachmentID string
+	if fu.Attachment != nil {
+		attachmentID = fu.Attachment.ID
+	}
+	fu.Sessions.Put(fu.BaseURL, fu.IssueKey, fu.UploadID, attachmentID)
+	return res, nil
+}
+
+// repairLoggedChunks probes every part the ETag log vouched for and
+// re-uploads the ones the server no longer has, reading them back from file.
+// It returns how many parts were re-uploaded.
+func (fu *FileUploader) repairLoggedChunks(ctx context.Context, file io.ReaderAt, offset int64, etags []string, done map[int]string, uploadID string) (int, error) {
+	fu.debugf("Finalize rejected; re-checking %d parts from the ETag log", len(done))
+	repaired := 0
+	pos := offset
+	for i, etag := range etags {
+		part, n := i+1, etagSize(etag)
+		if done[part] == etag {
+			span := chunkSpan{Part: part, Offset: pos, Size: int(n)}
+			exists, err := fu.checkIfChunkExists(ctx, etag, span, uploadID)
+			if err != nil {
+				return repaired, err
+			}
+			if !exists {
+				buf := make([]byte, n)
+				if _, err := file.ReadAt(buf, pos); err != nil {
+					return repaired, fmt.Errorf("%w at offset %d: %w", errSourceRead, pos, err)
+				}
+				if _, err := fu.uploadChunk(ctx, etag, buf, span, uploadID); err != nil {
+					return repaired, err
+				}
+				repaired++
+			}
+		}
+		pos += n
+	}
+	fu.debugf("Re-uploaded %d parts missing on the server", repaired)
+	return repaired, nil
 }
 
-func main() {
-	// URL flag
-	// Flags
-	userFlag := flag.String("user", defaultUser, "Username (overrides build-time default)")
-	tokenFlag := flag.String("token", defaultToken, "Auth token (overrides build-time default)")
-	baseURL := flag.String("url", "https://transfer.atlassian.com",
-		"Base API URL (e.g. https://api.example.com)")
-	flag.Parse()
-
-	if *userFlag == "" || *tokenFlag == "" {
-		fmt.Fprintln(os.Stderr,
-			"Error: missing user or token. Provide via build-time -ldflags or -user/-token flags.")
-		os.Exit(1)
-	} else {
-		defaultUser = *userFlag
-		defaultToken = *tokenFlag
+// watchIdle cancels the run once no chunk has completed for MaxIdleTime,
+// which catches connections that stay open without moving any data. It
+// returns when ctx is done.
+func (fu *FileUploader) watchIdle(ctx context.Context, cancel context.CancelCauseFunc, last *atomic.Int64) {
+	tick := min(fu.MaxIdleTime/4, time.Second)
+	if tick <= 0 {
+		tick = fu.MaxIdleTime
+	}
+	t := time.NewTicker(tick)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+			if time.Since(time.Unix(0, last.Load())) > fu.MaxIdleTime {
+				cancel(fmt.Errorf("%w: no chunk completed in %s", errStalled, fu.MaxIdleTime))
+				return
+			}
+		}
 	}
+}
 
-	// Positional args
-	args := flag.Args()
-	if len(args) < 2 {
-		fmt.Fprintf(os.Stderr, "Usage: %s [options] ISSUE-KEY FILEPATH\n", os.Args[0])
-		flag.PrintDefaults()
-		os.Exit(1)
+// byteRange validates Offset/Length against the file size and returns the
+// range to upload.
+func (fu *FileUploader) byteRange(fileSize int64) (offset, length int64, err error) {
+	offset, length = fu.Offset, fu.Length
+	if offset < 0 || length < 0 {
+		return 0, 0, fmt.Errorf("-offset and -length must not be negative")
 	}
-	issueKey := args[0]
-	filePath := args[1]
+	if offset >= fileSize && fileSize > 0 {
+		return 0, 0, fmt.Errorf("-offset %d is beyond the end of the file (%d bytes)", offset, fileSize)
+	}
+	if length == 0 {
+		length = fileSize - offset
+	}
+	if offset+length > fileSize {
+		return 0, 0, fmt.Errorf("-offset %d -length %d runs past the end of the file (%d bytes)", offset, length, fileSize)
+	}
+	return offset, length, nil
+}
 
-	if defaultUser == "" || defaultToken == "" {
-		fmt.Fprintln(os.Stderr, "Error: user/token not set—build with -ldflags to inject them.")
-		os.Exit(1)
+// openSession returns the uploadId to use and, when resuming, the parts the
+// ETag log already recorded as uploaded.
+func (fu *FileUploader) openSession(ctx context.Context, size, blockSize int64) (string, map[int]string, error) {
+	if fu.ExistingUploadID != "" {
+		return fu.ExistingUploadID, nil, nil
+	}
+	fu.sharedSession = false
+	fu.serverMaxParts, fu.serverPartSize = 0, 0
+	if id := fu.Sessions.Get(fu.BaseURL, fu.IssueKey); id != "" {
+		fu.sharedSession = true
+		fu.debugf("Uploading into shared session %s", id)
+		return id, nil, nil
+	}
+	fu.resume = nil
+	if fu.ResumeFile != "" {
+		st, err := loadResumeState(fu.ResumeFile)
+		if err == nil {
+			if err := fu.checkResumeState(st, size, blockSize); err != nil {
+				return "", nil, err
+			}
+			if st.Version < resumeStateVersion {
+				// Migrate: record what earlier formats left out.
+				st.BaseURL, st.File = fu.BaseURL, identify(fu.source)
+				if err := saveResumeState(fu.ResumeFile, st); err != nil {
+					return "", nil, err
+				}
+				fu.debugf("Rewrote resume file %s in format %d", fu.ResumeFile, resumeStateVersion)
+			}
+			fu.resume = st
+			done := maps.Clone(st.Parts)
+			if done == nil {
+				done = map[int]string{}
+			}
+			if fu.ETagLog != "" {
+				logged, err := loadETagLog(fu.ETagLog)
+				if err != nil {
+					return "", nil, err
+				}
+				maps.Copy(done, logged)
+			}
+			return st.UploadID, done, nil
+		}
+		switch {
+		case errors.Is(err, errResumeCorrupt):
+			ui.Warnf("%v; discarding it and starting a new upload session", err)
+		case !os.IsNotExist(err):
+			return "", nil, err
+		}
 	}
 
-	uploader := NewFileUploader(filePath, issueKey, defaultUser, defaultToken, *baseURL)
-	if err := uploader.Run(); err != nil {
-		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
-		os.Exit(1)
+	uploadID, err := fu.newSession(ctx, size, blockSize)
+	if err != nil {
+		return "", nil, err
 	}
-	fmt.Printf("Successfully uploaded %s to %s\n", filePath, issueKey)
+	return uploadID, nil, nil
 }
 
-type FileUploader struct {
-	FilePath  string
-	IssueKey  string
-	User      string
-	Token     string
-	BaseURL   string
-	Client    *http.Client
-	Semaphore chan struct{}
+// checkResumeState refuses a resume file written for another upload: another
+// issue, server, range, block size or hash algorithm, or another version of
+// the file. Files from before versioning record no server or file, so
+// those aren't checked.
+func (fu *FileUploader) checkResumeState(st *resumeState, size, blockSize int64) error {
+	mismatch := ""
+	switch {
+	case st.IssueKey != fu.IssueKey:
+		mismatch = fmt.Sprintf("it is for %s, not %s", st.IssueKey, fu.IssueKey)
+	case st.BaseURL != "" && strings.TrimRight(st.BaseURL, "/") != strings.TrimRight(fu.BaseURL, "/"):
+		mismatch = fmt.Sprintf("its session is on %s, not %s", st.BaseURL, fu.BaseURL)
+	case st.Size != size || st.Offset != fu.Offset:
+		mismatch = fmt.Sprintf("it covers %d bytes from offset %d, not %d from %d", st.Size, st.Offset, size, fu.Offset)
+	case st.BlockSize != blockSize:
+		mismatch = fmt.Sprintf("it was written with a block size of %d bytes, not %d", st.BlockSize, blockSize)
+	case st.HashAlgorithm != fu.HashAlgorithm:
+		mismatch = fmt.Sprintf("it was written with -hash-algorithm %s, not %s", st.HashAlgorithm, fu.HashAlgorithm)
+	default:
+		mismatch = st.File.mismatch(identify(fu.source))
+	}
+	if mismatch != "" {
+		return fmt.Errorf("resume file %s does not match this upload: %s; delete it to start over", fu.ResumeFile, mismatch)
+	}
+	return nil
 }
 
-func NewFileUploader(fp, ik, u, t, url string) *FileUploader {
-	return &FileUploader{
-		FilePath:  fp,
-		IssueKey:  ik,
-		User:      u,
-		Token:     t,
-		BaseURL:   url,
-		Client:    &http.Client{Timeout: 30 * time.Second},
-		Semaphore: make(chan struct{}, maxSem),
+// saveResumeParts records the parts confirmed so far in the resume file,
+// for a run that stops short of finalizing.
+func (fu *FileUploader) saveResumeParts(uploadID string, parts map[int]string) {
+	if fu.resume == nil || fu.resume.UploadID != uploadID || len(parts) == 0 {
+		return
+	}
+	fu.resume.Parts = parts
+	if err := saveResumeState(fu.ResumeFile, fu.resume); err != nil {
+		ui.Warnf("recording progress in resume file %s: %v", fu.ResumeFile, err)
+		return
 	}
+	fu.debugf("Recorded %d confirmed parts in resume file %s", len(parts), fu.ResumeFile)
 }
 
-func (fu *FileUploader) Run() error {
-	// Stat file to get size
-	fi, err := os.Stat(fu.FilePath)
+// newSession creates an upload session and records it in the resume file.
+func (fu *FileUploader) newSession(ctx context.Context, size, blockSize int64) (string, error) {
+	uploadID, err := fu.createUpload(ctx, size)
 	if err != nil {
-		return err
+		return "", err
 	}
-	size := fi.Size()
-	blockSize := getBlockSize(size)
-	totalChunks := int((size / blockSize) + 1)
-
-	// 1) Create upload session
-	uploadID, err := fu.createUpload()
-	if err != nil {
-		return err
+	if fu.serverPartSize > 0 && fu.serverPartSize <= maxBlockSize {
+		blockSize = fu.serverPartSize
 	}
+	if fu.ResumeFile != "" {
+		st := &resumeState{BaseURL: fu.BaseURL, UploadID: uploadID, IssueKey: fu.IssueKey, Size: size,
+			BlockSize: blockSize, HashAlgorithm: fu.HashAlgorithm, Offset: fu.Offset, File: identify(fu.source)}
+		if err := saveResumeState(fu.ResumeFile, st); err != nil {
+			return "", err
+		}
+		fu.resume = st
+	}
+	return uploadID, nil
+}
 
-	// 2) Progress bar
-	p := mpb.New()
-	bar := p.AddBar(int64(totalChunks),
-		mpb.PrependDecorators(
-			decor.Name("Uploading:", decor.WC{W: 10}),
-			decor.CountersNoUnit("%d / %d", decor.WC{W: 12}),
-		),
-		mpb.AppendDecorators(decor.Percentage()),
-	)
-
-	file, err := os.Open(fu.FilePath)
-	if err != nil {
-		return err
+// createUploadBody builds the session-creation payload; see CreateBody. A
+// nil result means no body.
+func (fu *FileUploader) createUploadBody(size int64) ([]byte, error) {
+	if fu.CreateBody == "empty" || fu.createBodyRejected.Load() {
+		return nil, nil
 	}
-	defer file.Close()
+	payload := map[string]interface{}{
+		"name":     fu.attachmentName(),
+		"size":     size,
+		"mimeType": fu.contentType(),
+	}
+	// A negative size is a stream whose length isn't known yet.
+	if size < 0 {
+		delete(payload, "size")
+	}
+	if fu.CreateBody != "" && fu.CreateBody != "metadata" {
+		if err := json.Unmarshal([]byte(fu.CreateBody), &payload); err != nil {
+			return nil, fmt.Errorf("-create-body: %v", err)
+		}
+	}
+	return json.Marshal(payload)
+}
 
-	// 3) Spawn workers
-	var wg sync.WaitGroup
-	results := make(chan chunkResult, totalChunks)
+func (fu *FileUploader) createUpload(ctx context.Context, size int64) (string, error) {
+	// Every attempt carries the same Idempotency-Key, so a server that
+	// honours it hands back the original session when a retry follows a
+	// response we lost, instead of opening a second one.
+	key := make([]byte, 16)
+	rand.Read(key)
+	idemKey := hex.EncodeToString(key)
 
-	idx := 0
-	for {
-		buf := make([]byte, blockSize)
-		n, readErr := file.Read(buf)
-		if n == 0 {
-			break
+	var uploadID string
+	op := func() error {
+		payload, err := fu.createUploadBody(size)
+		if err != nil {
+			return backoff.Permanent(err)
 		}
-		buf = buf[:n]
+		url := fu.endpoint(fu.Paths.Create)
+		var reqBody io.Reader
+		if payload != nil {
+			reqBody = bytes.NewReader(payload)
+		}
+		req, _ := http.NewRequestWithContext(ctx, "POST", url, reqBody)
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Idempotency-Key", idemKey)
 
-		wg.Add(1)
-		fu.Semaphore <- struct{}{} // acquire
-		go func(index int, chunk []byte) {
-			defer wg.Done()
-			defer func() { <-fu.Semaphore }() // release
+		resp, tok, err := fu.do(req)
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+		fu.logConnectionInfo(resp)
 
-			etag, err := fu.processChunk(chunk, index+1, uploadID)
-			results <- chunkResult{ETag: etag, Index: index + 1, Err: err}
-			bar.Increment()
-		}(idx, buf)
+		if resp.StatusCode == 401 {
+			return fu.unauthorized(tok)
+		}
+		// Servers that don't expect a body may reject the default metadata
+		// one; fall back to the empty body for the rest of the run. A body
+		// the user asked for explicitly is never dropped.
+		switch resp.StatusCode {
+		case http.StatusBadRequest, http.StatusUnsupportedMediaType, http.StatusUnprocessableEntity:
+			if payload != nil && (fu.CreateBody == "" || fu.CreateBody == "metadata") {
+				fu.createBodyRejected.Store(true)
+				fu.debugf("Server refused the create-upload body (status %d); retrying without one", resp.StatusCode)
+				return &statusError{op: "create upload (body refused)", status: resp.StatusCode}
+			}
+		}
+		if resp.StatusCode != http.StatusCreated {
+			rt, _ := io.ReadAll(resp.Body)
+			err := &statusError{op: "create upload", status: resp.StatusCode, body: string(rt)}
+			if resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500 {
+				return err
+			}
+			return backoff.Permanent(err)
+		}
 
-		idx++
-		if readErr == io.EOF {
-			break
-		} else if readErr != nil {
-			return readErr
+		// A body cut short by a dropped connection fails to decode and is
+		// retried like any other transient error.
+		var body struct {
+			UploadId string `json:"uploadId"`
+			MaxParts int    `json:"maxParts"`
+			// Servers name a part size they require or prefer.
+			PartSize          int64 `json:"partSize"`
+			PreferredPartSize int64 `json:"preferredPartSize"`
+		}
+		if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+			return fmt.Errorf("create upload: reading response: %v", err)
+		}
+		if !validUploadID(body.UploadId) {
+			return fmt.Errorf("create upload: unusable uploadId %q", body.UploadId)
 		}
+		uploadID, fu.serverMaxParts = body.UploadId, body.MaxParts
+		fu.serverPartSize = cmp.Or(body.PartSize, body.PreferredPartSize)
+		if fu.serverPartSize < 0 {
+			fu.serverPartSize = 0
+		}
+		return nil
 	}
 
-	// 4) Collect results
-	go func() {
-		wg.Wait()
-		close(results)
-	}()
+	if err := backoff.Retry(op, fu.retryPolicy(ctx)); err != nil {
+		return "", err
+	}
+	return uploadID, nil
+}
 
-	var chunks []chunkResult
-	for res := range results {
-		if res.Err != nil {
-			return res.Err
-		}
-		chunks = append(chunks, res)
+// validUploadID rejects ids that are empty or would corrupt the request
+// URLs they are substituted into.
+func validUploadID(id string) bool {
+	return id != "" && !strings.ContainsAny(id, " \t\r\n/?#&%")
+}
+
+// abortSession asks the server to discard the upload session. It is only
+// called when an abort path template is configured.
+func (fu *FileUploader) abortSession(uploadID string) error {
+	req, _ := http.NewRequest("DELETE", fu.endpoint(fu.Paths.Abort, "{uploadId}", uploadID), nil)
+	resp, _, err := fu.do(req)
+	if err != nil {
+		return err
 	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return &statusError{op: "abort", status: resp.StatusCode}
+	}
+	fu.debugf("Aborted upload session %s", uploadID)
+	return nil
+}
 
-	// Sort by Index
-	sort.Slice(chunks, func(i, j int) bool {
-		return chunks[i].Index < chunks[j].Index
-	})
+// processChunk uploads a chunk unless the server already has it, and
+// returns the number of upload attempts made, failed ones included; 0 means
+// it was skipped or failed at the probe. Errors are *chunkError.
+func (fu *FileUploader) processChunk(ctx context.Context, etag string, buf []byte, span chunkSpan, uploadID string) (int, error) {
+	// Parts named in -only-parts are known bad server-side, so the probe's
+	// answer isn't trusted for them.
+	if fu.OnlyParts == nil {
+		start := time.Now()
+		exists, err := fu.checkIfChunkExists(ctx, etag, span, uploadID)
+		since(&fu.work.probe, start)
+		if err != nil || exists {
+			return 0, err
+		}
+	}
+	start := time.Now()
+	attempts, err := fu.uploadChunk(ctx, etag, buf, span, uploadID)
+	since(&fu.work.send, start)
+	if err != nil {
+		return attempts, err
+	}
+	if fu.sizer != nil {
+		fu.sizer.Observe(int64(len(buf)), time.Since(start), attempts)
+	}
+	return attempts, nil
+}
 
-	// Build list of ETags
-	etags := make([]string, len(chunks))
-	for i, c := range chunks {
-		etags[i] = c.ETag
+// checkIfChunkExists probes for one chunk; errors are *chunkError.
+func (fu *FileUploader) checkIfChunkExists(ctx context.Context, etag string, span chunkSpan, uploadID string) (bool, error) {
+	exists, err := fu.probeChunks(ctx, []string{etag}, uploadID)
+	if err != nil {
+		return false, &chunkError{chunkSpan: span, err: err}
 	}
+	return exists[etag], nil
+}
 
-	// 5) Finalize upload
-	if err := fu.createFileChunked(etags, uploadID); err != nil {
+// probeChunks asks the server which of etags it holds for the session.
+func (fu *FileUploader) probeChunks(ctx context.Context, etags []string, uploadID string) (map[string]bool, error) {
+	var exists map[string]bool
+	op := func() (err error) {
+		exists, err = fu.probeOnce(ctx, etags, uploadID)
 		return err
 	}
 
-	p.Wait()
-	return nil
+	if err := backoff.Retry(op, fu.retryPolicy(ctx)); err != nil {
+		return nil, err
+	}
+	return exists, nil
 }
 
-func (fu *FileUploader) createUpload() (string, error) {
-	url := fmt.Sprintf("%s/api/upload/%s/create", fu.BaseURL, fu.IssueKey)
-	req, _ := http.NewRequest("POST", url, nil)
-	req.SetBasicAuth(fu.User, fu.Token)
+// probeOnce is a single probe request; errors that retrying can't fix are
+// wrapped with backoff.Permanent.
+func (fu *FileUploader) probeOnce(ctx context.Context, etags []string, uploadID string) (map[string]bool, error) {
+	url := fu.endpoint(fu.Paths.Probe, "{uploadId}", uploadID)
+	payload := map[string]interface{}{
+		"chunks": getChunksJSON(etags),
+	}
+	body, gzipped, err := fu.encodeJSON(payload)
+	if err != nil {
+		return nil, backoff.Permanent(err)
+	}
+
+	req, _ := http.NewRequestWithContext(ctx, "POST", url, bytes.NewReader(body))
 	req.Header.Set("Content-Type", "application/json")
+	if gzipped {
+		req.Header.Set("Content-Encoding", "gzip")
+	}
 
-	resp, err := fu.Client.Do(req)
+	resp, tok, err := fu.do(req)
 	if err != nil {
-		return "", err
+		return nil, err
 	}
 	defer resp.Body.Close()
 
 	if resp.StatusCode == 401 {
-		return "", fmt.Errorf("authentication failed")
+		return nil, fu.unauthorized(tok)
 	}
-	if resp.StatusCode != http.StatusCreated {
-		rt, _ := io.ReadAll(resp.Body)
-		return "", fmt.Errorf("create upload: status %d", resp.StatusCode, string(rt))
+	if err := fu.gzipRefused(resp, gzipped); err != nil {
+		return nil, err
 	}
-
-	var body struct {
-		UploadId string `json:"uploadId"`
+	if resp.StatusCode == http.StatusNotFound || resp.StatusCode == http.StatusGone {
+		// The session is gone; retrying won't bring it back.
+		return nil, backoff.Permanent(&statusError{op: "probe", status: resp.StatusCode})
 	}
-	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
-		return "", err
+	if resp.StatusCode != http.StatusOK {
+		return nil, &statusError{op: "probe", status: resp.StatusCode}
 	}
-	return body.UploadId, nil
-}
 
-func (fu *FileUploader) processChunk(buf []byte, partNumber int, uploadID string) (string, error) {
-	etag := generateETag(buf)
-	exists, err := fu.checkIfChunkExists(etag, uploadID)
+	var respJSON struct {
+		Data struct {
+			Results json.RawMessage `json:"results"`
+		} `json:"data"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&respJSON); err != nil {
+		return nil, err
+	}
+	results, err := parseProbeResults(respJSON.Data.Results, fu.HashAlgorithm)
 	if err != nil {
-		return "", err
+		return nil, backoff.Permanent(err)
 	}
-	if !exists {
-		if err := fu.uploadChunk(etag, buf, partNumber, uploadID); err != nil {
-			return "", err
-		}
+	exists := make(map[string]bool, len(etags))
+	for _, etag := range etags {
+		exists[etag] = results[fu.HashAlgorithm+"-"+etag]
 	}
-	return etag, nil
+	return exists, nil
 }
 
-func (fu *FileUploader) checkIfChunkExists(etag, uploadID string) (bool, error) {
-	var exists bool
-	op := func() error {
-		url := fmt.Sprintf("%s/api/upload/%s/chunk/probe?uploadId=%s",
-			fu.BaseURL, fu.IssueKey, uploadID)
-		payload := map[string]interface{}{
-			"chunks": getChunksJSON([]string{etag}),
+// parseProbeResults reads the results of a probe response into a set of
+// "<algorithm>-<etag>" keys of the chunks the server has. API versions
+// differ in its shape: most answer a map keyed that way,
+//
+//	{"sha256-<etag>": {"exists": true}, ...}
+//
+// others a list, where the hash may lack the algorithm prefix:
+//
+//	[{"hash": "sha256-<etag>", "exists": true}, ...]
+//
+// Any other shape is an error rather than every chunk reading as missing.
+func parseProbeResults(raw json.RawMessage, algorithm string) (map[string]bool, error) {
+	type result struct {
+		Hash   string `json:"hash"`
+		Exists bool   `json:"exists"`
+	}
+	exists := map[string]bool{}
+	if len(raw) == 0 {
+		return exists, nil
+	}
+	var byKey map[string]result
+	if err := json.Unmarshal(raw, &byKey); err == nil {
+		for key, r := range byKey {
+			exists[key] = r.Exists
 		}
-		body, _ := json.Marshal(payload)
+		return exists, nil
+	}
+	var list []result
+	if err := json.Unmarshal(raw, &list); err != nil {
+		return nil, fmt.Errorf("probe: results are neither a map nor a list of {hash, exists}: %.100s", raw)
+	}
+	for _, r := range list {
+		key := r.Hash
+		if !strings.HasPrefix(key, algorithm+"-") {
+			key = algorithm + "-" + key
+		}
+		exists[key] = exists[key] || r.Exists
+	}
+	return exists, nil
+}
 
-		req, _ := http.NewRequest("POST", url, bytes.NewReader(body))
-		req.SetBasicAuth(fu.User, fu.Token)
-		req.Header.Set("Content-Type", "application/json")
+// verifyProbeBatch is how many ETags verifyParts sends per probe request.
+const verifyProbeBatch = 500
 
-		resp, err := fu.Client.Do(req)
+// verifyParts probes every part before finalize and fails, naming the
+// missing parts, unless the server has all of them. It catches a chunk
+// upload that was acknowledged but not persisted.
+func (fu *FileUploader) verifyParts(ctx context.Context, etags []string, uploadID string) error {
+	var missing []string
+	for start := 0; start < len(etags); start += verifyProbeBatch {
+		batch := etags[start:min(start+verifyProbeBatch, len(etags))]
+		exists, err := fu.probeChunks(ctx, batch, uploadID)
 		if err != nil {
-			return err
+			return fmt.Errorf("verifying parts: %w", err)
 		}
-		defer resp.Body.Close()
-
-		if resp.StatusCode == 401 {
-			return backoff.Permanent(fmt.Errorf("authentication failed"))
+		for i, etag := range batch {
+			if !exists[etag] {
+				missing = append(missing, strconv.Itoa(start+i+1))
+			}
 		}
-		if resp.StatusCode != http.StatusOK {
-			return fmt.Errorf("probe status %d", resp.StatusCode)
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("server has %d of %d parts; missing parts %s",
+			len(etags)-len(missing), len(etags), strings.Join(missing, ","))
+	}
+	fu.debugf("Server has all %d parts", len(etags))
+	return nil
+}
+
+// probeFirst hashes every part of the range with HashWorkers readers and
+// asks the server, in batches, which of them it already holds, so the upload
+// can skip those and say up front how much is left. It costs a full read of
+// the range before the first byte is sent. The result maps part numbers to
+// their ETags.
+func (fu *FileUploader) probeFirst(ctx context.Context, r io.ReaderAt, offset, size, blockSize int64, uploadID string) (map[int]string, error) {
+	parts := int((size + blockSize - 1) / blockSize)
+	etags := make([]string, parts)
+	fu.debugf("Hashing %d parts before probing", parts)
+	hctx, cancel := context.WithCancelCause(ctx)
+	defer cancel(nil)
+	next := make(chan int)
+	var wg sync.WaitGroup
+	for i := 0; i < max(fu.HashWorkers, 1); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			buf := make([]byte, blockSize)
+			for i := range next {
+				pos := offset + int64(i)*blockSize
+				start := time.Now()
+				n, err := r.ReadAt(buf[:min(blockSize, offset+size-pos)], pos)
+				since(&fu.work.read, start)
+				if int64(n) < min(blockSize, offset+size-pos) {
+					if err == nil || err == io.EOF {
+						err = errTruncated
+					}
+					cancel(fmt.Errorf("%w at offset %d: %w", errSourceRead, pos+int64(n), err))
+					continue
+				}
+				start = time.Now()
+				etags[i] = generateETag(fu.HashAlgorithm, buf[:n])
+				since(&fu.work.hash, start)
+			}
+		}()
+	}
+	for i := 0; i < parts && hctx.Err() == nil; i++ {
+		select {
+		case next <- i:
+		case <-hctx.Done():
 		}
+	}
+	close(next)
+	wg.Wait()
+	if cause := context.Cause(hctx); cause != nil {
+		return nil, cause
+	}
 
-		var respJSON struct {
-			Data struct {
-				Results map[string]struct {
-					Exists bool `json:"exists"`
-				} `json:"results"`
-			} `json:"data"`
+	present := map[int]string{}
+	for start := 0; start < parts; start += verifyProbeBatch {
+		batch := etags[start:min(start+verifyProbeBatch, parts)]
+		exists, err := fu.probeChunks(ctx, batch, uploadID)
+		if err != nil {
+			return nil, fmt.Errorf("probing parts: %w", err)
 		}
-		if err := json.NewDecoder(resp.Body).Decode(&respJSON); err != nil {
-			return err
+		for i, etag := range batch {
+			if exists[etag] {
+				present[start+i+1] = etag
+			}
 		}
-		// JSON key is "sha256-"+etag
-		key := "sha256-" + etag
-		exists = respJSON.Data.Results[key].Exists
-		return nil
 	}
+	return present, nil
+}
 
-	backoffCfg := backoff.NewExponentialBackOff()
-	if err := backoff.Retry(op, backoffCfg); err != nil {
-		return false, err
+// percentOf is n as a whole percentage of total, rounded down.
+func percentOf(n, total int64) int64 {
+	if total == 0 {
+		return 100
 	}
-	return exists, nil
+	return n * 100 / total
 }
 
-func (fu *FileUploader) uploadChunk(etag string, chunk []byte, partNumber int, uploadID string) error {
-	op := func() error {
-		url := fmt.Sprintf("%s/api/upload/%s/chunk/%s?uploadId=%s&partNumber=%d",
-			fu.BaseURL, fu.IssueKey, etag, uploadID, partNumber)
+// uploadChunk uploads one part and reports how many attempts it took.
+// Errors are *chunkError, carrying the attempt that failed last.
+func (fu *FileUploader) uploadChunk(ctx context.Context, etag string, chunk []byte, span chunkSpan, uploadID string) (int, error) {
+	partNumber := span.Part
+	// The multipart body (and so its boundary) is built once, so every retry
+	// sends identical bytes and the checksum header stays valid.
+	buf := &bytes.Buffer{}
+	writer := multipart.NewWriter(buf)
+	part, _ := writer.CreateFormFile("chunk", fu.attachmentName())
+	io.Copy(part, bytes.NewReader(chunk))
+	writer.Close()
+	body := buf.Bytes()
+	sumHeader, sumValue := chunkChecksum(fu.ChunkChecksum, body)
 
-		buf := &bytes.Buffer{}
-		writer := multipart.NewWriter(buf)
-		part, _ := writer.CreateFormFile("chunk", filepath.Base(fu.FilePath))
-		io.Copy(part, bytes.NewReader(chunk))
-		writer.Close()
+	url := fu.endpoint(fu.Paths.Chunk, "{uploadId}", uploadID,
+		"{etag}", etag, "{partNumber}", strconv.Itoa(partNumber))
+	resumable := fu.ResumableChunks > 0 && int64(len(chunk)) >= fu.ResumableChunks
+	attempts := 0
+	attempt := func() error {
+		attempts++
+		if d, why, err := fu.Pacer.Wait(ctx); err != nil {
+			return backoff.Permanent(err)
+		} else if d > 0 {
+			fu.debugf("Upload of %s held %s by %s", span, d.Round(time.Millisecond), why)
+		}
+		if resumable && !fu.rangesRefused.Load() {
+			return fu.putChunkRange(ctx, url, chunk, span, attempts > 1)
+		}
 
-		req, _ := http.NewRequest("POST", url, buf)
-		req.SetBasicAuth(fu.User, fu.Token)
+		req, _ := http.NewRequestWithContext(ctx, "POST", url, bytes.NewReader(body))
 		req.Header.Set("Content-Type", writer.FormDataContentType())
+		if sumHeader != "" {
+			req.Header.Set(sumHeader, sumValue)
+		}
 
-		resp, err := fu.Client.Do(req)
+		if err := fu.Throttle.Wait(ctx, len(body)); err != nil {
+			return backoff.Permanent(err)
+		}
+		resp, tok, err := fu.do(req)
 		if err != nil {
 			return err
 		}
 		defer resp.Body.Close()
 
 		if resp.StatusCode == 401 {
-			return backoff.Permanent(fmt.Errorf("authentication failed"))
+			return fu.unauthorized(tok)
+		}
+		if resp.StatusCode == http.StatusTooManyRequests {
+			if rate, ok := fu.Throttle.Decrease(); ok {
+				fu.debugf("Server returned 429; send rate lowered to % .1f/s", decor.SizeB1024(int64(rate)))
+			}
 		}
 		if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusCreated {
-			return fmt.Errorf("upload chunk status %d", resp.StatusCode)
+			return fu.chunkStatusError(resp, span)
+		}
+		if fu.Throttle.Increase(len(body)) {
+			fu.debugf("Link capacity %s", fu.Throttle.describeCapacity())
+		}
+		return nil
+	}
+	// The health check behind the circuit breaker is an empty probe; any
+	// answer short of a 5xx means the service is up.
+	health := func(ctx context.Context) error {
+		if _, err := fu.probeOnce(ctx, []string{}, uploadID); systemicFailure(err) {
+			return err
+		}
+		return nil
+	}
+	op := func() error {
+		if err := fu.Breaker.Wait(ctx, health, func(timeout time.Duration) backoff.BackOff {
+			return fu.boundedRetryPolicy(ctx, timeout, 0, 0)
+		}); err != nil {
+			return backoff.Permanent(err)
+		}
+		err := attempt()
+		fu.Breaker.Record(partNumber, attempts == 1, err)
+		return err
+	}
+
+	// The progress bar shows the part as retrying while it backs off.
+	notify := func(err error, d time.Duration) {
+		fu.debugf("Upload of %s, attempt %d, failed: %v; retrying in %s", span, attempts, err, d.Round(time.Millisecond))
+		fu.retries.Wait(partNumber, attempts+1, d)
+		fu.retried.Add(1)
+	}
+	defer fu.retries.Done(partNumber)
+
+	if err := backoff.RetryNotify(op, fu.retryPolicy(ctx), notify); err != nil {
+		return attempts, &chunkError{chunkSpan: span, Attempts: attempts, err: err}
+	}
+	return attempts, nil
+}
+
+// putChunkRange sends a chunk as a raw PUT carrying Content-Range, the
+// protocol -resumable-chunks uses. On a retry it first asks the server how
+// much of the chunk it holds (an empty PUT with "Content-Range: bytes */N",
+// answered with 308 and a Range header) and sends only the rest. A server
+// that doesn't answer the protocol is remembered in rangesRefused and the
+// retry falls back to the multipart POST.
+func (fu *FileUploader) putChunkRange(ctx context.Context, url string, chunk []byte, span chunkSpan, retry bool) error {
+	total := len(chunk)
+	from := 0
+	if retry {
+		req, _ := http.NewRequestWithContext(ctx, "PUT", url, nil)
+		req.Header.Set("Content-Range", fmt.Sprintf("bytes */%d", total))
+		resp, tok, err := fu.do(req)
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+		switch resp.StatusCode {
+		case http.StatusOK, http.StatusCreated:
+			return nil
+		case http.StatusPermanentRedirect:
+			from = committedBytes(resp.Header.Get("Range"))
+			if from >= total {
+				return nil
+			}
+			if from > 0 {
+				fu.debugf("Resuming the upload of %s at byte %d of %d", span, from, total)
+			}
+		case http.StatusUnauthorized:
+			return fu.unauthorized(tok)
+		default:
+			return fu.refuseRanges(resp.StatusCode)
+		}
+	}
+
+	req, _ := http.NewRequestWithContext(ctx, "PUT", url, bytes.NewReader(chunk[from:]))
+	req.Header.Set("Content-Type", "application/octet-stream")
+	req.Header.Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", from, total-1, total))
+	if err := fu.Throttle.Wait(ctx, total-from); err != nil {
+		return backoff.Permanent(err)
+	}
+	resp, tok, err := fu.do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK, http.StatusCreated:
+		if fu.Throttle.Increase(total - from) {
+			fu.debugf("Link capacity %s", fu.Throttle.describeCapacity())
 		}
 		return nil
+	case http.StatusPermanentRedirect:
+		// Stored part of it; the retry asks how much.
+		return fmt.Errorf("upload chunk: server stored %d of %d bytes", committedBytes(resp.Header.Get("Range")), total)
+	case http.StatusUnauthorized:
+		return fu.unauthorized(tok)
+	case http.StatusTooManyRequests:
+		if rate, ok := fu.Throttle.Decrease(); ok {
+			fu.debugf("Server returned 429; send rate lowered to % .1f/s", decor.SizeB1024(int64(rate)))
+		}
+		return &statusError{op: "upload chunk", status: resp.StatusCode}
+	case http.StatusMethodNotAllowed, http.StatusNotImplemented, http.StatusRequestedRangeNotSatisfiable:
+		return fu.refuseRanges(resp.StatusCode)
+	}
+	return fu.chunkStatusError(resp, span)
+}
+
+// chunkStatusError turns a failed chunk upload response into its error, or
+// into success when the server says the session is already complete: the
+// chunk is then part of a finalized file, for instance after another run
+// on the same resume state got there first. A 413 fails for good: the same
+// chunk would only be refused again.
+func (fu *FileUploader) chunkStatusError(resp *http.Response, span chunkSpan) error {
+	if resp.StatusCode == http.StatusRequestEntityTooLarge {
+		return backoff.Permanent(fmt.Errorf("%w: a chunk of % .1f was refused with status 413; "+
+			"the server's limit appears to be lower, retry with a smaller -block-size",
+			errChunkTooLarge, decor.SizeB1024(int64(span.Size))))
+	}
+	if resp.StatusCode >= 400 && resp.StatusCode < 500 {
+		data, _ := io.ReadAll(io.LimitReader(resp.Body, 64<<10))
+		if alreadyCompleted(data) {
+			fu.debugf("Upload of %s answered with status %d: upload already completed", span, resp.StatusCode)
+			return nil
+		}
 	}
+	return &statusError{op: "upload chunk", status: resp.StatusCode}
+}
+
+// refuseRanges switches -resumable-chunks off for the rest of the run.
+func (fu *FileUploader) refuseRanges(status int) error {
+	if !fu.rangesRefused.Swap(true) {
+		fu.debugf("Server doesn't support ranged chunk uploads (status %d); using multipart uploads", status)
+	}
+	return &statusError{op: "upload chunk", status: status}
+}
 
-	backoffCfg := backoff.NewExponentialBackOff()
-	return backoff.Retry(op, backoffCfg)
+// committedBytes parses a "bytes=0-N" Range header into N+1, the number of
+// bytes the server holds. A missing or unparsable header means none.
+func committedBytes(h string) int {
+	_, last, ok := strings.Cut(strings.TrimPrefix(h, "bytes="), "-")
+	if !ok {
+		return 0
+	}
+	n, err := strconv.Atoi(last)
+	if err != nil {
+		return 0
+	}
+	return n + 1
 }
 
-func (fu *FileUploader) createFileChunked(etags []string, uploadID string) error {
+func (fu *FileUploader) createFileChunked(ctx context.Context, etags []string, uploadID string) error {
+	fu.IdempotencyKey = finalizeIdempotencyKey(uploadID, etags)
+	fu.finalizeStatus = ""
+	fu.debugf("Finalizing %s with Idempotency-Key %s", uploadID, fu.IdempotencyKey)
 	op := func() error {
-		url := fmt.Sprintf("%s/api/upload/%s/file/chunked?uploadId=%s",
-			fu.BaseURL, fu.IssueKey, uploadID)
+		url := fu.endpoint(fu.Paths.Finalize, "{uploadId}", uploadID)
 
 		payload := map[string]interface{}{
 			"chunks":   getChunksJSON(etags),
-			"name":     filepath.Base(fu.FilePath),
-			"mimeType": mime.TypeByExtension(filepath.Ext(fu.FilePath)),
+			"name":     fu.attachmentName(),
+			"mimeType": fu.contentType(),
+		}
+		strict := fu.StrictFinalize && !fu.strictFinalizeRejected.Load()
+		if strict {
+			var size int64
+			for _, et := range etags {
+				size += etagSize(et)
+			}
+			payload["size"], payload["partCount"] = size, len(etags)
+		}
+		declared := fu.DeclareHash && !fu.declareHashRejected.Load() && fu.SHA256 != ""
+		if declared {
+			payload["contentHash"] = "sha256-" + fu.SHA256
+		}
+		body, gzipped, err := fu.encodeJSON(payload)
+		if err != nil {
+			return backoff.Permanent(err)
 		}
-		body, _ := json.Marshal(payload)
 
-		req, _ := http.NewRequest("POST", url, bytes.NewReader(body))
-		req.SetBasicAuth(fu.User, fu.Token)
+		req, _ := http.NewRequestWithContext(ctx, "POST", url, bytes.NewReader(body))
 		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Idempotency-Key", fu.IdempotencyKey)
+		if gzipped {
+			req.Header.Set("Content-Encoding", "gzip")
+		}
 
-		resp, err := fu.Client.Do(req)
+		resp, tok, err := fu.do(req)
 		if err != nil {
 			return err
 		}
 		defer resp.Body.Close()
 
 		if resp.StatusCode == 401 {
-			return backoff.Permanent(fmt.Errorf("authentication failed"))
+			return fu.unauthorized(tok)
 		}
-		if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusCreated {
-			return fmt.Errorf("finalize status %d", resp.StatusCode)
+		if err := fu.gzipRefused(resp, gzipped); err != nil {
+			return err
+		}
+		switch resp.StatusCode {
+		case http.StatusOK, http.StatusCreated:
+		case http.StatusAccepted:
+			// Assembled in the background; finalizing again won't hurry it.
+			if err := fu.awaitAssembly(ctx, uploadID, resp); err != nil {
+				return backoff.Permanent(err)
+			}
+			return nil
+		case http.StatusBadRequest, http.StatusConflict, http.StatusGone, http.StatusUnprocessableEntity:
+			// A retry whose first attempt did go through, or another run
+			// that finalized the same session, is a success after all.
+			data, _ := io.ReadAll(io.LimitReader(resp.Body, 64<<10))
+			// A session that another file was finalized in may report
+			// itself completed; that is no success for this file.
+			if fu.sharedSession {
+				return backoff.Permanent(fmt.Errorf("%w: status %d: %s", errSharedSessionRefused, resp.StatusCode, data))
+			}
+			if alreadyCompleted(data) {
+				return backoff.Permanent(fu.adoptCompletedUpload(ctx, uploadID, data))
+			}
+			if resp.StatusCode == http.StatusGone {
+				return backoff.Permanent(&statusError{op: "finalize", status: resp.StatusCode, body: string(data)})
+			}
+			if strict && resp.StatusCode == http.StatusBadRequest && mentionsStrictFields(data) {
+				fu.strictFinalizeRejected.Store(true)
+				ui.Warnf("%s refused size and partCount in the finalize request; finalizing without them (-strict-finalize=false skips them)",
+					fu.BaseURL)
+				return &statusError{op: "finalize (size and partCount refused)", status: resp.StatusCode}
+			}
+			if declared && resp.StatusCode == http.StatusBadRequest && bytes.Contains(bytes.ToLower(data), []byte("contenthash")) {
+				fu.declareHashRejected.Store(true)
+				ui.Warnf("%s refused contentHash in the finalize request; finalizing without it (drop -declare-hash to skip it)",
+					fu.BaseURL)
+				return &statusError{op: "finalize (contentHash refused)", status: resp.StatusCode}
+			}
+			// Retrying the same body won't help; see finalizeRejectedError.
+			return backoff.Permanent(&finalizeRejectedError{status: resp.StatusCode, body: string(data)})
+		default:
+			return &statusError{op: "finalize", status: resp.StatusCode}
+		}
+		// Older servers answer with an empty body, so this is best-effort.
+		if data, err := io.ReadAll(resp.Body); err == nil {
+			fu.Attachment = parseFinalizeResponse(data)
+		}
+		if fu.sharedSession && fu.Attachment != nil && fu.Sessions.Finalized(fu.Attachment.ID) {
+			return backoff.Permanent(fmt.Errorf("%w: the server answered with the attachment of an earlier file, %s",
+				errSharedSessionRefused, fu.Attachment.ID))
+		}
+		fu.finalizeStatus = finalizeCompleted
+		return nil
+	}
+
+	return backoff.Retry(op, fu.retryPolicy(ctx))
+}
+
+// mentionsStrictFields recognises a 400 about the fields StrictFinalize
+// adds: one naming partCount, or the word "size" along with wording for an
+// unexpected field. A size mismatch between chunks isn't one.
+func mentionsStrictFields(body []byte) bool {
+	text := strings.ToLower(string(body))
+	if strings.Contains(text, "partcount") {
+		return true
+	}
+	words := strings.FieldsFunc(text, func(r rune) bool { return !unicode.IsLetter(r) })
+	if !slices.Contains(words, "size") {
+		return false
+	}
+	for _, w := range []string{"unknown", "unrecognized", "unrecognised", "unexpected", "field", "property", "allowed"} {
+		if slices.Contains(words, w) {
+			return true
 		}
+	}
+	return false
+}
+
+// adoptCompletedUpload accepts a finalize the server says already happened.
+// The attachment is taken from the response if it describes one, otherwise
+// looked up when a lookup path template is configured; a lookup that finds
+// nothing fails the upload rather than reporting an attachment that may not
+// exist. It returns nil on success.
+func (fu *FileUploader) adoptCompletedUpload(ctx context.Context, uploadID string, body []byte) error {
+	fu.debugf("Server reports upload %s as already completed", uploadID)
+	fu.finalizeStatus = finalizeAlreadyCompleted
+	if info := parseFinalizeResponse(body); info != nil {
+		fu.Attachment = info
 		return nil
 	}
+	if fu.Paths.Lookup == "" {
+		fu.debugf("No lookup path template; attachment details unavailable")
+		return nil
+	}
+	req, _ := http.NewRequestWithContext(ctx, "GET", fu.endpoint(fu.Paths.Lookup, "{uploadId}", uploadID), nil)
+	resp, _, err := fu.do(req)
+	if err != nil {
+		return fmt.Errorf("looking up completed upload: %w", err)
+	}
+	defer resp.Body.Close()
+	data, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK {
+		return &statusError{op: "lookup completed upload", status: resp.StatusCode, body: string(data)}
+	}
+	if fu.Attachment = parseFinalizeResponse(data); fu.Attachment == nil {
+		return fmt.Errorf("server reported upload %s as completed, but the lookup returned no attachment", uploadID)
+	}
+	return nil
+}
+
+// finalizeRejectedError is a finalize the server refused outright, which is
+// what it does when a listed chunk is missing. body is its answer, which
+// may say which; see missingParts.
+type finalizeRejectedError struct {
+	status int
+	body   string
+}
 
-	backoffCfg := backoff.NewExponentialBackOff()
-	return backoff.Retry(op, backoffCfg)
+func (e *finalizeRejectedError) Error() string {
+	return fmt.Sprintf("finalize rejected: status %d", e.status)
 }
 
 // Helpers
 
-// getBlockSize mirrors Python's FileService.get_block_size exactly.
+// checkParts refuses to finalize from an incomplete part list: the sorted
+// chunks must be numbered 1..N without gaps or duplicates, and the sizes in
+// their ETags must add up to the bytes read, or the server would assemble a
+// truncated file.
+func checkParts(chunks []chunkResult, size int64) error {
+	var missing, dup []string
+	var total int64
+	want := 1
+	for _, c := range chunks {
+		switch {
+		case c.Index < want:
+			dup = append(dup, strconv.Itoa(c.Index))
+			continue
+		case c.Index > want:
+			if c.Index-1 == want {
+				missing = append(missing, strconv.Itoa(want))
+			} else {
+				missing = append(missing, fmt.Sprintf("%d-%d", want, c.Index-1))
+			}
+		}
+		want = c.Index + 1
+		total += etagSize(c.ETag)
+	}
+	var problems []string
+	if len(missing) > 0 {
+		problems = append(problems, "missing parts "+strings.Join(missing, ","))
+	}
+	if len(dup) > 0 {
+		problems = append(problems, "duplicate parts "+strings.Join(dup, ","))
+	}
+	if len(problems) == 0 && total != size {
+		problems = append(problems, fmt.Sprintf("parts add up to %d bytes, expected %d", total, size))
+	}
+	if len(problems) > 0 {
+		return fmt.Errorf("refusing to finalize: %s", strings.Join(problems, "; "))
+	}
+	return nil
+}
+
+// getBlockSize is the default block-size policy. It mirrors Python's
+// FileService.get_block_size exactly.
 func getBlockSize(fileSize int64) int64 {
 	mb := float64(fileSize) / (1024 * 1024)
 	blocks := math.Ceil(mb / 10000)
@@ -380,13 +3087,59 @@ func getBlockSize(fileSize int64) int64 {
 	return int64(cnt * 1024 * 1024)
 }
 
-// generateETag mirrors hashlib.sha256 + "-" + len(buf)
-func generateETag(buf []byte) string {
-	sum := sha256.Sum256(buf)
-	h := hex.EncodeToString(sum[:])
+// constantBlockSize is a block-size policy that ignores the file size.
+func constantBlockSize(n int64) func(int64) int64 {
+	return func(int64) int64 { return n }
+}
+
+// generateETag mirrors hashlib.sha256 + "-" + len(buf), with the hash
+// algorithm selectable ("sha256" or "sha512").
+func generateETag(alg string, buf []byte) string {
+	var h string
+	if alg == "sha512" {
+		sum := sha512.Sum512(buf)
+		h = hex.EncodeToString(sum[:])
+	} else {
+		sum := sha256.Sum256(buf)
+		h = hex.EncodeToString(sum[:])
+	}
 	return fmt.Sprintf("%s-%d", h, len(buf))
 }
 
+// finalizeIdempotencyKey derives the finalize request's Idempotency-Key from
+// the session and the ordered chunk ETags (which together fingerprint the
+// whole file), so a finalize repeated after a lost response or a process
+// restart carries the same key and the server can return the original result.
+func finalizeIdempotencyKey(uploadID string, etags []string) string {
+	h := sha256.New()
+	io.WriteString(h, uploadID)
+	for _, et := range etags {
+		io.WriteString(h, "\n"+et)
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// chunkChecksum returns the header carrying the digest of a chunk request
+// body for the given -chunk-checksum kind, or "" for none.
+func chunkChecksum(kind string, body []byte) (string, string) {
+	switch kind {
+	case "md5":
+		sum := md5.Sum(body)
+		return "Content-MD5", base64.StdEncoding.EncodeToString(sum[:])
+	case "sha256":
+		sum := sha256.Sum256(body)
+		return "X-Checksum-Sha256", base64.StdEncoding.EncodeToString(sum[:])
+	}
+	return "", ""
+}
+
+// etagSize returns the byte count encoded in an ETag's "-<size>" suffix.
+func etagSize(etag string) int64 {
+	_, sz, _ := strings.Cut(etag, "-")
+	n, _ := strconv.ParseInt(sz, 10, 64)
+	return n
+}
+
 // getChunksJSON builds the exact JSON body from etag strings.
 func getChunksJSON(etags []string) []map[string]string {
 	out := make([]map[string]string, len(etags))
@@ -0,0 +1,1315 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	backoff "github.com/cenkalti/backoff/v4"
+)
+
+// newTestUploader returns an uploader for path on baseURL.
+func newTestUploader(t testing.TB, path, baseURL string) *FileUploader {
+	t.Helper()
+	fu := NewFileUploader(path, "TEST-1", "user", "token", baseURL)
+	fu.Backoff = func() backoff.BackOff { return backoff.WithMaxRetries(&backoff.ZeroBackOff{}, 3) }
+	t.Cleanup(func() { fu.Close() })
+	return fu
+}
+
+// writeTestFile writes size bytes of seeded random data to a temporary file
+// and returns its path and content.
+func writeTestFile(t testing.TB, size int64) (string, []byte) {
+	t.Helper()
+	data := make([]byte, size)
+	rand.New(rand.NewSource(size)).Read(data)
+	path := filepath.Join(t.TempDir(), "data.bin")
+	if err := os.WriteFile(path, data, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path, data
+}
+
+// partETags are the ETags of data cut into blockSize parts, in part order.
+func partETags(data []byte, blockSize int) []string {
+	var etags []string
+	for off := 0; off < len(data); off += blockSize {
+		etags = append(etags, generateETag("sha256", data[off:min(off+blockSize, len(data))]))
+	}
+	return etags
+}
+
+// finalizeRecorder is a fake transfer server that claims to already have the
+// chunks in present, holds every chunk upload for a random moment so the
+// workers finish out of order, and records the finalize bodies and aborted
+// sessions.
+type finalizeRecorder struct {
+	present map[string]bool
+
+	mu        sync.Mutex
+	uploaded  []string
+	finalizes []chunkList
+	names     []string // attachment name of each finalize
+	aborted   []string
+}
+
+// chunkList is the chunks array of a probe or finalize body.
+type chunkList struct {
+	Chunks []chunkRef `json:"chunks"`
+}
+
+type chunkRef struct {
+	Hash string `json:"hash"`
+	Size string `json:"size"`
+}
+
+func (f *finalizeRecorder) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch {
+	case r.Method == http.MethodDelete:
+		f.mu.Lock()
+		f.aborted = append(f.aborted, r.URL.Query().Get("uploadId"))
+		f.mu.Unlock()
+	case strings.HasSuffix(r.URL.Path, "/create"):
+		w.WriteHeader(http.StatusCreated)
+		io.WriteString(w, `{"uploadId":"u1"}`)
+	case strings.HasSuffix(r.URL.Path, "/chunk/probe"):
+		var body chunkList
+		json.NewDecoder(r.Body).Decode(&body)
+		results := map[string]map[string]bool{}
+		for _, c := range body.Chunks {
+			etag := c.Hash + "-" + c.Size
+			results["sha256-"+etag] = map[string]bool{"exists": f.present[etag]}
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"data": map[string]interface{}{"results": results}})
+	case strings.Contains(r.URL.Path, "/chunk/"):
+		io.Copy(io.Discard, r.Body)
+		time.Sleep(time.Duration(rand.Intn(20)) * time.Millisecond)
+		f.mu.Lock()
+		f.uploaded = append(f.uploaded, filepath.Base(r.URL.Path))
+		f.mu.Unlock()
+		w.WriteHeader(http.StatusCreated)
+	case strings.HasSuffix(r.URL.Path, "/file/chunked"):
+		var body struct {
+			chunkList
+			Name string `json:"name"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		f.mu.Lock()
+		f.finalizes = append(f.finalizes, body.chunkList)
+		f.names = append(f.names, body.Name)
+		f.mu.Unlock()
+		io.WriteString(w, `{"data":{"id":"att-1","name":"data.bin"}}`)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// expiringToken answers 401 to every request after create unless it carries
+// the token fresh, and passes the rest to next.
+func expiringToken(fresh string, next http.Handler) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if _, tok, _ := r.BasicAuth(); tok != fresh && !strings.HasSuffix(r.URL.Path, "/create") {
+			io.Copy(io.Discard, r.Body)
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r)
+	}
+}
+
+// TestTokenRefresh checks that a 401 mid-run calls RefreshToken and retries
+// with the new token, and that without a new token the run fails.
+func TestTokenRefresh(t *testing.T) {
+	tests := []struct {
+		name      string
+		refresh   func() (string, error)
+		refreshes int
+		wantErr   bool
+	}{
+		{"no refresh hook", nil, 0, true},
+		{"new token", func() (string, error) { return "fresh", nil }, 1, false},
+		{"same token again", func() (string, error) { return "token", nil }, 1, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path, _ := writeTestFile(t, 1000)
+			rec := &finalizeRecorder{}
+			srv := httptest.NewServer(expiringToken("fresh", rec))
+			defer srv.Close()
+
+			fu := newTestUploader(t, path, srv.URL)
+			refreshes := 0
+			if tt.refresh != nil {
+				fu.RefreshToken = func() (string, error) {
+					refreshes++
+					return tt.refresh()
+				}
+			}
+			_, err := fu.RunContext(t.Context())
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("got error %v, want error %v", err, tt.wantErr)
+			}
+			if refreshes != tt.refreshes {
+				t.Errorf("RefreshToken called %d times, want %d", refreshes, tt.refreshes)
+			}
+			if wantFinalizes := map[bool]int{false: 1, true: 0}[tt.wantErr]; len(rec.finalizes) != wantFinalizes {
+				t.Errorf("got %d finalize requests, want %d", len(rec.finalizes), wantFinalizes)
+			}
+		})
+	}
+}
+
+// TestReadData checks that every chunk is read whole and the last, short
+// one finalized exactly once.
+func TestReadData(t *testing.T) {
+	const blockSize = minBlockSize
+	for _, size := range []int64{3*blockSize + 1234, 1234} {
+		t.Run(fmt.Sprint(size), func(t *testing.T) {
+			path, data := writeTestFile(t, size)
+			srv := &finalizeRecorder{}
+			ts := httptest.NewServer(srv)
+			defer ts.Close()
+
+			fu := newTestUploader(t, path, ts.URL)
+			if _, err := fu.RunContext(t.Context()); err != nil {
+				t.Fatal(err)
+			}
+			etags := partETags(data, blockSize)
+			if len(srv.finalizes) != 1 || len(srv.finalizes[0].Chunks) != len(etags) {
+				t.Fatalf("finalize requests %+v, want one listing %d chunks", srv.finalizes, len(etags))
+			}
+			for i, c := range srv.finalizes[0].Chunks {
+				if got := c.Hash + "-" + c.Size; got != etags[i] {
+					t.Errorf("finalize chunk %d is %s, want %s", i, got, etags[i])
+				}
+			}
+			if len(srv.uploaded) != len(etags) {
+				t.Errorf("uploaded %d chunks, want %d", len(srv.uploaded), len(etags))
+			}
+		})
+	}
+}
+
+// eofReaderAt serves its bytes and returns io.EOF together with the last of
+// them rather than on a call of its own, as io.ReaderAt allows.
+type eofReaderAt []byte
+
+func (d eofReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	if off >= int64(len(d)) {
+		return 0, io.EOF
+	}
+	n := copy(p, d[off:])
+	if off+int64(n) == int64(len(d)) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+// TestReadDataWithEOF checks that the last chunk is finalized exactly once
+// when the source returns it together with io.EOF, with whole and short
+// reads and whether or not the size is a multiple of the block size.
+func TestReadDataWithEOF(t *testing.T) {
+	const blockSize = minBlockSize
+	tests := []struct {
+		name       string
+		size       int64
+		readBuffer int
+	}{
+		{"partial last chunk", 3*blockSize + 1234, 0},
+		{"exact multiple", 3 * blockSize, 0},
+		{"short reads, partial last chunk", 3*blockSize + 1234, 1<<20 + 7},
+		{"short reads, exact multiple", 3 * blockSize, 1<<20 + 7},
+		{"smaller than a block", 1234, 1000},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, data := writeTestFile(t, tt.size)
+			srv := &finalizeRecorder{}
+			ts := httptest.NewServer(srv)
+			defer ts.Close()
+
+			fu := newTestUploader(t, "data.bin", ts.URL)
+			fu.ReadBuffer = tt.readBuffer
+			res, err := fu.UploadReaderAt(t.Context(), eofReaderAt(data), tt.size, "data.bin")
+			if err != nil {
+				t.Fatal(err)
+			}
+			etags := partETags(data, blockSize)
+			if len(srv.finalizes) != 1 || len(srv.finalizes[0].Chunks) != len(etags) {
+				t.Fatalf("finalize requests %+v, want one listing %d chunks", srv.finalizes, len(etags))
+			}
+			for i, c := range srv.finalizes[0].Chunks {
+				if got := c.Hash + "-" + c.Size; got != etags[i] {
+					t.Errorf("finalize chunk %d is %s, want %s", i, got, etags[i])
+				}
+			}
+			if len(srv.uploaded) != len(etags) || res.Size != tt.size {
+				t.Errorf("uploaded %d chunks, %d bytes; want %d chunks, %d bytes", len(srv.uploaded), res.Size, len(etags), tt.size)
+			}
+		})
+	}
+}
+
+// TestChunkChecksum checks that chunk uploads carry the digest of their body
+// in the header -chunk-checksum names, and that a retry resends the same
+// body so the digest still holds.
+func TestChunkChecksum(t *testing.T) {
+	tests := []struct {
+		kind, header string
+		sum          func([]byte) []byte
+	}{
+		{"md5", "Content-MD5", func(b []byte) []byte { s := md5.Sum(b); return s[:] }},
+		{"sha256", "X-Checksum-Sha256", func(b []byte) []byte { s := sha256.Sum256(b); return s[:] }},
+		{"", "", nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.kind, func(t *testing.T) {
+			path, _ := writeTestFile(t, 1000)
+			rec := &finalizeRecorder{}
+			var bodies []string
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if !strings.Contains(r.URL.Path, "/chunk/") || strings.HasSuffix(r.URL.Path, "/probe") {
+					rec.ServeHTTP(w, r)
+					return
+				}
+				body, _ := io.ReadAll(r.Body)
+				bodies = append(bodies, string(body))
+				for _, h := range []string{"Content-MD5", "X-Checksum-Sha256"} {
+					if got := r.Header.Get(h); h != tt.header && got != "" {
+						t.Errorf("chunk sent with %s: %s", h, got)
+					}
+				}
+				if tt.header != "" {
+					if got, want := r.Header.Get(tt.header), base64.StdEncoding.EncodeToString(tt.sum(body)); got != want {
+						t.Errorf("%s is %q, want %q", tt.header, got, want)
+					}
+				}
+				// Fail the first attempt so the chunk is sent twice.
+				if len(bodies) == 1 {
+					w.WriteHeader(http.StatusInternalServerError)
+					return
+				}
+				w.WriteHeader(http.StatusCreated)
+			}))
+			defer srv.Close()
+
+			fu := newTestUploader(t, path, srv.URL)
+			fu.ChunkChecksum = tt.kind
+			if _, err := fu.RunContext(t.Context()); err != nil {
+				t.Fatal(err)
+			}
+			if len(bodies) != 2 || bodies[0] != bodies[1] {
+				t.Errorf("chunk sent %d times, identical %v; want twice with the same body", len(bodies), len(bodies) == 2 && bodies[0] == bodies[1])
+			}
+		})
+	}
+}
+
+// TestHashAlgorithm checks that chunk ETags, and the probe results looked up
+// for them, use the hash -hash-algorithm selects.
+func TestHashAlgorithm(t *testing.T) {
+	const blockSize = minBlockSize
+	for _, alg := range []string{"sha256", "sha512"} {
+		t.Run(alg, func(t *testing.T) {
+			path, data := writeTestFile(t, 2*blockSize+10)
+			var etags []string
+			for off := 0; off < len(data); off += blockSize {
+				etags = append(etags, generateETag(alg, data[off:min(off+blockSize, len(data))]))
+			}
+			if hash, _, _ := strings.Cut(etags[0], "-"); len(hash) != map[string]int{"sha256": 64, "sha512": 128}[alg] {
+				t.Fatalf("%s ETag %s has a hash of %d hex digits", alg, etags[0], len(hash))
+			}
+			rec := &finalizeRecorder{}
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if !strings.HasSuffix(r.URL.Path, "/chunk/probe") {
+					rec.ServeHTTP(w, r)
+					return
+				}
+				// Only the second part is on the server, under alg's key.
+				var body chunkList
+				json.NewDecoder(r.Body).Decode(&body)
+				results := map[string]map[string]bool{}
+				for _, c := range body.Chunks {
+					etag := c.Hash + "-" + c.Size
+					results[alg+"-"+etag] = map[string]bool{"exists": etag == etags[1]}
+				}
+				json.NewEncoder(w).Encode(map[string]interface{}{"data": map[string]interface{}{"results": results}})
+			}))
+			defer srv.Close()
+
+			fu := newTestUploader(t, path, srv.URL)
+			fu.HashAlgorithm = alg
+			if _, err := fu.RunContext(t.Context()); err != nil {
+				t.Fatal(err)
+			}
+			if len(rec.uploaded) != 2 {
+				t.Errorf("uploaded %d chunks, want 2 with the second already present", len(rec.uploaded))
+			}
+			if len(rec.finalizes) != 1 || len(rec.finalizes[0].Chunks) != len(etags) {
+				t.Fatalf("finalize requests %+v, want one listing %d chunks", rec.finalizes, len(etags))
+			}
+			for i, c := range rec.finalizes[0].Chunks {
+				if got := c.Hash + "-" + c.Size; got != etags[i] {
+					t.Errorf("finalize chunk %d is %s, want %s", i, got, etags[i])
+				}
+			}
+		})
+	}
+}
+
+// discardServer is a fake transfer server that has no chunks, takes each
+// chunk at rate bytes per second (unlimited when 0) and discards it.
+type discardServer struct {
+	rate int64
+}
+
+func (d *discardServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch {
+	case strings.HasSuffix(r.URL.Path, "/create"):
+		w.WriteHeader(http.StatusCreated)
+		io.WriteString(w, `{"uploadId":"u1"}`)
+	case strings.HasSuffix(r.URL.Path, "/chunk/probe"):
+		io.Copy(io.Discard, r.Body)
+		io.WriteString(w, `{"data":{"results":{}}}`)
+	case strings.Contains(r.URL.Path, "/chunk/"):
+		n, _ := io.Copy(io.Discard, r.Body)
+		if d.rate > 0 {
+			time.Sleep(time.Duration(n * int64(time.Second) / d.rate))
+		}
+		w.WriteHeader(http.StatusCreated)
+	default:
+		io.Copy(io.Discard, r.Body)
+		io.WriteString(w, `{"data":{"id":"att-1","name":"data.bin"}}`)
+	}
+}
+
+// benchmarkUpload uploads a benchFileSize file to srv b.N times with the
+// given workers, and reports the workers' time per phase as -timing does.
+func benchmarkUpload(b *testing.B, srv *httptest.Server, path string, concurrency, hashWorkers int) {
+	// The progress bar draws on stdout; a null device takes its place so
+	// the results stay readable.
+	null, err := os.OpenFile(os.DevNull, os.O_WRONLY, 0)
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer null.Close()
+	stdout := os.Stdout
+	os.Stdout = null
+	defer func() { os.Stdout = stdout }()
+	b.SetBytes(benchFileSize)
+	var work workTiming
+	for i := 0; i < b.N; i++ {
+		fu := newTestUploader(b, path, srv.URL)
+		fu.Concurrency = concurrency
+		fu.HashWorkers = hashWorkers
+		res, err := fu.RunContext(b.Context())
+		if err != nil {
+			b.Fatal(err)
+		}
+		work.Read += res.Work.Read
+		work.Hash += res.Work.Hash
+		work.Probe += res.Work.Probe
+		work.Send += res.Work.Send
+	}
+	for unit, d := range map[string]time.Duration{
+		"read-ms/op": work.Read, "hash-ms/op": work.Hash, "probe-ms/op": work.Probe, "send-ms/op": work.Send,
+	} {
+		b.ReportMetric(float64(d.Milliseconds())/float64(b.N), unit)
+	}
+}
+
+const (
+	benchFileSize  = 256 << 20
+	benchBlockSize = 16 << 20
+)
+
+// BenchmarkHashWorkers uploads over a 1 GiB/s link with one hashing worker
+// and with one per CPU, so hashing the next chunks overlaps with sending.
+func BenchmarkHashWorkers(b *testing.B) {
+	path, _ := writeTestFile(b, benchFileSize)
+	srv := httptest.NewServer(&discardServer{rate: 1 << 30})
+	defer srv.Close()
+	for _, workers := range []int{1, max(4, runtime.NumCPU())} {
+		b.Run(fmt.Sprintf("hash-workers=%d", workers), func(b *testing.B) {
+			benchmarkUpload(b, srv, path, 4, workers)
+		})
+	}
+}
+
+func BenchmarkGenerateETag(b *testing.B) {
+	for _, alg := range []string{"sha256", "sha512"} {
+		for _, size := range []int{minBlockSize, maxBlockSize} {
+			b.Run(fmt.Sprintf("%s/%dMiB", alg, size>>20), func(b *testing.B) {
+				buf := make([]byte, size)
+				b.SetBytes(int64(size))
+				for i := 0; i < b.N; i++ {
+					generateETag(alg, buf)
+				}
+			})
+		}
+	}
+}
+
+// BenchmarkUploadWorkers runs the worker loop against a server with no link
+// limit, so it measures the pipeline itself.
+func BenchmarkUploadWorkers(b *testing.B) {
+	path, _ := writeTestFile(b, benchFileSize)
+	srv := httptest.NewServer(&discardServer{})
+	defer srv.Close()
+	for _, concurrency := range []int{1, 4, 16} {
+		b.Run(fmt.Sprintf("concurrency=%d", concurrency), func(b *testing.B) {
+			benchmarkUpload(b, srv, path, concurrency, runtime.NumCPU())
+		})
+	}
+}
+
+// eventLog collects progress events for a test.
+type eventLog struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (l *eventLog) Write(p []byte) (int, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.buf.Write(p)
+}
+
+func (l *eventLog) Close() error { return nil }
+
+// all returns the events of type typ in the order they were written.
+func (l *eventLog) all(typ string) []map[string]interface{} {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	var evs []map[string]interface{}
+	for _, line := range strings.Split(l.buf.String(), "\n") {
+		var ev map[string]interface{}
+		if json.Unmarshal([]byte(line), &ev) == nil && ev["type"] == typ {
+			evs = append(evs, ev)
+		}
+	}
+	return evs
+}
+
+// find returns the first event of type typ.
+func (l *eventLog) find(typ string) map[string]interface{} {
+	if evs := l.all(typ); len(evs) > 0 {
+		return evs[0]
+	}
+	return nil
+}
+
+// TestProgressEvents checks the events of a run that finds one of its three
+// parts on the server, and of one that fails.
+func TestProgressEvents(t *testing.T) {
+	const blockSize = minBlockSize
+	path, data := writeTestFile(t, 2*blockSize+10)
+	etags := partETags(data, blockSize)
+	srv := &finalizeRecorder{present: map[string]bool{etags[1]: true}}
+	ts := httptest.NewServer(srv)
+	defer ts.Close()
+
+	events := &eventLog{}
+	fu := newTestUploader(t, path, ts.URL)
+	fu.Events = &eventSink{w: events}
+	if _, err := fu.RunContext(t.Context()); err != nil {
+		t.Fatal(err)
+	}
+	for _, line := range strings.Split(strings.TrimSpace(events.buf.String()), "\n") {
+		var ev map[string]interface{}
+		if err := json.Unmarshal([]byte(line), &ev); err != nil {
+			t.Fatalf("event %q: %v", line, err)
+		}
+		if ev["v"] != float64(eventsVersion) || ev["file"] != path || ev["time"] == nil {
+			t.Errorf("event %q lacks its version, file or time", line)
+		}
+	}
+	if ev := events.find("session_created"); ev == nil || ev["uploadId"] != "u1" || ev["resumed"] != false {
+		t.Errorf("session_created event %v", ev)
+	}
+	var phases []interface{}
+	for _, ev := range events.all("phase_changed") {
+		phases = append(phases, ev["phase"])
+	}
+	if fmt.Sprint(phases) != "[upload finalize]" {
+		t.Errorf("phases %v, want [upload finalize]", phases)
+	}
+	if n := len(events.all("chunk_started")); n != 3 {
+		t.Errorf("%d chunk_started events, want 3", n)
+	}
+	completed := events.all("chunk_completed")
+	if len(completed) != 3 {
+		t.Fatalf("%d chunk_completed events, want 3", len(completed))
+	}
+	for _, ev := range completed {
+		if skipped := ev["index"] == float64(2); ev["skipped"] != skipped || (ev["attempts"] == float64(0)) != skipped {
+			t.Errorf("chunk_completed event %v", ev)
+		}
+	}
+	want := map[string]interface{}{"size": float64(len(data)), "uploaded": float64(2), "skipped": float64(1), "probed": float64(1), "resumed": float64(0)}
+	if ev := events.find("run_completed"); ev == nil || ev["status"] != "success" || fmt.Sprint(ev["summary"]) != fmt.Sprint(want) {
+		t.Errorf("run_completed event %v, want success with summary %v", ev, want)
+	}
+
+	refused := httptest.NewServer(expiringToken("fresh", &finalizeRecorder{}))
+	defer refused.Close()
+	events = &eventLog{}
+	fu = newTestUploader(t, path, refused.URL)
+	fu.Events = &eventSink{w: events}
+	if _, err := fu.RunContext(t.Context()); err == nil {
+		t.Fatal("run with a refused token succeeded")
+	}
+	if ev := events.find("run_completed"); ev == nil || ev["status"] != "failed" || !strings.Contains(fmt.Sprint(ev["error"]), "authentication failed") {
+		t.Errorf("run_completed event %v, want failed with the error", ev)
+	}
+}
+
+// truncateOnCreate cuts the file at path to size once the session is
+// created, before the first chunk is read, and passes every request to next.
+func truncateOnCreate(t *testing.T, path string, size int64, next http.Handler) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasSuffix(r.URL.Path, "/create") {
+			if err := os.Truncate(path, size); err != nil {
+				t.Error(err)
+			}
+		}
+		next.ServeHTTP(w, r)
+	}
+}
+
+// TestReadErrorMidUpload checks that a source that comes up short after a
+// few chunks fails the run with the offset it stopped at, and that nothing
+// is finalized.
+func TestReadErrorMidUpload(t *testing.T) {
+	const blockSize = minBlockSize
+	path, _ := writeTestFile(t, 6*blockSize)
+	failAt := int64(2*blockSize + 1000)
+	rec := &finalizeRecorder{}
+	srv := httptest.NewServer(truncateOnCreate(t, path, failAt, rec))
+	defer srv.Close()
+
+	fu := newTestUploader(t, path, srv.URL)
+	_, err := fu.RunContext(t.Context())
+	if err == nil {
+		t.Fatal("run succeeded after the source was truncated")
+	}
+	if want := fmt.Sprintf("at offset %d", failAt); !strings.Contains(err.Error(), want) {
+		t.Errorf("error %q doesn't say %q", err, want)
+	}
+	if len(rec.finalizes) != 0 {
+		t.Errorf("got %d finalize requests after the read error, want none", len(rec.finalizes))
+	}
+}
+
+// activeTransport counts the requests started through it and those still
+// in flight.
+type activeTransport struct {
+	next             http.RoundTripper
+	started, running atomic.Int64
+}
+
+func (a *activeTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	a.started.Add(1)
+	a.running.Add(1)
+	defer a.running.Add(-1)
+	return a.next.RoundTrip(req)
+}
+
+// TestReadErrorShutdown checks that after a read error the run returns only
+// once every worker has stopped, and aborts the session unless a resume
+// file may still complete it.
+func TestReadErrorShutdown(t *testing.T) {
+	const blockSize = minBlockSize
+	for _, resume := range []bool{false, true} {
+		path, _ := writeTestFile(t, 8*blockSize)
+		rec := &finalizeRecorder{}
+		srv := httptest.NewServer(truncateOnCreate(t, path, 3*blockSize+1, rec))
+		defer srv.Close()
+
+		fu := newTestUploader(t, path, srv.URL)
+		fu.Concurrency = 4
+		fu.Paths.Abort = "/api/upload/{key}/abort?uploadId={uploadId}"
+		if resume {
+			fu.ResumeFile = filepath.Join(t.TempDir(), "upload.resume")
+		}
+		active := &activeTransport{next: fu.Client.Transport}
+		if active.next == nil {
+			active.next = http.DefaultTransport
+		}
+		fu.Client.Transport = active
+		if _, err := fu.RunContext(t.Context()); err == nil {
+			t.Fatalf("resume %v: run succeeded after the source was truncated", resume)
+		}
+		started := active.started.Load()
+		if n := active.running.Load(); n != 0 {
+			t.Errorf("resume %v: %d requests still running when the run returned", resume, n)
+		}
+		time.Sleep(50 * time.Millisecond)
+		if n := active.started.Load() - started; n != 0 {
+			t.Errorf("resume %v: %d requests started after the run returned", resume, n)
+		}
+		var want []string
+		if !resume {
+			want = []string{"u1"}
+		}
+		if got := strings.Join(rec.aborted, ","); got != strings.Join(want, ",") {
+			t.Errorf("resume %v: aborted sessions %q, want %q", resume, got, want)
+		}
+	}
+}
+
+// barResult records the state the progress bar ended in.
+type barResult struct {
+	current   int64
+	completed bool
+}
+
+func (b *barResult) done(current int64, completed bool) {
+	b.current, b.completed = current, completed
+}
+
+// TestProgressBarBytes checks that with many workers adding to the bar at
+// once it ends at exactly the file's size and completes by itself.
+func TestProgressBarBytes(t *testing.T) {
+	path, data := writeTestFile(t, 20*minBlockSize+4321)
+	srv := httptest.NewServer(&finalizeRecorder{})
+	defer srv.Close()
+
+	fu := newTestUploader(t, path, srv.URL)
+	fu.Concurrency = 16
+	var bar barResult
+	fu.barDone = bar.done
+	if _, err := fu.RunContext(t.Context()); err != nil {
+		t.Fatal(err)
+	}
+	if bar.current != int64(len(data)) || !bar.completed {
+		t.Errorf("bar ended at %d bytes, completed %v; want %d, completed", bar.current, bar.completed, len(data))
+	}
+}
+
+// TestExactMultipleSize checks that a file whose size is a multiple of the
+// block size gets no phantom last part, in the chunks read or the upload,
+// and a completed bar.
+func TestExactMultipleSize(t *testing.T) {
+	const blockSize = minBlockSize
+	tests := []struct {
+		size  int64
+		parts int
+	}{
+		{blockSize, 1},
+		{3 * blockSize, 3},
+		{3*blockSize + 1, 4},
+		{3*blockSize - 1, 3},
+	}
+	for _, tt := range tests {
+		path, _ := writeTestFile(t, tt.size)
+		rec := &finalizeRecorder{}
+		srv := httptest.NewServer(rec)
+		defer srv.Close()
+
+		fu := newTestUploader(t, path, srv.URL)
+		events := &eventLog{}
+		fu.Events = &eventSink{w: events}
+		var bar barResult
+		fu.barDone = bar.done
+		if _, err := fu.RunContext(t.Context()); err != nil {
+			t.Fatal(err)
+		}
+		if n := len(events.all("chunk_started")); n != tt.parts {
+			t.Errorf("size %d: %d chunks read, want %d", tt.size, n, tt.parts)
+		}
+		if len(rec.finalizes) != 1 || len(rec.finalizes[0].Chunks) != tt.parts || len(rec.uploaded) != tt.parts {
+			t.Errorf("size %d: finalized %+v after %d uploads; want %d parts", tt.size, rec.finalizes, len(rec.uploaded), tt.parts)
+		}
+		if bar.current != tt.size || !bar.completed {
+			t.Errorf("size %d: bar ended at %d, completed %v", tt.size, bar.current, bar.completed)
+		}
+	}
+}
+
+// failingReader yields data and then, instead of io.EOF, err.
+type failingReader struct {
+	data []byte
+	err  error
+}
+
+func (f *failingReader) Read(p []byte) (int, error) {
+	if len(f.data) == 0 {
+		return 0, f.err
+	}
+	n := copy(p, f.data)
+	f.data = f.data[n:]
+	return n, nil
+}
+
+// TestUploadReaderSizes checks the ends of a stream whose size isn't known:
+// one that is an exact multiple of the chunk size gets no empty last part,
+// an empty one is finalized with no parts, and one that fails midway fails
+// the run with the byte it stopped at, without finalizing.
+func TestUploadReaderSizes(t *testing.T) {
+	const chunkSize = minBlockSize
+	errDisk := errors.New("disk on fire")
+	tests := []struct {
+		name    string
+		size    int64
+		readErr error
+		parts   int
+	}{
+		{"exact multiple", 3 * chunkSize, nil, 3},
+		{"empty", 0, nil, 0},
+		{"read error midway", 2*chunkSize + 1000, errDisk, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := &finalizeRecorder{}
+			srv := httptest.NewServer(rec)
+			defer srv.Close()
+			_, data := writeTestFile(t, tt.size)
+			var r io.Reader = bytes.NewReader(data)
+			if tt.readErr != nil {
+				r = &failingReader{data: data, err: tt.readErr}
+			}
+
+			fu := newTestUploader(t, "", srv.URL)
+			fu.ChunkSize = chunkSize
+			var bar barResult
+			fu.barDone = bar.done
+			res, err := fu.UploadReader(t.Context(), r, "stream.bin")
+			if tt.readErr != nil {
+				if !errors.Is(err, errSourceRead) || !errors.Is(err, tt.readErr) {
+					t.Fatalf("got error %v, want a source read error wrapping %v", err, tt.readErr)
+				}
+				if want := fmt.Sprintf("at byte %d", tt.size); !strings.Contains(err.Error(), want) {
+					t.Errorf("error %q doesn't say %q", err, want)
+				}
+				if len(rec.finalizes) != 0 {
+					t.Errorf("got %d finalize requests after the read error, want none", len(rec.finalizes))
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			checkStreamed(t, rec, res, "stream.bin", data, tt.parts)
+			want := partETags(data, chunkSize)
+			sort.Strings(want)
+			if got := slices.Sorted(slices.Values(rec.uploaded)); !slices.Equal(got, want) {
+				t.Errorf("uploaded %v, want %v", got, want)
+			}
+			// A stream's bar has no total to complete at by itself.
+			if bar.current != tt.size {
+				t.Errorf("bar ended at %d bytes, want %d", bar.current, tt.size)
+			}
+		})
+	}
+}
+
+func TestCheckParts(t *testing.T) {
+	// parts returns chunk results of 10 bytes each with the given numbers.
+	parts := func(indexes ...int) []chunkResult {
+		var chunks []chunkResult
+		for _, i := range indexes {
+			chunks = append(chunks, chunkResult{Index: i, ETag: fmt.Sprintf("%064d-10", i)})
+		}
+		return chunks
+	}
+	tests := []struct {
+		name   string
+		chunks []chunkResult
+		size   int64
+		want   string // in the error, "" for none
+	}{
+		{"complete", parts(1, 2, 3, 4), 40, ""},
+		{"one dropped", parts(1, 2, 4), 40, "missing parts 3"},
+		{"several dropped", parts(1, 5, 7), 70, "missing parts 2-4,6"},
+		{"first dropped", parts(2, 3), 30, "missing parts 1"},
+		{"last dropped", parts(1, 2, 3), 40, "parts add up to 30 bytes, expected 40"},
+		{"duplicate", parts(1, 2, 2, 3), 30, "duplicate parts 2"},
+		{"dropped and duplicate", parts(1, 1, 3), 30, "missing parts 2; duplicate parts 1"},
+		{"none", nil, 10, "parts add up to 0 bytes, expected 10"},
+		{"empty file", nil, 0, ""},
+	}
+	for _, tt := range tests {
+		err := checkParts(tt.chunks, tt.size)
+		switch {
+		case tt.want == "" && err != nil:
+			t.Errorf("%s: unexpected error %v", tt.name, err)
+		case tt.want != "" && (err == nil || !strings.Contains(err.Error(), tt.want)):
+			t.Errorf("%s: got error %v, want one saying %q", tt.name, err, tt.want)
+		}
+	}
+}
+
+// rangeServer takes ranged chunk PUTs for -resumable-chunks. The first PUT
+// of each chunk stores only half of it and answers 308, as when the
+// connection breaks midway; the retry must ask how much arrived and send
+// the rest. Other requests go to next.
+type rangeServer struct {
+	next http.Handler
+
+	mu     sync.Mutex
+	stored map[string][]byte
+	ranges []string // Content-Range of every PUT carrying data
+}
+
+func (s *rangeServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPut {
+		s.next.ServeHTTP(w, r)
+		return
+	}
+	etag := filepath.Base(r.URL.Path)
+	cr := r.Header.Get("Content-Range")
+	body, _ := io.ReadAll(r.Body)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	have, seen := s.stored[etag]
+	if strings.HasPrefix(cr, "bytes */") {
+		if len(have) > 0 {
+			w.Header().Set("Range", fmt.Sprintf("bytes=0-%d", len(have)-1))
+		}
+		w.WriteHeader(http.StatusPermanentRedirect)
+		return
+	}
+	s.ranges = append(s.ranges, cr)
+	var from, to, total int
+	fmt.Sscanf(cr, "bytes %d-%d/%d", &from, &to, &total)
+	if from != len(have) || to-from+1 != len(body) {
+		http.Error(w, "bad range", http.StatusBadRequest)
+		return
+	}
+	if !seen {
+		body = body[:len(body)/2]
+	}
+	s.stored[etag] = append(have, body...)
+	if len(s.stored[etag]) < total {
+		w.Header().Set("Range", fmt.Sprintf("bytes=0-%d", len(s.stored[etag])-1))
+		w.WriteHeader(http.StatusPermanentRedirect)
+		return
+	}
+	w.WriteHeader(http.StatusCreated)
+}
+
+// TestResumableChunks checks that a ranged chunk upload broken off halfway
+// resumes from the byte the server reports, that chunks under the
+// threshold use the multipart POST, and that a server refusing PUT gets
+// multipart uploads instead.
+func TestResumableChunks(t *testing.T) {
+	const blockSize = minBlockSize
+	path, data := writeTestFile(t, 2*blockSize+1000)
+	etags := partETags(data, blockSize)
+
+	t.Run("resume", func(t *testing.T) {
+		rec := &finalizeRecorder{}
+		rs := &rangeServer{next: rec, stored: map[string][]byte{}}
+		srv := httptest.NewServer(rs)
+		defer srv.Close()
+		fu := newTestUploader(t, path, srv.URL)
+		fu.ResumableChunks = blockSize
+		if _, err := fu.RunContext(t.Context()); err != nil {
+			t.Fatal(err)
+		}
+		for i, etag := range etags[:2] {
+			if want := data[i*blockSize : (i+1)*blockSize]; !bytes.Equal(rs.stored[etag], want) {
+				t.Errorf("part %d: server holds %d bytes, want the %d of the part", i+1, len(rs.stored[etag]), len(want))
+			}
+		}
+		// Each full-size part is sent whole, then its second half.
+		half := blockSize / 2
+		want := []string{
+			fmt.Sprintf("bytes 0-%d/%d", blockSize-1, blockSize),
+			fmt.Sprintf("bytes %d-%d/%d", half, blockSize-1, blockSize),
+		}
+		sort.Strings(rs.ranges)
+		if got := slices.Compact(rs.ranges); !slices.Equal(got, want) {
+			t.Errorf("ranged PUTs %q, want %q", got, want)
+		}
+		if len(rs.ranges) != 4 {
+			t.Errorf("got %d ranged PUTs, want 4", len(rs.ranges))
+		}
+		if len(rec.uploaded) != 1 || rec.uploaded[0] != etags[2] {
+			t.Errorf("multipart uploads %q, want only the short last part", rec.uploaded)
+		}
+	})
+
+	t.Run("refused", func(t *testing.T) {
+		rec := &finalizeRecorder{}
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.Method == http.MethodPut {
+				w.WriteHeader(http.StatusMethodNotAllowed)
+				return
+			}
+			rec.ServeHTTP(w, r)
+		}))
+		defer srv.Close()
+		fu := newTestUploader(t, path, srv.URL)
+		fu.ResumableChunks = blockSize
+		if _, err := fu.RunContext(t.Context()); err != nil {
+			t.Fatal(err)
+		}
+		if !fu.rangesRefused.Load() || len(rec.uploaded) != len(etags) {
+			t.Errorf("refused %v, %d multipart uploads; want ranges refused and %d", fu.rangesRefused.Load(), len(rec.uploaded), len(etags))
+		}
+	})
+}
+
+func TestCommittedBytes(t *testing.T) {
+	for h, want := range map[string]int{"bytes=0-99": 100, "bytes=0-0": 1, "": 0, "bytes=0-": 0, "junk": 0} {
+		if got := committedBytes(h); got != want {
+			t.Errorf("committedBytes(%q) = %d, want %d", h, got, want)
+		}
+	}
+}
+
+// TestAlreadyCompletedResponses checks that chunk and finalize responses
+// saying the session is already complete count as success, and where the
+// attachment then comes from.
+func TestAlreadyCompletedResponses(t *testing.T) {
+	const done = `{"error":"UPLOAD_ALREADY_COMPLETED"}`
+	tests := []struct {
+		name     string
+		finalize string // 409 body of the finalize response
+		lookup   string // lookup response, "" for no lookup template
+		wantID   string
+		wantErr  string
+	}{
+		{"attachment in the response", `{"error":"UPLOAD_ALREADY_COMPLETED","data":{"id":"att-2"}}`, "", "att-2", ""},
+		{"no details and no lookup", done, "", "", ""},
+		{"looked up", done, `{"data":{"id":"att-3"}}`, "att-3", ""},
+		{"lookup finds nothing", done, `{}`, "", "lookup returned no attachment"},
+		{"other conflict", `{"error":"chunk missing"}`, "", "", "finalize rejected"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path, _ := writeTestFile(t, 3*minBlockSize)
+			rec := &finalizeRecorder{}
+			var chunks atomic.Int64
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				switch {
+				case strings.HasSuffix(r.URL.Path, "/lookup"):
+					io.WriteString(w, tt.lookup)
+				case strings.HasSuffix(r.URL.Path, "/file/chunked"):
+					w.WriteHeader(http.StatusConflict)
+					io.WriteString(w, tt.finalize)
+				case strings.Contains(r.URL.Path, "/chunk/") && !strings.HasSuffix(r.URL.Path, "/probe"):
+					// Another run finished the session after the first chunk.
+					if chunks.Add(1) > 1 {
+						io.Copy(io.Discard, r.Body)
+						w.WriteHeader(http.StatusConflict)
+						io.WriteString(w, done)
+						return
+					}
+					rec.ServeHTTP(w, r)
+				default:
+					rec.ServeHTTP(w, r)
+				}
+			}))
+			defer srv.Close()
+
+			fu := newTestUploader(t, path, srv.URL)
+			fu.Concurrency = 1
+			if tt.lookup != "" {
+				fu.Paths.Lookup = "/api/upload/{key}/lookup?uploadId={uploadId}"
+			}
+			_, err := fu.RunContext(t.Context())
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("got error %v, want one mentioning %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			gotID := ""
+			if fu.Attachment != nil {
+				gotID = fu.Attachment.ID
+			}
+			if gotID != tt.wantID {
+				t.Errorf("attachment %q, want %q", gotID, tt.wantID)
+			}
+		})
+	}
+}
+
+func TestMentionsStrictFields(t *testing.T) {
+	tests := []struct {
+		body string
+		want bool
+	}{
+		{`{"error":"Unrecognized field \"partCount\""}`, true},
+		{`{"message":"unknown field: size"}`, true},
+		{`{"errors":["property size is not allowed"]}`, true},
+		{`{"error":"chunk size mismatch"}`, false},
+		{`{"error":"unknown field: mimeType"}`, false},
+		{``, false},
+	}
+	for _, tt := range tests {
+		if got := mentionsStrictFields([]byte(tt.body)); got != tt.want {
+			t.Errorf("mentionsStrictFields(%q) = %v, want %v", tt.body, got, tt.want)
+		}
+	}
+}
+
+// TestStrictFinalize checks that finalize carries the size and part count,
+// that a server refusing them gets a plain finalize instead, and that
+// StrictFinalize false leaves them out.
+func TestStrictFinalize(t *testing.T) {
+	const blockSize = minBlockSize
+	tests := []struct {
+		name     string
+		strict   bool
+		refuse   bool
+		want     []bool // whether each finalize request carried the fields
+		rejected bool
+	}{
+		{"accepted", true, false, []bool{true}, false},
+		{"refused", true, true, []bool{true, false}, true},
+		{"off", false, true, []bool{false}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path, data := writeTestFile(t, 2*blockSize+10)
+			rec := &finalizeRecorder{}
+			var got []bool
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if strings.HasSuffix(r.URL.Path, "/file/chunked") {
+					body, _ := io.ReadAll(r.Body)
+					var payload struct {
+						Size      *int64 `json:"size"`
+						PartCount *int   `json:"partCount"`
+					}
+					json.Unmarshal(body, &payload)
+					strict := payload.Size != nil && payload.PartCount != nil
+					got = append(got, strict)
+					if strict && (*payload.Size != int64(len(data)) || *payload.PartCount != 3) {
+						t.Errorf("finalize says size %d, partCount %d; want %d and 3", *payload.Size, *payload.PartCount, len(data))
+					}
+					if strict && tt.refuse {
+						http.Error(w, `{"error":"Unrecognized field \"partCount\""}`, http.StatusBadRequest)
+						return
+					}
+					r.Body = io.NopCloser(bytes.NewReader(body))
+				}
+				rec.ServeHTTP(w, r)
+			}))
+			defer srv.Close()
+
+			fu := newTestUploader(t, path, srv.URL)
+			fu.BlockSize = constantBlockSize(blockSize)
+			fu.StrictFinalize = tt.strict
+			if _, err := fu.RunContext(t.Context()); err != nil {
+				t.Fatal(err)
+			}
+			if !slices.Equal(got, tt.want) || fu.strictFinalizeRejected.Load() != tt.rejected {
+				t.Errorf("finalize requests with size and partCount %v, refusal remembered %v; want %v, %v",
+					got, fu.strictFinalizeRejected.Load(), tt.want, tt.rejected)
+			}
+			if len(rec.finalizes) != 1 {
+				t.Errorf("got %d finalized files, want 1", len(rec.finalizes))
+			}
+		})
+	}
+}
+
+// TestRunContextCancel stops runs at each phase, by cancellation and by
+// deadline, and checks that they end promptly with an error that says which.
+func TestRunContextCancel(t *testing.T) {
+	path, _ := writeTestFile(t, 3*minBlockSize)
+	tests := []struct {
+		name    string
+		phase   string // request the server holds until the client gives up, "" for none
+		timeout time.Duration
+		want    error
+	}{
+		{"cancelled before create", "", 0, context.Canceled},
+		{"cancelled in create", "create", 0, context.Canceled},
+		{"cancelled mid-chunks", "chunk", 0, context.Canceled},
+		{"cancelled in finalize", "finalize", 0, context.Canceled},
+		{"deadline mid-chunks", "chunk", 100 * time.Millisecond, context.DeadlineExceeded},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx, cancel := context.WithCancel(t.Context())
+			defer cancel()
+			if tt.timeout > 0 {
+				ctx, cancel = context.WithTimeout(t.Context(), tt.timeout)
+				defer cancel()
+			}
+			var requests atomic.Int64
+			rec := &finalizeRecorder{}
+			release := make(chan struct{})
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				requests.Add(1)
+				op := "chunk"
+				switch {
+				case strings.HasSuffix(r.URL.Path, "/create"):
+					op = "create"
+				case strings.HasSuffix(r.URL.Path, "/chunk/probe"):
+					op = "probe"
+				case strings.HasSuffix(r.URL.Path, "/file/chunked"):
+					op = "finalize"
+				}
+				if op == tt.phase {
+					if tt.timeout == 0 {
+						cancel()
+					}
+					<-release
+					return
+				}
+				rec.ServeHTTP(w, r)
+			}))
+			defer srv.Close()
+			defer close(release)
+			if tt.phase == "" {
+				cancel()
+			}
+
+			fu := newTestUploader(t, path, srv.URL)
+			fu.BlockSize = constantBlockSize(minBlockSize)
+			start := time.Now()
+			_, err := fu.RunContext(ctx)
+			if took := time.Since(start); took > 2*time.Second {
+				t.Errorf("run took %s to stop", took)
+			}
+			if !errors.Is(err, tt.want) {
+				t.Errorf("got error %v, want %v", err, tt.want)
+			}
+			if tt.phase == "" && requests.Load() != 0 {
+				t.Errorf("a cancelled run sent %d requests", requests.Load())
+			}
+			if len(rec.finalizes) != 0 {
+				t.Error("a stopped run finalized")
+			}
+		})
+	}
+}
+
+func TestParseProbeResults(t *testing.T) {
+	tests := []struct {
+		name, raw string
+		want      map[string]bool
+		wantErr   bool
+	}{
+		{"map", `{"sha256-aa-1": {"exists": true}, "sha256-bb-2": {"exists": false}}`,
+			map[string]bool{"sha256-aa-1": true, "sha256-bb-2": false}, false},
+		{"list with prefixed hashes", `[{"hash": "sha256-aa-1", "exists": true}, {"hash": "sha256-bb-2", "exists": false}]`,
+			map[string]bool{"sha256-aa-1": true, "sha256-bb-2": false}, false},
+		{"list with bare hashes", `[{"hash": "aa-1", "exists": true}]`, map[string]bool{"sha256-aa-1": true}, false},
+		{"list with a repeated hash", `[{"hash": "aa-1", "exists": true}, {"hash": "sha256-aa-1", "exists": false}]`,
+			map[string]bool{"sha256-aa-1": true}, false},
+		{"absent", ``, map[string]bool{}, false},
+		{"string", `"ok"`, nil, true},
+		{"number list", `[1, 2]`, nil, true},
+	}
+	for _, tt := range tests {
+		got, err := parseProbeResults(json.RawMessage(tt.raw), "sha256")
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: error %v, want error %v", tt.name, err, tt.wantErr)
+			continue
+		}
+		if len(got) != len(tt.want) {
+			t.Errorf("%s: got %v, want %v", tt.name, got, tt.want)
+			continue
+		}
+		for k, v := range tt.want {
+			if got[k] != v {
+				t.Errorf("%s: got %v, want %v", tt.name, got, tt.want)
+				break
+			}
+		}
+	}
+}
+
+// TestProbeResponseShapes checks that a probe finds the chunks a server
+// reports in either response shape.
+func TestProbeResponseShapes(t *testing.T) {
+	etags := []string{"aa-1", "bb-2", "cc-3"}
+	for name, body := range map[string]string{
+		"map":  `{"data":{"results":{"sha256-aa-1":{"exists":true},"sha256-bb-2":{"exists":false},"sha256-cc-3":{"exists":true}}}}`,
+		"list": `{"data":{"results":[{"hash":"aa-1","exists":true},{"hash":"bb-2","exists":false},{"hash":"cc-3","exists":true}]}}`,
+	} {
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			io.WriteString(w, body)
+		}))
+		defer srv.Close()
+
+		fu := newTestUploader(t, "data.bin", srv.URL)
+		exists, err := fu.probeChunks(t.Context(), etags, "u1")
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if !exists["aa-1"] || exists["bb-2"] || !exists["cc-3"] {
+			t.Errorf("%s: got %v, want aa-1 and cc-3 present", name, exists)
+		}
+	}
+}
+
+// TestFinalizeChunkOrder checks that finalize lists every part's ETag in
+// ascending part order, without gaps, however the parallel uploads finish
+// and whichever parts the probe reports present.
+func TestFinalizeChunkOrder(t *testing.T) {
+	const blockSize = minBlockSize
+	path, data := writeTestFile(t, 12*blockSize+12345)
+	etags := partETags(data, blockSize)
+	srv := &finalizeRecorder{present: map[string]bool{}}
+	for _, part := range []int{2, 5, 6, 11} {
+		srv.present[etags[part-1]] = true
+	}
+	ts := httptest.NewServer(srv)
+	defer ts.Close()
+
+	fu := newTestUploader(t, path, ts.URL)
+	fu.BlockSize = constantBlockSize(blockSize)
+	fu.Concurrency = 16
+	fu.HashWorkers = 4
+	res, err := fu.RunContext(t.Context())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(srv.finalizes) != 1 {
+		t.Fatalf("got %d finalize requests, want 1", len(srv.finalizes))
+	}
+	chunks := srv.finalizes[0].Chunks
+	if len(chunks) != len(etags) {
+		t.Fatalf("finalize lists %d chunks, want %d", len(chunks), len(etags))
+	}
+	for i, c := range chunks {
+		if got := c.Hash + "-" + c.Size; got != etags[i] {
+			t.Errorf("finalize chunk %d is %s, want part %d's %s", i, got, i+1, etags[i])
+		}
+	}
+	if got, want := len(srv.uploaded), len(etags)-len(srv.present); got != want {
+		t.Errorf("uploaded %d chunks, want %d", got, want)
+	}
+	for _, etag := range srv.uploaded {
+		if srv.present[etag] {
+			t.Errorf("chunk %s was uploaded although the probe reported it present", etag)
+		}
+	}
+	if res.Sources.Probed != len(srv.present) {
+		t.Errorf("result credits %d parts to the probe, want %d", res.Sources.Probed, len(srv.present))
+	}
+}
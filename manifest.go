@@ -0,0 +1,107 @@
+package main
+
+import (
+	"crypto/sha512"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// manifestCheck is the outcome of comparing a file with the ETag log of an
+// earlier upload.
+type manifestCheck struct {
+	Parts   int   // listed in the log
+	Changed []int // parts whose bytes now hash differently, or are missing
+	Size    int64 // of the file now
+	Covered int64 // bytes the log describes, from the offset
+}
+
+// checkManifest re-hashes the file the way the upload that wrote the ETag
+// log cut it, and reports which parts no longer match. A log is the
+// manifest of a completed upload: it lists every part with its ETag, and
+// each ETag gives the part's size (so an -adaptive run is cut the same way)
+// and, by its length, the hash algorithm. offset is where the logged range
+// started; parts are hashed by workers goroutines in parallel.
+func checkManifest(path, logPath string, offset int64, workers int) (*manifestCheck, error) {
+	// A missing log would load as an empty one.
+	if _, err := os.Stat(logPath); err != nil {
+		return nil, err
+	}
+	logged, err := loadETagLog(logPath)
+	if err != nil {
+		return nil, err
+	}
+	if len(logged) == 0 {
+		return nil, fmt.Errorf("%s lists no parts", logPath)
+	}
+	parts := make([]int, 0, len(logged))
+	for p := range logged {
+		parts = append(parts, p)
+	}
+	sort.Ints(parts)
+	if parts[len(parts)-1] != len(parts) {
+		return nil, fmt.Errorf("%s doesn't list every part from 1 to %d; it is from an unfinished upload",
+			logPath, parts[len(parts)-1])
+	}
+	alg := "sha256"
+	if sum, _, _ := strings.Cut(logged[1], "-"); len(sum) == 2*sha512.Size {
+		alg = "sha512"
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	res := &manifestCheck{Parts: len(parts), Size: fi.Size()}
+	offsets := make([]int64, len(parts)+1)
+	offsets[0] = offset
+	for i, p := range parts {
+		offsets[i+1] = offsets[i] + etagSize(logged[p])
+	}
+	res.Covered = offsets[len(parts)] - offset
+
+	var mu sync.Mutex
+	var readErr error
+	next := make(chan int)
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for p := range next {
+				buf := make([]byte, offsets[p]-offsets[p-1])
+				n, err := f.ReadAt(buf, offsets[p-1])
+				if err != nil && err != io.EOF {
+					mu.Lock()
+					readErr = fmt.Errorf("%w at offset %d: %w", errSourceRead, offsets[p-1]+int64(n), err)
+					mu.Unlock()
+					continue
+				}
+				// A short read means the file ends inside or before the part.
+				if n < len(buf) || generateETag(alg, buf) != logged[p] {
+					mu.Lock()
+					res.Changed = append(res.Changed, p)
+					mu.Unlock()
+				}
+			}
+		}()
+	}
+	for _, p := range parts {
+		next <- p
+	}
+	close(next)
+	wg.Wait()
+	if readErr != nil {
+		return nil, readErr
+	}
+	sort.Ints(res.Changed)
+	return res, nil
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/vbauerster/mpb/v7/decor"
+)
+
+// partLimit is the most parts an upload may have: the lower of MaxParts
+// and the limit the server reported when the session was created, or 0
+// when neither is set.
+func (fu *FileUploader) partLimit() int {
+	limit := fu.MaxParts
+	if s := fu.serverMaxParts; s > 0 && (limit == 0 || s < limit) {
+		limit = s
+	}
+	return limit
+}
+
+// partsBlockSize is the smallest whole-MiB block size, and at least
+// minBlockSize, that cuts size bytes into no more than limit parts.
+func partsBlockSize(size int64, limit int) int64 {
+	const mib = 1024 * 1024
+	n := (size + int64(limit) - 1) / int64(limit)
+	return max((n+mib-1)/mib*mib, minBlockSize)
+}
+
+// fitPartLimit checks that size bytes cut into blockSize parts stay within
+// limit parts. A block size the default policy picked is raised to fit; a
+// fixed one (-block-size, or the one a resume file records) fails with
+// errTooManyParts, as does a size that doesn't fit even at maxBlockSize.
+// It returns the block size to use.
+func fitPartLimit(size, blockSize int64, limit int, fixed bool) (int64, error) {
+	parts := (size + blockSize - 1) / blockSize
+	if limit <= 0 || parts <= int64(limit) {
+		return blockSize, nil
+	}
+	need := partsBlockSize(size, limit)
+	if need > maxBlockSize {
+		return 0, fmt.Errorf("%w: %s needs more than %d parts even at the largest block size, %s",
+			errTooManyParts, decor.SizeB1024(size), limit, decor.SizeB1024(maxBlockSize))
+	}
+	if fixed {
+		return 0, fmt.Errorf("%w: %d parts of %s exceed the limit of %d; retry with -block-size %d or more",
+			errTooManyParts, parts, decor.SizeB1024(blockSize), limit, need)
+	}
+	return need, nil
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/cenkalti/backoff/v4"
+)
+
+// RetryDecision is what FileUploader.ShouldRetry makes of a request's
+// outcome.
+type RetryDecision int
+
+const (
+	// RetryDefault leaves the outcome to the uploader's own handling of
+	// statuses and errors.
+	RetryDefault RetryDecision = iota
+	// RetryAgain treats the outcome as a failure and retries the request
+	// with backoff, even a 2xx or a status that would fail at once.
+	RetryAgain
+	// DoNotRetry fails the request for good, even a 5xx or a network error
+	// that would be retried. A 2xx fails too.
+	DoNotRetry
+)
+
+// do sends req with Client; see doWith.
+func (fu *FileUploader) do(req *http.Request) (*http.Response, string, error) {
+	return fu.doWith(fu.Client, req)
+}
+
+// usedTokenKey is the request context key under which Authorize records
+// the token it set, in a *string doWith provides.
+type usedTokenKey struct{}
+
+// doWith is how every request of the uploader goes out. It runs
+// RequestMiddleware over req in order, Authorize among them, and sends it
+// with client, returning the token Authorize used for unauthorized; it is
+// empty when a caller's middleware set the credentials instead. A
+// middleware error fails the request without sending it. ShouldRetry then
+// gets its say on the outcome: a request it wants retried or failed comes
+// back as an error that backoff.Retry treats accordingly, with the
+// response closed.
+func (fu *FileUploader) doWith(client *http.Client, req *http.Request) (*http.Response, string, error) {
+	var tok string
+	req = req.WithContext(context.WithValue(req.Context(), usedTokenKey{}, &tok))
+	var resp *http.Response
+	var err error
+	for _, mw := range fu.RequestMiddleware {
+		if err = mw(req); err != nil {
+			err = backoff.Permanent(fmt.Errorf("request middleware: %w", err))
+			break
+		}
+	}
+	if err == nil {
+		resp, err = client.Do(req)
+	}
+	if fu.ShouldRetry == nil {
+		return resp, tok, err
+	}
+	decision := fu.ShouldRetry(resp, err)
+	if decision == RetryDefault {
+		return resp, tok, err
+	}
+	if resp != nil {
+		data, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		resp.Body.Close()
+		err = &statusError{op: "ShouldRetry on " + req.Method + " " + req.URL.Path, status: resp.StatusCode, body: string(data)}
+	} else if perm, ok := err.(*backoff.PermanentError); ok {
+		err = perm.Err
+	}
+	if decision == DoNotRetry {
+		err = backoff.Permanent(err)
+	}
+	fu.debugf("ShouldRetry: %s %s: %v", req.Method, req.URL.Path, err)
+	return nil, tok, err
+}
+
+// headerList collects repeated -header flags, "Name: value" each.
+type headerList []string
+
+func (h *headerList) String() string { return strings.Join(*h, ", ") }
+
+func (h *headerList) Set(s string) error {
+	name, _, ok := strings.Cut(s, ":")
+	name = strings.TrimSpace(name)
+	if !ok || name == "" || strings.ContainsAny(name, " \t") {
+		return fmt.Errorf("want \"Name: value\", got %q", s)
+	}
+	if strings.EqualFold(name, "Authorization") {
+		return fmt.Errorf("set the credentials with -token, -token-file or -token-cmd, not -header")
+	}
+	*h = append(*h, s)
+	return nil
+}
+
+// names returns the header names, for redacting their values in debug
+// output.
+func (h headerList) names() []string {
+	names := make([]string, len(h))
+	for i, s := range h {
+		name, _, _ := strings.Cut(s, ":")
+		names[i] = strings.TrimSpace(name)
+	}
+	return names
+}
+
+// setHeaders is the CLI's request middleware for -header: it sets each
+// header on every request, replacing one the uploader set itself.
+func setHeaders(headers []string) func(*http.Request) error {
+	h := http.Header{}
+	for _, s := range headers {
+		name, value, _ := strings.Cut(s, ":")
+		h.Add(strings.TrimSpace(name), strings.TrimSpace(value))
+	}
+	return func(req *http.Request) error {
+		for name, values := range h {
+			req.Header[name] = values
+		}
+		return nil
+	}
+}
+
+// setUserAgent is the CLI's request middleware naming the tool and its
+// version in User-Agent, unless a -header set one.
+func setUserAgent(agent string) func(*http.Request) error {
+	return func(req *http.Request) error {
+		if req.Header.Get("User-Agent") == "" {
+			req.Header.Set("User-Agent", agent)
+		}
+		return nil
+	}
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"encoding/base64"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	backoff "github.com/cenkalti/backoff/v4"
+)
+
+// headerEcho answers with the request's Authorization, X-Audit and
+// User-Agent headers.
+func headerEcho(w http.ResponseWriter, r *http.Request) {
+	io.WriteString(w, r.Header.Get("Authorization")+"|"+r.Header.Get("X-Audit")+"|"+r.Header.Get("User-Agent"))
+}
+
+// send makes one request through fu's middleware and returns what
+// headerEcho answered and the token doWith reported.
+func send(t *testing.T, fu *FileUploader) (string, string) {
+	t.Helper()
+	req, _ := http.NewRequest("GET", fu.BaseURL, nil)
+	resp, tok, err := fu.do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	data, _ := io.ReadAll(resp.Body)
+	return string(data), tok
+}
+
+func basic(user, tok string) string {
+	return "Basic " + base64.StdEncoding.EncodeToString([]byte(user+":"+tok))
+}
+
+// TestCLIMiddleware checks the chain the command line installs: Authorize,
+// then -header, then the User-Agent.
+func TestCLIMiddleware(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(headerEcho))
+	defer srv.Close()
+
+	fu := newTestUploader(t, "data.bin", srv.URL)
+	fu.Tokens = newTokenPool([]string{"tok-a", "tok-b"})
+	fu.RequestMiddleware = append(fu.RequestMiddleware, setHeaders([]string{"X-Audit: ticket-7"}), setUserAgent("atlassian-uploader/test"))
+	for _, want := range []string{"tok-a", "tok-b", "tok-a"} {
+		got, tok := send(t, fu)
+		if tok != want {
+			t.Errorf("doWith reported token %q, want %q", tok, want)
+		}
+		if exp := basic("user", want) + "|ticket-7|atlassian-uploader/test"; got != exp {
+			t.Errorf("server got %q, want %q", got, exp)
+		}
+	}
+
+	fu.RequestMiddleware = []func(*http.Request) error{fu.Authorize,
+		setHeaders([]string{"User-Agent: custom/1"}), setUserAgent("atlassian-uploader/test")}
+	if got, _ := send(t, fu); got != basic("user", "tok-b")+"||custom/1" {
+		t.Errorf("-header User-Agent: server got %q", got)
+	}
+}
+
+// TestMiddlewareReplacesAuthorize checks that a caller's middleware can
+// supply the credentials instead of Authorize.
+func TestMiddlewareReplacesAuthorize(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(headerEcho))
+	defer srv.Close()
+
+	fu := newTestUploader(t, "data.bin", srv.URL)
+	fu.RequestMiddleware = []func(*http.Request) error{func(req *http.Request) error {
+		req.Header.Set("Authorization", "Bearer signed")
+		return nil
+	}}
+	got, tok := send(t, fu)
+	if !strings.HasPrefix(got, "Bearer signed|") || tok != "" {
+		t.Errorf("server got %q with token %q, want the caller's credentials and no token", got, tok)
+	}
+
+	refused := errors.New("no signing key")
+	fu.RequestMiddleware = append(fu.RequestMiddleware, func(*http.Request) error { return refused })
+	req, _ := http.NewRequest("GET", srv.URL, nil)
+	var perm *backoff.PermanentError
+	if _, _, err := fu.do(req); !errors.As(err, &perm) || !errors.Is(err, refused) {
+		t.Errorf("a failing middleware returned %v, want a permanent error wrapping %v", err, refused)
+	}
+}
+
+func TestShouldRetry(t *testing.T) {
+	tests := []struct {
+		name     string
+		status   int
+		decision RetryDecision
+		requests int64
+		wantErr  bool
+	}{
+		{"default retries a 500", http.StatusInternalServerError, RetryDefault, 4, true},
+		{"DoNotRetry stops a 500", http.StatusInternalServerError, DoNotRetry, 1, true},
+		{"RetryAgain retries a 200", http.StatusOK, RetryAgain, 4, true},
+		{"default accepts a 200", http.StatusOK, RetryDefault, 1, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var requests atomic.Int64
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				requests.Add(1)
+				w.WriteHeader(tt.status)
+				io.WriteString(w, `{"data":{"results":{}}}`)
+			}))
+			defer srv.Close()
+
+			fu := newTestUploader(t, "data.bin", srv.URL)
+			fu.ShouldRetry = func(resp *http.Response, err error) RetryDecision {
+				if resp != nil && resp.StatusCode == tt.status {
+					return tt.decision
+				}
+				return RetryDefault
+			}
+			_, err := fu.probeChunks(t.Context(), []string{"abc-1"}, "u1")
+			if (err != nil) != tt.wantErr {
+				t.Errorf("probe error %v, want error %v", err, tt.wantErr)
+			}
+			if got := requests.Load(); got != tt.requests {
+				t.Errorf("sent %d requests, want %d", got, tt.requests)
+			}
+		})
+	}
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"io"
+	"mime"
+	"net/http"
+	"path/filepath"
+	"strings"
+)
+
+// sniffLength is how much of the file http.DetectContentType looks at.
+const sniffLength = 512
+
+// resolveMimeType picks the attachment's content type; the first of these
+// that gives an answer wins:
+//
+//  1. explicit, from -mime-type
+//  2. userMap, the config file's extension map
+//  3. the standard library's extension table (and the system's mime.types)
+//  4. sniffing head, the start of the file
+//  5. application/octet-stream
+//
+// head may be nil when the content isn't available up front.
+func resolveMimeType(explicit string, userMap map[string]string, path string, head []byte) string {
+	if explicit != "" {
+		return explicit
+	}
+	ext := strings.ToLower(filepath.Ext(path))
+	if t := userMap[ext]; t != "" && ext != "" {
+		return t
+	}
+	if t := mime.TypeByExtension(ext); t != "" {
+		return t
+	}
+	if len(head) > 0 {
+		// DetectContentType falls back to application/octet-stream itself.
+		return http.DetectContentType(head)
+	}
+	return "application/octet-stream"
+}
+
+// normalizeMimeMap lower-cases the map's extensions and gives them a
+// leading dot, so "ZIP", ".zip" and "zip" all match report.zip.
+func normalizeMimeMap(m map[string]string) map[string]string {
+	if len(m) == 0 {
+		return nil
+	}
+	out := make(map[string]string, len(m))
+	for ext, t := range m {
+		ext = strings.ToLower(ext)
+		if !strings.HasPrefix(ext, ".") {
+			ext = "." + ext
+		}
+		out[ext] = t
+	}
+	return out
+}
+
+// readHead returns up to sniffLength bytes of r from off.
+func readHead(r io.ReaderAt, off, size int64) ([]byte, error) {
+	buf := make([]byte, min(sniffLength, size))
+	n, err := r.ReadAt(buf, off)
+	if err == io.EOF {
+		err = nil
+	}
+	return buf[:n], err
+}
+
+// contentType is the attachment's MIME type as resolved for this run, or
+// without sniffing when the run didn't resolve one.
+func (fu *FileUploader) contentType() string {
+	if fu.mimeType != "" {
+		return fu.mimeType
+	}
+	return resolveMimeType(fu.MimeType, fu.MimeTypes, fu.FilePath, nil)
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestResolveMimeType(t *testing.T) {
+	userMap := normalizeMimeMap(map[string]string{"LOG": "text/x-log", ".pdf": "application/x-custom-pdf"})
+	png := []byte("\x89PNG\r\n\x1a\n\x00\x00\x00\rIHDR")
+	tests := []struct {
+		name     string
+		explicit string
+		path     string
+		head     []byte
+		want     string
+	}{
+		{"explicit beats everything", "application/zip", "report.pdf", png, "application/zip"},
+		{"user map beats the extension table", "", "report.pdf", png, "application/x-custom-pdf"},
+		{"user map, any case", "", "server.LOG", nil, "text/x-log"},
+		{"extension table beats sniffing", "", "image.png", []byte("plain text"), "image/png"},
+		{"sniffed without a known extension", "", "image.qqz", png, "image/png"},
+		{"sniffed without an extension", "", "README", []byte("plain text"), "text/plain; charset=utf-8"},
+		{"octet-stream without content", "", "data.qqz", nil, "application/octet-stream"},
+		{"octet-stream for unknown content", "", "data.qqz", []byte{0, 1, 2, 3}, "application/octet-stream"},
+	}
+	for _, tt := range tests {
+		if got := resolveMimeType(tt.explicit, userMap, tt.path, tt.head); got != tt.want {
+			t.Errorf("%s: got %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestLoadMimeTypes(t *testing.T) {
+	path := writeConfig(t, `{"mimeTypes": {"Log": "text/x-log", ".dump": "application/x-dump"}}`)
+	got, err := loadMimeTypes(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 2 || got[".log"] != "text/x-log" || got[".dump"] != "application/x-dump" {
+		t.Errorf("got %v, want .log and .dump", got)
+	}
+	if got, err := loadMimeTypes(filepath.Join(t.TempDir(), "missing.json")); got != nil || err != nil {
+		t.Errorf("missing config: got %v, %v; want no map and no error", got, err)
+	}
+}
+
+// TestSniffedMimeTypeUploaded checks that the type sniffed from the file
+// reaches the server in finalize.
+func TestSniffedMimeTypeUploaded(t *testing.T) {
+	var mimeType string
+	rec := &finalizeRecorder{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasSuffix(r.URL.Path, "/file/chunked") {
+			body, _ := io.ReadAll(r.Body)
+			var payload struct {
+				MimeType string `json:"mimeType"`
+			}
+			json.Unmarshal(body, &payload)
+			mimeType = payload.MimeType
+			r.Body = io.NopCloser(bytes.NewReader(body))
+		}
+		rec.ServeHTTP(w, r)
+	}))
+	defer srv.Close()
+	path := filepath.Join(t.TempDir(), "capture")
+	if err := os.WriteFile(path, []byte("%PDF-1.7\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	fu := newTestUploader(t, path, srv.URL)
+	fu.BlockSize = constantBlockSize(minBlockSize)
+	if _, err := fu.RunContext(t.Context()); err != nil {
+		t.Fatal(err)
+	}
+	if len(rec.finalizes) != 1 || mimeType != "application/pdf" {
+		t.Errorf("got %d finalizes with mimeType %q, want one application/pdf file", len(rec.finalizes), mimeType)
+	}
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// missingPartNumbers finds the numbers in a finalize refusal such as
+// "missing chunk 3", "chunks 4, 7 and 9 not found" or "part #2 was never
+// uploaded".
+var missingPartNumbers = regexp.MustCompile(`(?i)\b(?:chunk|part)s?\s*(?:numbers?\s*)?[#:]?\s*(\d+(?:\s*(?:,|and)\s*\d+)*)`)
+
+// missingParts reads which of etags a finalize refusal says the server
+// lacks: the parts whose hash the body quotes or, failing that, the part
+// numbers it names next to "missing", "not found" and the like. Numbers
+// outside 1..len(etags) are ignored. It returns the part numbers in order,
+// or nil when the body doesn't say.
+func missingParts(body []byte, etags []string) []int {
+	text := bytes.ToLower(body)
+	var parts []int
+	for i, et := range etags {
+		sum, _, _ := strings.Cut(et, "-")
+		if bytes.Contains(text, []byte(sum)) {
+			parts = append(parts, i+1)
+		}
+	}
+	if len(parts) > 0 {
+		return parts
+	}
+	missing := false
+	for _, w := range []string{"missing", "not found", "never uploaded", "unknown", "not uploaded", "not persisted"} {
+		missing = missing || bytes.Contains(text, []byte(w))
+	}
+	if !missing {
+		return nil
+	}
+	for _, m := range missingPartNumbers.FindAllSubmatch(text, -1) {
+		for _, f := range strings.FieldsFunc(string(m[1]), func(r rune) bool { return r < '0' || r > '9' }) {
+			if n, err := strconv.Atoi(f); err == nil && n >= 1 && n <= len(etags) && !slices.Contains(parts, n) {
+				parts = append(parts, n)
+			}
+		}
+	}
+	slices.Sort(parts)
+	return parts
+}
+
+// finalizeRepairing finalizes, and when the server refuses because parts
+// are missing, as happens when an acknowledged chunk wasn't durably stored
+// yet, re-uploads those parts from r and finalizes again, up to
+// FinalizeRepairs times. It returns the number of parts re-uploaded.
+func (fu *FileUploader) finalizeRepairing(ctx context.Context, r io.ReaderAt, offset int64, etags []string, uploadID string) (int, error) {
+	repaired := 0
+	err := fu.createFileChunked(ctx, etags, uploadID)
+	for round := 1; err != nil && round <= fu.FinalizeRepairs; round++ {
+		var rejected *finalizeRejectedError
+		if !errors.As(err, &rejected) {
+			break
+		}
+		parts := missingParts([]byte(rejected.body), etags)
+		if len(parts) == 0 {
+			fu.debugf("Finalize refusal names no missing parts: %.200s", rejected.body)
+			break
+		}
+		ui.Warnf("%s: finalize reports missing parts %s; re-uploading them, repair %d of %d",
+			fu.FilePath, partList(parts), round, fu.FinalizeRepairs)
+		n, rerr := fu.reuploadParts(ctx, r, offset, etags, parts, uploadID)
+		repaired += n
+		if rerr != nil {
+			return repaired, rerr
+		}
+		fu.emit("parts_repaired", map[string]interface{}{"parts": parts, "round": round})
+		err = fu.createFileChunked(ctx, etags, uploadID)
+	}
+	return repaired, err
+}
+
+// reuploadParts sends the given parts again, read back from r. A part that
+// no longer hashes to its ETag means the file changed since it was read.
+func (fu *FileUploader) reuploadParts(ctx context.Context, r io.ReaderAt, offset int64, etags []string, parts []int, uploadID string) (int, error) {
+	done := 0
+	pos := offset
+	for i, et := range etags {
+		n := etagSize(et)
+		if slices.Contains(parts, i+1) {
+			buf := make([]byte, n)
+			if _, err := r.ReadAt(buf, pos); err != nil {
+				return done, fmt.Errorf("%w at offset %d: %w", errSourceRead, pos, err)
+			}
+			if generateETag(fu.HashAlgorithm, buf) != et {
+				return done, fmt.Errorf("%w: part %d no longer matches what was uploaded", errSourceChanged, i+1)
+			}
+			span := chunkSpan{Part: i + 1, Offset: pos, Size: int(n)}
+			if _, err := fu.uploadChunk(ctx, et, buf, span, uploadID); err != nil {
+				return done, err
+			}
+			fu.debugf("Re-uploaded %s", span)
+			done++
+		}
+		pos += n
+	}
+	return done, nil
+}
+
+// partList renders part numbers for a message, the first ten of them.
+func partList(parts []int) string {
+	s := make([]string, 0, min(len(parts), maxListedFailures))
+	for _, p := range parts[:min(len(parts), maxListedFailures)] {
+		s = append(s, strconv.Itoa(p))
+	}
+	if len(parts) > maxListedFailures {
+		s = append(s, fmt.Sprintf("and %d more", len(parts)-maxListedFailures))
+	}
+	return strings.Join(s, ", ")
+}
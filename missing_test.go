@@ -0,0 +1,116 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestMissingParts(t *testing.T) {
+	etags := []string{"aaaa-5", "bbbb-5", "cccc-5", "dddd-3"}
+	tests := []struct {
+		body string
+		want []int
+	}{
+		{`{"error":"chunk bbbb not found"}`, []int{2}},
+		{`{"missing":["sha256-dddd-3","sha256-aaaa-5"]}`, []int{1, 4}},
+		{`Missing chunks 3, 1 and 2`, []int{1, 2, 3}},
+		{`part #4 was never uploaded`, []int{4}},
+		{`missing part 9`, nil},
+		{`chunk 2 is too small`, nil},
+		{`{"error":"conflict"}`, nil},
+	}
+	for _, tt := range tests {
+		if got := missingParts([]byte(tt.body), etags); !slices.Equal(got, tt.want) {
+			t.Errorf("missingParts(%s) = %v, want %v", tt.body, got, tt.want)
+		}
+	}
+}
+
+// forgetfulStore acknowledges the first upload of part forget without
+// keeping it, as a server whose storage lags its acknowledgements does, and
+// refuses a finalize that lists chunks it lacks, naming their part numbers.
+type forgetfulStore struct {
+	forget int
+
+	mu        sync.Mutex
+	chunks    map[string]bool
+	forgotten bool
+	finalized int
+}
+
+func (s *forgetfulStore) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	switch {
+	case strings.HasSuffix(r.URL.Path, "/create"):
+		w.WriteHeader(http.StatusCreated)
+		io.WriteString(w, `{"uploadId":"u1"}`)
+	case strings.HasSuffix(r.URL.Path, "/chunk/probe"):
+		io.Copy(io.Discard, r.Body)
+		io.WriteString(w, `{"data":{"results":{}}}`)
+	case strings.Contains(r.URL.Path, "/chunk/"):
+		io.Copy(io.Discard, r.Body)
+		if part := r.URL.Query().Get("partNumber"); part == fmt.Sprint(s.forget) && !s.forgotten {
+			s.forgotten = true
+		} else {
+			s.chunks[path.Base(r.URL.Path)] = true
+		}
+		w.WriteHeader(http.StatusCreated)
+	case strings.HasSuffix(r.URL.Path, "/file/chunked"):
+		var body chunkList
+		json.NewDecoder(r.Body).Decode(&body)
+		var missing []string
+		for i, c := range body.Chunks {
+			if !s.chunks[c.Hash+"-"+c.Size] {
+				missing = append(missing, fmt.Sprint(i+1))
+			}
+		}
+		if len(missing) > 0 {
+			http.Error(w, "missing chunks "+strings.Join(missing, ", "), http.StatusConflict)
+			return
+		}
+		s.finalized++
+		io.WriteString(w, `{"data":{"id":"att-1","name":"data.bin"}}`)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// TestFinalizeRepairs checks that with -finalize-repairs a part the server
+// lost after acknowledging it is sent again and the upload finalizes, and
+// that without it the refusal fails the upload.
+func TestFinalizeRepairs(t *testing.T) {
+	path, _ := writeTestFile(t, 3*minBlockSize+99)
+	for _, repairs := range []int{0, 1} {
+		t.Run(fmt.Sprintf("repairs=%d", repairs), func(t *testing.T) {
+			store := &forgetfulStore{forget: 2, chunks: map[string]bool{}}
+			srv := httptest.NewServer(store)
+			defer srv.Close()
+
+			fu := newTestUploader(t, path, srv.URL)
+			fu.BlockSize = constantBlockSize(minBlockSize)
+			fu.FinalizeRepairs = repairs
+			res, err := fu.RunContext(t.Context())
+			if repairs == 0 {
+				if err == nil {
+					t.Fatal("upload finalized with a part missing")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if res.PartsRepaired != 1 || store.finalized != 1 {
+				t.Errorf("repaired %d parts and finalized %d times, want 1 and 1", res.PartsRepaired, store.finalized)
+			}
+		})
+	}
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// defaultNameDateLayout formats {date} when the placeholder gives no layout.
+const defaultNameDateLayout = "2006-01-02"
+
+// shortSHALength is how many hex digits of the SHA-256 {sha} keeps.
+const shortSHALength = 12
+
+var namePlaceholder = regexp.MustCompile(`\{([^{}]*)\}`)
+
+// nameTemplate renders -name-template, e.g. "{issue}_{date}_{basename}".
+// Placeholders:
+//
+//	{issue}        issue key
+//	{basename}     file name, e.g. support.zip
+//	{stem}         file name without its extension, e.g. support
+//	{ext}          extension without the dot, e.g. zip
+//	{date}         upload start in local time, as 2006-01-02
+//	{date:LAYOUT}  the same in a Go time layout, e.g. {date:20060102-1504}
+//	{sha}          first 12 hex digits of the file's SHA-256
+//	{host}         this machine's host name
+type nameTemplate struct {
+	text string
+	sha  bool
+}
+
+// parseNameTemplate rejects unknown placeholders, so a typo fails at startup
+// rather than after the first upload.
+func parseNameTemplate(text string) (*nameTemplate, error) {
+	t := &nameTemplate{text: text}
+	for _, m := range namePlaceholder.FindAllStringSubmatch(text, -1) {
+		key, _, _ := strings.Cut(m[1], ":")
+		switch key {
+		case "issue", "basename", "stem", "ext", "date", "host":
+		case "sha":
+			t.sha = true
+		default:
+			return nil, fmt.Errorf("-name-template: unknown placeholder %s", m[0])
+		}
+		if key != "date" && strings.Contains(m[1], ":") {
+			return nil, fmt.Errorf("-name-template: %s takes no format", m[0])
+		}
+	}
+	return t, nil
+}
+
+// nameVars are the values a nameTemplate draws from.
+type nameVars struct {
+	Issue  string
+	Base   string // file name the attachment would otherwise get
+	SHA256 string // hex digest; needed only when the template uses {sha}
+	Host   string
+	Time   time.Time
+}
+
+// Render fills in the placeholders and validates the result.
+func (t *nameTemplate) Render(v nameVars) (string, error) {
+	if t.sha && v.SHA256 == "" {
+		return "", fmt.Errorf("-name-template uses {sha}, which isn't known up front for a directory or pipe")
+	}
+	ext := filepath.Ext(v.Base)
+	name := namePlaceholder.ReplaceAllStringFunc(t.text, func(m string) string {
+		key, layout, found := strings.Cut(m[1:len(m)-1], ":")
+		switch key {
+		case "issue":
+			return v.Issue
+		case "basename":
+			return v.Base
+		case "stem":
+			return strings.TrimSuffix(v.Base, ext)
+		case "ext":
+			return strings.TrimPrefix(ext, ".")
+		case "date":
+			if !found {
+				layout = defaultNameDateLayout
+			}
+			return v.Time.Local().Format(layout)
+		case "sha":
+			return v.SHA256[:min(shortSHALength, len(v.SHA256))]
+		case "host":
+			return v.Host
+		}
+		return m
+	})
+	if err := validateAttachmentName(name); err != nil {
+		return "", fmt.Errorf("-name-template rendered %q: %w", name, err)
+	}
+	return name, nil
+}
+
+// validateAttachmentName checks a name given for the attachment rather than
+// taken from the file: it has to be a plain file name.
+func validateAttachmentName(name string) error {
+	switch {
+	case strings.TrimSpace(name) == "":
+		return fmt.Errorf("attachment name is empty")
+	case strings.ContainsAny(name, `/\`):
+		return fmt.Errorf("attachment name contains a path separator")
+	case name == "." || name == "..":
+		return fmt.Errorf("attachment name %q is not a file name", name)
+	}
+	return nil
+}
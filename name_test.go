@@ -0,0 +1,48 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestNameTemplate(t *testing.T) {
+	vars := nameVars{Issue: "ABC-123", Base: "support.zip", SHA256: "0123456789abcdef0123", Host: "build7",
+		Time: time.Date(2024, 6, 1, 12, 0, 0, 0, time.Local)}
+	tests := []struct {
+		text, want string
+		parseErr   bool
+		renderErr  bool
+	}{
+		{text: "{issue}_{date}_{basename}", want: "ABC-123_2024-06-01_support.zip"},
+		{text: "{stem}-{sha}.{ext}", want: "support-0123456789ab.zip"},
+		{text: "{host}_{date:20060102-1504}_{basename}", want: "build7_20240601-1200_support.zip"},
+		{text: "{isue}_{basename}", parseErr: true},
+		{text: "{issue:x}", parseErr: true},
+		{text: "{issue}/{basename}", renderErr: true},
+		{text: " ", renderErr: true},
+	}
+	for _, tt := range tests {
+		tmpl, err := parseNameTemplate(tt.text)
+		if (err != nil) != tt.parseErr {
+			t.Errorf("parseNameTemplate(%q) error %v, want error %v", tt.text, err, tt.parseErr)
+		}
+		if err != nil {
+			continue
+		}
+		got, err := tmpl.Render(vars)
+		if (err != nil) != tt.renderErr || got != tt.want {
+			t.Errorf("%q rendered %q, %v; want %q, error %v", tt.text, got, err, tt.want, tt.renderErr)
+		}
+	}
+}
+
+func TestValidateAttachmentName(t *testing.T) {
+	for name, ok := range map[string]bool{
+		"support.zip": true, "a b.tar.gz": true, "": false, "  ": false,
+		"dir/file": false, `dir\file`: false, ".": false, "..": false,
+	} {
+		if err := validateAttachmentName(name); (err == nil) != ok {
+			t.Errorf("validateAttachmentName(%q) = %v, want ok %v", name, err, ok)
+		}
+	}
+}
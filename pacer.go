@@ -0,0 +1,73 @@
+package main
+
+import (
+	"context"
+	"math/rand/v2"
+	"sync"
+	"time"
+)
+
+// dispatchPacer spreads chunk requests out in time, so a run doesn't open
+// with every worker sending at once and trip a policer on a shared link.
+// During the ramp-up the first request of each of the workers is held back
+// so they start evenly across the window: the k-th at k*rampUp/workers.
+// After that, consecutive requests are at least gap apart, jittered by up
+// to half of it either way. The sendThrottle then caps the sustained rate;
+// the pacer only shapes when requests go out. A nil pacer never waits.
+type dispatchPacer struct {
+	mu      sync.Mutex
+	rampUp  time.Duration
+	gap     time.Duration
+	workers int
+	started int       // requests let through so far, up to workers
+	start   time.Time // of the first request
+	next    time.Time // earliest start of the next request under gap
+}
+
+// newDispatchPacer returns nil when both rampUp and gap are 0.
+func newDispatchPacer(rampUp, gap time.Duration, workers int) *dispatchPacer {
+	if rampUp <= 0 && gap <= 0 {
+		return nil
+	}
+	return &dispatchPacer{rampUp: rampUp, gap: gap, workers: max(workers, 1)}
+}
+
+// Wait blocks until the next chunk request may go out, and returns how
+// long it held it and why ("ramp-up" or "pacing").
+func (p *dispatchPacer) Wait(ctx context.Context) (time.Duration, string, error) {
+	if p == nil {
+		return 0, "", nil
+	}
+	p.mu.Lock()
+	now := time.Now()
+	if p.start.IsZero() {
+		p.start = now
+	}
+	at, why := now, ""
+	if p.started < p.workers && p.rampUp > 0 {
+		at = p.start.Add(p.rampUp * time.Duration(p.started) / time.Duration(p.workers))
+		why = "ramp-up"
+		p.started++
+	}
+	if p.gap > 0 && at.Before(p.next) {
+		at, why = p.next, "pacing"
+	}
+	if p.gap > 0 {
+		jitter := time.Duration(rand.Int64N(int64(p.gap)+1)) - p.gap/2
+		p.next = at.Add(p.gap + jitter)
+	}
+	p.mu.Unlock()
+
+	d := time.Until(at)
+	if d <= 0 {
+		return 0, "", nil
+	}
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return d, why, nil
+	case <-ctx.Done():
+		return 0, "", ctx.Err()
+	}
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// parsePartList parses an -only-parts list such as "5,12,40-42" into a set
+// of 1-based part numbers.
+func parsePartList(spec string) (map[int]bool, error) {
+	parts := map[int]bool{}
+	for _, field := range strings.Split(spec, ",") {
+		field = strings.TrimSpace(field)
+		if field == "" {
+			continue
+		}
+		lo, hi, isRange := strings.Cut(field, "-")
+		from, err := strconv.Atoi(lo)
+		if err != nil || from < 1 {
+			return nil, fmt.Errorf("-only-parts: invalid part %q", field)
+		}
+		to := from
+		if isRange {
+			if to, err = strconv.Atoi(hi); err != nil || to < from {
+				return nil, fmt.Errorf("-only-parts: invalid range %q", field)
+			}
+		}
+		for p := from; p <= to; p++ {
+			parts[p] = true
+		}
+	}
+	if len(parts) == 0 {
+		return nil, fmt.Errorf("-only-parts: no parts given")
+	}
+	return parts, nil
+}
+
+// formatPartList is the inverse of parsePartList: sorted part numbers with
+// runs collapsed, e.g. "5,12,40-42".
+func formatPartList(parts []int) string {
+	var b strings.Builder
+	for i := 0; i < len(parts); {
+		j := i
+		for j+1 < len(parts) && parts[j+1] == parts[j]+1 {
+			j++
+		}
+		if b.Len() > 0 {
+			b.WriteByte(',')
+		}
+		if j > i {
+			fmt.Fprintf(&b, "%d-%d", parts[i], parts[j])
+		} else {
+			b.WriteString(strconv.Itoa(parts[i]))
+		}
+		i = j + 1
+	}
+	return b.String()
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// PathTemplates holds the URL path (and query) for each API operation,
+// relative to the base URL. Placeholders are substituted per request:
+// {key} issue key, {uploadId}, {etag} and {partNumber}.
+type PathTemplates struct {
+	Create   string
+	Probe    string
+	Chunk    string
+	Finalize string
+	// Abort is optional: when set, a DELETE to it discards the session
+	// after the source file could not be read.
+	Abort string
+	// Lookup is optional: when set, a GET to it returns the attachment of a
+	// completed session in the finalize response format. It is used when
+	// finalize reports the upload as already completed without details.
+	Lookup string
+	// Permissions is what -check-permissions asks, with a GET, whether the
+	// token may attach to the issue; see CheckPermissions.
+	Permissions string
+	// Comment is where -comment posts the issue comment; see PostComment.
+	Comment string
+}
+
+// builtinTemplates are selectable by name with -path-template.
+var builtinTemplates = map[string]PathTemplates{
+	"transfer": {
+		Create:      "/api/upload/{key}/create",
+		Probe:       "/api/upload/{key}/chunk/probe?uploadId={uploadId}",
+		Chunk:       "/api/upload/{key}/chunk/{etag}?uploadId={uploadId}&partNumber={partNumber}",
+		Finalize:    "/api/upload/{key}/file/chunked?uploadId={uploadId}",
+		Permissions: "/rest/api/2/mypermissions?issueKey={key}&permissions=" + attachPermission,
+		Comment:     "/rest/api/2/issue/{key}/comment",
+	},
+}
+
+// requiredPlaceholders lists what each operation's template must contain for
+// the server to be able to tell requests apart.
+var requiredPlaceholders = map[string][]string{
+	"create":      {"{key}"},
+	"probe":       {"{key}", "{uploadId}"},
+	"chunk":       {"{key}", "{uploadId}", "{etag}", "{partNumber}"},
+	"finalize":    {"{key}", "{uploadId}"},
+	"abort":       {"{key}", "{uploadId}"},
+	"lookup":      {"{key}", "{uploadId}"},
+	"permissions": {"{key}"},
+	"comment":     {"{key}"},
+}
+
+// parsePathTemplates accepts either a built-in name or a list of
+// "op=path" pairs separated by ";", e.g.
+//
+//	create=/v2/{key}/uploads;chunk=/v2/{key}/uploads/{uploadId}/{partNumber}/{etag}
+//
+// Operations not listed keep the "transfer" template.
+func parsePathTemplates(spec string) (PathTemplates, error) {
+	if spec == "" {
+		return builtinTemplates["transfer"], nil
+	}
+	if pt, ok := builtinTemplates[spec]; ok {
+		return pt, nil
+	}
+	if !strings.Contains(spec, "=") {
+		names := make([]string, 0, len(builtinTemplates))
+		for n := range builtinTemplates {
+			names = append(names, n)
+		}
+		sort.Strings(names)
+		return PathTemplates{}, fmt.Errorf("unknown path template %q (built-in: %s)",
+			spec, strings.Join(names, ", "))
+	}
+
+	pt := builtinTemplates["transfer"]
+	for _, pair := range strings.Split(spec, ";") {
+		op, path, ok := strings.Cut(strings.TrimSpace(pair), "=")
+		if !ok {
+			return PathTemplates{}, fmt.Errorf("path template %q: expected op=path", pair)
+		}
+		switch op {
+		case "create":
+			pt.Create = path
+		case "probe":
+			pt.Probe = path
+		case "chunk":
+			pt.Chunk = path
+		case "finalize":
+			pt.Finalize = path
+		case "abort":
+			pt.Abort = path
+		case "lookup":
+			pt.Lookup = path
+		case "permissions":
+			pt.Permissions = path
+		case "comment":
+			pt.Comment = path
+		default:
+			return PathTemplates{}, fmt.Errorf("path template: unknown operation %q", op)
+		}
+	}
+	return pt, pt.validate()
+}
+
+func (pt PathTemplates) validate() error {
+	for op, tmpl := range map[string]string{
+		"create": pt.Create, "probe": pt.Probe, "chunk": pt.Chunk, "finalize": pt.Finalize, "abort": pt.Abort,
+		"lookup": pt.Lookup, "permissions": pt.Permissions, "comment": pt.Comment,
+	} {
+		if (op == "abort" || op == "lookup" || op == "permissions" || op == "comment") && tmpl == "" {
+			continue
+		}
+		if !strings.HasPrefix(tmpl, "/") {
+			return fmt.Errorf("path template for %s must start with /: %q", op, tmpl)
+		}
+		for _, ph := range requiredPlaceholders[op] {
+			if !strings.Contains(tmpl, ph) {
+				return fmt.Errorf("path template for %s is missing %s: %q", op, ph, tmpl)
+			}
+		}
+	}
+	return nil
+}
+
+// endpoint renders tmpl against the base URL, replacing placeholders from
+// the given name/value pairs.
+func (fu *FileUploader) endpoint(tmpl string, kv ...string) string {
+	r := strings.NewReplacer(append([]string{"{key}", fu.IssueKey}, kv...)...)
+	return strings.TrimRight(fu.BaseURL, "/") + r.Replace(tmpl)
+}
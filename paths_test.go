@@ -0,0 +1,78 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestParsePathTemplates(t *testing.T) {
+	transfer := builtinTemplates["transfer"]
+	custom := transfer
+	custom.Create = "/rest/v2/{key}/uploads"
+	custom.Chunk = "/rest/v2/{key}/uploads/{uploadId}/parts/{partNumber}/{etag}"
+
+	tests := []struct {
+		spec    string
+		want    PathTemplates
+		wantErr string
+	}{
+		{"", transfer, ""},
+		{"transfer", transfer, ""},
+		{"create=/rest/v2/{key}/uploads; chunk=/rest/v2/{key}/uploads/{uploadId}/parts/{partNumber}/{etag}", custom, ""},
+		{"jira", PathTemplates{}, `unknown path template "jira" (built-in: transfer)`},
+		{"create", PathTemplates{}, `unknown path template "create"`},
+		{"create=/x/{key};probe", PathTemplates{}, "expected op=path"},
+		{"upload=/x/{key}", PathTemplates{}, `unknown operation "upload"`},
+		{"create=x/{key}", PathTemplates{}, "must start with /"},
+		{"chunk=/x/{key}/{uploadId}/{etag}", PathTemplates{}, "chunk is missing {partNumber}"},
+	}
+	for _, tt := range tests {
+		got, err := parsePathTemplates(tt.spec)
+		if tt.wantErr != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("parsePathTemplates(%q) error %v, want one mentioning %q", tt.spec, err, tt.wantErr)
+			}
+			continue
+		}
+		if err != nil || got != tt.want {
+			t.Errorf("parsePathTemplates(%q) = %+v, %v; want %+v", tt.spec, got, err, tt.want)
+		}
+	}
+}
+
+// TestPathTemplateRequests checks that a run sends each operation to the
+// path its template gives, with the placeholders filled in.
+func TestPathTemplateRequests(t *testing.T) {
+	path, data := writeTestFile(t, 1000)
+	etag := generateETag("sha256", data)
+	var mu sync.Mutex
+	var got []string
+	rec := &finalizeRecorder{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		got = append(got, r.URL.RequestURI())
+		mu.Unlock()
+		rec.ServeHTTP(w, r)
+	}))
+	defer srv.Close()
+
+	fu := newTestUploader(t, path, srv.URL+"/")
+	var err error
+	if fu.Paths, err = parsePathTemplates("create=/v2/{key}/create;probe=/v2/{key}/{uploadId}/chunk/probe;" +
+		"chunk=/v2/{key}/{uploadId}/chunk/{partNumber}/{etag};finalize=/v2/{key}/{uploadId}/file/chunked"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fu.RunContext(t.Context()); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"/v2/TEST-1/create", "/v2/TEST-1/u1/chunk/probe", "/v2/TEST-1/u1/chunk/1/" + etag, "/v2/TEST-1/u1/file/chunked"}
+	if strings.Join(got, " ") != strings.Join(want, " ") {
+		t.Errorf("requests went to\n%s\nwant\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+	if len(rec.finalizes) != 1 {
+		t.Errorf("got %d finalize requests, want 1", len(rec.finalizes))
+	}
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	backoff "github.com/cenkalti/backoff/v4"
+)
+
+// attachPermission is the Jira project permission needed to add
+// attachments to an issue.
+const attachPermission = "CREATE_ATTACHMENTS"
+
+// CheckPermissions asks the server whether the token may attach files to
+// the issue, so a missing permission fails before any data is sent rather
+// than as a 403 at finalize. It uses the permissions path template, which
+// must answer in the format of Jira's mypermissions resource:
+//
+//	{"permissions": {"CREATE_ATTACHMENTS": {"havePermission": true}}}
+//
+// With several tokens only the one the pool hands out next is checked.
+func (fu *FileUploader) CheckPermissions(ctx context.Context) error {
+	if fu.Paths.Permissions == "" {
+		return fmt.Errorf("no permissions path template to check against")
+	}
+	op := func() error {
+		req, _ := http.NewRequestWithContext(ctx, "GET", fu.endpoint(fu.Paths.Permissions), nil)
+		req.Header.Set("Accept", "application/json")
+		resp, tok, err := fu.do(req)
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+
+		switch {
+		case resp.StatusCode == http.StatusUnauthorized:
+			return fu.unauthorized(tok)
+		case resp.StatusCode == http.StatusForbidden:
+			return backoff.Permanent(fmt.Errorf("%w: the server refused to list permissions on %s", errPermissionDenied, fu.IssueKey))
+		case resp.StatusCode == http.StatusNotFound:
+			// Jira answers 404 both for a missing issue and for one the
+			// account can't browse.
+			return backoff.Permanent(fmt.Errorf("%w: issue %s doesn't exist or isn't visible to this account", errPermissionDenied, fu.IssueKey))
+		case resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500:
+			return &statusError{op: "check permissions", status: resp.StatusCode}
+		case resp.StatusCode != http.StatusOK:
+			return backoff.Permanent(&statusError{op: "check permissions", status: resp.StatusCode})
+		}
+
+		var respJSON struct {
+			Permissions map[string]struct {
+				HavePermission bool `json:"havePermission"`
+			} `json:"permissions"`
+		}
+		if err := json.NewDecoder(resp.Body).Decode(&respJSON); err != nil {
+			return backoff.Permanent(fmt.Errorf("check permissions: decoding response: %w", err))
+		}
+		perm, ok := respJSON.Permissions[attachPermission]
+		switch {
+		case !ok:
+			return backoff.Permanent(fmt.Errorf("check permissions: response doesn't list %s", attachPermission))
+		case !perm.HavePermission:
+			return backoff.Permanent(fmt.Errorf("%w: this account can't add attachments to %s", errPermissionDenied, fu.IssueKey))
+		}
+		return nil
+	}
+
+	if err := backoff.Retry(op, fu.retryPolicy(ctx)); err != nil {
+		return err
+	}
+	fu.debugf("Token may add attachments to %s", fu.IssueKey)
+	return nil
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/vbauerster/mpb/v7/decor"
+)
+
+// prehashSampleBlocks is how many blocks shouldPrehash reads to time the
+// source before committing to hash all of it.
+const prehashSampleBlocks = 2
+
+// shouldPrehash decides whether ProbeFirst's full hashing pass is worth it.
+// On slow media, such as a network share, hashing a large file first can
+// take longer than the upload, so the first blocks are read and hashed to
+// estimate the whole pass. An estimate within PrehashLimit goes ahead;
+// beyond it PrehashConfirm, when set, is asked, and otherwise the upload
+// falls back to probing chunk by chunk as it goes.
+func (fu *FileUploader) shouldPrehash(r io.ReaderAt, offset, size, blockSize int64) (bool, error) {
+	sample := min(size, prehashSampleBlocks*blockSize)
+	if fu.PrehashLimit <= 0 || sample == size {
+		return true, nil
+	}
+	buf := make([]byte, blockSize)
+	start := time.Now()
+	for pos := offset; pos < offset+sample; pos += blockSize {
+		n, err := r.ReadAt(buf[:min(blockSize, offset+sample-pos)], pos)
+		if err != nil && err != io.EOF {
+			return false, fmt.Errorf("%w at offset %d: %w", errSourceRead, pos+int64(n), err)
+		}
+		generateETag(fu.HashAlgorithm, buf[:n])
+	}
+	took := max(time.Since(start), time.Millisecond)
+	rate := float64(sample) / took.Seconds()
+	estimate := time.Duration(float64(size) / rate * float64(time.Second))
+	fu.debugf("Read and hashed % .1f in %s (% .1f/s); hashing all % .1f first would take about %s",
+		decor.SizeB1024(sample), took.Round(time.Millisecond), decor.SizeB1024(int64(rate)),
+		decor.SizeB1024(size), estimate.Round(time.Second))
+	if estimate <= fu.PrehashLimit {
+		fu.debugf("Pre-hashing: the estimate is within %s", fu.PrehashLimit)
+		return true, nil
+	}
+	if fu.PrehashConfirm != nil {
+		hash := fu.PrehashConfirm(fu.FilePath, estimate, rate)
+		fu.debugf("Pre-hashing: %t, as answered", hash)
+		return hash, nil
+	}
+	ui.Warnf("%s: hashing it before the upload would take about %s at % .1f/s; probing chunk by chunk instead (-prehash always hashes first)",
+		fu.FilePath, estimate.Round(time.Second), decor.SizeB1024(int64(rate)))
+	return false, nil
+}
+
+// promptPrehash offers on the terminal to skip pre-hashing a slow file. It
+// serves as FileUploader.PrehashConfirm: "n" or "no" hashes anyway,
+// anything else skips.
+func promptPrehash(name string, estimate time.Duration, rate float64) bool {
+	fmt.Fprintf(os.Stderr, "Hashing %s before the upload would take about %s at % .1f/s.\n"+
+		"Skip it and probe chunk by chunk as the upload goes? [Y/n] ",
+		name, estimate.Round(time.Second), decor.SizeB1024(int64(rate)))
+	line, _ := bufio.NewReader(os.Stdin).ReadString('\n')
+	switch strings.ToLower(strings.TrimSpace(line)) {
+	case "n", "no":
+		return true
+	}
+	return false
+}
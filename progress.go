@@ -0,0 +1,176 @@
+package main
+
+import (
+	"context"
+	"os"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/vbauerster/mpb/v7"
+	"github.com/vbauerster/mpb/v7/decor"
+)
+
+// uploadProgress reports the chunks of one upload as they finish: to the
+// progress bar, or the plain lines standing in for it, the rate meter behind
+// both, the batch status line, ChunkStats and the progress events.
+// UploadReaderAt and UploadReader share it, so a stream is shown as a file
+// is, percentage and ETA aside.
+type uploadProgress struct {
+	fu    *FileUploader
+	meter *rateMeter
+	bar   *mpb.Bar
+	// total is the number of bytes the bar counts to, or -1 for a stream,
+	// whose size is only known at its end.
+	total int64
+	done  atomic.Int64
+	mu    sync.Mutex
+
+	p         *mpb.Progress
+	stopPlain func()
+}
+
+// newUploadProgress shows a bar labelled label for total bytes, -1 when the
+// size isn't known, that starts at the done bytes the server already has.
+// Workers report to it concurrently; mpb serialises bar updates itself.
+func (fu *FileUploader) newUploadProgress(label string, total, done int64) *uploadProgress {
+	up := &uploadProgress{fu: fu, meter: newRateMeter(max(total, 0)), total: total, stopPlain: func() {}}
+	if done > 0 {
+		up.meter.Add(done, false)
+		fu.Status.Add(done, false)
+	}
+	up.done.Store(done)
+	fu.retries = newRetryTracker()
+	var barOpts []mpb.ContainerOption
+	// A terminal too narrow for any bar gets a line now and then instead.
+	if fu.Status != nil {
+		barOpts = append(barOpts, mpb.WithOutput(nil))
+	} else if pickBarLayout(stdoutWidth()) == layoutPlain {
+		barOpts = append(barOpts, mpb.WithOutput(nil))
+		up.stopPlain = plainProgress(os.Stdout, label, up.meter, fu.retries, fu.Breaker)
+	}
+	up.p = mpb.New(barOpts...)
+	layout := &barLayoutSwitch{}
+	prepend := []decor.Decorator{
+		layout.Track(),
+		layout.Only(decor.Name(ui.Label(label), decor.WC{W: 10}), layoutFull),
+	}
+	speed := layout.Only(up.meter.SpeedDecorator(decor.WC{W: 32}), layoutFull)
+	currentSpeed := layout.Only(up.meter.CurrentSpeedDecorator(decor.WC{W: 14}), layoutCompact)
+	retries := layout.Only(fu.retries.Decorator(fu.Breaker), layoutFull)
+	var appended []decor.Decorator
+	if total < 0 {
+		prepend = append(prepend, decor.CurrentKibiByte("% .1f", decor.WC{W: 12}))
+		appended = []decor.Decorator{speed, currentSpeed, retries}
+	} else {
+		prepend = append(prepend,
+			layout.Only(decor.CountersKibiByte("% .1f / % .1f", decor.WC{W: 24}), layoutFull),
+			layout.Only(decor.Percentage(decor.WC{W: 5}), layoutCompact),
+		)
+		appended = []decor.Decorator{
+			layout.Only(decor.Percentage(decor.WC{W: 5}), layoutFull),
+			speed, currentSpeed,
+			layout.Only(up.meter.ETADecorator(decor.WC{W: 12}), layoutFull),
+			retries,
+		}
+	}
+	up.bar = up.p.AddBar(max(total, 0), mpb.PrependDecorators(prepend...), mpb.AppendDecorators(appended...))
+	if done > 0 {
+		up.bar.SetCurrent(done)
+	}
+	return up
+}
+
+// add counts chunk c as done: sent in attempts tries since start or, with
+// attempts 0, found on the server. A chunk that was sent is recorded in
+// ChunkStats.
+func (up *uploadProgress) add(c pendingChunk, attempts int, start time.Time) {
+	n := len(c.data)
+	if attempts > 0 {
+		up.mu.Lock()
+		up.fu.ChunkStats = append(up.fu.ChunkStats, chunkStat{Part: c.part, Bytes: n,
+			Attempts: attempts, Seconds: time.Since(start).Seconds()})
+		up.mu.Unlock()
+	}
+	up.meter.Add(int64(n), attempts > 0)
+	up.fu.Status.Add(int64(n), attempts > 0)
+	up.bar.IncrBy(n)
+	up.done.Add(int64(n))
+}
+
+// completed emits the chunk_completed event for c, with the bytes done so
+// far; a stream's has no bytesTotal.
+func (up *uploadProgress) completed(c pendingChunk, attempts int) {
+	ev := map[string]interface{}{
+		"index": c.part, "bytes": len(c.data), "skipped": attempts == 0, "attempts": attempts,
+		"bytesDone": up.done.Load(),
+	}
+	if up.total >= 0 {
+		ev["bytesTotal"] = up.total
+	}
+	up.fu.emit("chunk_completed", ev)
+}
+
+// finish takes the bar down, completing it unless err says the upload
+// failed, and waits for it to be drawn for the last time, so the caller's
+// messages never interleave with it. A stream's total becomes what was read.
+func (up *uploadProgress) finish(err error) {
+	if up.fu.barDone != nil {
+		up.fu.barDone(up.bar.Current(), up.bar.Completed())
+	}
+	if err == nil {
+		up.bar.SetTotal(up.total, true)
+	}
+	if !up.bar.Completed() {
+		up.bar.Abort(err != nil)
+	}
+	up.p.Wait()
+	up.stopPlain()
+	up.fu.retries = nil
+}
+
+// sendChunk uploads c to the session uploadID, unless the server has it
+// already, and returns the attempts it took: 0 for a chunk skipped.
+func (fu *FileUploader) sendChunk(ctx context.Context, c pendingChunk, uploadID string) (int, error) {
+	fu.emit("chunk_started", map[string]interface{}{"index": c.part, "bytes": len(c.data)})
+	span := chunkSpan{Part: c.part, Offset: c.offset, Size: len(c.data)}
+	return fu.processChunk(ctx, c.etag, c.data, span, uploadID)
+}
+
+// hashChunks starts HashWorkers goroutines that fill in the ETag of each
+// chunk from in and pass it on to out, which is closed after in is. Chunks
+// that arrive once ctx is cancelled are dropped.
+func (fu *FileUploader) hashChunks(ctx context.Context, in <-chan pendingChunk, out chan<- pendingChunk) {
+	var wg sync.WaitGroup
+	for range max(fu.HashWorkers, 1) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for c := range in {
+				if ctx.Err() != nil {
+					continue
+				}
+				start := time.Now()
+				c.etag = generateETag(fu.HashAlgorithm, c.data)
+				since(&fu.work.hash, start)
+				out <- c
+			}
+		}()
+	}
+	go func() {
+		wg.Wait()
+		close(out)
+	}()
+}
+
+// partOrder sorts chunks by part number and returns their ETags in that
+// order, as finalize lists them.
+func partOrder(chunks []chunkResult) []string {
+	sort.Slice(chunks, func(i, j int) bool { return chunks[i].Index < chunks[j].Index })
+	etags := make([]string, len(chunks))
+	for i, c := range chunks {
+		etags[i] = c.ETag
+	}
+	return etags
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"runtime"
+	"strings"
+)
+
+// canPrompt reports whether a person is there to answer promptToken: stdin
+// and stderr are terminals and the run isn't under CI.
+func canPrompt() bool {
+	return isTerminal(os.Stdin) && isTerminal(os.Stderr) && os.Getenv("CI") == ""
+}
+
+// promptToken asks on the terminal for a token to replace one the server
+// rejected mid-run, so a long upload can carry on instead of starting over.
+// It serves as FileUploader.RefreshToken; an empty answer aborts. Where
+// stty is available the token isn't echoed.
+func promptToken() (string, error) {
+	fmt.Fprint(os.Stderr, "\nAuthentication failed. Re-enter token to continue, or press Enter to abort: ")
+	if runtime.GOOS != "windows" && stty("-echo") == nil {
+		defer func() {
+			stty("echo")
+			fmt.Fprintln(os.Stderr)
+		}()
+	}
+	line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	tok := strings.TrimSpace(line)
+	if tok == "" {
+		if err != nil {
+			return "", err
+		}
+		return "", errors.New("no new token entered")
+	}
+	return tok, nil
+}
+
+func stty(arg string) error {
+	cmd := exec.Command("stty", arg)
+	cmd.Stdin = os.Stdin
+	return cmd.Run()
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/vbauerster/mpb/v7/decor"
+)
+
+// rateWindow is how far back the "current" transfer speed looks.
+const rateWindow = 30 * time.Second
+
+type rateSample struct {
+	at time.Time
+	n  int64
+}
+
+// rateMeter tracks bytes sent per completed chunk so the progress bar can
+// show the recent speed next to the run average, and base the ETA on the
+// recent one. Chunks skipped because the server already had them count
+// towards completion but not towards speed.
+type rateMeter struct {
+	mu      sync.Mutex
+	start   time.Time
+	size    int64
+	done    int64
+	sent    int64
+	samples []rateSample
+}
+
+func newRateMeter(size int64) *rateMeter {
+	return &rateMeter{start: time.Now(), size: size}
+}
+
+// Add records a finished chunk of n bytes; sent is false when it was
+// skipped rather than transferred.
+func (m *rateMeter) Add(n int64, sent bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.done += n
+	if !sent {
+		return
+	}
+	now := time.Now()
+	m.sent += n
+	m.samples = append(m.samples, rateSample{at: now, n: n})
+	cut := 0
+	for cut < len(m.samples) && now.Sub(m.samples[cut].at) > rateWindow {
+		cut++
+	}
+	m.samples = m.samples[cut:]
+}
+
+// rates returns the windowed and overall speeds in bytes per second.
+func (m *rateMeter) rates() (current, average float64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	now := time.Now()
+	elapsed := now.Sub(m.start)
+	if elapsed <= 0 {
+		return 0, 0
+	}
+	average = float64(m.sent) / elapsed.Seconds()
+
+	span := rateWindow
+	if elapsed < span {
+		span = elapsed
+	}
+	var n int64
+	for _, s := range m.samples {
+		if now.Sub(s.at) <= rateWindow {
+			n += s.n
+		}
+	}
+	current = float64(n) / span.Seconds()
+	return current, average
+}
+
+// SpeedDecorator renders "12.3 MiB/s (avg 10.1 MiB/s)".
+func (m *rateMeter) SpeedDecorator(wcc ...decor.WC) decor.Decorator {
+	return decor.Any(func(decor.Statistics) string {
+		cur, avg := m.rates()
+		return fmt.Sprintf("% .1f/s (avg % .1f/s)", decor.SizeB1024(int64(cur)), decor.SizeB1024(int64(avg)))
+	}, wcc...)
+}
+
+// ETADecorator estimates the remaining time from the windowed speed, so it
+// reacts within rateWindow when the link slows down.
+func (m *rateMeter) ETADecorator(wcc ...decor.WC) decor.Decorator {
+	return decor.Any(func(st decor.Statistics) string {
+		if st.Completed {
+			return ""
+		}
+		cur, _ := m.rates()
+		m.mu.Lock()
+		remaining := m.size - m.done
+		m.mu.Unlock()
+		if cur <= 0 || remaining <= 0 {
+			return "ETA --"
+		}
+		eta := time.Duration(float64(remaining) / cur * float64(time.Second))
+		return "ETA " + eta.Round(time.Second).String()
+	}, wcc...)
+}
+
+// CurrentSpeedDecorator renders the windowed speed alone, "12.3 MiB/s", for
+// narrow terminals.
+func (m *rateMeter) CurrentSpeedDecorator(wcc ...decor.WC) decor.Decorator {
+	return decor.Any(func(decor.Statistics) string {
+		cur, _ := m.rates()
+		return fmt.Sprintf("% .1f/s", decor.SizeB1024(int64(cur)))
+	}, wcc...)
+}
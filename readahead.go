@@ -0,0 +1,108 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+const (
+	// defaultMaxMemory is what MaxMemory 0 means: the budget for chunks
+	// read ahead of the upload workers.
+	defaultMaxMemory = 1 << 30
+	// readAheadStarved is how long an upload worker may wait for its next
+	// chunk before the read-ahead is deepened.
+	readAheadStarved = 50 * time.Millisecond
+	// readAheadStale is how long a chunk may wait to be picked up before
+	// the read-ahead is made shallower, and how often at most that happens:
+	// every chunk queued behind a stale one is about as stale.
+	readAheadStale = 5 * time.Second
+)
+
+// readAhead sets how many chunks the reader may have read and hashed ahead
+// of the upload workers. A fixed depth either starves the network when the
+// disk hiccups or fills memory when the network is the slower side, so it
+// adapts: a worker that had to wait for a chunk deepens it by one, up to
+// limit, and a chunk that sat queued for readAheadStale makes it one
+// shallower, down to 1. Whatever the depth, the queued chunks never add up
+// to more than budget bytes, also when -adaptive grows them past the
+// block size limit was worked out from. The reader calls Acquire before
+// reading each chunk and the worker that picks it up calls Take.
+type readAhead struct {
+	mu         sync.Mutex
+	depth      int
+	limit      int
+	queued     int
+	budget     int64
+	bytes      int64 // of the queued chunks
+	low, high  int
+	lastShrink time.Time
+	wake       chan struct{} // a slot freed up
+	debugf     func(format string, args ...interface{})
+	now        func() time.Time // the clock; time.Now but in tests
+}
+
+// readAheadStats is the read-ahead depth at the end of a run, the range it
+// moved in and its limit, for -stats.
+type readAheadStats struct {
+	Depth, Low, High, Limit int
+}
+
+func newReadAhead(depth, limit int, budget int64, debugf func(string, ...interface{})) *readAhead {
+	limit = max(limit, 1)
+	depth = min(max(depth, 1), limit)
+	return &readAhead{depth: depth, limit: limit, budget: budget, low: depth, high: depth, wake: make(chan struct{}, 1),
+		debugf: debugf, now: time.Now}
+}
+
+// Acquire waits until fewer than depth chunks are queued and a chunk of n
+// bytes fits in the budget beside them, and counts it. A chunk larger than
+// the whole budget still goes ahead once nothing else is queued.
+func (r *readAhead) Acquire(ctx context.Context, n int64) error {
+	for {
+		r.mu.Lock()
+		if r.queued < r.depth && (r.queued == 0 || r.bytes+n <= r.budget) {
+			r.queued++
+			r.bytes += n
+			r.mu.Unlock()
+			return nil
+		}
+		r.mu.Unlock()
+		select {
+		case <-r.wake:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// Take records a worker picking up a chunk of n bytes, as acquired, that
+// was read at readAt, after waiting waited for it.
+func (r *readAhead) Take(n int64, readAt time.Time, waited time.Duration) {
+	r.mu.Lock()
+	now := r.now()
+	r.queued--
+	r.bytes -= n
+	switch {
+	case waited >= readAheadStarved && r.depth < r.limit:
+		r.depth++
+		r.high = max(r.high, r.depth)
+		r.debugf("Upload worker waited %s for data; reading %d chunks ahead", waited.Round(time.Millisecond), r.depth)
+	case now.Sub(readAt) >= readAheadStale && r.depth > 1 && now.Sub(r.lastShrink) >= readAheadStale:
+		r.depth--
+		r.low = min(r.low, r.depth)
+		r.lastShrink = now
+		r.debugf("Chunks waited %s for an upload worker; reading %d chunks ahead", now.Sub(readAt).Round(time.Second), r.depth)
+	}
+	r.mu.Unlock()
+	select {
+	case r.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (r *readAhead) Stats() readAheadStats {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return readAheadStats{Depth: r.depth, Low: r.low, High: r.high, Limit: r.limit}
+}
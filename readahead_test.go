@@ -0,0 +1,163 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+// fakeClock is a clock for readAhead that only moves when told to.
+type fakeClock struct{ t time.Time }
+
+func newFakeClock() *fakeClock { return &fakeClock{t: time.Unix(1_700_000_000, 0)} }
+
+func (c *fakeClock) Now() time.Time { return c.t }
+
+func (c *fakeClock) Advance(d time.Duration) { c.t = c.t.Add(d) }
+
+func nopDebugf(string, ...interface{}) {}
+
+// simulate runs chunks through r with the reader producing one every
+// readEvery and the workers consuming one every sendEvery, one at a time.
+// A worker that comes for a chunk before it is read waits for it; a chunk
+// read before a worker is free waits in the queue.
+func simulate(t *testing.T, r *readAhead, clock *fakeClock, chunks int, readEvery, sendEvery time.Duration) {
+	t.Helper()
+	ctx := t.Context()
+	readAt := make([]time.Time, 0, chunks)
+	start := clock.Now()
+	nextRead, nextFree := start, start
+	for i := 0; i < chunks; i++ {
+		// The reader reads as soon as the read-ahead has room and the
+		// disk is ready.
+		for len(readAt) < chunks && len(readAt)-i < r.Stats().Depth {
+			nextRead = nextRead.Add(readEvery)
+			readAt = append(readAt, nextRead)
+			if err := r.Acquire(ctx, 1); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if len(readAt) <= i {
+			t.Fatalf("chunk %d never read", i)
+		}
+		waited := time.Duration(0)
+		if ready := readAt[i]; ready.After(nextFree) {
+			waited = ready.Sub(nextFree)
+			nextFree = ready
+		}
+		clock.t = nextFree
+		r.Take(1, readAt[i], waited)
+		nextFree = nextFree.Add(sendEvery)
+	}
+}
+
+func TestReadAheadGrowsWhenWorkersWait(t *testing.T) {
+	clock := newFakeClock()
+	r := newReadAhead(2, 6, 1<<30, nopDebugf)
+	r.now = clock.Now
+	// A disk slower than the network: every chunk is waited for.
+	simulate(t, r, clock, 20, 200*time.Millisecond, 10*time.Millisecond)
+	st := r.Stats()
+	if st.Depth != 6 || st.High != 6 || st.Low != 2 {
+		t.Errorf("stats %+v, want depth 6 (the limit), high 6, low 2", st)
+	}
+}
+
+func TestReadAheadShrinksWhenChunksGoStale(t *testing.T) {
+	clock := newFakeClock()
+	r := newReadAhead(4, 8, 1<<30, nopDebugf)
+	r.now = clock.Now
+	// A network far slower than the disk: chunks sit queued for longer
+	// than readAheadStale, and the depth comes down one step per
+	// readAheadStale until it reaches 1.
+	simulate(t, r, clock, 30, time.Millisecond, 3*time.Second)
+	st := r.Stats()
+	if st.Depth != 1 || st.Low != 1 || st.High != 4 {
+		t.Errorf("stats %+v, want depth 1, low 1, high 4", st)
+	}
+}
+
+func TestReadAheadShrinksAtMostOncePerStaleInterval(t *testing.T) {
+	clock := newFakeClock()
+	r := newReadAhead(5, 5, 1<<30, nopDebugf)
+	r.now = clock.Now
+	ctx := t.Context()
+	for i := 0; i < 5; i++ {
+		r.Acquire(ctx, 1)
+	}
+	readAt := clock.Now()
+	clock.Advance(readAheadStale)
+	// Every chunk queued behind the first is about as stale, but only the
+	// first counts.
+	for i := 0; i < 4; i++ {
+		r.Take(1, readAt, 0)
+	}
+	if d := r.Stats().Depth; d != 4 {
+		t.Fatalf("depth %d after four stale chunks at once, want 4", d)
+	}
+	clock.Advance(readAheadStale)
+	r.Take(1, readAt, 0)
+	if d := r.Stats().Depth; d != 3 {
+		t.Errorf("depth %d after another stale interval, want 3", d)
+	}
+}
+
+func TestReadAheadAcquireBlocksAtDepth(t *testing.T) {
+	r := newReadAhead(2, 2, 1<<30, nopDebugf)
+	ctx, cancel := context.WithTimeout(t.Context(), 20*time.Millisecond)
+	defer cancel()
+	for i := 0; i < 2; i++ {
+		if err := r.Acquire(ctx, 1); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := r.Acquire(ctx, 1); err == nil {
+		t.Fatal("a third Acquire at depth 2 didn't block")
+	}
+	r.Take(1, time.Now(), 0)
+	if err := r.Acquire(t.Context(), 1); err != nil {
+		t.Errorf("Acquire after a Take: %v", err)
+	}
+}
+
+// TestReadAheadByteBudget checks that the chunks queued never add up to
+// more than the budget while -adaptive grows them past the block size the
+// depth limit was worked out from, and that a chunk larger than the whole
+// budget still gets through on its own.
+func TestReadAheadByteBudget(t *testing.T) {
+	const budget = 64 << 20
+	r := newReadAhead(4, budget/minBlockSize, budget, nopDebugf)
+	sizer := newAdaptiveSizer(minBlockSize)
+	queue := make(chan int64, 64)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for n := range queue {
+			time.Sleep(time.Millisecond)
+			r.Take(n, time.Now(), readAheadStarved)
+			// Fast uploads: the size doubles with each one, up to
+			// maxBlockSize.
+			sizer.Observe(n, time.Millisecond, 1)
+		}
+	}()
+	grown := false
+	for range 40 {
+		n := sizer.Next()
+		if err := r.Acquire(t.Context(), n); err != nil {
+			t.Fatal(err)
+		}
+		r.mu.Lock()
+		queued, bytes := r.queued, r.bytes
+		r.mu.Unlock()
+		if queued > 1 && bytes > budget {
+			t.Fatalf("%d chunks of up to %d bytes queued, %d bytes in all; budget %d", queued, n, bytes, budget)
+		}
+		grown = grown || n == maxBlockSize
+		queue <- n
+	}
+	close(queue)
+	<-done
+	if !grown {
+		t.Error("chunks never grew to maxBlockSize")
+	}
+}
@@ -0,0 +1,38 @@
+package main
+
+import "io"
+
+// cappedReader hands each Read on to r with at most size bytes asked for.
+// io.ReadFull then fills a chunk in reads of that size, straight into the
+// chunk's buffer: a bufio.Reader would copy every byte, and bypasses its
+// buffer for reads larger than it anyway. Some network filesystems and
+// FUSE mounts stream steadily in moderate reads but stall on one read of a
+// whole 100 MiB chunk. Seeks go to the underlying reader.
+type cappedReader struct {
+	io.ReadSeeker
+	size int
+}
+
+func (c *cappedReader) Read(p []byte) (int, error) {
+	if len(p) > c.size {
+		p = p[:c.size]
+	}
+	return c.ReadSeeker.Read(p)
+}
+
+// sourceReader reads the size bytes at offset of r in order, for the
+// upload's reader: in reads of ReadBuffer bytes when it is set, and with
+// the OS told to read ahead sequentially unless NoReadAdvice.
+func (fu *FileUploader) sourceReader(r io.ReaderAt, offset, size int64) io.ReadSeeker {
+	if !fu.NoReadAdvice {
+		if err := adviseSequential(r, offset, size); err != nil {
+			fu.debugf("Sequential read-ahead hint not applied: %v", err)
+		}
+	}
+	var src io.ReadSeeker = io.NewSectionReader(r, offset, size)
+	if fu.ReadBuffer > 0 {
+		fu.debugf("Reading %s in reads of %d bytes", fu.FilePath, fu.ReadBuffer)
+		src = &cappedReader{ReadSeeker: src, size: fu.ReadBuffer}
+	}
+	return src
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"testing"
+)
+
+// BenchmarkReadBuffer reads a file in chunks through sourceReader with
+// each -read-buffer size, 0 being one read per chunk.
+func BenchmarkReadBuffer(b *testing.B) {
+	path, _ := writeTestFile(b, benchFileSize)
+	file, err := os.Open(path)
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer file.Close()
+	buf := make([]byte, benchBlockSize)
+	for _, size := range []int{0, 64 << 10, 1 << 20, 8 << 20} {
+		b.Run(fmt.Sprintf("read-buffer=%d", size), func(b *testing.B) {
+			fu := newTestUploader(b, path, "")
+			fu.ReadBuffer = size
+			b.SetBytes(benchFileSize)
+			for i := 0; i < b.N; i++ {
+				src := fu.sourceReader(file, 0, benchFileSize)
+				for {
+					if _, err := io.ReadFull(src, buf); err == io.EOF {
+						break
+					} else if err != nil {
+						b.Fatal(err)
+					}
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/cenkalti/backoff/v4"
+)
+
+// maxRedirects is how many redirects a request follows, as net/http's own
+// default policy.
+const maxRedirects = 10
+
+// redirectPolicy is the CheckRedirect of the uploader's clients. Some
+// deployments answer chunk uploads with a 307 to a nearer ingestion host;
+// net/http follows it, resending the body through GetBody, but drops the
+// Authorization header unless the new host is the original one or a
+// subdomain of it, and the request then fails with a 401 that looks like a
+// bad token. The policy puts the credentials back for a subdomain of the
+// original host (eu.acme.example.net for acme.example.net) or a host that
+// matches one of trusted, each a host or a domain and its subdomains. Hosts
+// beside the original one, even under the same parent domain, aren't
+// trusted: on a shared domain such as atlassian.net or co.uk they belong to
+// someone else. A redirect to any other host is refused, for good, naming
+// both hosts.
+func redirectPolicy(trusted []string) func(req *http.Request, via []*http.Request) error {
+	return func(req *http.Request, via []*http.Request) error {
+		if len(via) >= maxRedirects {
+			return fmt.Errorf("stopped after %d redirects", maxRedirects)
+		}
+		first := via[0]
+		from, to := first.URL.Hostname(), req.URL.Hostname()
+		if strings.EqualFold(from, to) {
+			return nil
+		}
+		if !redirectTrusted(from, to, trusted) {
+			return backoff.Permanent(fmt.Errorf("%w: %s redirected the request to %s; "+
+				"pass -trust-redirect-hosts %s to send it there with your credentials",
+				errUntrustedRedirect, from, to, to))
+		}
+		if req.Body == nil && first.ContentLength > 0 {
+			return backoff.Permanent(fmt.Errorf("%s redirected the request to %s, but its body can't be sent again", from, to))
+		}
+		if auth := first.Header.Get("Authorization"); auth != "" {
+			req.Header.Set("Authorization", auth)
+		}
+		return nil
+	}
+}
+
+// redirectTrusted reports whether a redirect from host from may take the
+// credentials to host to; see redirectPolicy.
+func redirectTrusted(from, to string, trusted []string) bool {
+	from, to = strings.ToLower(from), strings.ToLower(to)
+	for _, t := range trusted {
+		if t = strings.ToLower(strings.TrimPrefix(strings.TrimSpace(t), "*.")); t != "" && domainMatch(to, t) {
+			return true
+		}
+	}
+	// An IP address has no subdomains.
+	return net.ParseIP(from) == nil && domainMatch(to, from)
+}
+
+// domainMatch reports whether host is domain or one of its subdomains.
+func domainMatch(host, domain string) bool {
+	return host == domain || strings.HasSuffix(host, "."+domain)
+}
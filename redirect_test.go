@@ -0,0 +1,117 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestRedirectTrusted(t *testing.T) {
+	tests := []struct {
+		from, to string
+		trusted  []string
+		want     bool
+	}{
+		{"acme.example.net", "eu.acme.example.net", nil, true},
+		{"acme.example.net", "EU.Acme.Example.net", nil, true},
+		{"acme.example.net", "other.example.net", nil, false},
+		{"acme.example.net", "example.net", nil, false},
+		{"mysite.atlassian.net", "attacker.atlassian.net", nil, false},
+		{"example.co.uk", "evil.co.uk", nil, false},
+		{"example.co.uk", "cdn.example.co.uk", nil, true},
+		{"10.0.0.1", "10.0.0.2", nil, false},
+		{"acme.example.net", "ingest.example.org", []string{"ingest.example.org"}, true},
+		{"acme.example.net", "eu.ingest.example.org", []string{" *.ingest.example.org"}, true},
+		{"acme.example.net", "ingest.example.org.evil.com", []string{"ingest.example.org"}, false},
+		{"acme.example.net", "cdn.example.org", []string{"", "ingest.example.org"}, false},
+	}
+	for _, tt := range tests {
+		if got := redirectTrusted(tt.from, tt.to, tt.trusted); got != tt.want {
+			t.Errorf("redirectTrusted(%q, %q, %q) = %v, want %v", tt.from, tt.to, tt.trusted, got, tt.want)
+		}
+	}
+}
+
+// authEcho answers with the Authorization header and body it received.
+func authEcho(w http.ResponseWriter, r *http.Request) {
+	body, _ := io.ReadAll(r.Body)
+	io.WriteString(w, r.Header.Get("Authorization")+"|"+string(body))
+}
+
+// redirectTo answers every request with a 307 to target.
+func redirectTo(target string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(io.Discard, r.Body)
+		http.Redirect(w, r, target, http.StatusTemporaryRedirect)
+	}
+}
+
+// postThrough sends a chunk-like POST with credentials to url through a
+// client using redirectPolicy(trusted) and returns what the final server
+// echoed.
+func postThrough(t *testing.T, url string, trusted []string) (string, error) {
+	t.Helper()
+	client := &http.Client{CheckRedirect: redirectPolicy(trusted)}
+	req, _ := http.NewRequest("POST", url, strings.NewReader("chunk"))
+	req.SetBasicAuth("user", "secret")
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	data, _ := io.ReadAll(resp.Body)
+	return string(data), nil
+}
+
+// localhostURL is srv's URL under the name localhost instead of its
+// address, so a redirect there changes host.
+func localhostURL(srv *httptest.Server) string {
+	_, port, _ := net.SplitHostPort(srv.Listener.Addr().String())
+	return "http://localhost:" + port
+}
+
+func TestRedirectPolicy(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/final", authEcho)
+	mux.Handle("/moved", redirectTo("/final"))
+	target := httptest.NewServer(mux)
+	defer target.Close()
+	auth := "Basic dXNlcjpzZWNyZXQ=|chunk"
+
+	t.Run("same host", func(t *testing.T) {
+		got, err := postThrough(t, target.URL+"/moved", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != auth {
+			t.Errorf("server got %q, want %q", got, auth)
+		}
+	})
+
+	origin := httptest.NewServer(redirectTo(localhostURL(target) + "/final"))
+	defer origin.Close()
+
+	t.Run("trusted host", func(t *testing.T) {
+		got, err := postThrough(t, origin.URL, []string{"localhost"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != auth {
+			t.Errorf("server got %q, want %q", got, auth)
+		}
+	})
+
+	t.Run("untrusted host", func(t *testing.T) {
+		_, err := postThrough(t, origin.URL, []string{"ingest.example.org"})
+		if !errors.Is(err, errUntrustedRedirect) {
+			t.Fatalf("got error %v, want %v", err, errUntrustedRedirect)
+		}
+		if msg := err.Error(); !strings.Contains(msg, "127.0.0.1") || !strings.Contains(msg, "localhost") {
+			t.Errorf("error %q doesn't name both hosts", msg)
+		}
+	})
+}
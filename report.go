@@ -0,0 +1,133 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/vbauerster/mpb/v7/decor"
+)
+
+// reportTimeLayout formats the report's timestamps.
+const reportTimeLayout = "2006-01-02 15:04:05 MST"
+
+// parseReportSpec parses -report, currently only "markdown=PATH", and
+// returns the path.
+func parseReportSpec(spec string) (string, error) {
+	format, path, ok := strings.Cut(spec, "=")
+	switch {
+	case !ok || path == "":
+		return "", fmt.Errorf("-report: expected format=PATH, e.g. markdown=report.md")
+	case format != "markdown":
+		return "", fmt.Errorf("-report: unknown format %q (supported: markdown)", format)
+	}
+	return path, nil
+}
+
+// writeMarkdownReport writes the batch as a Markdown document for pasting
+// into a runbook or Confluence page: the counts, then per file its details,
+// phase timings, what the server already had, retries, the attachment link
+// and, for a failure, the error and failed parts. It reads the same
+// fileResult records as the JSON outputs, so the two can't disagree.
+func writeMarkdownReport(path string, s batchSummary) error {
+	var b strings.Builder
+	b.WriteString("# Upload report\n\n")
+	fmt.Fprintf(&b, "%d uploaded, %d skipped, %d failed", s.Succeeded, s.Skipped, s.Failed)
+	if len(s.Results) > 0 {
+		first, last := s.Results[0].Started, s.Results[0].Finished
+		for _, r := range s.Results[1:] {
+			if r.Finished.After(last) {
+				last = r.Finished
+			}
+		}
+		fmt.Fprintf(&b, ", %s to %s", first.Local().Format(reportTimeLayout), last.Local().Format(reportTimeLayout))
+	}
+	b.WriteString(".\n")
+	for _, r := range s.Results {
+		writeReportFile(&b, r)
+	}
+	return writeFileAtomic(path, []byte(b.String()))
+}
+
+func writeReportFile(b *strings.Builder, r fileResult) {
+	fmt.Fprintf(b, "\n## %s → %s\n\n", r.Name, r.IssueKey)
+	b.WriteString("| | |\n|---|---|\n")
+	row := func(key, format string, args ...interface{}) {
+		fmt.Fprintf(b, "| %s | %s |\n", key, markdownCell(fmt.Sprintf(format, args...)))
+	}
+	// Code spans show backslashes literally, so their text isn't escaped.
+	code := func(key, value string) {
+		fmt.Fprintf(b, "| %s | `%s` |\n", key, strings.NewReplacer("`", "'", "|", `\|`).Replace(value))
+	}
+	row("Status", "%s", r.Status)
+	row("Issue", "%s", r.IssueKey)
+	row("File", "%s", r.File)
+	if a := r.Attachment; a != nil && a.DownloadURL != "" {
+		// Not escaped, so the link survives.
+		fmt.Fprintf(b, "| Attachment | [%s](%s) |\n", markdownCell(a.ID), a.DownloadURL)
+	} else if r.AttachmentID != "" {
+		row("Attachment", "%s", r.AttachmentID)
+	}
+	row("Size", "% .1f (%d bytes)", decor.SizeB1024(r.Size), r.Size)
+	if r.SHA256 != "" {
+		code("SHA-256", r.SHA256)
+	}
+	if r.UploadID != "" {
+		code("Upload ID", r.UploadID)
+	}
+	row("Started", "%s", r.Started.Local().Format(reportTimeLayout))
+	row("Finished", "%s", r.Finished.Local().Format(reportTimeLayout))
+	row("Duration", "%s", reportDuration(r.Finished.Sub(r.Started)))
+	if r.Status == "skipped" {
+		row("Skipped", "%s", r.Reason)
+	} else {
+		row("Sent", "% .1f", decor.SizeB1024(r.BytesSent))
+		if r.BytesSkipped > 0 {
+			row("Already on the server", "% .1f (%d%%)", decor.SizeB1024(r.BytesSkipped), percentOf(r.BytesSkipped, r.Size))
+		}
+		row("Retries", "%d", r.Retries)
+	}
+
+	if len(r.Phases) > 0 {
+		b.WriteString("\n| Phase | Duration |\n|-------|----------|\n")
+		for _, p := range r.Phases {
+			fmt.Fprintf(b, "| %s | %s |\n", p.Name, reportDuration(time.Duration(p.Seconds*float64(time.Second))))
+		}
+	}
+
+	if r.Status != "failed" {
+		return
+	}
+	fmt.Fprintf(b, "\n**Error:** %s\n", markdownText(r.Error))
+	if len(r.FailedParts) > 0 {
+		b.WriteString("\n| Part | Bytes | Attempts | Error |\n|------|-------|----------|-------|\n")
+		for _, f := range r.FailedParts {
+			fmt.Fprintf(b, "| %d | %d-%d | %d | %s |\n", f.Part, f.Offset, f.Offset+int64(f.Size)-1, f.Attempts,
+				markdownCell(f.Error))
+		}
+	}
+}
+
+// reportDuration rounds d to what a reader cares about: milliseconds below
+// a second, tenths of a second below a minute, seconds above.
+func reportDuration(d time.Duration) string {
+	switch {
+	case d < time.Second:
+		return d.Round(time.Millisecond).String()
+	case d < time.Minute:
+		return d.Round(100 * time.Millisecond).String()
+	}
+	return d.Round(time.Second).String()
+}
+
+// markdownCell escapes text for a table cell.
+func markdownCell(s string) string {
+	return strings.ReplaceAll(markdownText(s), "|", `\|`)
+}
+
+// markdownText keeps text on one line and stops it from being read as
+// markup.
+func markdownText(s string) string {
+	s = strings.NewReplacer("\r", "", "\n", " ").Replace(s)
+	return strings.NewReplacer(`\`, `\\`, "*", `\*`, "_", `\_`, "<", "&lt;", "[", `\[`).Replace(s)
+}
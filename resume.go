@@ -0,0 +1,365 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// resumeStateVersion is the format saveResumeState writes. Files without a
+// version predate it: the bare session fields, no checksum, no file
+// identity. loadResumeState still reads them, and openSession rewrites them
+// in the current format.
+const resumeStateVersion = 1
+
+// errResumeCorrupt is a resume file that can't be trusted: truncated by a
+// crash mid-write, or edited so that its checksum no longer matches. It is
+// discarded rather than failing the run.
+var errResumeCorrupt = errors.New("resume file is corrupt")
+
+// resumeState is written right after the upload session is created, so a
+// later run can reattach to the same uploadId. Per-chunk progress lives in
+// the append-only ETag log instead of being rewritten here; Parts is only
+// a snapshot of the parts confirmed when a run stopped short of finalizing,
+// which lets a resume without -etag-log skip them too. Fields a later
+// version adds are ignored on reading, and kept by the checksum.
+type resumeState struct {
+	Version int `json:"version"`
+	// WrittenBy is the version of the tool that wrote the file.
+	WrittenBy string `json:"writtenBy,omitempty"`
+	BaseURL   string `json:"baseUrl,omitempty"`
+	UploadID  string `json:"uploadId"`
+	IssueKey  string `json:"issueKey"`
+	Size      int64  `json:"size"`
+	BlockSize int64  `json:"blockSize"`
+	// HashAlgorithm is absent from files written before -hash-algorithm
+	// existed; those were always sha256.
+	HashAlgorithm string `json:"hashAlgorithm,omitempty"`
+	// Offset is the start of the -offset/-length range; Size is its length.
+	Offset int64 `json:"offset,omitempty"`
+	// File identifies the source file, so a resume against another one, or
+	// the same one changed, is refused; nil when the source isn't a file.
+	File  *fileIdentity  `json:"file,omitempty"`
+	Parts map[int]string `json:"parts,omitempty"`
+	// Checksum is the SHA-256 of the rest of the file; see stateChecksum.
+	Checksum string `json:"checksum,omitempty"`
+}
+
+// fileIdentity is what a resume checks the source against: its whole size,
+// modification time and, where the platform has them, inode number.
+type fileIdentity struct {
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"modTime"`
+	Inode   uint64    `json:"inode,omitempty"`
+}
+
+func identify(fi os.FileInfo) *fileIdentity {
+	if fi == nil {
+		return nil
+	}
+	return &fileIdentity{Size: fi.Size(), ModTime: fi.ModTime(), Inode: inode(fi)}
+}
+
+// mismatch says how the file now differs from id, or "" when it doesn't.
+func (id *fileIdentity) mismatch(now *fileIdentity) string {
+	switch {
+	case id == nil || now == nil:
+		return ""
+	case id.Inode != 0 && now.Inode != 0 && id.Inode != now.Inode:
+		return fmt.Sprintf("it was written for another file (inode %d, this one is %d)", id.Inode, now.Inode)
+	case id.Size != now.Size:
+		return fmt.Sprintf("the file was %d bytes then and is %d now", id.Size, now.Size)
+	case !id.ModTime.Equal(now.ModTime):
+		return fmt.Sprintf("the file was modified since (%s, now %s)",
+			id.ModTime.Format(time.RFC3339), now.ModTime.Format(time.RFC3339))
+	}
+	return ""
+}
+
+// stateChecksum hashes the fields of a state file other than checksum, in
+// a canonical form (compact, keys sorted) so that it doesn't depend on the
+// layout, and covers fields this version doesn't know.
+func stateChecksum(data []byte) (string, error) {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return "", err
+	}
+	delete(fields, "checksum")
+	canonical, err := json.Marshal(fields)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(canonical)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// loadResumeState reads a resume file, failing with errResumeCorrupt when
+// it doesn't parse or its checksum doesn't match. Files from before
+// versioning load with Version 0.
+func loadResumeState(path string) (*resumeState, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var st resumeState
+	if err := json.Unmarshal(data, &st); err != nil {
+		return nil, fmt.Errorf("%w: %s: %v", errResumeCorrupt, path, err)
+	}
+	if st.Version > 0 {
+		sum, err := stateChecksum(data)
+		if err != nil || sum != st.Checksum {
+			return nil, fmt.Errorf("%w: %s doesn't match its checksum", errResumeCorrupt, path)
+		}
+	}
+	if st.UploadID == "" {
+		return nil, fmt.Errorf("%w: %s has no uploadId", errResumeCorrupt, path)
+	}
+	if st.HashAlgorithm == "" {
+		st.HashAlgorithm = "sha256"
+	}
+	return &st, nil
+}
+
+// resumeBlockSize is the block size for a run resuming from the resume file
+// at path, given the one the run picked. Chunks of another size have other
+// ETags, so none of the logged parts would match and everything would be
+// uploaded again. A size the default policy picked gives way to the
+// recorded one; a forced one that differs is an error. A missing or
+// unreadable file is left to openSession.
+func resumeBlockSize(path string, blockSize int64, forced bool) (int64, bool, error) {
+	st, err := loadResumeState(path)
+	if err != nil || st.BlockSize == blockSize {
+		return blockSize, false, nil
+	}
+	if forced {
+		return 0, false, fmt.Errorf("resume file %s was written with a block size of %d bytes, not %d; "+
+			"resume with -block-size %d, or delete it to start over", path, st.BlockSize, blockSize, st.BlockSize)
+	}
+	return st.BlockSize, true, nil
+}
+
+// saveResumeState writes st in the current format, with its checksum. The
+// file is replaced atomically, through a synced temporary file renamed over
+// it, so a crash leaves the old state or the new one, never half of one.
+func saveResumeState(path string, st *resumeState) error {
+	st.Version, st.WrittenBy, st.Checksum = resumeStateVersion, toolVersion(), ""
+	data, err := json.Marshal(st)
+	if err != nil {
+		return err
+	}
+	if st.Checksum, err = stateChecksum(data); err != nil {
+		return err
+	}
+	if data, err = json.MarshalIndent(st, "", "  "); err != nil {
+		return err
+	}
+	f, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	if _, err = f.Write(append(data, '\n')); err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Chmod(f.Name(), 0o600)
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), path)
+}
+
+// checkpointInterval says how often the ETag log is flushed: after every
+// Chunks completed chunks, or Every after the first unflushed one. The zero
+// value flushes after each chunk.
+type checkpointInterval struct {
+	Chunks int
+	Every  time.Duration
+}
+
+// parseCheckpointInterval accepts a chunk count ("10") or a duration ("30s").
+func parseCheckpointInterval(s string) (checkpointInterval, error) {
+	if n, err := strconv.Atoi(s); err == nil && n >= 1 {
+		return checkpointInterval{Chunks: n}, nil
+	}
+	if d, err := time.ParseDuration(s); err == nil && d > 0 {
+		return checkpointInterval{Every: d}, nil
+	}
+	return checkpointInterval{}, fmt.Errorf("-checkpoint-interval must be a chunk count or a duration such as 30s, not %q", s)
+}
+
+// lockResumeState keeps two processes from resuming the same session at
+// once, which would upload the same parts twice and race to finalize. The
+// lock is a file next to the resume file holding the owner's pid; a lock
+// whose process is gone is taken over.
+func lockResumeState(path string) (func(), error) {
+	lockPath := path + ".lock"
+	for i := 0; i < 2; i++ {
+		f, err := os.OpenFile(lockPath, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0o600)
+		if err == nil {
+			fmt.Fprintf(f, "%d\n", os.Getpid())
+			f.Close()
+			return func() { os.Remove(lockPath) }, nil
+		}
+		if !os.IsExist(err) {
+			return nil, err
+		}
+		data, _ := os.ReadFile(lockPath)
+		if pid, err := strconv.Atoi(strings.TrimSpace(string(data))); err == nil && processAlive(pid) {
+			return nil, fmt.Errorf("another upload of this file appears to be in progress (pid %d holds %s)", pid, lockPath)
+		}
+		os.Remove(lockPath)
+	}
+	return nil, fmt.Errorf("could not lock %s", path)
+}
+
+// processAlive reports whether pid names a running process. On Windows
+// FindProcess itself fails for a process that is gone.
+func processAlive(pid int) bool {
+	p, err := os.FindProcess(pid)
+	if err != nil {
+		return false
+	}
+	if runtime.GOOS == "windows" {
+		p.Release()
+		return true
+	}
+	err = p.Signal(syscall.Signal(0))
+	return err == nil || errors.Is(err, os.ErrPermission)
+}
+
+// etagLog appends "partNumber,etag" lines as chunks complete. Lines are
+// buffered until the checkpoint interval is reached, then written in one go
+// and synced, so a crash loses at most the chunks since the last flush; a
+// resumed run probes those again. Close flushes whatever is left, which
+// covers completion, failure and cancellation.
+type etagLog struct {
+	mu       sync.Mutex
+	file     *os.File
+	interval checkpointInterval
+	pending  []byte
+	count    int
+	timer    *time.Timer
+	err      error // first failed timed flush, reported by the next call
+}
+
+// openETagLog opens the log for appending. A fresh session truncates it so
+// entries from an unrelated earlier upload are never mixed in.
+func openETagLog(path string, fresh bool, interval checkpointInterval) (*etagLog, error) {
+	flags := os.O_CREATE | os.O_WRONLY | os.O_APPEND
+	if fresh {
+		flags |= os.O_TRUNC
+	}
+	f, err := os.OpenFile(path, flags, 0o600)
+	if err != nil {
+		return nil, err
+	}
+	return &etagLog{file: f, interval: interval}, nil
+}
+
+func (l *etagLog) Append(partNumber int, etag string) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.err != nil {
+		return l.err
+	}
+	l.pending = fmt.Appendf(l.pending, "%d,%s\n", partNumber, etag)
+	l.count++
+	if l.interval.Every > 0 {
+		if l.timer == nil {
+			l.timer = time.AfterFunc(l.interval.Every, func() {
+				l.mu.Lock()
+				defer l.mu.Unlock()
+				if err := l.flush(); err != nil && l.err == nil {
+					l.err = err
+				}
+			})
+		}
+		return nil
+	}
+	if l.count >= max(l.interval.Chunks, 1) {
+		return l.flush()
+	}
+	return nil
+}
+
+// flush writes the pending lines and syncs them to disk. l.mu must be held.
+func (l *etagLog) flush() error {
+	if l.timer != nil {
+		l.timer.Stop()
+		l.timer = nil
+	}
+	if len(l.pending) == 0 {
+		return nil
+	}
+	if _, err := l.file.Write(l.pending); err != nil {
+		return err
+	}
+	l.pending, l.count = l.pending[:0], 0
+	return l.file.Sync()
+}
+
+func (l *etagLog) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	err := l.flush()
+	if cerr := l.file.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// AppendSHA256 records the digest of the whole file as a "sha256,HEX" line,
+// which loadETagLog passes over.
+func (l *etagLog) AppendSHA256(sum string) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.err != nil {
+		return l.err
+	}
+	l.pending = fmt.Appendf(l.pending, "sha256,%s\n", sum)
+	return nil
+}
+
+// loadETagLog reads a log written by etagLog. A truncated last line from a
+// crash mid-write is ignored rather than treated as an error.
+func loadETagLog(path string) (map[int]string, error) {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return map[int]string{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	done := make(map[int]string)
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		parts := strings.SplitN(strings.TrimSpace(sc.Text()), ",", 2)
+		if len(parts) != 2 || !strings.Contains(parts[1], "-") {
+			continue
+		}
+		n, err := strconv.Atoi(parts[0])
+		if err != nil || n < 1 {
+			continue
+		}
+		done[n] = parts[1]
+	}
+	return done, sc.Err()
+}
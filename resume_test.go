@@ -0,0 +1,222 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// chunkStore is a fake transfer server that keeps the chunks it was sent,
+// answers probes from them and rejects a finalize that lists a chunk it
+// doesn't have, as the real server does.
+type chunkStore struct {
+	mu             sync.Mutex
+	chunks         map[string]bool
+	probes, sent   int
+	rejectFinalize bool
+	finalized      int
+}
+
+func (s *chunkStore) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	switch {
+	case strings.HasSuffix(r.URL.Path, "/create"):
+		w.WriteHeader(http.StatusCreated)
+		io.WriteString(w, `{"uploadId":"u1"}`)
+	case strings.HasSuffix(r.URL.Path, "/chunk/probe"):
+		var body chunkList
+		json.NewDecoder(r.Body).Decode(&body)
+		results := map[string]map[string]bool{}
+		for _, c := range body.Chunks {
+			s.probes++
+			etag := c.Hash + "-" + c.Size
+			results["sha256-"+etag] = map[string]bool{"exists": s.chunks[etag]}
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"data": map[string]interface{}{"results": results}})
+	case strings.Contains(r.URL.Path, "/chunk/"):
+		io.Copy(io.Discard, r.Body)
+		s.sent++
+		s.chunks[path.Base(r.URL.Path)] = true
+		w.WriteHeader(http.StatusCreated)
+	case strings.HasSuffix(r.URL.Path, "/file/chunked"):
+		var body chunkList
+		json.NewDecoder(r.Body).Decode(&body)
+		missing := false
+		for _, c := range body.Chunks {
+			missing = missing || !s.chunks[c.Hash+"-"+c.Size]
+		}
+		if missing || s.rejectFinalize {
+			http.Error(w, "missing chunk", http.StatusConflict)
+			return
+		}
+		s.finalized++
+		io.WriteString(w, `{"data":{"id":"att-1","name":"data.bin"}}`)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// TestResumeProbeCache checks that a resumed upload takes the parts in the
+// ETag log as present without probing them, and that when finalize then
+// fails because the server lost one, it probes the logged parts, sends the
+// lost one again and finalizes.
+func TestResumeProbeCache(t *testing.T) {
+	const blockSize = minBlockSize
+	tests := []struct {
+		name string
+		lost int // part the server forgets between the runs, 0 for none
+	}{
+		{"nothing lost", 0},
+		{"part 2 lost", 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := &chunkStore{chunks: map[string]bool{}}
+			srv := httptest.NewServer(store)
+			defer srv.Close()
+			path, data := writeTestFile(t, 4*blockSize+777)
+			etags := partETags(data, blockSize)
+			dir := t.TempDir()
+
+			run := func() error {
+				fu := newTestUploader(t, path, srv.URL)
+				fu.ResumeFile = filepath.Join(dir, "upload.resume")
+				fu.ETagLog = filepath.Join(dir, "upload.etags")
+				_, err := fu.RunContext(t.Context())
+				return err
+			}
+
+			// The first run uploads everything but can't finalize, which
+			// leaves the resume file and a full ETag log behind.
+			store.rejectFinalize = true
+			if err := run(); err == nil {
+				t.Fatal("first run finalized, want it to fail")
+			}
+			store.rejectFinalize = false
+			if tt.lost > 0 {
+				delete(store.chunks, etags[tt.lost-1])
+			}
+			probes, sent := store.probes, store.sent
+
+			if err := run(); err != nil {
+				t.Fatal(err)
+			}
+			wantSent, wantProbes := 0, 0
+			if tt.lost > 0 {
+				wantSent, wantProbes = 1, len(etags)
+			}
+			if got := store.sent - sent; got != wantSent {
+				t.Errorf("resume sent %d chunks, want %d", got, wantSent)
+			}
+			if got := store.probes - probes; got != wantProbes {
+				t.Errorf("resume sent %d probes, want %d", got, wantProbes)
+			}
+			if store.finalized != 1 {
+				t.Errorf("finalized %d times, want once", store.finalized)
+			}
+		})
+	}
+}
+
+func TestLockResumeState(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "upload.resume")
+	unlock, err := lockResumeState(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := lockResumeState(path); err == nil || !strings.Contains(err.Error(), "in progress") {
+		t.Fatalf("second lock: got %v, want an upload in progress", err)
+	}
+	unlock()
+
+	// A lock left by a process that has exited is taken over.
+	if runtime.GOOS != "windows" {
+		cmd := exec.Command("true")
+		if err := cmd.Run(); err != nil {
+			t.Skip(err)
+		}
+		os.WriteFile(path+".lock", []byte(strconv.Itoa(cmd.Process.Pid)+"\n"), 0o600)
+	}
+	unlock, err = lockResumeState(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	unlock()
+	if _, err := os.Stat(path + ".lock"); !os.IsNotExist(err) {
+		t.Errorf("lock file left behind: %v", err)
+	}
+}
+
+// TestResumeStateRecovery checks what a run does with a resume file it
+// can't take as is: one whose checksum doesn't match or that a crash cut
+// short is discarded for a new session, and one from before versioning is
+// migrated and its session kept.
+func TestResumeStateRecovery(t *testing.T) {
+	path, data := writeTestFile(t, 2*minBlockSize+5)
+	valid := func(t *testing.T) []byte {
+		resume := filepath.Join(t.TempDir(), "valid.resume")
+		st := &resumeState{UploadID: "old-session", IssueKey: "TEST-1", Size: int64(len(data)), BlockSize: minBlockSize}
+		if err := saveResumeState(resume, st); err != nil {
+			t.Fatal(err)
+		}
+		b, _ := os.ReadFile(resume)
+		return b
+	}
+	tests := []struct {
+		name        string
+		contents    func(t *testing.T) []byte
+		wantSession string
+	}{
+		{"bad checksum", func(t *testing.T) []byte {
+			return []byte(strings.Replace(string(valid(t)), "old-session", "new-session", 1))
+		}, "u1"},
+		{"truncated", func(t *testing.T) []byte {
+			b := valid(t)
+			return b[:len(b)/2]
+		}, "u1"},
+		{"old version", func(t *testing.T) []byte {
+			return []byte(`{"uploadId":"old-session","issueKey":"TEST-1","size":` + strconv.Itoa(len(data)) +
+				`,"blockSize":` + strconv.Itoa(minBlockSize) + `}`)
+		}, "old-session"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// The finalize is refused so that the run leaves the resume
+			// file behind to look at.
+			store := &chunkStore{chunks: map[string]bool{}, rejectFinalize: true}
+			srv := httptest.NewServer(store)
+			defer srv.Close()
+			resume := filepath.Join(t.TempDir(), "upload.resume")
+			if err := os.WriteFile(resume, tt.contents(t), 0o600); err != nil {
+				t.Fatal(err)
+			}
+
+			fu := newTestUploader(t, path, srv.URL)
+			fu.BlockSize = constantBlockSize(minBlockSize)
+			fu.ResumeFile = resume
+			if _, err := fu.RunContext(t.Context()); err == nil || errors.Is(err, errResumeCorrupt) {
+				t.Fatalf("got error %v, want the refused finalize", err)
+			}
+			st, err := loadResumeState(resume)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if st.UploadID != tt.wantSession || st.Version != resumeStateVersion || st.BaseURL != srv.URL || st.File == nil {
+				t.Errorf("resume file has session %q, version %d, server %q, file %+v; want %q in the current format",
+					st.UploadID, st.Version, st.BaseURL, st.File, tt.wantSession)
+			}
+		})
+	}
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/vbauerster/mpb/v7/decor"
+)
+
+// retryTracker knows which chunks are waiting out a backoff, so the progress
+// bar can say the run is waiting rather than look hung. Upload workers
+// report each backoff with Wait and the chunk's outcome with Done; a nil
+// tracker ignores both.
+type retryTracker struct {
+	mu         sync.Mutex
+	pending    map[int]retryWait // by part number
+	refreshing bool              // RefreshToken is running
+}
+
+type retryWait struct {
+	attempt int       // the attempt that comes next
+	at      time.Time // when it is due
+}
+
+func newRetryTracker() *retryTracker {
+	return &retryTracker{pending: map[int]retryWait{}}
+}
+
+// Wait records that part's attempt is due after the backoff d.
+func (t *retryTracker) Wait(part, attempt int, d time.Duration) {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	t.pending[part] = retryWait{attempt: attempt, at: time.Now().Add(d)}
+	t.mu.Unlock()
+}
+
+// Done forgets part once it succeeded or failed for good.
+func (t *retryTracker) Done(part int) {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	delete(t.pending, part)
+	t.mu.Unlock()
+}
+
+// Refreshing records that the token is being refreshed after a 401, which
+// may mean waiting for someone to type it in.
+func (t *retryTracker) Refreshing(on bool) {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	t.refreshing = on
+	t.mu.Unlock()
+}
+
+// Decorator renders the retry state after the bar's other decorators; see
+// status.
+func (t *retryTracker) Decorator(breaker *circuitBreaker, wcc ...decor.WC) decor.Decorator {
+	return decor.Any(func(st decor.Statistics) string {
+		if st.Completed {
+			return ""
+		}
+		if s := t.status(breaker); s != "" {
+			return " " + s
+		}
+		return ""
+	}, wcc...)
+}
+
+// status is e.g. "part 7: attempt 3 in 4s" or "3 parts retrying, next in
+// 2s", or "paused, checking the service" while the circuit breaker is open;
+// empty while all is well.
+func (t *retryTracker) status(breaker *circuitBreaker) string {
+	if breaker.Paused() {
+		return "paused, checking the service"
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.refreshing {
+		return "authentication failed, waiting for a new token"
+	}
+	now := time.Now()
+	var next time.Duration
+	for _, w := range t.pending {
+		if d := w.at.Sub(now); d > 0 && (next == 0 || d < next) {
+			next = d
+		}
+	}
+	// Rounded up, so a wait under a second doesn't read "in 0s".
+	in := ""
+	if next > 0 {
+		in = " in " + (next + time.Second - 1).Truncate(time.Second).String()
+	}
+	switch len(t.pending) {
+	case 0:
+		return ""
+	case 1:
+		for part, w := range t.pending {
+			return fmt.Sprintf("part %d: attempt %d%s", part, w.attempt, in)
+		}
+	}
+	if in != "" {
+		in = ", next" + in
+	}
+	return fmt.Sprintf("%d parts retrying%s", len(t.pending), in)
+}
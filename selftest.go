@@ -0,0 +1,208 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/vbauerster/mpb/v7/decor"
+
+	"github.com/yuksbg/atlassian-big-file-uploader/internal/mockserver"
+)
+
+// selftestIssue is the issue key the self-test uploads to.
+const selftestIssue = "SELFTEST-1"
+
+// selftest is "abfu selftest": a full upload of a generated file to an
+// in-process mock server, through the same client, flags and pipeline as a
+// real one, followed by a pass/fail line per protocol stage. By default the
+// server listens on loopback, which bypasses any proxy; with an address it
+// listens there and is reached by this host's name, so HTTP(S)_PROXY and
+// NO_PROXY apply as they would to the real service. With TLS it presents a
+// certificate generated for that name, trusted in addition to the system
+// roots.
+type selftest struct {
+	mock   *mockserver.Server
+	srv    *httptest.Server
+	url    string
+	roots  *x509.CertPool // nil without TLS
+	file   string
+	size   int64
+	sha256 string
+}
+
+// startSelftest starts the server and writes the test file to tempDir.
+func startSelftest(listen string, useTLS bool, size int64, tempDir string) (*selftest, error) {
+	st := &selftest{mock: mockserver.New(), size: size}
+	st.srv = httptest.NewUnstartedServer(st.mock)
+	host := "127.0.0.1"
+	if listen != "" {
+		l, err := net.Listen("tcp", listen)
+		if err != nil {
+			return nil, fmt.Errorf("selftest: %v", err)
+		}
+		st.srv.Listener.Close()
+		st.srv.Listener = l
+		if host, err = os.Hostname(); err != nil {
+			return nil, fmt.Errorf("selftest: %v", err)
+		}
+	}
+	port := strconv.Itoa(st.srv.Listener.Addr().(*net.TCPAddr).Port)
+	if useTLS {
+		cert, err := selftestCert(host)
+		if err != nil {
+			st.srv.Listener.Close()
+			return nil, fmt.Errorf("selftest: generating certificate: %v", err)
+		}
+		if st.roots, err = x509.SystemCertPool(); err != nil {
+			st.roots = x509.NewCertPool()
+		}
+		st.roots.AddCert(cert.Leaf)
+		st.srv.TLS = &tls.Config{Certificates: []tls.Certificate{cert}}
+		st.srv.StartTLS()
+		st.url = "https://" + net.JoinHostPort(host, port)
+	} else {
+		st.srv.Start()
+		st.url = "http://" + net.JoinHostPort(host, port)
+	}
+
+	if err := st.writeFile(tempDir); err != nil {
+		st.Close()
+		return nil, err
+	}
+	return st, nil
+}
+
+// writeFile fills a temporary file with size random bytes, so no chunk
+// repeats and nothing is skipped as already present.
+func (st *selftest) writeFile(dir string) error {
+	f, err := os.CreateTemp(dir, "abfu-selftest-*.bin")
+	if err != nil {
+		return fmt.Errorf("selftest: %v", err)
+	}
+	st.file = f.Name()
+	h := sha256.New()
+	_, err = io.CopyN(io.MultiWriter(f, h), rand.Reader, st.size)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return fmt.Errorf("selftest: writing %s: %v", st.file, err)
+	}
+	st.sha256 = hex.EncodeToString(h.Sum(nil))
+	return nil
+}
+
+// Trust makes client accept the server's certificate. The transport must be
+// an *http.Transport, before any wrapping.
+func (st *selftest) Trust(client *http.Client) {
+	if st == nil || st.roots == nil {
+		return
+	}
+	if tr, ok := client.Transport.(*http.Transport); ok {
+		tr.TLSClientConfig = &tls.Config{RootCAs: st.roots}
+	}
+}
+
+func (st *selftest) Close() {
+	st.srv.Close()
+	if st.file != "" {
+		os.Remove(st.file)
+	}
+}
+
+// Report prints a line per stage and returns whether all passed. res is the
+// outcome of uploading the test file.
+func (st *selftest) Report(w io.Writer, res fileResult, checkedPermissions bool) bool {
+	stats := st.mock.Stats()
+	files := st.mock.Files()
+	fmt.Fprintf(w, "\nSelf-test against %s (% .1f test file):\n", st.url, decor.SizeB1024(st.size))
+	ok := true
+	stage := func(name string, pass bool, detail string) {
+		status := "PASS"
+		if !pass {
+			status, ok = "FAIL", false
+		}
+		if detail != "" {
+			detail = " (" + detail + ")"
+		}
+		fmt.Fprintf(w, "  %s  %s%s\n", status, name, detail)
+	}
+	if checkedPermissions {
+		stage("check permissions", stats.Permissions > 0, "")
+	}
+	stage("create session", stats.Creates > 0, "")
+	stage("probe chunks", stats.Probes > 0, fmt.Sprintf("%d requests", stats.Probes))
+	stage("upload chunks", stats.Chunks > 0 && stats.Chunks >= res.Parts,
+		fmt.Sprintf("%d accepted, %d retries", stats.Chunks, res.Retries))
+	stage("finalize", stats.Finalizes > 0, "")
+	var verify string
+	pass := false
+	switch {
+	case len(files) == 0:
+		verify = "nothing was finalized"
+	case files[0].Size != st.size || files[0].SHA256 != st.sha256:
+		verify = fmt.Sprintf("server assembled %d bytes with SHA-256 %.12s, expected %d bytes with %.12s",
+			files[0].Size, files[0].SHA256, st.size, st.sha256)
+	default:
+		pass = true
+		verify = "SHA-256 " + st.sha256[:shortSHALength]
+	}
+	stage("verify content", pass, verify)
+	if stats.Rejected > 0 {
+		fmt.Fprintf(w, "  The server refused %d requests; the last because: %s\n", stats.Rejected, stats.LastRejection)
+	}
+	if res.Status == "failed" {
+		fmt.Fprintf(w, "  Upload error: %s\n", res.Error)
+	}
+	return ok
+}
+
+// selftestCert generates a short-lived self-signed certificate for host and
+// the loopback addresses.
+func selftestCert(host string) (tls.Certificate, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: "abfu selftest"},
+		NotBefore:             time.Now().Add(-time.Minute),
+		NotAfter:              time.Now().Add(24 * time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		IPAddresses:           []net.IP{net.IPv4(127, 0, 0, 1), net.IPv6loopback},
+		DNSNames:              []string{"localhost"},
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		tmpl.IPAddresses = append(tmpl.IPAddresses, ip)
+	} else {
+		tmpl.DNSNames = append(tmpl.DNSNames, host)
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf}, nil
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/yuksbg/atlassian-big-file-uploader/internal/mockserver"
+)
+
+// TestUploadToMockServer runs full uploads, create, probe, chunk and
+// finalize, against the mock server and checks what it assembled. The
+// second upload of the same file finds every chunk on the server already.
+func TestUploadToMockServer(t *testing.T) {
+	mock := mockserver.New()
+	srv := httptest.NewServer(mock)
+	defer srv.Close()
+	path, data := writeTestFile(t, 2*minBlockSize+4321)
+	sum := sha256.Sum256(data)
+
+	for i, issue := range []string{"TEST-1", "TEST-2"} {
+		fu := newTestUploader(t, path, srv.URL)
+		fu.IssueKey = issue
+		fu.BlockSize = constantBlockSize(minBlockSize)
+		res, err := fu.RunContext(t.Context())
+		if err != nil {
+			t.Fatalf("upload %d: %v", i+1, err)
+		}
+		if res.Parts != 3 || res.Attachment == nil {
+			t.Errorf("upload %d: %d parts, attachment %+v; want 3 parts and an attachment", i+1, res.Parts, res.Attachment)
+		}
+		if i == 1 && res.BytesSkipped != int64(len(data)) {
+			t.Errorf("upload %d: skipped %d bytes the server had, want all %d", i+1, res.BytesSkipped, len(data))
+		}
+	}
+
+	stats := mock.Stats()
+	if stats.Creates != 2 || stats.Chunks != 3 || stats.Finalizes != 2 || stats.Rejected != 0 {
+		t.Errorf("server stats %+v, want 2 sessions, 3 chunks, 2 finalizes and nothing rejected", stats)
+	}
+	files := mock.Files()
+	if len(files) != 2 {
+		t.Fatalf("server assembled %d files, want 2", len(files))
+	}
+	for i, f := range files {
+		if f.Name != "data.bin" || f.Size != int64(len(data)) || f.SHA256 != hex.EncodeToString(sum[:]) {
+			t.Errorf("file %d is %+v, want data.bin with %d bytes and SHA-256 %x", i+1, f, len(data), sum)
+		}
+	}
+}
+
+// TestSelftest runs the selftest command's upload over TLS and checks its
+// report.
+func TestSelftest(t *testing.T) {
+	st, err := startSelftest("", true, minBlockSize+100, t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer st.Close()
+	fu := newTestUploader(t, st.file, st.url)
+	fu.IssueKey = selftestIssue
+	fu.Client = newHTTPClient(0)
+	st.Trust(fu.Client)
+
+	res := fileResult{Status: "success"}
+	up, err := fu.RunContext(t.Context())
+	if err != nil {
+		res.Status, res.Error = "failed", err.Error()
+	}
+	if up != nil {
+		res.apply(up)
+	}
+	var out bytes.Buffer
+	if !st.Report(&out, res, false) {
+		t.Errorf("selftest failed:\n%s", out.String())
+	}
+	if !strings.Contains(out.String(), "PASS  verify content (SHA-256 "+st.sha256[:shortSHALength]) {
+		t.Errorf("report doesn't verify the content:\n%s", out.String())
+	}
+}
@@ -0,0 +1,70 @@
+package main
+
+import "sync"
+
+// sessionPool lets the files of a batch that go to the same issue share one
+// upload session (-shared-session), saving a create per file and letting
+// the probe find chunks an earlier file already sent. A session joins the
+// pool once a file has been finalized in it. When the server refuses a
+// second finalize in a session, every file from then on gets its own. A
+// nil pool shares nothing.
+type sessionPool struct {
+	mu          sync.Mutex
+	ids         map[string]string // by base URL and issue key
+	attachments map[string]bool   // finalized in the pool's sessions
+	refused     bool
+}
+
+func newSessionPool() *sessionPool {
+	return &sessionPool{ids: map[string]string{}, attachments: map[string]bool{}}
+}
+
+// Get returns the session to upload the next file to issueKey on baseURL
+// through, or "" to create one.
+func (p *sessionPool) Get(baseURL, issueKey string) string {
+	if p == nil {
+		return ""
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.refused {
+		return ""
+	}
+	return p.ids[baseURL+" "+issueKey]
+}
+
+// Put offers a session a file was just finalized in to the next files.
+// attachmentID is the attachment it made, if the server said.
+func (p *sessionPool) Put(baseURL, issueKey, uploadID, attachmentID string) {
+	if p == nil {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if attachmentID != "" {
+		p.attachments[attachmentID] = true
+	}
+	if !p.refused {
+		p.ids[baseURL+" "+issueKey] = uploadID
+	}
+}
+
+// Finalized reports whether attachmentID came from an earlier file. A
+// server that answers every finalize of a session with the first one's
+// attachment doesn't take several files per session either.
+func (p *sessionPool) Finalized(attachmentID string) bool {
+	if p == nil {
+		return false
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.attachments[attachmentID]
+}
+
+// Refuse records that the server doesn't take several files per session.
+func (p *sessionPool) Refuse() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.refused = true
+	clear(p.ids)
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/yuksbg/atlassian-big-file-uploader/internal/mockserver"
+)
+
+// TestSharedSession uploads three files to one issue through a session
+// pool, the second and third starting with the first's first part, to a
+// server that takes several files per session and to one that refuses a
+// second finalize.
+func TestSharedSession(t *testing.T) {
+	const blockSize = minBlockSize
+	_, a := writeTestFile(t, 2*blockSize)
+	_, b := writeTestFile(t, blockSize+100)
+	dir := t.TempDir()
+	contents := [][]byte{a, append(a[:blockSize:blockSize], b[blockSize:]...), append(a[:blockSize:blockSize], 1, 2, 3)}
+	var paths []string
+	for i, data := range contents {
+		path := filepath.Join(dir, string(rune('a'+i))+".bin")
+		if err := os.WriteFile(path, data, 0o600); err != nil {
+			t.Fatal(err)
+		}
+		paths = append(paths, path)
+	}
+
+	tests := []struct {
+		name       string
+		multiFile  bool
+		creates    int
+		chunks     int
+		sharedLast bool
+	}{
+		// The shared first part is sent once, and the probe finds it for
+		// the later files.
+		{"server takes several files", true, 1, 4, true},
+		// The second file's finalize is refused; it starts over in a
+		// session of its own and so does every file after it. The mock
+		// keeps chunks across sessions, so none is sent twice.
+		{"server refuses a second finalize", false, 3, 4, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mock := mockserver.New()
+			mock.MultiFileSessions = tt.multiFile
+			srv := httptest.NewServer(mock)
+			defer srv.Close()
+
+			pool := newSessionPool()
+			var last *UploadResult
+			for _, path := range paths {
+				fu := newTestUploader(t, path, srv.URL)
+				fu.BlockSize = constantBlockSize(blockSize)
+				fu.Sessions = pool
+				res, err := fu.RunContext(t.Context())
+				if err != nil {
+					t.Fatalf("%s: %v", filepath.Base(path), err)
+				}
+				last = res
+			}
+
+			stats := mock.Stats()
+			if stats.Creates != tt.creates || stats.Chunks != tt.chunks {
+				t.Errorf("server stats %+v, want %d sessions and %d chunks", stats, tt.creates, tt.chunks)
+			}
+			files := mock.Files()
+			if len(files) != len(paths) {
+				t.Fatalf("server assembled %d files, want %d", len(files), len(paths))
+			}
+			for i, f := range files {
+				if f.Name != filepath.Base(paths[i]) || f.Size != int64(len(contents[i])) {
+					t.Errorf("file %d is %+v, want %s with %d bytes", i+1, f, filepath.Base(paths[i]), len(contents[i]))
+				}
+			}
+			if shared := last.UploadID == "selftest-1"; shared != tt.sharedLast {
+				t.Errorf("last file went through session %s", last.UploadID)
+			}
+		})
+	}
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/vbauerster/mpb/v7/decor"
+)
+
+// slowChunkRatio flags chunks slower than this fraction of the median rate.
+const slowChunkRatio = 0.2
+
+// chunkStat is one transferred chunk as seen by its upload worker. Seconds
+// is wall time from the probe to the accepted upload, retries and backoff
+// included, so a chunk that needed three attempts shows up as slow.
+type chunkStat struct {
+	Part     int     `json:"part"`
+	Bytes    int     `json:"bytes"`
+	Attempts int     `json:"attempts"`
+	Seconds  float64 `json:"seconds"`
+}
+
+// chunkSources counts the parts of an upload, and their bytes, by how they
+// got to the server: Uploaded this run, Probed (the server said it had them)
+// or Resumed (the ETag log of an earlier run vouched for them, unprobed).
+type chunkSources struct {
+	Uploaded      int   `json:"uploaded"`
+	Probed        int   `json:"probed"`
+	Resumed       int   `json:"resumed"`
+	BytesUploaded int64 `json:"bytesUploaded"`
+	BytesProbed   int64 `json:"bytesProbed"`
+	BytesResumed  int64 `json:"bytesResumed"`
+}
+
+// phaseTiming is how long one phase of an upload took: "hash", "session",
+// "probe", "upload", "verify" or "finalize". Hashing during "upload"
+// overlaps with sending and isn't a phase of its own.
+type phaseTiming struct {
+	Name    string  `json:"name"`
+	Seconds float64 `json:"seconds"`
+}
+
+// beginPhase ends the running phase, if any, and starts name.
+func (r *UploadResult) beginPhase(name string) {
+	r.endPhase()
+	r.Phases = append(r.Phases, phaseTiming{Name: name})
+	r.phaseStart = time.Now()
+}
+
+// endPhase records the running phase's duration.
+func (r *UploadResult) endPhase() {
+	if !r.phaseStart.IsZero() {
+		r.Phases[len(r.Phases)-1].Seconds = time.Since(r.phaseStart).Seconds()
+		r.phaseStart = time.Time{}
+	}
+}
+
+// rate is the chunk's effective throughput in bytes per second.
+func (c chunkStat) rate() float64 {
+	if c.Seconds <= 0 {
+		return 0
+	}
+	return float64(c.Bytes) / c.Seconds
+}
+
+// printStats writes the -stats summary: totals, a histogram of per-chunk
+// throughput and the chunks well below the median, which tells a uniformly
+// slow link apart from a few pathological chunks.
+func printStats(w io.Writer, file string, chunks []chunkStat, elapsed time.Duration, ahead readAheadStats) {
+	var total int64
+	retries := 0
+	for _, c := range chunks {
+		total += int64(c.Bytes)
+		retries += c.Attempts - 1
+	}
+	fmt.Fprintf(w, "Stats for %s: %d chunks sent, % .1f in %s, %d retries\n",
+		file, len(chunks), decor.SizeB1024(total), elapsed.Round(time.Millisecond), retries)
+	if ahead.Limit > 0 {
+		fmt.Fprintf(w, "  read-ahead: %d chunks at the end, %d-%d during the run (at most %d within -max-memory)\n",
+			ahead.Depth, ahead.Low, ahead.High, ahead.Limit)
+	}
+	if len(chunks) == 0 {
+		return
+	}
+
+	rates := make([]float64, len(chunks))
+	for i, c := range chunks {
+		rates[i] = c.rate()
+	}
+	sort.Float64s(rates)
+	median := rates[len(rates)/2]
+	lo, hi := rates[0], rates[len(rates)-1]
+
+	const buckets, width = 8, 40
+	counts := make([]int, buckets)
+	step := (hi - lo) / buckets
+	for _, r := range rates {
+		i := buckets - 1
+		if step > 0 {
+			i = min(int((r-lo)/step), buckets-1)
+		}
+		counts[i]++
+	}
+	peak := 0
+	for _, n := range counts {
+		peak = max(peak, n)
+	}
+	fmt.Fprintf(w, "  per-chunk throughput (median % .1f/s):\n", decor.SizeB1024(int64(median)))
+	for i, n := range counts {
+		if step == 0 && n == 0 {
+			continue
+		}
+		from := lo + float64(i)*step
+		fmt.Fprintf(w, "  %12s/s %-*s %d\n", fmt.Sprintf("% .1f", decor.SizeB1024(int64(from))),
+			width, strings.Repeat("#", n*width/peak), n)
+	}
+
+	var slow []chunkStat
+	for _, c := range chunks {
+		if c.rate() < median*slowChunkRatio {
+			slow = append(slow, c)
+		}
+	}
+	if len(slow) == 0 {
+		return
+	}
+	sort.Slice(slow, func(i, j int) bool { return slow[i].Part < slow[j].Part })
+	fmt.Fprintf(w, "  %d chunks below %d%% of the median:\n", len(slow), int(slowChunkRatio*100))
+	for _, c := range slow {
+		fmt.Fprintf(w, "    part %d: % .1f/s, %d attempts\n", c.Part, decor.SizeB1024(int64(c.rate())), c.Attempts)
+	}
+}
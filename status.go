@@ -0,0 +1,129 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/vbauerster/mpb/v7/decor"
+)
+
+// statusInterval is how often -summary-only redraws its line on a terminal.
+const statusInterval = 500 * time.Millisecond
+
+// batchStatus is the single line -summary-only shows instead of one progress
+// bar per file: files finished out of the batch, bytes done and the
+// aggregate speed. On a terminal it is redrawn in place; otherwise a line is
+// printed as each file finishes, so logs stay readable. One status is
+// shared by all files of the batch; a nil status ignores every call.
+type batchStatus struct {
+	mu     sync.Mutex
+	w      io.Writer
+	live   bool
+	files  int
+	done   int
+	failed int
+	meter  *rateMeter
+	shown  bool // a live line is on screen
+	stop   chan struct{}
+	wg     sync.WaitGroup
+}
+
+func newBatchStatus(f *os.File, files int) *batchStatus {
+	s := &batchStatus{w: f, live: isTerminal(f), files: files, meter: newRateMeter(0), stop: make(chan struct{})}
+	if s.live {
+		s.wg.Add(1)
+		go s.redraw()
+	}
+	return s
+}
+
+// Add records a finished chunk of n bytes; sent is false when it was
+// skipped rather than transferred.
+func (s *batchStatus) Add(n int64, sent bool) {
+	if s != nil {
+		s.meter.Add(n, sent)
+	}
+}
+
+// FileDone counts a finished file.
+func (s *batchStatus) FileDone(failed bool) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.done++
+	if failed {
+		s.failed++
+	}
+	if !s.live {
+		fmt.Fprintln(s.w, s.line(false))
+	}
+}
+
+// Clear erases the live line so other output can be printed; the next
+// redraw puts it back.
+func (s *batchStatus) Clear() {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.shown {
+		fmt.Fprint(s.w, "\r\x1b[K")
+		s.shown = false
+	}
+}
+
+// Stop ends the redraws and leaves the final line on screen.
+func (s *batchStatus) Stop() {
+	if s == nil {
+		return
+	}
+	close(s.stop)
+	s.wg.Wait()
+	if s.live {
+		s.mu.Lock()
+		fmt.Fprintf(s.w, "\r\x1b[K%s\n", s.line(true))
+		s.mu.Unlock()
+	}
+}
+
+func (s *batchStatus) redraw() {
+	defer s.wg.Done()
+	t := time.NewTicker(statusInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-s.stop:
+			return
+		case <-t.C:
+		}
+		s.mu.Lock()
+		fmt.Fprintf(s.w, "\r\x1b[K%s", s.line(false))
+		s.shown = true
+		s.mu.Unlock()
+	}
+}
+
+// line renders e.g. "12/200 files done (1 failed), 3.4 GiB, 48.2 MiB/s",
+// with the recent speed, or the whole run's for the final line. Called with
+// mu held.
+func (s *batchStatus) line(final bool) string {
+	speed, average := s.meter.rates()
+	if final {
+		speed = average
+	}
+	s.meter.mu.Lock()
+	done := s.meter.done
+	s.meter.mu.Unlock()
+	failed := ""
+	if s.failed > 0 {
+		failed = fmt.Sprintf(" (%d failed)", s.failed)
+	}
+	return fmt.Sprintf("%d/%d files done%s, % .1f, % .1f/s", s.done, s.files, failed,
+		decor.SizeB1024(done), decor.SizeB1024(int64(speed)))
+}
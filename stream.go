@@ -0,0 +1,241 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/vbauerster/mpb/v7/decor"
+)
+
+// defaultStreamChunkSize is what UploadReader uses when ChunkSize is 0.
+// Without a total size getBlockSize has nothing to go on, so this is a
+// middle-of-the-road size that keeps a retry cheap.
+const defaultStreamChunkSize = 16 * 1024 * 1024
+
+// UploadResult describes an upload made by RunContext, UploadReader or
+// UploadReaderAt; the command line builds its output from it.
+type UploadResult struct {
+	IssueKey string
+	// Name is the attachment name.
+	Name           string
+	UploadID       string
+	IdempotencyKey string
+	// Parts is the number of parts finalized, or for an -only-parts run
+	// without -refinalize the number of parts handled.
+	Parts int
+	// Size is the number of bytes uploaded from the source, BytesSent how
+	// many of them were transferred and BytesSkipped how many the server or
+	// the ETag log already had.
+	Size         int64
+	BytesSent    int64
+	BytesSkipped int64
+	// PartsPresent and BytesPresent are what -probe-first found on the
+	// server before the upload started.
+	PartsPresent int
+	BytesPresent int64
+	// SHA256 is the hex digest of the source bytes; it is empty when parts
+	// were skipped unread.
+	SHA256 string
+	// Attachment is set when the finalize response describes the new file.
+	// FinalizeStatus says how finalize ended: "completed", "already
+	// completed" or, when the server assembled the file in the background,
+	// "assembled".
+	Attachment     *attachmentInfo
+	FinalizeStatus string
+	// Chunks has one entry per chunk actually transferred.
+	Chunks  []chunkStat
+	Elapsed time.Duration
+	// Phases times the steps of the upload in order; Retries counts chunk
+	// attempts beyond the first, those of failed chunks included.
+	Phases     []phaseTiming
+	Retries    int
+	phaseStart time.Time
+	// PartsRepaired counts the parts sent again because finalize reported
+	// them missing; see FinalizeRepairs.
+	PartsRepaired int
+	// ReadAhead is how far reading ran ahead of the upload workers; it is
+	// zero for UploadReader.
+	ReadAhead readAheadStats
+	// BaseURL is the server the upload went to, and Failovers the ones
+	// given up on before it; see FileUploader.FailoverURLs.
+	BaseURL   string
+	Failovers []failover
+	// Sources says where the parts came from; see chunkSources. It is
+	// zero for UploadReader.
+	Sources chunkSources
+	// Work is the time the workers spent reading, hashing, probing and
+	// sending, summed over all of them; see -timing.
+	Work workTiming
+}
+
+// UploadReader uploads everything r yields, up to io.EOF, as an attachment
+// called name (or Name, if set), for callers that produce data on the fly and don't know its
+// length up front. The stream is cut into ChunkSize chunks as it is read;
+// only the chunks being hashed or uploaded are kept in memory,
+// HashWorkers+Concurrency+1 at most, so each can be retried without
+// re-reading r. The create request carries
+// no size, and the progress bar and events report bytes done only.
+//
+// Data with a known size should go through UploadReaderAt instead, which
+// picks the block size from it and supports resuming and part repair. Of
+// those options, ExistingUploadID, OnlyParts, Offset, Length, Adaptive,
+// ProbeFirst, ETagLog and ResumeFile are ignored here.
+func (fu *FileUploader) UploadReader(ctx context.Context, r io.Reader, name string) (*UploadResult, error) {
+	res, err := fu.uploadReader(ctx, r, name)
+	return res, stopped(ctx, err)
+}
+
+func (fu *FileUploader) uploadReader(ctx context.Context, r io.Reader, name string) (res *UploadResult, err error) {
+	// The name is what the chunk form fields and finalize request report.
+	fu.FilePath = name
+	res = &UploadResult{IssueKey: fu.IssueKey, Name: fu.attachmentName()}
+	started := time.Now()
+	defer func() {
+		res.Elapsed, res.Retries = time.Since(started), int(fu.retried.Load())
+		res.Chunks = fu.ChunkStats
+		res.Work = fu.work.timing()
+		res.endPhase()
+	}()
+	chunkSize := fu.ChunkSize
+	if chunkSize == 0 {
+		chunkSize = defaultStreamChunkSize
+	}
+	if chunkSize < minBlockSize || chunkSize > maxBlockSize {
+		return res, fmt.Errorf("chunk size %d is outside %d..%d", chunkSize, minBlockSize, maxBlockSize)
+	}
+	fu.ChunkStats = nil
+	// Nothing has been read when the session is created, so there is no
+	// sniffing; see contentType.
+	fu.mimeType = ""
+	fu.retried.Store(0)
+	fu.work.reset()
+
+	res.beginPhase("session")
+	uploadID, err := fu.createUpload(ctx, -1)
+	if err != nil {
+		return res, err
+	}
+	if ps := fu.serverPartSize; ps > 0 && ps <= maxBlockSize && ps != chunkSize {
+		fu.debugf("Chunk size %s, from the server", decor.SizeB1024(ps))
+		chunkSize = ps
+	}
+	fu.UploadID = uploadID
+	res.UploadID = uploadID
+	fu.emit("session_created", map[string]interface{}{"uploadId": uploadID, "resumed": false})
+	// The bar counts bytes with no total until the stream ends.
+	progress := fu.newUploadProgress("Uploading:", -1, 0)
+	defer func() { progress.finish(err) }()
+
+	res.beginPhase("upload")
+	fu.emit("phase_changed", map[string]interface{}{"phase": "upload"})
+
+	// The reader feeds the hash workers, which feed the upload workers, as
+	// for UploadReaderAt. parent outlives the upload stage, for the finalize.
+	parent := ctx
+	ctx, cancel := context.WithCancelCause(ctx)
+	defer cancel(nil)
+
+	toHash := make(chan pendingChunk)
+	toUpload := make(chan pendingChunk)
+	results := make(chan chunkResult)
+	fu.hashChunks(ctx, toHash, toUpload)
+
+	var sentBytes, skippedBytes atomic.Int64
+	defer func() { res.BytesSent, res.BytesSkipped = sentBytes.Load(), skippedBytes.Load() }()
+	var wg sync.WaitGroup
+	for range max(fu.Concurrency, 1) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for c := range toUpload {
+				if ctx.Err() != nil {
+					continue
+				}
+				start := time.Now()
+				attempts, err := fu.sendChunk(ctx, c, uploadID)
+				if err != nil {
+					cancel(err)
+				} else {
+					if attempts > 0 {
+						sentBytes.Add(int64(len(c.data)))
+					} else {
+						skippedBytes.Add(int64(len(c.data)))
+					}
+					progress.add(c, attempts, start)
+					progress.completed(c, attempts)
+				}
+				results <- chunkResult{ETag: c.etag, Index: c.part, Offset: c.offset, Size: len(c.data),
+					Attempts: attempts, Err: err}
+			}
+		}()
+	}
+
+	var chunks []chunkResult
+	collected := make(chan struct{})
+	go func() {
+		for res := range results {
+			chunks = append(chunks, res)
+		}
+		close(collected)
+	}()
+
+	h := sha256.New()
+	for part := 1; ctx.Err() == nil; part++ {
+		buf := make([]byte, chunkSize)
+		readStart := time.Now()
+		n, err := io.ReadFull(r, buf)
+		since(&fu.work.read, readStart)
+		if limit := fu.partLimit(); n > 0 && limit > 0 && part > limit {
+			cancel(fmt.Errorf("%w: %s needs more than %d parts of %s; retry with a larger -block-size",
+				errTooManyParts, name, limit, decor.SizeB1024(chunkSize)))
+			break
+		}
+		if n > 0 {
+			h.Write(buf[:n])
+			offset := res.Size
+			res.Size += int64(n)
+			select {
+			case toHash <- pendingChunk{part: part, offset: offset, data: buf[:n]}:
+			case <-ctx.Done():
+			}
+		}
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			break
+		}
+		if err != nil {
+			cancel(fmt.Errorf("%w %s at byte %d: %w", errSourceRead, name, res.Size, err))
+		}
+	}
+	close(toHash)
+	wg.Wait()
+	close(results)
+	<-collected
+
+	if cause := context.Cause(ctx); cause != nil {
+		return res, collectFailures(cause, chunks)
+	}
+	res.SHA256 = hex.EncodeToString(h.Sum(nil))
+	fu.SHA256 = res.SHA256
+
+	etags := partOrder(chunks)
+	if err := checkParts(chunks, res.Size); err != nil {
+		return res, err
+	}
+	res.Parts = len(etags)
+	res.beginPhase("finalize")
+	fu.emit("phase_changed", map[string]interface{}{"phase": "finalize"})
+	if err := fu.createFileChunked(parent, etags, uploadID); err != nil {
+		return res, err
+	}
+	res.IdempotencyKey = fu.IdempotencyKey
+	res.Attachment = fu.Attachment
+	res.FinalizeStatus = fu.finalizeStatus
+	return res, nil
+}
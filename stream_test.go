@@ -0,0 +1,64 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"testing"
+)
+
+// checkStreamed checks that rec finalized one file called name from data,
+// sent as parts chunks.
+func checkStreamed(t *testing.T, rec *finalizeRecorder, res *UploadResult, name string, data []byte, parts int) {
+	t.Helper()
+	sum := sha256.Sum256(data)
+	if res.Name != name || res.Parts != parts || res.Size != int64(len(data)) || res.SHA256 != hex.EncodeToString(sum[:]) {
+		t.Errorf("result %q, %d parts, %d bytes, SHA-256 %s; want %q, %d parts, %d bytes, %x",
+			res.Name, res.Parts, res.Size, res.SHA256, name, parts, len(data), sum)
+	}
+	if len(rec.finalizes) != 1 {
+		t.Fatalf("server got %d finalizes, want 1", len(rec.finalizes))
+	}
+	var size int64
+	for _, c := range rec.finalizes[0].Chunks {
+		n, _ := strconv.ParseInt(c.Size, 10, 64)
+		size += n
+	}
+	if rec.names[0] != name || len(rec.finalizes[0].Chunks) != parts || size != int64(len(data)) {
+		t.Errorf("finalized %q from %d chunks of %d bytes, want %s with %d chunks of %d bytes",
+			rec.names[0], len(rec.finalizes[0].Chunks), size, name, parts, len(data))
+	}
+	if len(rec.uploaded) != parts {
+		t.Errorf("server got %d chunks, want %d", len(rec.uploaded), parts)
+	}
+}
+
+// TestUploadReaderPipe streams an os.Pipe, which has no size and can't be
+// read twice, named with Name as -name does for /dev/stdin.
+func TestUploadReaderPipe(t *testing.T) {
+	rec := &finalizeRecorder{}
+	srv := httptest.NewServer(rec)
+	defer srv.Close()
+	_, data := writeTestFile(t, 2*minBlockSize+999)
+
+	pr, pw, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pr.Close()
+	go func() {
+		pw.Write(data)
+		pw.Close()
+	}()
+
+	fu := newTestUploader(t, "", srv.URL)
+	fu.ChunkSize = minBlockSize
+	fu.Name = "dump.sql"
+	res, err := fu.UploadReader(t.Context(), pr, "/dev/stdin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkStreamed(t, rec, res, "dump.sql", data, 3)
+}
@@ -0,0 +1,42 @@
+//go:build unix
+
+package main
+
+import (
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+)
+
+// TestRunContextFIFO checks that RunContext streams a named pipe, which
+// reports size 0, instead of sizing the upload from it, and names the
+// attachment after the pipe.
+func TestRunContextFIFO(t *testing.T) {
+	rec := &finalizeRecorder{}
+	srv := httptest.NewServer(rec)
+	defer srv.Close()
+	_, data := writeTestFile(t, 2*minBlockSize+999)
+
+	path := filepath.Join(t.TempDir(), "dump.sql")
+	if err := syscall.Mkfifo(path, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		f, err := os.OpenFile(path, os.O_WRONLY, 0)
+		if err != nil {
+			return
+		}
+		f.Write(data)
+		f.Close()
+	}()
+
+	fu := newTestUploader(t, path, srv.URL)
+	fu.ChunkSize = minBlockSize
+	res, err := fu.RunContext(t.Context())
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkStreamed(t, rec, res, "dump.sql", data, 3)
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"fmt"
+	"os"
+)
+
+// ui styles every human-facing line: errors, warnings, the success summary
+// and the progress bar label. It is configured once from -color and
+// -ci-annotations.
+var ui = &styler{}
+
+type styler struct {
+	color bool
+	// annotate turns errors and warnings into GitHub Actions workflow
+	// commands so they show up in the checks UI.
+	annotate bool
+}
+
+// colorEnabled resolves -color auto|always|never. In auto mode colour is
+// used only when f is a terminal, TERM isn't "dumb" and NO_COLOR is unset.
+func colorEnabled(mode string, f *os.File) (bool, error) {
+	switch mode {
+	case "always":
+		return true, nil
+	case "never":
+		return false, nil
+	case "auto":
+	default:
+		return false, fmt.Errorf("-color must be auto, always or never, not %q", mode)
+	}
+	if _, ok := os.LookupEnv("NO_COLOR"); ok || os.Getenv("TERM") == "dumb" {
+		return false, nil
+	}
+	return isTerminal(f), nil
+}
+
+func isTerminal(f *os.File) bool {
+	fi, err := f.Stat()
+	return err == nil && fi.Mode()&os.ModeCharDevice != 0
+}
+
+func (s *styler) paint(code, text string) string {
+	if !s.color {
+		return text
+	}
+	return "\x1b[" + code + "m" + text + "\x1b[0m"
+}
+
+// Label styles the progress bar's leading name.
+func (s *styler) Label(text string) string { return s.paint("1;36", text) }
+
+// Link makes url clickable in terminals that support OSC 8 hyperlinks.
+func (s *styler) Link(url string) string {
+	if !s.color {
+		return url
+	}
+	return "\x1b]8;;" + url + "\x1b\\" + url + "\x1b]8;;\x1b\\"
+}
+
+func (s *styler) Errorf(format string, args ...interface{}) {
+	if s.annotate {
+		fmt.Println(workflowCommand("error", fmt.Sprintf(format, args...)))
+		return
+	}
+	fmt.Fprintln(os.Stderr, s.paint("1;31", "Error:"), fmt.Sprintf(format, args...))
+}
+
+func (s *styler) Warnf(format string, args ...interface{}) {
+	if s.annotate {
+		fmt.Println(workflowCommand("warning", fmt.Sprintf(format, args...)))
+		return
+	}
+	fmt.Fprintln(os.Stderr, s.paint("1;33", "Warning:"), fmt.Sprintf(format, args...))
+}
+
+func (s *styler) Successf(format string, args ...interface{}) {
+	fmt.Println(s.paint("32", fmt.Sprintf(format, args...)))
+}
+
+// fatalf reports a startup error and exits.
+func fatalf(format string, args ...interface{}) {
+	exitf(exitFailure, format, args...)
+}
+
+// usagef reports invalid flags or arguments and exits with exitUsage.
+func usagef(format string, args ...interface{}) {
+	exitf(exitUsage, format, args...)
+}
+
+// exitHooks run before exitf exits, since deferred calls don't; they remove
+// temporary files.
+var exitHooks []func()
+
+func exitf(code int, format string, args ...interface{}) {
+	ui.Errorf(format, args...)
+	for _, f := range exitHooks {
+		f()
+	}
+	os.Exit(code)
+}
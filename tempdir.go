@@ -0,0 +1,25 @@
+package main
+
+import (
+	"fmt"
+	"os"
+)
+
+// checkTempDir makes sure -temp-dir exists and takes files, so a run that
+// needs scratch space fails at startup rather than partway through.
+func checkTempDir(dir string) error {
+	fi, err := os.Stat(dir)
+	if err != nil {
+		return fmt.Errorf("-temp-dir: %v", err)
+	}
+	if !fi.IsDir() {
+		return fmt.Errorf("-temp-dir: %s is not a directory", dir)
+	}
+	f, err := os.CreateTemp(dir, "abfu-check-*")
+	if err != nil {
+		return fmt.Errorf("-temp-dir: %s is not writable: %v", dir, err)
+	}
+	f.Close()
+	os.Remove(f.Name())
+	return nil
+}
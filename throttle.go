@@ -0,0 +1,219 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/vbauerster/mpb/v7/decor"
+)
+
+const (
+	// throttleDecrease is the factor the send rate is multiplied by when the
+	// server answers 429.
+	throttleDecrease = 0.5
+	// throttleSteps is how many accepted chunks it takes to climb from the
+	// minimum back to the maximum rate.
+	throttleSteps = 20
+	// throttleCooldown keeps a burst of 429s from workers that were all in
+	// flight at once from cutting the rate more than once.
+	throttleCooldown = 2 * time.Second
+	// capacityRemeasure is how often -limit-rate N% measures the link
+	// again, so the cap follows a link whose speed changes.
+	capacityRemeasure = 10 * time.Minute
+)
+
+// sendThrottle paces chunk uploads to an aggregate rate in bytes per second
+// that adapts to the server (AIMD): a 429 multiplies the rate by
+// throttleDecrease, every accepted chunk adds (max-min)/throttleSteps, and
+// the rate stays within [min, max]. One throttle is shared by all workers
+// and all files of a batch.
+//
+// A throttle for a share of the link (-limit-rate N%) has no max to begin
+// with: for the measurement window it lets chunks through unthrottled and
+// adds up the bytes the server accepts, then sets max to share of the
+// throughput that made. It measures again every capacityRemeasure.
+type sendThrottle struct {
+	mu      sync.Mutex
+	min     float64
+	max     float64
+	rate    float64
+	next    time.Time // when the next reservation may start
+	lastCut time.Time
+
+	share        float64       // of the measured capacity; 0 for a fixed max
+	fixedMin     float64       // -min-rate, or 0 for a tenth of max
+	window       time.Duration // of a measurement
+	measuring    bool
+	measureStart time.Time // of the measurement, at its first reservation
+	measured     int64     // bytes accepted during the measurement
+	capacity     float64   // the last measurement, in bytes per second
+	nextMeasure  time.Time
+}
+
+// newSendThrottle returns nil when hi is 0 (no throttling). A lo of 0
+// defaults to a tenth of hi. It starts at the maximum rate.
+func newSendThrottle(lo, hi int64) *sendThrottle {
+	if hi <= 0 {
+		return nil
+	}
+	if lo <= 0 {
+		lo = max(hi/10, 1)
+	}
+	return &sendThrottle{min: float64(lo), max: float64(hi), rate: float64(hi)}
+}
+
+// newShareThrottle returns a throttle capped at share (0 to 1) of the
+// throughput measured over window. A lo of 0 defaults to a tenth of the
+// cap.
+func newShareThrottle(share float64, lo int64, window time.Duration) *sendThrottle {
+	return &sendThrottle{share: share, fixedMin: float64(lo), window: window, measuring: true}
+}
+
+// parseRateLimit parses -limit-rate: a share of the measured link capacity
+// such as "50%", or an absolute rate in bytes per second with an optional
+// K, M or G suffix (powers of 1024, as curl's --limit-rate), optionally
+// followed by "iB", "B" and "/s": "800K", "10MiB/s". It returns the share
+// (0 to 1) or the rate, the other being 0.
+func parseRateLimit(spec string) (share float64, rate int64, err error) {
+	s := strings.TrimSpace(spec)
+	if pct, ok := strings.CutSuffix(s, "%"); ok {
+		n, err := strconv.ParseFloat(strings.TrimSpace(pct), 64)
+		if err != nil || n <= 0 || n > 100 {
+			return 0, 0, fmt.Errorf("-limit-rate %q: want a percentage above 0 and up to 100", spec)
+		}
+		return n / 100, 0, nil
+	}
+	s = strings.TrimSuffix(s, "/s")
+	s = strings.TrimSuffix(strings.TrimSuffix(s, "iB"), "B")
+	mult := int64(1)
+	if s != "" {
+		switch s[len(s)-1] {
+		case 'k', 'K':
+			mult = 1 << 10
+		case 'm', 'M':
+			mult = 1 << 20
+		case 'g', 'G':
+			mult = 1 << 30
+		}
+		if mult > 1 {
+			s = s[:len(s)-1]
+		}
+	}
+	n, err := strconv.ParseFloat(strings.TrimSpace(s), 64)
+	if err != nil || n <= 0 || n*float64(mult) < 1 {
+		return 0, 0, fmt.Errorf("-limit-rate %q: want a percentage such as 50%% or a rate such as 10M", spec)
+	}
+	return 0, int64(n * float64(mult)), nil
+}
+
+// Wait blocks until n more bytes may be sent at the current rate. A nil
+// throttle never blocks.
+func (t *sendThrottle) Wait(ctx context.Context, n int) error {
+	if t == nil {
+		return nil
+	}
+	t.mu.Lock()
+	now := time.Now()
+	if t.share > 0 && !t.measuring && now.After(t.nextMeasure) {
+		t.measuring, t.measureStart, t.measured = true, time.Time{}, 0
+	}
+	if t.measuring {
+		if t.measureStart.IsZero() {
+			t.measureStart = now
+		}
+		t.mu.Unlock()
+		return nil
+	}
+	start := t.next
+	if start.Before(now) {
+		start = now
+	}
+	t.next = start.Add(time.Duration(float64(n) / t.rate * float64(time.Second)))
+	t.mu.Unlock()
+
+	if d := time.Until(start); d > 0 {
+		timer := time.NewTimer(d)
+		defer timer.Stop()
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	return nil
+}
+
+// Decrease reacts to a 429. It returns the new rate and whether it changed.
+func (t *sendThrottle) Decrease() (float64, bool) {
+	if t == nil {
+		return 0, false
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	// While measuring there is no rate to lower yet.
+	if t.measuring || time.Since(t.lastCut) < throttleCooldown || t.rate == t.min {
+		return t.rate, false
+	}
+	t.lastCut = time.Now()
+	t.rate = max(t.rate*throttleDecrease, t.min)
+	return t.rate, true
+}
+
+// Increase reacts to an accepted chunk of n bytes. It reports whether the
+// chunk completed a measurement, which set a new cap; see Capacity.
+func (t *sendThrottle) Increase(n int) bool {
+	if t == nil {
+		return false
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.measuring {
+		t.measured += int64(n)
+		elapsed := time.Since(t.measureStart)
+		if t.measureStart.IsZero() || elapsed < t.window {
+			return false
+		}
+		now := time.Now()
+		t.capacity = float64(t.measured) / elapsed.Seconds()
+		t.max = max(t.capacity*t.share, 1)
+		t.min = min(t.fixedMin, t.max)
+		if t.min <= 0 {
+			t.min = max(t.max/10, 1)
+		}
+		t.rate, t.next = t.max, now
+		t.measuring, t.nextMeasure = false, now.Add(capacityRemeasure)
+		return true
+	}
+	t.rate = min(t.rate+(t.max-t.min)/throttleSteps, t.max)
+	return false
+}
+
+// Capacity returns the last measured link capacity and the cap set from it,
+// in bytes per second; both are 0 for a fixed rate or before the first
+// measurement.
+func (t *sendThrottle) Capacity() (capacity, limit float64) {
+	if t == nil {
+		return 0, 0
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.share == 0 || t.capacity == 0 {
+		return 0, 0
+	}
+	return t.capacity, t.max
+}
+
+// describeCapacity is "measured 12.3 MiB/s, capped at 6.1 MiB/s (50%)", or
+// "" when the throttle has no measurement.
+func (t *sendThrottle) describeCapacity() string {
+	capacity, limit := t.Capacity()
+	if capacity == 0 {
+		return ""
+	}
+	return fmt.Sprintf("measured % .1f/s, capped at % .1f/s (%g%%)",
+		decor.SizeB1024(int64(capacity)), decor.SizeB1024(int64(limit)), t.share*100)
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// workTimes adds up the time the workers of a run spend on each kind of
+// work. Workers run in parallel, so the sums can exceed the wall time of
+// the phase they ran in; comparing them shows which stage the others wait
+// on.
+type workTimes struct {
+	read, hash, probe, send atomic.Int64 // nanoseconds
+}
+
+// since adds the time elapsed since start to one of the counters.
+func since(counter *atomic.Int64, start time.Time) {
+	counter.Add(int64(time.Since(start)))
+}
+
+// workTiming is workTimes at the end of a run. Probe is the per-chunk
+// existence checks and Send the chunk requests, retries and their backoff
+// included.
+type workTiming struct {
+	Read, Hash, Probe, Send time.Duration
+}
+
+func (w *workTimes) reset() {
+	w.read.Store(0)
+	w.hash.Store(0)
+	w.probe.Store(0)
+	w.send.Store(0)
+}
+
+func (w *workTimes) timing() workTiming {
+	return workTiming{Read: time.Duration(w.read.Load()), Hash: time.Duration(w.hash.Load()),
+		Probe: time.Duration(w.probe.Load()), Send: time.Duration(w.send.Load())}
+}
+
+// timingTotals accumulates -timing over the files of a batch. A nil
+// *timingTotals ignores everything.
+type timingTotals struct {
+	files   int
+	elapsed time.Duration
+	phases  []phaseTiming // in order of first appearance
+	work    workTiming
+}
+
+// Add counts one file's phases and worker times.
+func (t *timingTotals) Add(phases []phaseTiming, work workTiming, elapsed time.Duration) {
+	if t == nil {
+		return
+	}
+	t.files++
+	t.elapsed += elapsed
+	for _, p := range phases {
+		i := 0
+		for i < len(t.phases) && t.phases[i].Name != p.Name {
+			i++
+		}
+		if i == len(t.phases) {
+			t.phases = append(t.phases, phaseTiming{Name: p.Name})
+		}
+		t.phases[i].Seconds += p.Seconds
+	}
+	t.work.Read += work.Read
+	t.work.Hash += work.Hash
+	t.work.Probe += work.Probe
+	t.work.Send += work.Send
+}
+
+// Print writes the -timing breakdown: wall time per phase with its share of
+// the total, then the worker time summed per kind of work.
+func (t *timingTotals) Print(w io.Writer) {
+	if t == nil || t.files == 0 {
+		return
+	}
+	what := "the upload"
+	if t.files > 1 {
+		what = fmt.Sprintf("%d files", t.files)
+	}
+	fmt.Fprintf(w, "Timing for %s: %s\n", what, t.elapsed.Round(time.Millisecond))
+	var phases []string
+	for _, p := range t.phases {
+		d := time.Duration(p.Seconds * float64(time.Second))
+		share := ""
+		if t.elapsed > 0 {
+			share = fmt.Sprintf(" (%.0f%%)", 100*float64(d)/float64(t.elapsed))
+		}
+		phases = append(phases, fmt.Sprintf("%s %s%s", p.Name, d.Round(time.Millisecond), share))
+	}
+	fmt.Fprintf(w, "  phases: %s\n", strings.Join(phases, ", "))
+	fmt.Fprintf(w, "  worker time: read %s, hash %s, probe %s, send %s\n",
+		t.work.Read.Round(time.Millisecond), t.work.Hash.Round(time.Millisecond),
+		t.work.Probe.Round(time.Millisecond), t.work.Send.Round(time.Millisecond))
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+)
+
+// tokenPool spreads requests across several credentials, one per request in
+// turn, so a bulk migration isn't held to a single token's rate limit. A
+// token the server answers 401 for is dropped for the rest of the run. One
+// pool is shared by all workers and all files of a batch.
+type tokenPool struct {
+	mu     sync.Mutex
+	tokens []string
+	next   int
+}
+
+// newTokenPool returns nil for fewer than two tokens, leaving the single
+// token to FileUploader.Token.
+func newTokenPool(tokens []string) *tokenPool {
+	if len(tokens) < 2 {
+		return nil
+	}
+	return &tokenPool{tokens: tokens}
+}
+
+// Next returns the token for the next request, or "" once every token has
+// been dropped.
+func (p *tokenPool) Next() string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if len(p.tokens) == 0 {
+		return ""
+	}
+	tok := p.tokens[p.next%len(p.tokens)]
+	p.next++
+	return tok
+}
+
+// Drop removes tok after a 401. It reports how many tokens are left and
+// whether tok was still in the pool, so a 401 seen by several workers at
+// once is only reported once.
+func (p *tokenPool) Drop(tok string) (int, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for i, t := range p.tokens {
+		if t == tok {
+			p.tokens = append(p.tokens[:i], p.tokens[i+1:]...)
+			return len(p.tokens), true
+		}
+	}
+	return len(p.tokens), false
+}
+
+// splitTokens parses -token, which may hold a comma-separated list.
+func splitTokens(s string) []string {
+	var tokens []string
+	for _, t := range strings.Split(s, ",") {
+		if t = strings.TrimSpace(t); t != "" {
+			tokens = append(tokens, t)
+		}
+	}
+	return tokens
+}
+
+// readTokenFile reads one token per line; blank lines and lines starting
+// with # are skipped.
+func readTokenFile(path string) ([]string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var tokens []string
+	for _, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		tokens = append(tokens, line)
+	}
+	if len(tokens) == 0 {
+		return nil, fmt.Errorf("%s: no tokens", path)
+	}
+	return tokens, nil
+}
+
+// tokenHint identifies a token in messages without revealing it.
+func tokenHint(tok string) string {
+	if len(tok) <= 8 {
+		return "…"
+	}
+	return "…" + tok[len(tok)-4:]
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"testing"
+)
+
+func TestTokenPool(t *testing.T) {
+	if newTokenPool([]string{"only"}) != nil {
+		t.Error("a single token should not make a pool")
+	}
+	p := newTokenPool([]string{"a", "b", "c"})
+	var got []string
+	for range 4 {
+		got = append(got, p.Next())
+	}
+	if want := []string{"a", "b", "c", "a"}; !slices.Equal(got, want) {
+		t.Errorf("Next gave %q, want %q", got, want)
+	}
+	if left, dropped := p.Drop("b"); left != 2 || !dropped {
+		t.Errorf("Drop(b) = %d, %v; want 2, true", left, dropped)
+	}
+	if left, dropped := p.Drop("b"); left != 2 || dropped {
+		t.Errorf("second Drop(b) = %d, %v; want 2, false", left, dropped)
+	}
+	p.Drop("a")
+	p.Drop("c")
+	if tok := p.Next(); tok != "" {
+		t.Errorf("Next on an empty pool = %q", tok)
+	}
+}
+
+func TestReadTokenFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "tokens")
+	os.WriteFile(path, []byte("# migration tokens\ntok-1\n\n  tok-2  \n"), 0o600)
+	got, err := readTokenFile(path)
+	if want := []string{"tok-1", "tok-2"}; err != nil || !slices.Equal(got, want) {
+		t.Errorf("readTokenFile = %q, %v; want %q", got, err, want)
+	}
+	os.WriteFile(path, []byte("# none yet\n"), 0o600)
+	if _, err := readTokenFile(path); err == nil {
+		t.Error("a file without tokens was accepted")
+	}
+	if got := splitTokens(" a, ,b,"); !slices.Equal(got, []string{"a", "b"}) {
+		t.Errorf("splitTokens = %q", got)
+	}
+	if got := tokenHint("abcdefghijkl"); got != "…ijkl" {
+		t.Errorf("tokenHint = %q", got)
+	}
+}
+
+// TestTokenRotation checks that requests rotate across the pool, that a
+// token the server rejects is dropped and its request retried with another,
+// and that the upload fails once every token is rejected.
+func TestTokenRotation(t *testing.T) {
+	tests := []struct {
+		name    string
+		tokens  []string
+		wantErr bool
+	}{
+		{"one token revoked", []string{"good-a", "revoked-1", "good-b"}, false},
+		{"every token revoked", []string{"revoked-1", "revoked-2"}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path, _ := writeTestFile(t, 4*minBlockSize)
+			rec := &finalizeRecorder{}
+			var mu sync.Mutex
+			used := map[string]int{}
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				_, tok, _ := r.BasicAuth()
+				mu.Lock()
+				used[tok]++
+				mu.Unlock()
+				if tok == "revoked-1" || tok == "revoked-2" {
+					w.WriteHeader(http.StatusUnauthorized)
+					return
+				}
+				rec.ServeHTTP(w, r)
+			}))
+			defer srv.Close()
+
+			fu := newTestUploader(t, path, srv.URL)
+			fu.Tokens = newTokenPool(slices.Clone(tt.tokens))
+			// One worker, so no request can pick the revoked token up
+			// while another is being turned away with it.
+			fu.Concurrency = 1
+			_, err := fu.RunContext(t.Context())
+			if tt.wantErr {
+				if !errors.Is(err, errAuthFailed) {
+					t.Fatalf("got error %v, want %v", err, errAuthFailed)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if used["good-a"] == 0 || used["good-b"] == 0 {
+				t.Errorf("requests per token %v, want both good tokens used", used)
+			}
+			if used["revoked-1"] != 1 {
+				t.Errorf("revoked token used %d times, want once", used["revoked-1"])
+			}
+			if len(rec.finalizes) != 1 {
+				t.Errorf("got %d finalizes, want 1", len(rec.finalizes))
+			}
+		})
+	}
+}
@@ -0,0 +1,222 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httputil"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// newHTTPClient returns a client whose transport opens at most maxConns
+// connections per host (0 means unlimited, the net/http default). Workers
+// beyond that queue for a connection, or share one as HTTP/2 streams when
+// the server negotiates h2.
+func newHTTPClient(maxConns int) *http.Client {
+	tr := http.DefaultTransport.(*http.Transport).Clone()
+	tr.MaxConnsPerHost = maxConns
+	if maxConns > 0 {
+		tr.MaxIdleConnsPerHost = maxConns
+	}
+	return &http.Client{Timeout: 30 * time.Second, Transport: tr}
+}
+
+// dumpBodyLimit caps how much of each request and response body -dump-http
+// prints; chunk uploads are hundreds of megabytes.
+const dumpBodyLimit = 2048
+
+// dumpTransport prints every exchange to w for protocol debugging, with
+// the redacted headers' values hidden and bodies truncated to
+// dumpBodyLimit.
+type dumpTransport struct {
+	next   http.RoundTripper
+	redact redactedHeaders
+	mu     sync.Mutex
+	w      io.Writer
+}
+
+// newDumpTransport returns a dumpTransport printing to w. headers names the
+// -header headers, whose values are redacted along with the credentials.
+func newDumpTransport(next http.RoundTripper, w io.Writer, headers []string) *dumpTransport {
+	if next == nil {
+		next = http.DefaultTransport
+	}
+	return &dumpTransport{next: next, redact: newRedactedHeaders(headers), w: w}
+}
+
+// Unwrap returns the transport d sends through.
+func (d *dumpTransport) Unwrap() http.RoundTripper { return d.next }
+
+func (d *dumpTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	redacted := req.Clone(req.Context())
+	redacted.Header = d.redact.apply(req.Header, "REDACTED")
+	head, _ := httputil.DumpRequestOut(redacted, false)
+	var body []byte
+	if req.Header.Get("Content-Encoding") == "gzip" {
+		body = []byte(fmt.Sprintf("[gzip-compressed body, %d bytes]", req.ContentLength))
+	} else if req.GetBody != nil {
+		if rc, err := req.GetBody(); err == nil {
+			body, _ = io.ReadAll(io.LimitReader(rc, dumpBodyLimit))
+			rc.Close()
+		}
+	}
+	d.print(">>> ", head, body, req.ContentLength)
+
+	resp, err := d.next.RoundTrip(req)
+	if err != nil {
+		d.mu.Lock()
+		fmt.Fprintf(d.w, "<<< %s %s: %v\n\n", req.Method, req.URL, err)
+		d.mu.Unlock()
+		return nil, err
+	}
+	head, _ = httputil.DumpResponse(resp, false)
+	body, _ = io.ReadAll(io.LimitReader(resp.Body, dumpBodyLimit))
+	// Put the bytes we peeked at back in front of the rest of the body.
+	resp.Body = struct {
+		io.Reader
+		io.Closer
+	}{io.MultiReader(bytes.NewReader(body), resp.Body), resp.Body}
+	d.print("<<< ", head, body, resp.ContentLength)
+	return resp, nil
+}
+
+func (d *dumpTransport) print(prefix string, head, body []byte, length int64) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	fmt.Fprintf(d.w, "%s%s", prefix, head)
+	if len(body) > 0 {
+		d.w.Write(body)
+		if len(body) == dumpBodyLimit && (length < 0 || length > dumpBodyLimit) {
+			fmt.Fprintf(d.w, "\n[... body truncated after %d bytes]", len(body))
+		}
+	}
+	fmt.Fprint(d.w, "\n\n")
+}
+
+// redactedHeaders names the headers whose values are never printed: the
+// credentials, Authorization, Proxy-Authorization and Cookie, and every
+// header set with -header, which is how API keys and session cookies
+// usually get there.
+type redactedHeaders map[string]bool
+
+func newRedactedHeaders(extra []string) redactedHeaders {
+	r := redactedHeaders{"Authorization": true, "Proxy-Authorization": true, "Cookie": true}
+	for _, name := range extra {
+		r[http.CanonicalHeaderKey(name)] = true
+	}
+	return r
+}
+
+// apply returns a copy of h with the values of the redacted headers
+// replaced by placeholder.
+func (r redactedHeaders) apply(h http.Header, placeholder string) http.Header {
+	out := h.Clone()
+	for name, values := range out {
+		if r[http.CanonicalHeaderKey(name)] {
+			out[name] = slices.Repeat([]string{placeholder}, len(values))
+		}
+	}
+	return out
+}
+
+// curlTransport prints an equivalent curl command for every request that
+// fails, either with a transport error or a 4xx/5xx status, so the call can
+// be reproduced by hand or handed to a server admin. The token and the
+// other redacted headers are replaced by placeholders; bodies are included
+// only when they are small JSON.
+type curlTransport struct {
+	next   http.RoundTripper
+	redact redactedHeaders
+	mu     sync.Mutex
+	w      io.Writer
+}
+
+// newCurlTransport returns a curlTransport printing to w. headers names
+// the -header headers, whose values are redacted along with the
+// credentials.
+func newCurlTransport(next http.RoundTripper, w io.Writer, headers []string) *curlTransport {
+	if next == nil {
+		next = http.DefaultTransport
+	}
+	return &curlTransport{next: next, redact: newRedactedHeaders(headers), w: w}
+}
+
+// Unwrap returns the transport c sends through.
+func (c *curlTransport) Unwrap() http.RoundTripper { return c.next }
+
+func (c *curlTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := c.next.RoundTrip(req)
+	var outcome string
+	switch {
+	case err != nil:
+		outcome = err.Error()
+	case resp.StatusCode >= 400:
+		outcome = resp.Status
+	default:
+		return resp, nil
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	fmt.Fprintf(c.w, "Request failed (%s); reproduce with:\n%s\n\n", outcome, curlCommand(req, c.redact))
+	return resp, err
+}
+
+// curlCommand renders req as a curl command line, with the token and the
+// values of the redact headers left out.
+func curlCommand(req *http.Request, redact redactedHeaders) string {
+	lines := []string{"curl -X " + req.Method + " " + shellQuote(req.URL.String())}
+	if user, _, ok := req.BasicAuth(); ok {
+		lines = append(lines, "-u "+shellQuote(user+":<TOKEN>"))
+	} else if auth := req.Header.Get("Authorization"); auth != "" {
+		scheme, _, _ := strings.Cut(auth, " ")
+		lines = append(lines, "-H "+shellQuote("Authorization: "+scheme+" <TOKEN>"))
+	}
+	header := redact.apply(req.Header, "<REDACTED>")
+	names := make([]string, 0, len(header))
+	for name := range header {
+		if name != "Authorization" {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		for _, v := range header[name] {
+			lines = append(lines, "-H "+shellQuote(name+": "+v))
+		}
+	}
+	if note := curlBody(req); note != "" {
+		lines = append(lines, note)
+	}
+	return strings.Join(lines, " \\\n  ")
+}
+
+// curlBody returns the --data-raw argument for a small JSON body, or a
+// comment describing a body that isn't reproduced.
+func curlBody(req *http.Request) string {
+	if req.ContentLength == 0 || req.GetBody == nil {
+		return ""
+	}
+	ctype := req.Header.Get("Content-Type")
+	if strings.HasPrefix(ctype, "application/json") && req.Header.Get("Content-Encoding") == "" &&
+		req.ContentLength > 0 && req.ContentLength <= dumpBodyLimit {
+		if rc, err := req.GetBody(); err == nil {
+			defer rc.Close()
+			if body, err := io.ReadAll(rc); err == nil {
+				return "--data-raw " + shellQuote(string(body))
+			}
+		}
+	}
+	media, _, _ := strings.Cut(ctype, ";")
+	return fmt.Sprintf("--data-binary @body.bin  # %d-byte %s body not shown; save it to body.bin",
+		req.ContentLength, media)
+}
+
+// shellQuote quotes s for a POSIX shell.
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// TestMaxConnsPerHost checks that the configured connection limit is found
+// behind any stack of wrapper transports.
+func TestMaxConnsPerHost(t *testing.T) {
+	base := newHTTPClient(3).Transport
+	chaos, err := newChaosTransport(base, "rate=0.1,seed=1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name string
+		rt   http.RoundTripper
+		want int
+	}{
+		{"plain", base, 3},
+		{"dump", newDumpTransport(base, io.Discard, nil), 3},
+		{"chaos", chaos, 3},
+		{"dump over curl over chaos", newDumpTransport(newCurlTransport(chaos, io.Discard, nil), io.Discard, nil), 3},
+		{"unlimited", newHTTPClient(0).Transport, 0},
+		{"unknown transport", struct{ http.RoundTripper }{base}, 0},
+	}
+	for _, tt := range tests {
+		if got := maxConnsPerHost(tt.rt); got != tt.want {
+			t.Errorf("%s: maxConnsPerHost = %d, want %d", tt.name, got, tt.want)
+		}
+	}
+}
+
+// TestRedactSecrets checks that neither -print-curl nor -dump-http prints
+// the token, a -header value, a cookie or proxy credentials.
+func TestRedactSecrets(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "boom", http.StatusInternalServerError)
+	}))
+	defer srv.Close()
+	var headers headerList
+	if err := headers.Set("x-api-key: s3cret"); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name      string
+		transport func(w io.Writer) http.RoundTripper
+		want      []string
+	}{
+		{"print-curl", func(w io.Writer) http.RoundTripper { return newCurlTransport(nil, w, headers.names()) },
+			[]string{"'alice:<TOKEN>'", "'X-Api-Key: <REDACTED>'", "'Cookie: <REDACTED>'",
+				"'Proxy-Authorization: <REDACTED>'", "'Content-Type: application/json'", `'{"name":"data.bin"}'`}},
+		{"dump-http", func(w io.Writer) http.RoundTripper { return newDumpTransport(nil, w, headers.names()) },
+			[]string{"Authorization: REDACTED", "X-Api-Key: REDACTED", "Cookie: REDACTED",
+				"Proxy-Authorization: REDACTED", "Content-Type: application/json", `{"name":"data.bin"}`}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var out strings.Builder
+			client := &http.Client{Transport: tt.transport(&out)}
+			req, _ := http.NewRequest("POST", srv.URL+"/create", strings.NewReader(`{"name":"data.bin"}`))
+			req.SetBasicAuth("alice", "t0ken")
+			req.Header.Set("Content-Type", "application/json")
+			setHeaders(headers)(req)
+			req.Header.Set("Cookie", "session=c00kie")
+			req.Header.Set("Proxy-Authorization", "Basic pr0xy")
+			resp, err := client.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+
+			got := out.String()
+			for _, secret := range []string{"s3cret", "t0ken", "dDBrZW4", "c00kie", "pr0xy"} {
+				if strings.Contains(got, secret) {
+					t.Errorf("output shows %q:\n%s", secret, got)
+				}
+			}
+			for _, want := range tt.want {
+				if !strings.Contains(got, want) {
+					t.Errorf("output lacks %s:\n%s", want, got)
+				}
+			}
+			if req.Header.Get("X-Api-Key") != "s3cret" {
+				t.Error("redacting changed the request itself")
+			}
+		})
+	}
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// inProgressSuffixes are names browsers, download managers and copy tools
+// give a file until it is complete: file.zip.crdownload, file.zip.part,
+// file.zip~ and the like.
+var inProgressSuffixes = []string{".part", ".partial", ".crdownload", ".download", ".tmp", "~"}
+
+// inProgressName returns the suffix that marks path as still being
+// written, or "" when its name looks finished.
+func inProgressName(path string) string {
+	base := strings.ToLower(filepath.Base(path))
+	for _, suffix := range inProgressSuffixes {
+		if strings.HasSuffix(base, suffix) && len(base) > len(suffix) {
+			return suffix
+		}
+	}
+	return ""
+}
+
+// checkStable refuses a file that looks like it is still being downloaded
+// or copied: one named like a partial download, or one whose size or
+// modification time changes over StableWindow. Uploading it would attach
+// a truncated copy that may well pass every check of its own. With
+// ForceUnstable the name only earns a warning and the file isn't watched.
+func (fu *FileUploader) checkStable(ctx context.Context, file *os.File, fi os.FileInfo) error {
+	suffix := inProgressName(fu.FilePath)
+	if fu.ForceUnstable {
+		if suffix != "" {
+			ui.Warnf("%s: the %q suffix suggests the file is still being written; uploading it as -force-unstable says",
+				fu.FilePath, suffix)
+		}
+		return nil
+	}
+	if suffix != "" {
+		return fmt.Errorf("%w: its name ends in %q, which downloads and copies use until they finish; "+
+			"upload the finished file, or pass -force-unstable to upload this one anyway", errUnstableFile, suffix)
+	}
+	if fu.StableWindow <= 0 {
+		return nil
+	}
+	fu.debugf("Checking that %s doesn't change for %s", fu.FilePath, fu.StableWindow)
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-time.After(fu.StableWindow):
+	}
+	now, err := file.Stat()
+	if err != nil {
+		return err
+	}
+	change := ""
+	switch {
+	case now.Size() != fi.Size():
+		change = fmt.Sprintf("it went from %d to %d bytes", fi.Size(), now.Size())
+	case !now.ModTime().Equal(fi.ModTime()):
+		change = "it was modified"
+	default:
+		return nil
+	}
+	return fmt.Errorf("%w: %s within %s; wait for whatever writes it to finish, "+
+		"or pass -force-unstable to upload it anyway", errUnstableFile, change, fu.StableWindow)
+}